@@ -2,26 +2,43 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/gocardless/draupnir/pkg/client/config"
+	"github.com/gocardless/draupnir/pkg/connection"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	clientPkg "github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/tunnel"
 	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/prometheus/common/log"
 	"github.com/urfave/cli"
+	"golang.org/x/oauth2"
 )
 
+// formatFlag chooses how the details for connecting to an instance are output
+var formatFlag = cli.StringFlag{
+	Name:  "format",
+	Value: connection.DefaultFormat,
+	Usage: "how to output the connection details: " + strings.Join(connection.Formats, ", "),
+}
+
 const quickStart string = `
 QUICK START:
 		draupnir authenticate
@@ -47,6 +64,10 @@ func main() {
 			Name:  "insecure",
 			Usage: "don't validate certificates when connecting to draupnir",
 		},
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "the configuration profile of the draupnir server to use, overriding $" + config.ProfileEnvVar + " and the current profile",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -72,7 +93,9 @@ func main() {
 					Usage:     "show the current configuration",
 					UsageText: "draupnir config show",
 					Action: func(c *cli.Context) error {
-						cfg := loadConfig(logger)
+						cfg := loadConfig(c, logger)
+
+						fmt.Printf("Profile: %s\n", loadConfigFile(logger).Profile(c.GlobalString("profile")))
 
 						domain := cfg.Domain
 						accessToken := cfg.Token.AccessToken
@@ -96,7 +119,10 @@ func main() {
 
 [key] can take the following values:
     domain: The domain of the draupnir server.
-    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable.`,
+    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable.
+
+The value is set in the profile chosen by --profile, $DRAUPNIR_PROFILE or
+'draupnir config use-profile', which is created if it doesn't exist.`,
 					Action: func(c *cli.Context) error {
 						if len(c.Args()) != 2 {
 							cli.ShowCommandHelp(c, c.Command.Name)
@@ -105,17 +131,63 @@ func main() {
 						key := c.Args().First()
 						val := c.Args()[1]
 
-						cfg := loadConfig(logger)
+						// Setting a value in a profile that doesn't exist yet creates it
+						file := loadConfigFile(logger)
+						profile := file.Profile(c.GlobalString("profile"))
+						cfg := file.Profiles[profile]
+
 						switch strings.ToLower(key) {
 						case "domain":
 							cfg.Domain = val
-							storeConfig(cfg, logger)
 						case "database":
 							cfg.Database = val
-							storeConfig(cfg, logger)
 						default:
 							logger.With("key", key).Fatal("Invalid key")
 						}
+
+						file.Profiles[profile] = cfg
+						storeConfigFile(file, logger)
+						return nil
+					},
+				},
+				{
+					Name:      "use-profile",
+					Usage:     "choose the profile to use when --profile and $" + config.ProfileEnvVar + " aren't set",
+					UsageText: "draupnir config use-profile [name]",
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 1 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a profile name")
+						}
+						profile := c.Args().First()
+
+						file := loadConfigFile(logger)
+						if _, ok := file.Profiles[profile]; !ok {
+							logger.With("profile", profile).Fatal("No such profile")
+						}
+
+						file.CurrentProfile = profile
+						storeConfigFile(file, logger)
+
+						logger.With("profile", profile).Info("Switched profile")
+						return nil
+					},
+				},
+				{
+					Name:      "list-profiles",
+					Usage:     "list the configured profiles, marking the one in use",
+					UsageText: "draupnir config list-profiles",
+					Action: func(c *cli.Context) error {
+						file := loadConfigFile(logger)
+						current := file.Profile(c.GlobalString("profile"))
+
+						for _, name := range file.ProfileNames() {
+							marker := " "
+							if name == current {
+								marker = "*"
+							}
+							fmt.Printf("%s %s [ DOMAIN: %s ]\n", marker, name, file.Profiles[name].Domain)
+						}
 						return nil
 					},
 				},
@@ -125,36 +197,75 @@ func main() {
 			Name:    "authenticate",
 			Aliases: []string{},
 			Usage:   "authenticate with google",
-			Flags:   []cli.Flag{cli.BoolFlag{Name: "force", Usage: "Force reauthentication"}},
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "force", Usage: "Force reauthentication"},
+				cli.BoolFlag{
+					Name:  "device",
+					Usage: "Authenticate in a browser on another device, e.g. when connected over SSH. This is the default when no browser can be opened.",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				cfg := loadConfig(logger)
+				cfg := loadConfig(c, logger)
 				client := NewClient(c, logger)
 
-				if cfg.Token.RefreshToken != "" && !c.Bool("force") {
-					logger.Info("You're already authenticated. Pass --force to reauthenticate.")
+				if cfg.Token.Valid() && !c.Bool("force") {
+					logger.Infof("You're already authenticated until %s. Pass --force to reauthenticate.", cfg.Token.Expiry.Format(time.RFC3339))
 					return nil
 				}
 
-				state := fmt.Sprintf("%d", rand.Int31())
+				var token oauth2.Token
+				var err error
 
-				url := fmt.Sprintf("%s/authenticate?state=%s", getServerURL(c, cfg), state)
-				err := exec.Command("open", url).Run()
-				if err != nil {
-					fmt.Printf("Visit this link in your browser: %s\n", url)
-				}
+				device := c.Bool("device")
+				if !device {
+					state := fmt.Sprintf("%d", rand.Int31())
 
-				token, err := client.CreateAccessToken(state)
+					url := fmt.Sprintf("%s/authenticate?state=%s", getServerURL(c, cfg), state)
+					if browserErr := openBrowser(url); browserErr != nil {
+						logger.With("error", browserErr).Debug("Could not open browser")
+						device = true
+					} else {
+						token, err = client.CreateAccessToken(state)
+					}
+				}
+				if device {
+					token, err = authenticateDevice(client)
+				}
 				if err != nil {
 					logger.With("error", err).Fatal("Could not create access token")
 				}
 
 				cfg.Token = token
-				storeConfig(cfg, logger)
+				storeConfig(c, cfg, logger)
 
 				logger.Info("Successfully authenticated.")
 				return nil
 			},
 		},
+		{
+			Name:  "logout",
+			Usage: "end your session, and remove your token from this machine",
+			Action: func(c *cli.Context) error {
+				cfg := loadConfig(c, logger)
+				if cfg.Token.AccessToken == "" {
+					logger.Info("You're not authenticated.")
+					return nil
+				}
+
+				// The token is removed even if the server doesn't accept it, e.g.
+				// because it has already expired or been revoked
+				client := NewClient(c, logger)
+				if err := client.LogOut(); err != nil {
+					logger.With("error", err).Warn("Could not end your session on the server")
+				}
+
+				cfg.Token = oauth2.Token{}
+				storeConfig(c, cfg, logger)
+
+				logger.Info("Successfully logged out.")
+				return nil
+			},
+		},
 		{
 			Name:    "instances",
 			Aliases: []string{},
@@ -179,6 +290,9 @@ func main() {
 				{
 					Name:  "create",
 					Usage: "create a new instance",
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "password", Usage: "authenticate to the instance with a password instead of a client certificate, for tools that can't use one"},
+					},
 					Action: func(c *cli.Context) error {
 						var image models.Image
 						client := NewClient(c, logger)
@@ -193,7 +307,7 @@ func main() {
 							logger.With("error", err).Fatal("Could not fetch image")
 						}
 
-						instance, err := client.CreateInstance(image)
+						instance, err := client.CreateInstance(image, c.Bool("password"))
 						if err != nil {
 							logger.With("error", err).Fatal("Could not create instance")
 						}
@@ -228,6 +342,42 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:  "rotate-credentials",
+					Usage: "issue new certificates for an instance",
+					UsageText: `draupnir instances rotate-credentials [--ca] [id]
+
+[id] the instance ID to rotate the credentials of
+
+Prints the environment variables to connect with the new credentials, as
+draupnir env does.`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "ca", Usage: "also rotate the instance's certificate authority and server certificate"},
+						formatFlag,
+					},
+					Action: func(c *cli.Context) error {
+						id := c.Args().First()
+						if id == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id")
+						}
+
+						client := NewClient(c, logger)
+
+						instance, err := client.GetInstance(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance")
+						}
+
+						instance, err = client.RotateInstanceCredentials(instance, c.Bool("ca"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not rotate instance credentials")
+						}
+
+						logger.With("id", instance.ID).Info("Rotated instance credentials")
+						return setupClientEnvironment(loadConfig(c, logger), instance, c.String("format"))
+					},
+				},
 			},
 		},
 		{
@@ -346,14 +496,628 @@ func main() {
 						return nil
 					},
 				},
+				{
+					Name:  "access",
+					Usage: "manage which users and groups can access an image",
+					Subcommands: []cli.Command{
+						{
+							Name:      "list",
+							Usage:     "list the access rules for an image",
+							UsageText: "draupnir images access list [id]",
+							Action: func(c *cli.Context) error {
+								imageID, err := strconv.Atoi(c.Args().First())
+								if err != nil {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Must supply an image id")
+								}
+
+								client := NewClient(c, logger)
+
+								rules, err := client.ListImageAccessRules(imageID)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch access rules")
+								}
+								for _, rule := range rules {
+									fmt.Println(ImageAccessRuleToString(rule))
+								}
+								return nil
+							},
+						},
+						{
+							Name:  "grant",
+							Usage: "grant a user or group access to an image",
+							UsageText: `draupnir images access grant [id] (--user EMAIL | --group NAME)
+
+Once an image has at least one access rule, only the users and groups it names can use it.`,
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "user", Usage: "the email address of the user to grant access to"},
+								cli.StringFlag{Name: "group", Usage: "the name of the group to grant access to"},
+							},
+							Action: func(c *cli.Context) error {
+								imageID, err := strconv.Atoi(c.Args().First())
+								if err != nil || (c.String("user") == "") == (c.String("group") == "") {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								client := NewClient(c, logger)
+
+								rule, err := client.CreateImageAccessRule(imageID, c.String("user"), c.String("group"))
+								if err != nil {
+									logger.With("error", err).Fatal("Could not create access rule")
+								}
+
+								fmt.Println(ImageAccessRuleToString(rule))
+								return nil
+							},
+						},
+						{
+							Name:      "revoke",
+							Usage:     "remove an access rule from an image",
+							UsageText: "draupnir images access revoke [id] [rule id]",
+							Action: func(c *cli.Context) error {
+								if len(c.Args()) != 2 {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								imageID, err := strconv.Atoi(c.Args().Get(0))
+								if err != nil {
+									logger.With("error", err).Fatal("Invalid image ID")
+								}
+
+								ruleID, err := strconv.Atoi(c.Args().Get(1))
+								if err != nil {
+									logger.With("error", err).Fatal("Invalid rule ID")
+								}
+
+								client := NewClient(c, logger)
+
+								err = client.DestroyImageAccessRule(imageID, ruleID)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not destroy access rule")
+								}
+
+								logger.With("image", imageID).With("rule", ruleID).Info("Revoked access rule")
+								return nil
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "admin",
+			Usage: "administer the draupnir server",
+			Subcommands: []cli.Command{
+				{
+					Name:  "instances",
+					Usage: "manage every user's instances",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list all instances, with their owner and disk usage",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								instances, err := client.ListAllInstances()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch instances")
+								}
+								for _, instance := range instances {
+									fmt.Println(InstanceSummaryToString(instance))
+								}
+								return nil
+							},
+						},
+						{
+							Name:      "destroy",
+							Usage:     "destroy any user's instance",
+							UsageText: "draupnir admin instances destroy [id] --reason REASON",
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "reason", Usage: "why the instance is being destroyed, which is recorded"},
+							},
+							Action: func(c *cli.Context) error {
+								id, err := strconv.Atoi(c.Args().First())
+								if err != nil || c.String("reason") == "" {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Must supply an instance id and a reason")
+								}
+
+								client := NewClient(c, logger)
+
+								err = client.AdminDestroyInstance(id, c.String("reason"))
+								if err != nil {
+									logger.With("error", err).Fatal("Could not destroy instance")
+								}
+
+								logger.With("id", id).Info("Destroyed instance")
+								return nil
+							},
+						},
+						{
+							Name:      "reassign",
+							Usage:     "transfer an instance to another user",
+							UsageText: "draupnir admin instances reassign [id] [email]",
+							Action: func(c *cli.Context) error {
+								if len(c.Args()) != 2 {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								id, err := strconv.Atoi(c.Args().Get(0))
+								if err != nil {
+									logger.With("error", err).Fatal("Invalid instance ID")
+								}
+
+								client := NewClient(c, logger)
+
+								instance, err := client.ReassignInstance(id, c.Args().Get(1))
+								if err != nil {
+									logger.With("error", err).Fatal("Could not reassign instance")
+								}
+
+								fmt.Println(InstanceSummaryToString(instance))
+								return nil
+							},
+						},
+						{
+							Name:  "destructions",
+							Usage: "list instances destroyed by admins, and why",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								destructions, err := client.ListInstanceDestructions()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch instance destructions")
+								}
+								for _, destruction := range destructions {
+									fmt.Println(InstanceDestructionToString(destruction))
+								}
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "audit",
+					Usage: "show the most recent audit events",
+					UsageText: `draupnir admin audit [--actor EMAIL] [--action ACTION] [--resource-type TYPE] [--resource-id ID] [--since TIME] [--until TIME] [--limit N]
+
+Times are in RFC 3339 format, e.g. 2017-05-01T16:00:00Z.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "actor", Usage: "only show events performed by this user"},
+						cli.StringFlag{Name: "action", Usage: "only show events of this action, e.g. instance.create"},
+						cli.StringFlag{Name: "resource-type", Usage: "only show events affecting this type of resource, e.g. instance"},
+						cli.StringFlag{Name: "resource-id", Usage: "only show events affecting the resource with this ID"},
+						cli.StringFlag{Name: "since", Usage: "only show events at or after this time"},
+						cli.StringFlag{Name: "until", Usage: "only show events before this time"},
+						cli.StringFlag{Name: "limit", Usage: "the maximum number of events to show (default 100)"},
+					},
+					Action: func(c *cli.Context) error {
+						filters := url.Values{}
+						for _, name := range []string{"actor", "action", "resource-type", "resource-id", "since", "until", "limit"} {
+							if value := c.String(name); value != "" {
+								filters.Set(strings.Replace(name, "-", "_", -1), value)
+							}
+						}
+
+						client := NewClient(c, logger)
+
+						events, err := client.ListAuditEvents(filters)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch audit events")
+						}
+						for _, event := range events {
+							fmt.Println(AuditEventToString(event))
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "roles",
+					Usage: "manage the roles assigned to users and groups",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list all role assignments",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								assignments, err := client.ListRoleAssignments()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch role assignments")
+								}
+								for _, assignment := range assignments {
+									fmt.Println(RoleAssignmentToString(assignment))
+								}
+								return nil
+							},
+						},
+						{
+							Name:  "assign",
+							Usage: "assign a role to a user or group",
+							UsageText: `draupnir admin roles assign [role] (--user EMAIL | --group NAME)
+
+[role] one of viewer, user, image-publisher or admin`,
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "user", Usage: "the email address of the user to assign the role to"},
+								cli.StringFlag{Name: "group", Usage: "the name of the group to assign the role to"},
+							},
+							Action: func(c *cli.Context) error {
+								role := c.Args().First()
+								principal, ok := rolePrincipal(c)
+								if role == "" || !ok {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								client := NewClient(c, logger)
+
+								assignment, err := client.AssignRole(principal, role)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not assign role")
+								}
+
+								fmt.Println(RoleAssignmentToString(assignment))
+								return nil
+							},
+						},
+						{
+							Name:      "unassign",
+							Usage:     "remove the role assigned to a user or group",
+							UsageText: "draupnir admin roles unassign (--user EMAIL | --group NAME)",
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "user", Usage: "the email address of the user"},
+								cli.StringFlag{Name: "group", Usage: "the name of the group"},
+							},
+							Action: func(c *cli.Context) error {
+								principal, ok := rolePrincipal(c)
+								if !ok {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								client := NewClient(c, logger)
+
+								err := client.UnassignRole(principal)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not unassign role")
+								}
+
+								logger.With("principal", principal).Info("Unassigned role")
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "api-keys",
+					Usage: "manage the API keys that automated clients authenticate with",
+					Subcommands: []cli.Command{
+						{
+							Name:  "list",
+							Usage: "list all API keys, including revoked ones",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								keys, err := client.ListAPIKeys()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch API keys")
+								}
+								for _, key := range keys {
+									fmt.Println(APIKeyToString(key))
+								}
+								return nil
+							},
+						},
+						{
+							Name:  "create",
+							Usage: "create an API key",
+							UsageText: `draupnir admin api-keys create --description DESCRIPTION --scope SCOPE [--scope SCOPE...] [--expires TIME]
+
+SCOPE is one of read-only, images:write or instances:write.
+Times are in RFC 3339 format, e.g. 2017-05-01T16:00:00Z.`,
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "description", Usage: "what the key is used for"},
+								cli.StringSliceFlag{Name: "scope", Usage: "what the key can be used for"},
+								cli.StringFlag{Name: "expires", Usage: "when the key stops being accepted (default: never)"},
+							},
+							Action: func(c *cli.Context) error {
+								description, scopes := c.String("description"), c.StringSlice("scope")
+								if description == "" || len(scopes) == 0 {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								var expiresAt *time.Time
+								if expires := c.String("expires"); expires != "" {
+									t, err := time.Parse(time.RFC3339, expires)
+									if err != nil {
+										logger.With("error", err).Fatal("Invalid time for --expires")
+									}
+									expiresAt = &t
+								}
+
+								client := NewClient(c, logger)
+
+								key, err := client.CreateAPIKey(description, scopes, expiresAt)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not create API key")
+								}
+
+								fmt.Println(APIKeyToString(key))
+								fmt.Printf("\n%s\n\nThis key won't be shown again.\n", key.Key)
+								return nil
+							},
+						},
+						{
+							Name:      "revoke",
+							Usage:     "revoke an API key, after which it's no longer accepted",
+							UsageText: "draupnir admin api-keys revoke [id]",
+							Action: func(c *cli.Context) error {
+								id := c.Args().First()
+								if id == "" {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Must supply an API key id")
+								}
+
+								client := NewClient(c, logger)
+
+								err := client.RevokeAPIKey(id)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not revoke API key")
+								}
+
+								logger.With("id", id).Info("Revoked API key")
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "users",
+					Usage: "manage users' access",
+					Subcommands: []cli.Command{
+						{
+							Name:  "revoke-sessions",
+							Usage: "revoke every session of a user, e.g. when they leave",
+							UsageText: `draupnir admin users revoke-sessions --reason REASON [--destroy-instances | --reassign-instances-to EMAIL] [email]
+
+Unless they're destroyed or reassigned, instances created in the revoked
+sessions are destroyed by the cleaner when it next runs.`,
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "reason", Usage: "why the user's access is being revoked"},
+								cli.BoolFlag{Name: "destroy-instances", Usage: "destroy all of the user's instances straight away"},
+								cli.StringFlag{Name: "reassign-instances-to", Usage: "transfer all of the user's instances to this user"},
+							},
+							Action: func(c *cli.Context) error {
+								email, reason := c.Args().First(), c.String("reason")
+								reassignTo := c.String("reassign-instances-to")
+								if email == "" || reason == "" || (c.Bool("destroy-instances") && reassignTo != "") {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								instances := ""
+								if c.Bool("destroy-instances") {
+									instances = routes.DestroyInstances
+								}
+								if reassignTo != "" {
+									instances = routes.ReassignInstances
+								}
+
+								client := NewClient(c, logger)
+
+								revocation, err := client.RevokeUserSessions(email, reason, instances, reassignTo)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not revoke sessions")
+								}
+
+								fmt.Println(SessionRevocationToString(revocation))
+								return nil
+							},
+						},
+					},
+				},
+				{
+					Name:  "maintenance",
+					Usage: "stop users from creating images and instances during maintenance",
+					Subcommands: []cli.Command{
+						{
+							Name:  "status",
+							Usage: "show whether maintenance mode is enabled",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								mode, err := client.GetMaintenanceMode()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not fetch maintenance mode")
+								}
+
+								fmt.Println(MaintenanceModeToString(mode))
+								return nil
+							},
+						},
+						{
+							Name:  "enable",
+							Usage: "enable maintenance mode",
+							UsageText: `draupnir admin maintenance enable --message MESSAGE [--until TIME]
+
+The message is shown to users who try to create an image or instance.
+Times are in RFC 3339 format, e.g. 2017-05-01T16:00:00Z.`,
+							Flags: []cli.Flag{
+								cli.StringFlag{Name: "message", Usage: "why draupnir is down for maintenance"},
+								cli.StringFlag{Name: "until", Usage: "when the maintenance is expected to end"},
+							},
+							Action: func(c *cli.Context) error {
+								message := c.String("message")
+								if message == "" {
+									cli.ShowCommandHelp(c, c.Command.Name)
+									logger.Fatal("Invalid command arguments")
+								}
+
+								var endsAt *time.Time
+								if until := c.String("until"); until != "" {
+									t, err := time.Parse(time.RFC3339, until)
+									if err != nil {
+										logger.With("error", err).Fatal("Invalid time for --until")
+									}
+									endsAt = &t
+								}
+
+								client := NewClient(c, logger)
+
+								mode, err := client.EnableMaintenanceMode(message, endsAt)
+								if err != nil {
+									logger.With("error", err).Fatal("Could not enable maintenance mode")
+								}
+
+								fmt.Println(MaintenanceModeToString(mode))
+								return nil
+							},
+						},
+						{
+							Name:  "disable",
+							Usage: "disable maintenance mode",
+							Action: func(c *cli.Context) error {
+								client := NewClient(c, logger)
+
+								err := client.DisableMaintenanceMode()
+								if err != nil {
+									logger.With("error", err).Fatal("Could not disable maintenance mode")
+								}
+
+								logger.Info("Disabled maintenance mode")
+								return nil
+							},
+						},
+					},
+				},
 			},
 		},
 		{
 			Name:  "env",
 			Usage: "show the environment variables to connect to an instance",
-			UsageText: `draupnir env [id]
+			UsageText: `draupnir env [--format FORMAT] [id]
+
+[id] the instance ID to connect to
+
+FORMAT is one of:
+  libpq-env     a command exporting libpq environment variables (the default)
+  database-url  a postgresql:// connection URI
+  pg-service    an entry for pg_service.conf
+  pgpass        a line for .pgpass
+  jdbc          a JDBC URL, which uses a PKCS #12 key store
+  json          every detail, including the paths of the key and trust stores`,
+			Flags: []cli.Flag{formatFlag},
+			Action: func(c *cli.Context) error {
+				id := c.Args().First()
+				if id == "" {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Must supply an instance id")
+				}
+
+				client := NewClient(c, logger)
+
+				instance, err := client.GetInstance(id)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				return setupClientEnvironment(loadConfig(c, logger), instance, c.String("format"))
+			},
+		},
+		{
+			Name:  "psql",
+			Usage: "connect to an instance with psql",
+			UsageText: `draupnir psql [id] [-- psql arguments]
 
-[id] the instance ID to connect to`,
+[id] the instance ID to connect to, defaulting to your most recently created instance
+
+The instance's credentials are written to a private temporary directory, and
+removed when psql exits.`,
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				args, psqlArgs := splitCommandArgs(c.Args())
+				if len(args) > 1 {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Arguments for psql must follow --")
+				}
+
+				client := NewClient(c, logger)
+
+				var instance models.Instance
+				if len(args) == 1 {
+					instance, err = client.GetInstance(args[0])
+				} else {
+					var latest models.Instance
+					latest, err = latestInstance(client)
+					if err == nil {
+						instance, err = client.GetInstance(strconv.Itoa(latest.ID))
+					}
+				}
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				code, err := runWithCredentials(loadConfig(c, logger), instance, "psql", psqlArgs)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not run psql")
+				}
+				os.Exit(code)
+				return nil
+			},
+		},
+		{
+			Name:  "exec",
+			Usage: "run a command with the environment variables to connect to an instance",
+			UsageText: `draupnir exec [id] -- [command]
+
+[id] the instance ID to connect to
+[command] the command to run, such as pg_dump or a test suite, which is given
+the libpq environment variables (PGHOST, PGSSLCERT and so on)
+
+The instance's credentials are written to a private temporary directory, and
+removed when the command exits.`,
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				args, command := splitCommandArgs(c.Args())
+				if len(args) != 1 || len(command) == 0 {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Must supply an instance id and a command")
+				}
+
+				client := NewClient(c, logger)
+
+				instance, err := client.GetInstance(args[0])
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				code, err := runWithCredentials(loadConfig(c, logger), instance, command[0], command[1:])
+				if err != nil {
+					logger.With("error", err).Fatal("Could not run command")
+				}
+				os.Exit(code)
+				return nil
+			},
+		},
+		{
+			Name:  "tunnel",
+			Usage: "connect to an instance through the draupnir server, without being whitelisted",
+			UsageText: `draupnir tunnel [--port PORT] [--format FORMAT] [id]
+
+[id] the instance ID to connect to
+
+Connections to the local port are forwarded to the instance through the
+draupnir server, for networks where the instance's port can't be reached or
+the IP address isn't stable enough to be whitelisted. The connection details
+for the local port are printed, and the tunnel stays open until interrupted.`,
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "port", Usage: "the local port to listen on (default: any free port)"},
+				formatFlag,
+			},
 			Action: func(c *cli.Context) error {
 				id := c.Args().First()
 				if id == "" {
@@ -361,6 +1125,11 @@ func main() {
 					logger.Fatal("Must supply an instance id")
 				}
 
+				format := c.String("format")
+				if !connection.ValidFormat(format) {
+					logger.Fatalf("Unknown format %q, expected one of: %s", format, strings.Join(connection.Formats, ", "))
+				}
+
 				client := NewClient(c, logger)
 
 				instance, err := client.GetInstance(id)
@@ -368,13 +1137,21 @@ func main() {
 					logger.With("error", err).Fatal("Could not fetch instance")
 				}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
+				err = runTunnel(logger, loadConfig(c, logger), client, instance, c.Int("port"), format)
+				if err != nil {
+					logger.With("error", err).Fatal("Tunnel failed")
+				}
+				return nil
 			},
 		},
 		{
 			Name:    "new",
 			Aliases: []string{},
 			Usage:   "create a new instance",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "password", Usage: "authenticate to the instance with a password instead of a client certificate, for tools that can't use one"},
+				formatFlag,
+			},
 			Action: func(c *cli.Context) error {
 				client := NewClient(c, logger)
 
@@ -383,12 +1160,12 @@ func main() {
 					logger.With("error", err).Fatal("Could not fetch image")
 				}
 
-				instance, err := client.CreateInstance(image)
+				instance, err := client.CreateInstance(image, c.Bool("password"))
 				if err != nil {
 					logger.With("error", err).Fatal("Could not create instance")
 				}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
+				return setupClientEnvironment(loadConfig(c, logger), instance, c.String("format"))
 			},
 		},
 	}
@@ -396,9 +1173,121 @@ func main() {
 	app.Run(os.Args)
 }
 
-func setupClientEnvironment(config config.Config, instance models.Instance) error {
+func setupClientEnvironment(config config.Config, instance models.Instance, format string) error {
+	if !connection.ValidFormat(format) {
+		return fmt.Errorf("unknown format %q, expected one of: %s", format, strings.Join(connection.Formats, ", "))
+	}
+
+	dir, err := writeCredentials(instance)
+	if err != nil {
+		return err
+	}
+
+	output, err := connection.Render(format, connection.New(instance, databaseName(config), dir))
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(output)
+	return nil
+}
+
+// runWithCredentials runs the command with the environment needed to connect to
+// the instance, and returns its exit code. Unlike setupClientEnvironment, the
+// credentials are removed once the command exits.
+func runWithCredentials(config config.Config, instance models.Instance, name string, args []string) (int, error) {
+	dir, err := writeCredentials(instance)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	details := connection.New(instance, databaseName(config), dir)
+
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), connection.Environment(details)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// An interrupt from the terminal is delivered to the command too, which
+	// decides what to do with it (psql cancels the running query). We have to
+	// outlive the command to remove the credentials, so we ignore interrupts
+	// and pass on requests to terminate.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 0, errors.Wrapf(err, "failed to run %s", name)
+	}
+
+	go func() {
+		for sig := range signals {
+			if sig != os.Interrupt {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// runTunnel forwards connections on the local port to the instance, until
+// interrupted. The connection details printed refer to the local port, and the
+// credentials are removed once the tunnel closes.
+func runTunnel(logger log.Logger, config config.Config, client clientPkg.Client, instance models.Instance, port int, format string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for connections")
+	}
+
+	// Postgres' TLS runs end to end through the tunnel, and verify-ca doesn't
+	// check the hostname, so the instance's credentials work unchanged
+	local := instance
+	local.Hostname = "127.0.0.1"
+	local.Port = uint16(listener.Addr().(*net.TCPAddr).Port)
+
+	dir, err := writeCredentials(local)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	output, err := connection.Render(format, connection.New(local, databaseName(config), dir))
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	fmt.Print(output)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	logger.
+		With("address", listener.Addr().String()).
+		Infof("Forwarding connections to instance %d, press Ctrl-C to stop", instance.ID)
+
+	return tunnel.Forward(logger, listener, func() (io.ReadWriteCloser, error) {
+		return client.OpenTunnel(instance)
+	})
+}
+
+// writeCredentials writes the instance's credentials to a new private
+// directory, and returns its path
+func writeCredentials(instance models.Instance) (string, error) {
 	if instance.Credentials == nil {
-		return errors.New("database credentials are not available")
+		return "", errors.New("database credentials are not available")
 	}
 
 	// We use an OS-defined private temporary directory for storing the
@@ -411,72 +1300,225 @@ func setupClientEnvironment(config config.Config, instance models.Instance) erro
 	// this use case: https://superuser.com/a/187105
 	dir, err := ioutil.TempDir("", fmt.Sprintf("draupnir-%d-", instance.ID))
 	if err != nil {
-		return errors.Wrap(err, "failed to create temporary directory")
+		return "", errors.Wrap(err, "failed to create temporary directory")
+	}
+
+	if err := connection.WriteFiles(dir, *instance.Credentials); err != nil {
+		os.RemoveAll(dir)
+		return "", err
 	}
 
-	caCertPath := filepath.Join(dir, "ca.crt")
-	clientCertPath := filepath.Join(dir, "client.crt")
-	clientKeyPath := filepath.Join(dir, "client.key")
+	return dir, nil
+}
 
-	if err := ioutil.WriteFile(caCertPath, []byte(instance.Credentials.CACertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", caCertPath)
+// databaseName returns the database to connect to. The precedence is config ->
+// environment variable -> 'postgres'.
+func databaseName(config config.Config) string {
+	if config.Database != "" {
+		return config.Database
+	}
+	if database := os.Getenv("PGDATABASE"); database != "" {
+		return database
 	}
-	if err := ioutil.WriteFile(clientCertPath, []byte(instance.Credentials.ClientCertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientCertPath)
+	return "postgres"
+}
+
+// splitCommandArgs splits arguments at the first "--", into those for draupnir
+// and those for the command it runs
+func splitCommandArgs(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
 	}
-	if err := ioutil.WriteFile(clientKeyPath, []byte(instance.Credentials.ClientKey), 0600); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientKeyPath)
+	return args, nil
+}
+
+// openBrowser opens the URL in a browser on this machine, failing if there
+// isn't one, such as when connected over SSH or inside a container
+func openBrowser(url string) error {
+	if os.Getenv("SSH_CONNECTION") != "" {
+		return errors.New("connected over SSH")
 	}
 
-	// The database precedence is config -> environment variable -> 'postgres'
-	database := config.Database
-	if database == "" {
-		database = os.Getenv("PGDATABASE")
+	if runtime.GOOS == "darwin" {
+		return exec.Command("open", url).Run()
 	}
-	if database == "" {
-		database = "postgres"
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return errors.New("no display available")
 	}
+	return exec.Command("xdg-open", url).Run()
+}
 
-	// Output enviroment variables that can be read by libpq:
-	// https://www.postgresql.org/docs/current/libpq-envars.html
-	fmt.Printf(
-		"export PGHOST=%s PGPORT=%d PGUSER=draupnir PGPASSWORD='' PGDATABASE=%s PGSSLMODE=verify-ca PGSSLROOTCERT='%s' PGSSLCERT='%s' PGSSLKEY='%s'\n",
-		instance.Hostname,
-		instance.Port,
-		database,
-		caCertPath,
-		clientCertPath,
-		clientKeyPath,
-	)
+// authenticateDevice authenticates using a browser on any device, polling
+// until the user has entered the code it prints
+func authenticateDevice(client clientPkg.Client) (oauth2.Token, error) {
+	authorisation, err := client.CreateDeviceAuthorisation()
+	if err != nil {
+		return oauth2.Token{}, err
+	}
 
-	return nil
+	fmt.Printf("Visit %s and enter the code %s\n", authorisation.VerificationURL, authorisation.UserCode)
+	fmt.Printf("or open this link on any device: %s\n", authorisation.VerificationURLComplete)
+
+	interval := time.Duration(authorisation.Interval) * time.Second
+	for time.Now().Before(authorisation.ExpiresAt) {
+		time.Sleep(interval)
+
+		token, err := client.CreateDeviceAccessToken(authorisation.DeviceCode)
+		if err == clientPkg.ErrAuthorizationPending {
+			continue
+		}
+		return token, err
+	}
+
+	return oauth2.Token{}, errors.New("the code expired before it was entered")
+}
+
+// latestInstance returns the user's most recently created instance
+func latestInstance(client clientPkg.Client) (models.Instance, error) {
+	instances, err := client.ListInstances()
+	if err != nil {
+		return models.Instance{}, err
+	}
+	if len(instances) == 0 {
+		return models.Instance{}, errors.New("you have no instances, create one with `draupnir new`")
+	}
+
+	latest := instances[0]
+	for _, instance := range instances[1:] {
+		if instance.CreatedAt.After(latest.CreatedAt) {
+			latest = instance
+		}
+	}
+	return latest, nil
 }
 
 func ImageToString(i models.Image) string {
 	return fmt.Sprintf("%2d [ %s - READY: %5t ]", i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready)
 }
 
+func ImageAccessRuleToString(r models.ImageAccessRule) string {
+	if r.GroupName != "" {
+		return fmt.Sprintf("%2d [ IMAGE: %d - GROUP: %s ]", r.ID, r.ImageID, r.GroupName)
+	}
+	return fmt.Sprintf("%2d [ IMAGE: %d - USER: %s ]", r.ID, r.ImageID, r.UserEmail)
+}
+
+func InstanceSummaryToString(i models.InstanceSummary) string {
+	usage := "unknown"
+	if i.DiskUsage >= 0 {
+		usage = fmt.Sprintf("%.1f MiB", float64(i.DiskUsage)/(1024*1024))
+	}
+	owner := i.UserEmail
+	if i.Pooled {
+		owner = "(pool)"
+	}
+	age := time.Since(i.CreatedAt).Truncate(time.Minute)
+	return fmt.Sprintf(
+		"%2d [ OWNER: %s - IMAGE: %d - PORT: %d - AGE: %s - DISK: %s ]",
+		i.ID, owner, i.ImageID, i.Port, age, usage,
+	)
+}
+
+func InstanceDestructionToString(d models.InstanceDestruction) string {
+	return fmt.Sprintf(
+		"%2d [ OWNER: %s - BY: %s - %s ] %s",
+		d.InstanceID, d.UserEmail, d.DestroyedBy, d.CreatedAt.Format(time.RFC3339), d.Reason,
+	)
+}
+
+func AuditEventToString(e models.AuditEvent) string {
+	return fmt.Sprintf(
+		"%s [ %s - %s %s/%s - %s - FROM: %s ] %s",
+		e.CreatedAt.Format(time.RFC3339), e.Actor, e.Action, e.ResourceType, e.ResourceID, e.Outcome, e.SourceIP, e.Detail,
+	)
+}
+
+func RoleAssignmentToString(a models.RoleAssignment) string {
+	return fmt.Sprintf("%s [ ROLE: %s ]", a.Principal, a.Role)
+}
+
+func APIKeyToString(k models.APIKey) string {
+	expires := "never"
+	if k.ExpiresAt != nil {
+		expires = k.ExpiresAt.Format(time.RFC3339)
+	}
+	if k.RevokedAt != nil {
+		expires = "revoked " + k.RevokedAt.Format(time.RFC3339)
+	}
+	return fmt.Sprintf(
+		"%d [ SCOPES: %s - BY: %s - EXPIRES: %s ] %s",
+		k.ID, strings.Join(k.Scopes, ", "), k.CreatedBy, expires, k.Description,
+	)
+}
+
+func SessionRevocationToString(r models.SessionRevocation) string {
+	return fmt.Sprintf(
+		"%s [ SESSIONS REVOKED: %d - INSTANCES DESTROYED: %d - INSTANCES REASSIGNED: %d ]",
+		r.ID, r.RevokedSessions, r.DestroyedInstances, r.ReassignedInstances,
+	)
+}
+
+func MaintenanceModeToString(m models.MaintenanceMode) string {
+	if !m.Enabled {
+		return "Maintenance mode is disabled"
+	}
+	return fmt.Sprintf(
+		"Maintenance mode is enabled [ BY: %s - SINCE: %s ] %s",
+		m.EnabledBy, m.CreatedAt.Format(time.RFC3339), m.Description(),
+	)
+}
+
+// rolePrincipal returns the principal named by exactly one of the --user and
+// --group flags
+func rolePrincipal(c *cli.Context) (string, bool) {
+	user, group := c.String("user"), c.String("group")
+	if (user == "") == (group == "") {
+		return "", false
+	}
+	if group != "" {
+		return auth.GroupPrincipal(group), true
+	}
+	return user, true
+}
+
 func InstanceToString(i models.Instance) string {
 	return fmt.Sprintf("%2d [ PORT: %d - %s ]", i.ID, i.Port, i.CreatedAt.Format(time.RFC3339))
 }
 
-func loadConfig(logger log.Logger) config.Config {
-	cfg, err := config.Load()
+func loadConfig(c *cli.Context, logger log.Logger) config.Config {
+	cfg, err := config.Load(c.GlobalString("profile"))
 	if err != nil {
 		logger.With("error", err.Error()).Fatal("Could not load configuration")
 	}
 	return cfg
 }
 
-func storeConfig(cfg config.Config, logger log.Logger) {
-	err := config.Store(cfg)
+func storeConfig(c *cli.Context, cfg config.Config, logger log.Logger) {
+	err := config.Store(c.GlobalString("profile"), cfg)
+	if err != nil {
+		logger.With("error", err.Error()).Fatal("Could not store configuration")
+	}
+}
+
+func loadConfigFile(logger log.Logger) config.File {
+	file, err := config.LoadFile()
+	if err != nil {
+		logger.With("error", err.Error()).Fatal("Could not load configuration")
+	}
+	return file
+}
+
+func storeConfigFile(file config.File, logger log.Logger) {
+	err := config.StoreFile(file)
 	if err != nil {
 		logger.With("error", err.Error()).Fatal("Could not store configuration")
 	}
 }
 
 func NewClient(c *cli.Context, logger log.Logger) clientPkg.Client {
-	cfg := loadConfig(logger)
+	cfg := loadConfig(c, logger)
 	return clientPkg.NewClient(
 		getServerURL(c, cfg),
 		cfg.Token,
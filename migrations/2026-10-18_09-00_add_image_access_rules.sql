@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE image_access_rules (
+  id serial PRIMARY KEY,
+  image_id integer NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+  user_email text,
+  group_name text,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+
+  CHECK ((user_email IS NULL) <> (group_name IS NULL))
+);
+
+CREATE INDEX image_access_rules_image_id_idx ON image_access_rules (image_id);
+
+-- +migrate Down
+DROP TABLE image_access_rules;
@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE role_assignments (
+  principal text PRIMARY KEY,
+  role text NOT NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL,
+
+  CHECK (role IN ('viewer', 'user', 'image-publisher', 'admin'))
+);
+
+-- +migrate Down
+DROP TABLE role_assignments;
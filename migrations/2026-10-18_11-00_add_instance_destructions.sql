@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE instance_destructions (
+  id serial PRIMARY KEY,
+  instance_id integer NOT NULL,
+  image_id integer NOT NULL,
+  user_email text NOT NULL,
+  destroyed_by text NOT NULL,
+  reason text NOT NULL,
+  created_at timestamptz NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE instance_destructions;
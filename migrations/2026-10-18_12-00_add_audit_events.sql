@@ -0,0 +1,33 @@
+-- +migrate Up
+CREATE TABLE audit_events (
+  id bigserial PRIMARY KEY,
+  actor text NOT NULL,
+  action text NOT NULL,
+  resource_type text NOT NULL,
+  resource_id text NOT NULL,
+  source_ip text,
+  outcome text NOT NULL,
+  detail text,
+  created_at timestamptz NOT NULL
+);
+
+CREATE INDEX audit_events_resource_idx ON audit_events (resource_type, resource_id);
+CREATE INDEX audit_events_actor_idx ON audit_events (actor);
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+
+-- Audit events are append-only: reject any attempt to change or remove them
+-- +migrate StatementBegin
+CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +migrate StatementEnd
+
+CREATE TRIGGER audit_events_append_only
+  BEFORE UPDATE OR DELETE ON audit_events
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_events_append_only();
+
+-- +migrate Down
+DROP TABLE audit_events;
+DROP FUNCTION audit_events_append_only();
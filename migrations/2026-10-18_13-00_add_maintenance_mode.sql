@@ -0,0 +1,15 @@
+-- +migrate Up
+-- Maintenance mode is enabled while this table has a row in it. The check
+-- constraint ensures that it never has more than one.
+CREATE TABLE maintenance_mode (
+  id integer PRIMARY KEY DEFAULT 1,
+  message text NOT NULL,
+  ends_at timestamptz,
+  enabled_by text NOT NULL,
+  created_at timestamptz NOT NULL,
+
+  CHECK (id = 1)
+);
+
+-- +migrate Down
+DROP TABLE maintenance_mode;
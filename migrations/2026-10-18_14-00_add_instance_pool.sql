@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN pooled boolean NOT NULL DEFAULT false;
+CREATE INDEX instances_pooled_image_id_idx ON instances (image_id) WHERE pooled;
+
+-- +migrate Down
+DROP INDEX instances_pooled_image_id_idx;
+ALTER TABLE instances DROP COLUMN pooled;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN password_authentication boolean NOT NULL DEFAULT false;
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN password_authentication;
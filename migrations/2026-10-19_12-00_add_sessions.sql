@@ -0,0 +1,35 @@
+-- +migrate Up
+CREATE TABLE sessions (
+    id text PRIMARY KEY,
+    user_email text NOT NULL,
+    refresh_token text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    revoked_at timestamp with time zone,
+    revocation_reason text NOT NULL DEFAULT ''
+);
+
+-- Instances record the session they were created in, rather than their owner's
+-- refresh token. Existing refresh tokens are moved to sessions that have
+-- already expired, so that the cleaner still checks them.
+ALTER TABLE instances ADD COLUMN session_id text NOT NULL DEFAULT '';
+
+INSERT INTO sessions (id, user_email, refresh_token, created_at, expires_at)
+SELECT 'instance-' || id, user_email, refresh_token, NOW(), NOW()
+FROM instances
+WHERE refresh_token IS NOT NULL AND refresh_token <> '';
+
+UPDATE instances SET session_id = 'instance-' || id
+WHERE refresh_token IS NOT NULL AND refresh_token <> '';
+
+ALTER TABLE instances DROP COLUMN refresh_token;
+
+-- +migrate Down
+ALTER TABLE instances ADD COLUMN refresh_token text;
+
+UPDATE instances SET refresh_token = sessions.refresh_token
+FROM sessions
+WHERE sessions.id = instances.session_id;
+
+ALTER TABLE instances DROP COLUMN session_id;
+DROP TABLE sessions;
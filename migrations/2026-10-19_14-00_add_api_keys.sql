@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE api_keys (
+    id serial PRIMARY KEY,
+    description text NOT NULL,
+    key_hash text NOT NULL UNIQUE,
+    scopes text[] NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone,
+    revoked_at timestamp with time zone
+);
+
+-- +migrate Down
+DROP TABLE api_keys;
@@ -0,0 +1,11 @@
+-- +migrate Up
+CREATE TABLE oauth_handshakes (
+    state text PRIMARY KEY,
+    token text,
+    error text,
+    completed_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE oauth_handshakes;
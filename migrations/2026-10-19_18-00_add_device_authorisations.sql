@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE device_authorisations (
+    device_code text PRIMARY KEY,
+    user_code text NOT NULL UNIQUE,
+    state text UNIQUE,
+    token text,
+    error text,
+    completed_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE device_authorisations;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN api_key_id integer REFERENCES api_keys (id);
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN api_key_id;
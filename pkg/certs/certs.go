@@ -0,0 +1,409 @@
+// Package certs generates the certificates that secure connections to
+// instances. Each instance has its own certificate authority, which signs a
+// server certificate for Postgres and a client certificate for its user.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+
+	DefaultKeyType      = KeyTypeRSA
+	DefaultRSAKeySize   = 2048
+	DefaultECDSAKeySize = 256
+	DefaultValidity     = 30 * 24 * time.Hour
+	// DefaultAuthorityValidity outlasts any instance, so that only client
+	// certificates need to be reissued
+	DefaultAuthorityValidity = 10 * 365 * 24 * time.Hour
+)
+
+// Options control the keys and certificates that are generated. Zero values
+// are replaced by the defaults.
+type Options struct {
+	// KeyType is one of "rsa", "ecdsa" or "ed25519"
+	KeyType string
+	// KeySize is the number of bits in an RSA key, or the size of the curve for
+	// an ECDSA key: 256, 384 or 521. It is ignored for Ed25519 keys.
+	KeySize int
+	// Validity is how long client certificates are valid for from when they're
+	// issued
+	Validity time.Duration
+	// AuthorityValidity is how long each instance's certificate authority, and
+	// the server certificate it signs, are valid for
+	AuthorityValidity time.Duration
+}
+
+// WithDefaults returns the options with any unset values replaced by defaults
+func (o Options) WithDefaults() Options {
+	if o.KeyType == "" {
+		o.KeyType = DefaultKeyType
+	}
+	if o.KeySize == 0 {
+		switch o.KeyType {
+		case KeyTypeRSA:
+			o.KeySize = DefaultRSAKeySize
+		case KeyTypeECDSA:
+			o.KeySize = DefaultECDSAKeySize
+		}
+	}
+	if o.Validity == 0 {
+		o.Validity = DefaultValidity
+	}
+	if o.AuthorityValidity == 0 {
+		o.AuthorityValidity = DefaultAuthorityValidity
+	}
+	return o
+}
+
+// Validate checks that keys can be generated with the options
+func (o Options) Validate() error {
+	switch o.KeyType {
+	case KeyTypeRSA:
+		if o.KeySize < 2048 {
+			return fmt.Errorf("RSA keys must be at least 2048 bits, not %d", o.KeySize)
+		}
+	case KeyTypeECDSA:
+		if _, err := o.curve(); err != nil {
+			return err
+		}
+	case KeyTypeEd25519:
+	default:
+		return fmt.Errorf("unknown key type: %s", o.KeyType)
+	}
+	return nil
+}
+
+// Bundle holds the PEM encoded certificates and private keys of an instance
+type Bundle struct {
+	CACertificate     []byte
+	CAKey             []byte
+	ServerCertificate []byte
+	ServerKey         []byte
+	ClientCertificate []byte
+	ClientKey         []byte
+}
+
+// ClientCommonName is the common name of an instance's client certificate,
+// which Postgres maps to the draupnir user in pg_ident.conf
+func ClientCommonName(instanceID int) string {
+	return fmt.Sprintf("Draupnir instance %d client", instanceID)
+}
+
+// GenerateInstanceBundle generates a certificate authority for the instance,
+// and uses it to sign a server and client certificate. The CA and server
+// certificate are valid for opts.AuthorityValidity, and the client certificate
+// for opts.Validity.
+func GenerateInstanceBundle(instanceID int, opts Options) (Bundle, error) {
+	opts = opts.WithDefaults()
+	now := time.Now()
+
+	caKey, err := opts.generateKey()
+	if err != nil {
+		return Bundle{}, errors.Wrap(err, "failed to generate CA key")
+	}
+	caTemplate, err := template(fmt.Sprintf("Draupnir instance %d certification authority", instanceID), now, opts.AuthorityValidity)
+	if err != nil {
+		return Bundle{}, err
+	}
+	caTemplate.IsCA = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		return Bundle{}, errors.Wrap(err, "failed to create CA certificate")
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return Bundle{}, errors.Wrap(err, "failed to parse CA certificate")
+	}
+
+	bundle := Bundle{CACertificate: encodeCertificate(caDER)}
+	if bundle.CAKey, err = encodeKey(caKey); err != nil {
+		return Bundle{}, err
+	}
+
+	bundle.ServerCertificate, bundle.ServerKey, err = issue(
+		caCert, caKey, opts, now, opts.AuthorityValidity,
+		fmt.Sprintf("Draupnir instance %d server", instanceID),
+		x509.ExtKeyUsageServerAuth,
+	)
+	if err != nil {
+		return Bundle{}, errors.Wrap(err, "failed to issue server certificate")
+	}
+
+	bundle.ClientCertificate, bundle.ClientKey, err = issue(
+		caCert, caKey, opts, now, opts.Validity,
+		ClientCommonName(instanceID),
+		x509.ExtKeyUsageClientAuth,
+	)
+	if err != nil {
+		return Bundle{}, errors.Wrap(err, "failed to issue client certificate")
+	}
+
+	return bundle, nil
+}
+
+// IssueClientCertificate issues a new client certificate for an instance,
+// signed by its existing certificate authority, so that the instance's other
+// certificates remain valid. The certificate expires no later than the CA.
+func IssueClientCertificate(instanceID int, caCertificate, caKey []byte, opts Options) ([]byte, []byte, error) {
+	opts = opts.WithDefaults()
+
+	caCert, signer, err := parseCA(caCertificate, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, key, err := issue(caCert, signer, opts, time.Now(), opts.Validity, ClientCommonName(instanceID), x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to issue client certificate")
+	}
+
+	return certificate, key, nil
+}
+
+// IssueProxyCertificate issues a server certificate for hostname, signed by
+// the instance's certificate authority, so that a proxy terminating TLS in
+// front of the instance is trusted by its clients in the same way as the
+// instance itself
+func IssueProxyCertificate(instanceID int, hostname string, caCertificate, caKey []byte, opts Options) ([]byte, []byte, error) {
+	opts = opts.WithDefaults()
+
+	caCert, signer, err := parseCA(caCertificate, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, key, err := issue(
+		caCert, signer, opts, time.Now(), opts.Validity,
+		fmt.Sprintf("Draupnir instance %d proxy", instanceID),
+		x509.ExtKeyUsageServerAuth,
+		hostname,
+	)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to issue proxy certificate")
+	}
+
+	return certificate, key, nil
+}
+
+// ParseCertificate parses the first PEM encoded certificate in data
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ExpiresAt returns the time at which a PEM encoded certificate expires
+func ExpiresAt(certificate []byte) (time.Time, error) {
+	cert, err := ParseCertificate(certificate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// ReadBundle reads the files written by WriteFiles from dir. Files that are
+// missing or can't be read are left empty: Draupnir can't read an instance's
+// server key, for example.
+func ReadBundle(dir string) Bundle {
+	read := func(name string) []byte {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil
+		}
+		return contents
+	}
+
+	return Bundle{
+		CACertificate:     read("ca.crt"),
+		CAKey:             read("ca.key"),
+		ServerCertificate: read("server.crt"),
+		ServerKey:         read("server.key"),
+		ClientCertificate: read("client.crt"),
+		ClientKey:         read("client.key"),
+	}
+}
+
+// WriteFiles writes the bundle to dir as ca.crt, ca.key, server.crt,
+// server.key, client.crt and client.key. Private keys are only readable by
+// their owner. Files absent from the bundle, e.g. when only the client
+// certificate has been reissued, aren't written.
+func (b Bundle) WriteFiles(dir string) error {
+	files := []struct {
+		name     string
+		contents []byte
+		mode     os.FileMode
+	}{
+		{"ca.crt", b.CACertificate, 0644},
+		{"ca.key", b.CAKey, 0600},
+		{"server.crt", b.ServerCertificate, 0644},
+		{"server.key", b.ServerKey, 0600},
+		{"client.crt", b.ClientCertificate, 0644},
+		{"client.key", b.ClientKey, 0600},
+	}
+
+	for _, file := range files {
+		if len(file.contents) == 0 {
+			continue
+		}
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, file.contents, file.mode); err != nil {
+			return errors.Wrapf(err, "failed to write %s", path)
+		}
+	}
+
+	return nil
+}
+
+// issue generates a key and a certificate for it, signed by the CA, valid for
+// any DNS names given. A certificate can't be verified once its CA has
+// expired, so it expires no later than the CA does.
+func issue(ca *x509.Certificate, caKey crypto.Signer, opts Options, now time.Time, validity time.Duration, commonName string, usage x509.ExtKeyUsage, dnsNames ...string) ([]byte, []byte, error) {
+	key, err := opts.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl, err := template(commonName, now, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tmpl.NotAfter.After(ca.NotAfter) {
+		tmpl.NotAfter = ca.NotAfter
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		// RSA key exchange encrypts the session key with the server's key
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	tmpl.DNSNames = dnsNames
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertificate(der), keyPEM, nil
+}
+
+func template(commonName string, now time.Time, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+func (o Options) generateKey() (crypto.Signer, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch o.KeyType {
+	case KeyTypeECDSA:
+		curve, _ := o.curve()
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, o.KeySize)
+	}
+}
+
+func (o Options) curve() (elliptic.Curve, error) {
+	switch o.KeySize {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("ECDSA keys must be 256, 384 or 521 bits, not %d", o.KeySize)
+	}
+}
+
+func encodeCertificate(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func parseCA(caCertificate, caKey []byte) (*x509.Certificate, crypto.Signer, error) {
+	caCert, err := ParseCertificate(caCertificate)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+
+	signer, err := parseKey(caKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse CA key")
+	}
+
+	return caCert, signer, nil
+}
+
+// parseKey parses a PEM encoded private key. Keys generated by openssl for
+// older instances may be in PKCS #1 rather than PKCS #8 form.
+func parseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key found")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key can't be used for signing")
+	}
+	return signer, nil
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
@@ -0,0 +1,302 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseCertificate(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM block found")
+	}
+	assert.Equal(t, "CERTIFICATE", block.Type)
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestGenerateInstanceBundle(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(42, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := parseCertificate(t, bundle.CACertificate)
+	assert.Equal(t, "Draupnir instance 42 certification authority", ca.Subject.CommonName)
+	assert.True(t, ca.IsCA)
+	assert.Equal(t, x509.KeyUsageCertSign|x509.KeyUsageCRLSign, ca.KeyUsage)
+	assert.WithinDuration(t, time.Now().Add(DefaultAuthorityValidity), ca.NotAfter, time.Minute)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	server := parseCertificate(t, bundle.ServerCertificate)
+	assert.Equal(t, "Draupnir instance 42 server", server.Subject.CommonName)
+	assert.False(t, server.IsCA)
+	_, err = server.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	assert.Nil(t, err, "the server certificate is signed by the CA")
+
+	client := parseCertificate(t, bundle.ClientCertificate)
+	assert.Equal(t, ClientCommonName(42), client.Subject.CommonName)
+	assert.False(t, client.IsCA)
+	_, err = client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.Nil(t, err, "the client certificate is signed by the CA")
+
+	// Each key matches its certificate
+	_, err = tls.X509KeyPair(bundle.CACertificate, bundle.CAKey)
+	assert.Nil(t, err)
+	_, err = tls.X509KeyPair(bundle.ServerCertificate, bundle.ServerKey)
+	assert.Nil(t, err)
+	_, err = tls.X509KeyPair(bundle.ClientCertificate, bundle.ClientKey)
+	assert.Nil(t, err)
+
+	assert.NotEqual(t, ca.SerialNumber, server.SerialNumber)
+	assert.NotEqual(t, server.SerialNumber, client.SerialNumber)
+}
+
+func TestGenerateInstanceBundleKeyTypes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		opts    Options
+		checkFn func(t *testing.T, key interface{})
+	}{
+		{
+			"rsa",
+			Options{KeyType: KeyTypeRSA, KeySize: 3072},
+			func(t *testing.T, key interface{}) {
+				if assert.IsType(t, &rsa.PublicKey{}, key) {
+					assert.Equal(t, 3072, key.(*rsa.PublicKey).N.BitLen())
+				}
+			},
+		},
+		{
+			"ecdsa",
+			Options{KeyType: KeyTypeECDSA, KeySize: 384},
+			func(t *testing.T, key interface{}) {
+				if assert.IsType(t, &ecdsa.PublicKey{}, key) {
+					assert.Equal(t, 384, key.(*ecdsa.PublicKey).Curve.Params().BitSize)
+				}
+			},
+		},
+		{
+			"ed25519",
+			Options{KeyType: KeyTypeEd25519},
+			func(t *testing.T, key interface{}) {
+				assert.IsType(t, ed25519.PublicKey{}, key)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bundle, err := GenerateInstanceBundle(1, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, data := range [][]byte{bundle.CACertificate, bundle.ServerCertificate, bundle.ClientCertificate} {
+				tc.checkFn(t, parseCertificate(t, data).PublicKey)
+			}
+		})
+	}
+}
+
+func TestGenerateInstanceBundleValidity(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(1, Options{KeyType: KeyTypeECDSA, Validity: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := parseCertificate(t, bundle.ClientCertificate)
+	assert.Equal(t, 7*24*time.Hour, client.NotAfter.Sub(client.NotBefore))
+
+	// The CA and server certificate outlast the client certificate, so that it
+	// can be reissued without replacing them
+	for _, data := range [][]byte{bundle.CACertificate, bundle.ServerCertificate} {
+		cert := parseCertificate(t, data)
+		assert.Equal(t, DefaultAuthorityValidity, cert.NotAfter.Sub(cert.NotBefore))
+	}
+}
+
+func TestIssueClientCertificateExpiresWithCA(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(7, Options{KeyType: KeyTypeECDSA, AuthorityValidity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := parseCertificate(t, bundle.CACertificate)
+
+	certificate, _, err := IssueClientCertificate(7, bundle.CACertificate, bundle.CAKey, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiresAt, err := ExpiresAt(certificate)
+	assert.Nil(t, err)
+	assert.Equal(t, ca.NotAfter, expiresAt)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.Nil(t, Options{}.WithDefaults().Validate())
+	assert.Nil(t, Options{KeyType: KeyTypeEd25519}.WithDefaults().Validate())
+	assert.EqualError(t, Options{KeyType: KeyTypeRSA, KeySize: 1024}.Validate(), "RSA keys must be at least 2048 bits, not 1024")
+	assert.EqualError(t, Options{KeyType: KeyTypeECDSA, KeySize: 128}.Validate(), "ECDSA keys must be 256, 384 or 521 bits, not 128")
+	assert.EqualError(t, Options{KeyType: "dsa"}.Validate(), "unknown key type: dsa")
+
+	_, err := GenerateInstanceBundle(1, Options{KeyType: "dsa"})
+	assert.EqualError(t, err, "failed to generate CA key: unknown key type: dsa")
+}
+
+func TestIssueClientCertificate(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(7, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, key, err := IssueClientCertificate(7, bundle.CACertificate, bundle.CAKey, Options{KeyType: KeyTypeECDSA, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parseCertificate(t, bundle.CACertificate))
+
+	client := parseCertificate(t, certificate)
+	assert.Equal(t, ClientCommonName(7), client.Subject.CommonName)
+	_, err = client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.Nil(t, err, "the new certificate is signed by the existing CA")
+	assert.NotEqual(t, bundle.ClientCertificate, certificate)
+
+	_, err = tls.X509KeyPair(certificate, key)
+	assert.Nil(t, err)
+
+	expiresAt, err := ExpiresAt(certificate)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Minute)
+}
+
+func TestIssueClientCertificateWithInvalidCA(t *testing.T) {
+	_, _, err := IssueClientCertificate(7, []byte("not a certificate"), []byte("not a key"), Options{})
+	assert.EqualError(t, err, "failed to parse CA certificate: no PEM encoded certificate found")
+}
+
+func TestBundleWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle, err := GenerateInstanceBundle(1, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bundle.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mode := range map[string]os.FileMode{
+		"ca.crt":     0644,
+		"ca.key":     0600,
+		"server.crt": 0644,
+		"server.key": 0600,
+		"client.crt": 0644,
+		"client.key": 0600,
+	} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, mode, info.Mode().Perm()&mode, name)
+		assert.Zero(t, info.Mode().Perm()&^mode, name)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bundle.ClientKey, contents)
+}
+
+func TestBundleWriteFilesOnlyWritesPresentFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := Bundle{ClientCertificate: []byte("certificate"), ClientKey: []byte("key")}
+	if err := bundle.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.Equal(t, []string{"client.crt", "client.key"}, names)
+}
+
+func TestIssueProxyCertificate(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(7, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, key, err := IssueProxyCertificate(7, "instance-7.draupnir.example", bundle.CACertificate, bundle.CAKey, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parseCertificate(t, bundle.CACertificate))
+
+	proxy := parseCertificate(t, certificate)
+	assert.Equal(t, "Draupnir instance 7 proxy", proxy.Subject.CommonName)
+	_, err = proxy.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   "instance-7.draupnir.example",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	assert.Nil(t, err, "the certificate is valid for the hostname, and signed by the instance's CA")
+
+	_, err = tls.X509KeyPair(certificate, key)
+	assert.Nil(t, err)
+}
+
+func TestReadBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle, err := GenerateInstanceBundle(1, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.ServerKey = nil
+	if err := bundle.WriteFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, bundle, ReadBundle(dir))
+}
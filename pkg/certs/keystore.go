@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// KeyStorePassword protects the PKCS #12 key and trust stores. Their
+// encryption is weak, so, as with the PEM encoded client key, they're
+// protected by their file permissions rather than a secret password.
+const KeyStorePassword = pkcs12.DefaultPassword
+
+// PKCS8 converts a PEM encoded private key to the DER encoded PKCS #8 form
+// that Java expects
+func PKCS8(key []byte) ([]byte, error) {
+	signer, err := parseKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse key")
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode key")
+	}
+	return der, nil
+}
+
+// KeyStore returns a PKCS #12 key store holding the PEM encoded key, its
+// certificate and the CA certificate that signed it
+func KeyStore(certificate, key, caCertificate []byte) ([]byte, error) {
+	cert, err := ParseCertificate(certificate)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+
+	caCert, err := ParseCertificate(caCertificate)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+
+	signer, err := parseKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse key")
+	}
+
+	store, err := pkcs12.Encode(rand.Reader, signer, cert, []*x509.Certificate{caCert}, KeyStorePassword)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode key store")
+	}
+	return store, nil
+}
+
+// TrustStore returns a PKCS #12 trust store holding the PEM encoded CA
+// certificate
+func TrustStore(caCertificate []byte) ([]byte, error) {
+	caCert, err := ParseCertificate(caCertificate)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+
+	store, err := pkcs12.EncodeTrustStore(rand.Reader, []*x509.Certificate{caCert}, KeyStorePassword)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode trust store")
+	}
+	return store, nil
+}
@@ -0,0 +1,71 @@
+package certs
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestPKCS8(t *testing.T) {
+	for _, keyType := range []string{KeyTypeRSA, KeyTypeECDSA, KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			bundle, err := GenerateInstanceBundle(1, Options{KeyType: keyType})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			der, err := PKCS8(bundle.ClientKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := x509.ParsePKCS8PrivateKey(der)
+			assert.Nil(t, err)
+			assert.NotNil(t, key)
+		})
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(1, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := KeyStore(bundle.ClientCertificate, bundle.ClientKey, bundle.CACertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, cert, caCerts, err := pkcs12.DecodeChain(store, KeyStorePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, key)
+	assert.Equal(t, ClientCommonName(1), cert.Subject.CommonName)
+	if assert.Len(t, caCerts, 1) {
+		assert.Equal(t, "Draupnir instance 1 certification authority", caCerts[0].Subject.CommonName)
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	bundle, err := GenerateInstanceBundle(1, Options{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := TrustStore(bundle.CACertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := pkcs12.DecodeTrustStore(store, KeyStorePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, certs, 1) {
+		assert.Equal(t, "Draupnir instance 1 certification authority", certs[0].Subject.CommonName)
+	}
+}
@@ -2,49 +2,223 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/oauth2"
 )
 
-// Config describes the configuration for the draupnir client
+// DefaultProfile is the profile used when none has been chosen, and the one
+// that single-profile configuration files are migrated to
+const DefaultProfile = "default"
+
+// ProfileEnvVar names the environment variable that chooses a profile, taking
+// precedence over the file's current profile
+const ProfileEnvVar = "DRAUPNIR_PROFILE"
+
+// Config describes the configuration for the draupnir client, for a single
+// server
 type Config struct {
 	Domain   string
 	Token    oauth2.Token
 	Database string
 }
 
-// Load parses the client config file
-func Load() (Config, error) {
-	config := Config{Domain: "set-me-to-a-real-domain"}
-	file, err := os.Open(configFilePath())
+// Profile is the part of a Config that's kept in the config file. Its token
+// is kept in the TokenStore.
+type Profile struct {
+	Domain   string
+	Database string
+}
+
+// File is the client configuration file, which holds a named profile for each
+// draupnir server
+type File struct {
+	CurrentProfile string
+	Profiles       map[string]Profile
+}
+
+// legacyFile describes config files from earlier versions, which kept tokens
+// alongside the rest of the configuration, and before that only had a single
+// server's configuration at the top level
+type legacyFile struct {
+	CurrentProfile string
+	Profiles       map[string]Config
+	Domain         string
+	Token          oauth2.Token
+	Database       string
+}
+
+// newProfile returns the configuration of a new profile
+func newProfile() Profile {
+	return Profile{Domain: "set-me-to-a-real-domain"}
+}
+
+// Profile returns the name of the profile to use: the one given, such as by
+// the --profile flag, then the environment variable, then the file's current
+// profile
+func (f File) Profile(name string) string {
+	if name != "" {
+		return name
+	}
+	if name := os.Getenv(ProfileEnvVar); name != "" {
+		return name
+	}
+	if f.CurrentProfile != "" {
+		return f.CurrentProfile
+	}
+	return DefaultProfile
+}
+
+// ProfileNames returns the names of every profile, in alphabetical order
+func (f File) ProfileNames() []string {
+	names := make([]string, 0, len(f.Profiles))
+	for name := range f.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load returns the configuration of the named profile, or of the profile
+// chosen by the environment or the file if name is empty
+func Load(name string) (Config, error) {
+	file, err := LoadFile()
+	if err != nil {
+		return Config{}, err
+	}
+
+	name = file.Profile(name)
+	profile, ok := file.Profiles[name]
+	if !ok {
+		return Config{}, fmt.Errorf("no profile named %q, create it with `draupnir --profile %s config set domain <domain>`", name, name)
+	}
+
+	tokens, err := Tokens()
+	if err != nil {
+		return Config{}, err
+	}
+
+	token, err := tokens.Get(name)
+	if err != nil && err != ErrTokenNotFound {
+		return Config{}, err
+	}
+
+	return Config{Domain: profile.Domain, Token: token, Database: profile.Database}, nil
+}
+
+// Store saves the configuration of the named profile, or of the profile chosen
+// by the environment or the file if name is empty, creating it if needed. The
+// token is saved in the token store, or removed from it if it's empty.
+func Store(name string, config Config) error {
+	file, err := LoadFile()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := Tokens()
+	if err != nil {
+		return err
+	}
+
+	name = file.Profile(name)
+	if emptyToken(config.Token) {
+		err = tokens.Delete(name)
+	} else {
+		err = tokens.Set(name, config.Token)
+	}
+	if err != nil {
+		return err
+	}
+
+	file.Profiles[name] = Profile{Domain: config.Domain, Database: config.Database}
+	return StoreFile(file)
+}
+
+// LoadFile parses the client config file, creating it if it doesn't exist.
+// Files from earlier versions are migrated: a single server's configuration
+// becomes the default profile, and tokens are moved to the token store.
+func LoadFile() (File, error) {
+	file := File{
+		CurrentProfile: DefaultProfile,
+		Profiles:       map[string]Profile{DefaultProfile: newProfile()},
+	}
+
+	f, err := os.Open(configFilePath())
 	if err != nil {
 		if os.IsNotExist(err) {
-			err = nil
-			err = Store(config)
-			return config, err
+			return file, StoreFile(file)
 		}
-		return config, err
+		return file, err
 	}
-	_, err = toml.DecodeReader(file, &config)
+	defer f.Close()
+
+	var decoded legacyFile
+	var singleProfile bool
+	metadata, err := toml.DecodeReader(f, &decoded)
 	if err != nil {
 		// Older versions of .draupnir were JSON formatted
 		// TODO: remove this in a future major version
-		file.Seek(0, 0)
-		err = json.NewDecoder(file).Decode(&config)
+		decoded = legacyFile{}
+		f.Seek(0, 0)
+		if err := json.NewDecoder(f).Decode(&decoded); err != nil {
+			return file, err
+		}
+		singleProfile = true
+	} else {
+		singleProfile = metadata.IsDefined("Domain") || metadata.IsDefined("Token")
 	}
-	return config, err
+
+	if singleProfile {
+		decoded.CurrentProfile = DefaultProfile
+		decoded.Profiles = map[string]Config{
+			DefaultProfile: {Domain: decoded.Domain, Token: decoded.Token, Database: decoded.Database},
+		}
+	}
+
+	file = File{CurrentProfile: decoded.CurrentProfile, Profiles: make(map[string]Profile)}
+	legacyTokens := make(map[string]oauth2.Token)
+	for name, config := range decoded.Profiles {
+		file.Profiles[name] = Profile{Domain: config.Domain, Database: config.Database}
+		if !emptyToken(config.Token) {
+			legacyTokens[name] = config.Token
+		}
+	}
+
+	if !singleProfile && len(legacyTokens) == 0 {
+		return file, nil
+	}
+
+	tokens, err := Tokens()
+	if err != nil {
+		return file, err
+	}
+	for name, token := range legacyTokens {
+		if err := tokens.Set(name, token); err != nil {
+			return file, err
+		}
+	}
+
+	return file, StoreFile(file)
 }
 
-// Store serialises the given config struct as TOML and saves it to disk
-func Store(config Config) error {
-	file, err := os.Create(configFilePath())
+// StoreFile serialises the given config file as TOML and saves it to disk
+func StoreFile(file File) error {
+	f, err := os.Create(configFilePath())
 	if err != nil {
 		return err
 	}
-	err = toml.NewEncoder(file).Encode(config)
-	return err
+	defer f.Close()
+
+	return toml.NewEncoder(f).Encode(file)
+}
+
+// emptyToken reports whether the profile has no token. Tokens can't be
+// compared, as they may hold the raw response they were parsed from.
+func emptyToken(token oauth2.Token) bool {
+	return token.AccessToken == "" && token.RefreshToken == ""
 }
 
 func configFilePath() string {
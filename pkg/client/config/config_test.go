@@ -0,0 +1,143 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// withHome points the config file at an empty temporary directory
+func withHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(ProfileEnvVar, "")
+	t.Setenv(TokenStoreEnvVar, "file")
+	return filepath.Join(home, ".draupnir")
+}
+
+func TestLoadCreatesDefaultProfile(t *testing.T) {
+	withHome(t)
+
+	config, err := Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, "set-me-to-a-real-domain", config.Domain)
+
+	file, err := LoadFile()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultProfile, file.CurrentProfile)
+	assert.Equal(t, []string{DefaultProfile}, file.ProfileNames())
+}
+
+func TestLoadMigratesSingleProfileFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		contents string
+	}{
+		{
+			"toml",
+			`Domain = "draupnir.example.com"
+Database = "myapp"
+
+[Token]
+  RefreshToken = "refresh-token"
+`,
+		},
+		{
+			"json",
+			`{"Domain": "draupnir.example.com", "Database": "myapp", "Token": {"refresh_token": "refresh-token"}}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := withHome(t)
+			if err := ioutil.WriteFile(path, []byte(tc.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := Load("")
+			assert.Nil(t, err)
+			assert.Equal(t, "draupnir.example.com", config.Domain)
+			assert.Equal(t, "myapp", config.Database)
+			assert.Equal(t, "refresh-token", config.Token.RefreshToken)
+
+			// The migrated file is written back with a single default profile, and
+			// without the token
+			file, err := LoadFile()
+			assert.Nil(t, err)
+			assert.Equal(t, DefaultProfile, file.CurrentProfile)
+			assert.Equal(t, Profile{Domain: "draupnir.example.com", Database: "myapp"}, file.Profiles[DefaultProfile])
+
+			migrated, err := ioutil.ReadFile(path)
+			assert.Nil(t, err)
+			assert.Contains(t, string(migrated), "[Profiles.default]")
+			assert.NotContains(t, string(migrated), "refresh-token")
+		})
+	}
+}
+
+func TestLoadMigratesProfileTokens(t *testing.T) {
+	path := withHome(t)
+	contents := `CurrentProfile = "staging"
+
+[Profiles.staging]
+  Domain = "staging.example.com"
+  Database = ""
+  [Profiles.staging.Token]
+    RefreshToken = "staging-token"
+`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, "staging.example.com", config.Domain)
+	assert.Equal(t, "staging-token", config.Token.RefreshToken)
+
+	migrated, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(migrated), "staging-token")
+}
+
+func TestProfiles(t *testing.T) {
+	withHome(t)
+
+	staging := Config{Domain: "staging.example.com", Token: oauth2.Token{RefreshToken: "staging-token"}}
+	assert.Nil(t, Store("staging", staging))
+	assert.Nil(t, Store("", Config{Domain: "production.example.com"}))
+
+	tokens, err := ioutil.ReadFile(filepath.Join(os.Getenv("HOME"), ".draupnir-tokens"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(tokens), "staging-token")
+
+	// The current profile is used unless another is chosen
+	config, err := Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, "production.example.com", config.Domain)
+
+	config, err = Load("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, staging, config)
+
+	t.Setenv(ProfileEnvVar, "staging")
+	config, err = Load("")
+	assert.Nil(t, err)
+	assert.Equal(t, staging, config)
+
+	// A profile given explicitly takes precedence over the environment
+	config, err = Load(DefaultProfile)
+	assert.Nil(t, err)
+	assert.Equal(t, "production.example.com", config.Domain)
+
+	_, err = Load("missing")
+	assert.NotNil(t, err)
+
+	file, err := LoadFile()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{DefaultProfile, "staging"}, file.ProfileNames())
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+)
+
+// TokenStoreEnvVar names the environment variable that chooses where tokens
+// are stored: "keychain", "file", or unset to use the keychain when it's
+// available and the file otherwise
+const TokenStoreEnvVar = "DRAUPNIR_TOKEN_STORE"
+
+// keychainService is the service that tokens are stored under in the OS
+// secret store
+const keychainService = "draupnir"
+
+// ErrTokenNotFound is returned when a profile has no stored token
+var ErrTokenNotFound = errors.New("no token stored for profile")
+
+// TokenStore holds the OAuth token of each profile, which is kept out of the
+// config file
+type TokenStore interface {
+	Get(profile string) (oauth2.Token, error)
+	Set(profile string, token oauth2.Token) error
+	Delete(profile string) error
+}
+
+// Tokens returns the token store chosen by the environment
+func Tokens() (TokenStore, error) {
+	switch os.Getenv(TokenStoreEnvVar) {
+	case "keychain":
+		return KeychainTokenStore{}, nil
+	case "file":
+		return FileTokenStore{Path: tokenFilePath()}, nil
+	case "":
+		return fallbackTokenStore{
+			primary:  KeychainTokenStore{},
+			fallback: FileTokenStore{Path: tokenFilePath()},
+		}, nil
+	default:
+		return nil, errors.Errorf("%s must be keychain or file", TokenStoreEnvVar)
+	}
+}
+
+// KeychainTokenStore keeps tokens in the OS secret store: the keychain on
+// macOS, the Secret Service API on Linux and the credential manager on Windows
+type KeychainTokenStore struct{}
+
+func (KeychainTokenStore) Get(profile string) (oauth2.Token, error) {
+	var token oauth2.Token
+
+	secret, err := keyring.Get(keychainService, profile)
+	if err == keyring.ErrNotFound {
+		return token, ErrTokenNotFound
+	}
+	if err != nil {
+		return token, errors.Wrap(err, "failed to read token from keychain")
+	}
+
+	err = json.Unmarshal([]byte(secret), &token)
+	return token, errors.Wrap(err, "failed to decode token from keychain")
+}
+
+func (KeychainTokenStore) Set(profile string, token oauth2.Token) error {
+	secret, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(keyring.Set(keychainService, profile, string(secret)), "failed to write token to keychain")
+}
+
+func (KeychainTokenStore) Delete(profile string) error {
+	err := keyring.Delete(keychainService, profile)
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	return errors.Wrap(err, "failed to delete token from keychain")
+}
+
+// FileTokenStore keeps tokens in a JSON file that only its owner can read, for
+// systems without a secret store
+type FileTokenStore struct {
+	Path string
+}
+
+func (s FileTokenStore) Get(profile string) (oauth2.Token, error) {
+	tokens, err := s.read()
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+
+	token, ok := tokens[profile]
+	if !ok {
+		return token, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (s FileTokenStore) Set(profile string, token oauth2.Token) error {
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	tokens[profile] = token
+	return s.write(tokens)
+}
+
+func (s FileTokenStore) Delete(profile string) error {
+	tokens, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[profile]; !ok {
+		return nil
+	}
+
+	delete(tokens, profile)
+	return s.write(tokens)
+}
+
+func (s FileTokenStore) read() (map[string]oauth2.Token, error) {
+	tokens := make(map[string]oauth2.Token)
+
+	contents, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read token file")
+	}
+
+	err = json.Unmarshal(contents, &tokens)
+	return tokens, errors.Wrap(err, "failed to decode token file")
+}
+
+func (s FileTokenStore) write(tokens map[string]oauth2.Token) error {
+	contents, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(s.Path, contents, 0600); err != nil {
+		return errors.Wrap(err, "failed to write token file")
+	}
+
+	// WriteFile only sets the permissions of new files
+	return errors.Wrap(os.Chmod(s.Path, 0600), "failed to restrict token file permissions")
+}
+
+// fallbackTokenStore uses the primary store, and the fallback store whenever
+// the primary is unavailable
+type fallbackTokenStore struct {
+	primary  TokenStore
+	fallback TokenStore
+}
+
+func (s fallbackTokenStore) Get(profile string) (oauth2.Token, error) {
+	token, err := s.primary.Get(profile)
+	if err == nil {
+		return token, nil
+	}
+
+	// A token may have been stored in the fallback while the primary was
+	// unavailable
+	return s.fallback.Get(profile)
+}
+
+func (s fallbackTokenStore) Set(profile string, token oauth2.Token) error {
+	if err := s.primary.Set(profile, token); err != nil {
+		return s.fallback.Set(profile, token)
+	}
+
+	// Don't leave an older token behind in the fallback
+	return s.fallback.Delete(profile)
+}
+
+func (s fallbackTokenStore) Delete(profile string) error {
+	// The primary may be unavailable, in which case it holds nothing to delete
+	s.primary.Delete(profile)
+	return s.fallback.Delete(profile)
+}
+
+func tokenFilePath() string {
+	return os.Getenv("HOME") + "/.draupnir-tokens"
+}
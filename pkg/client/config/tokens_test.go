@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/oauth2"
+)
+
+func TestKeychainTokenStore(t *testing.T) {
+	keyring.MockInit()
+	store := KeychainTokenStore{}
+
+	_, err := store.Get("default")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	token := oauth2.Token{AccessToken: "access-token", RefreshToken: "refresh-token"}
+	assert.Nil(t, store.Set("default", token))
+
+	stored, err := store.Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh-token", stored.RefreshToken)
+
+	assert.Nil(t, store.Delete("default"))
+	assert.Nil(t, store.Delete("default"))
+	_, err = store.Get("default")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	store := FileTokenStore{Path: path}
+
+	_, err := store.Get("default")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	assert.Nil(t, store.Set("default", oauth2.Token{RefreshToken: "default-token"}))
+	assert.Nil(t, store.Set("staging", oauth2.Token{RefreshToken: "staging-token"}))
+
+	info, err := os.Stat(path)
+	if assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	token, err := store.Get("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, "staging-token", token.RefreshToken)
+
+	assert.Nil(t, store.Delete("staging"))
+	_, err = store.Get("staging")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	token, err = store.Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "default-token", token.RefreshToken)
+}
+
+// unavailableTokenStore fails like a keychain that isn't running
+type unavailableTokenStore struct{}
+
+var errUnavailable = errors.New("secret service unavailable")
+
+func (unavailableTokenStore) Get(string) (oauth2.Token, error) { return oauth2.Token{}, errUnavailable }
+func (unavailableTokenStore) Set(string, oauth2.Token) error   { return errUnavailable }
+func (unavailableTokenStore) Delete(string) error              { return errUnavailable }
+
+func TestFallbackTokenStore(t *testing.T) {
+	fallback := FileTokenStore{Path: filepath.Join(t.TempDir(), "tokens")}
+	token := oauth2.Token{RefreshToken: "refresh-token"}
+
+	// Without the primary, tokens are kept in the fallback
+	unavailable := fallbackTokenStore{primary: unavailableTokenStore{}, fallback: fallback}
+	assert.Nil(t, unavailable.Set("default", token))
+
+	stored, err := unavailable.Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh-token", stored.RefreshToken)
+
+	// Once the primary is available, tokens move to it
+	keyring.MockInit()
+	available := fallbackTokenStore{primary: KeychainTokenStore{}, fallback: fallback}
+
+	stored, err = available.Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "refresh-token", stored.RefreshToken)
+
+	assert.Nil(t, available.Set("default", oauth2.Token{RefreshToken: "new-token"}))
+	_, err = fallback.Get("default")
+	assert.Equal(t, ErrTokenNotFound, err)
+
+	stored, err = available.Get("default")
+	assert.Nil(t, err)
+	assert.Equal(t, "new-token", stored.RefreshToken)
+
+	assert.Nil(t, available.Delete("default"))
+	_, err = available.Get("default")
+	assert.Equal(t, ErrTokenNotFound, err)
+}
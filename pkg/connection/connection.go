@@ -0,0 +1,235 @@
+// Package connection renders the details needed to connect to an instance in
+// the formats understood by libpq, JDBC and other tools
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Formats that connection details can be rendered in
+const (
+	// FormatLibpqEnv is a shell command exporting libpq environment variables
+	FormatLibpqEnv = "libpq-env"
+	// FormatDatabaseURL is a postgresql:// connection URI
+	FormatDatabaseURL = "database-url"
+	// FormatPgService is an entry for pg_service.conf
+	FormatPgService = "pg-service"
+	// FormatPgpass is a line for .pgpass
+	FormatPgpass = "pgpass"
+	// FormatJDBC is a JDBC URL, which authenticates with a PKCS #12 key store
+	FormatJDBC = "jdbc"
+	// FormatJSON is every detail, as a JSON object
+	FormatJSON = "json"
+
+	DefaultFormat = FormatLibpqEnv
+)
+
+// Formats lists every format, in the order they're documented
+var Formats = []string{
+	FormatLibpqEnv,
+	FormatDatabaseURL,
+	FormatPgService,
+	FormatPgpass,
+	FormatJDBC,
+	FormatJSON,
+}
+
+// Files are the names of the files that hold an instance's credentials, as
+// written by the client. Connection details refer to them by these names,
+// relative to the directory they're written to.
+const (
+	CACertificateFile     = "ca.crt"
+	ClientCertificateFile = "client.crt"
+	ClientKeyFile         = "client.key"
+	// ClientKeyPKCS8File is the client key in DER encoded PKCS #8 form
+	ClientKeyPKCS8File = "client.pk8"
+	// KeyStoreFile is a PKCS #12 key store of the client key and certificate
+	KeyStoreFile = "client.p12"
+	// TrustStoreFile is a PKCS #12 trust store of the CA certificate
+	TrustStoreFile = "truststore.p12"
+)
+
+// Details are everything needed to connect to an instance
+type Details struct {
+	InstanceID int    `json:"instance_id"`
+	Host       string `json:"host"`
+	Port       uint16 `json:"port"`
+	User       string `json:"user"`
+	// Password is only set for instances using password authentication
+	Password string `json:"password,omitempty"`
+	Database string `json:"database"`
+	SSLMode  string `json:"sslmode"`
+
+	SSLRootCert   string `json:"sslrootcert"`
+	SSLCert       string `json:"sslcert"`
+	SSLKey        string `json:"sslkey"`
+	SSLKeyPKCS8   string `json:"sslkey_pkcs8"`
+	KeyStore      string `json:"keystore"`
+	TrustStore    string `json:"truststore"`
+	StorePassword string `json:"store_password"`
+}
+
+// ValidFormat reports whether format is one of Formats
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Render returns the details in format
+func Render(format string, d Details) (string, error) {
+	switch format {
+	case FormatLibpqEnv:
+		return libpqEnv(d), nil
+	case FormatDatabaseURL:
+		return databaseURL(d), nil
+	case FormatPgService:
+		return pgService(d), nil
+	case FormatPgpass:
+		return pgpass(d), nil
+	case FormatJDBC:
+		return jdbcURL(d), nil
+	case FormatJSON:
+		out, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(out) + "\n", nil
+	default:
+		return "", fmt.Errorf("unknown format %q, expected one of: %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+// libpqEnv returns a command exporting environment variables that can be read
+// by libpq: https://www.postgresql.org/docs/current/libpq-envars.html
+func libpqEnv(d Details) string {
+	return fmt.Sprintf(
+		"export PGHOST=%s PGPORT=%d PGUSER=%s PGPASSWORD=%s PGDATABASE=%s PGSSLMODE=%s PGSSLROOTCERT=%s PGSSLCERT=%s PGSSLKEY=%s\n",
+		d.Host,
+		d.Port,
+		d.User,
+		shellQuote(d.Password),
+		d.Database,
+		d.SSLMode,
+		shellQuote(d.SSLRootCert),
+		shellQuote(d.SSLCert),
+		shellQuote(d.SSLKey),
+	)
+}
+
+// Environment returns the libpq environment variables for the details, in the
+// KEY=value form that exec.Cmd expects. PGPASSWORD is only set when there's a
+// password, so that libpq can fall back to .pgpass otherwise.
+func Environment(d Details) []string {
+	env := []string{
+		"PGHOST=" + d.Host,
+		"PGPORT=" + strconv.Itoa(int(d.Port)),
+		"PGUSER=" + d.User,
+		"PGDATABASE=" + d.Database,
+		"PGSSLMODE=" + d.SSLMode,
+		"PGSSLROOTCERT=" + d.SSLRootCert,
+		"PGSSLCERT=" + d.SSLCert,
+		"PGSSLKEY=" + d.SSLKey,
+	}
+	if d.Password != "" {
+		env = append(env, "PGPASSWORD="+d.Password)
+	}
+	return env
+}
+
+// databaseURL returns a connection URI:
+// https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING-URIS
+func databaseURL(d Details) string {
+	u := url.URL{
+		Scheme: "postgresql",
+		Host:   hostPort(d),
+		Path:   "/" + d.Database,
+		RawQuery: encodeQuery([][2]string{
+			{"sslmode", d.SSLMode},
+			{"sslrootcert", d.SSLRootCert},
+			{"sslcert", d.SSLCert},
+			{"sslkey", d.SSLKey},
+		}),
+	}
+	if d.Password != "" {
+		u.User = url.UserPassword(d.User, d.Password)
+	} else {
+		u.User = url.User(d.User)
+	}
+	return u.String() + "\n"
+}
+
+// pgService returns a section for the connection service file:
+// https://www.postgresql.org/docs/current/libpq-pgservice.html
+func pgService(d Details) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[draupnir-%d]\n", d.InstanceID)
+	fmt.Fprintf(&b, "host=%s\n", d.Host)
+	fmt.Fprintf(&b, "port=%d\n", d.Port)
+	fmt.Fprintf(&b, "user=%s\n", d.User)
+	if d.Password != "" {
+		fmt.Fprintf(&b, "password=%s\n", d.Password)
+	}
+	fmt.Fprintf(&b, "dbname=%s\n", d.Database)
+	fmt.Fprintf(&b, "sslmode=%s\n", d.SSLMode)
+	fmt.Fprintf(&b, "sslrootcert=%s\n", d.SSLRootCert)
+	fmt.Fprintf(&b, "sslcert=%s\n", d.SSLCert)
+	fmt.Fprintf(&b, "sslkey=%s\n", d.SSLKey)
+	return b.String()
+}
+
+// pgpass returns a line for the password file:
+// https://www.postgresql.org/docs/current/libpq-pgpass.html
+func pgpass(d Details) string {
+	escape := strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace
+	return strings.Join([]string{
+		escape(d.Host),
+		strconv.Itoa(int(d.Port)),
+		escape(d.Database),
+		escape(d.User),
+		escape(d.Password),
+	}, ":") + "\n"
+}
+
+// jdbcURL returns a URL for the PostgreSQL JDBC driver, which reads the client
+// key and certificate from the PKCS #12 key store:
+// https://jdbc.postgresql.org/documentation/use/#connection-parameters
+func jdbcURL(d Details) string {
+	params := [][2]string{{"user", d.User}}
+	if d.Password != "" {
+		params = append(params, [2]string{"password", d.Password})
+	}
+	params = append(params,
+		[2]string{"sslmode", d.SSLMode},
+		[2]string{"sslrootcert", d.SSLRootCert},
+		[2]string{"sslkey", d.KeyStore},
+		[2]string{"sslpassword", d.StorePassword},
+	)
+
+	return fmt.Sprintf("jdbc:postgresql://%s/%s?%s\n", hostPort(d), url.PathEscape(d.Database), encodeQuery(params))
+}
+
+func hostPort(d Details) string {
+	return fmt.Sprintf("%s:%d", d.Host, d.Port)
+}
+
+// encodeQuery encodes parameters in the order given, unlike url.Values
+func encodeQuery(params [][2]string) string {
+	pairs := make([]string, 0, len(params))
+	for _, p := range params {
+		pairs = append(pairs, url.QueryEscape(p[0])+"="+url.QueryEscape(p[1]))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,101 @@
+package connection
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gocardless/draupnir/pkg/certs"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/pkg/errors"
+)
+
+// User is the Postgres user that clients connect to instances as
+const User = "draupnir"
+
+// New returns the details for connecting to database on the instance, with
+// its credentials in the files written to dir by WriteFiles. If dir is empty,
+// files are referred to by their names alone.
+func New(instance models.Instance, database, dir string) Details {
+	d := Details{
+		InstanceID:    instance.ID,
+		Host:          instance.Hostname,
+		Port:          instance.Port,
+		User:          User,
+		Database:      database,
+		SSLMode:       "verify-ca",
+		SSLRootCert:   filepath.Join(dir, CACertificateFile),
+		SSLCert:       filepath.Join(dir, ClientCertificateFile),
+		SSLKey:        filepath.Join(dir, ClientKeyFile),
+		SSLKeyPKCS8:   filepath.Join(dir, ClientKeyPKCS8File),
+		KeyStore:      filepath.Join(dir, KeyStoreFile),
+		TrustStore:    filepath.Join(dir, TrustStoreFile),
+		StorePassword: certs.KeyStorePassword,
+	}
+	if instance.Credentials != nil {
+		d.Password = instance.Credentials.Password
+	}
+	return d
+}
+
+// Java represents the client's credentials in the forms that Java expects
+type Java struct {
+	ClientKeyPKCS8 []byte
+	KeyStore       []byte
+	TrustStore     []byte
+}
+
+// ConvertForJava converts the PEM encoded credentials to the forms that Java
+// expects
+func ConvertForJava(credentials models.InstanceCredentials) (Java, error) {
+	var java Java
+	var err error
+
+	java.ClientKeyPKCS8, err = certs.PKCS8([]byte(credentials.ClientKey))
+	if err != nil {
+		return java, err
+	}
+
+	java.KeyStore, err = certs.KeyStore(
+		[]byte(credentials.ClientCertificate),
+		[]byte(credentials.ClientKey),
+		[]byte(credentials.CACertificate),
+	)
+	if err != nil {
+		return java, err
+	}
+
+	java.TrustStore, err = certs.TrustStore([]byte(credentials.CACertificate))
+	return java, err
+}
+
+// WriteFiles writes the credentials to dir, in every form that the formats
+// refer to. Files holding private keys are only readable by their owner.
+func WriteFiles(dir string, credentials models.InstanceCredentials) error {
+	java, err := ConvertForJava(credentials)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert credentials")
+	}
+
+	files := []struct {
+		name     string
+		contents []byte
+		perm     os.FileMode
+	}{
+		{CACertificateFile, []byte(credentials.CACertificate), 0644},
+		{ClientCertificateFile, []byte(credentials.ClientCertificate), 0644},
+		{ClientKeyFile, []byte(credentials.ClientKey), 0600},
+		{ClientKeyPKCS8File, java.ClientKeyPKCS8, 0600},
+		{KeyStoreFile, java.KeyStore, 0600},
+		{TrustStoreFile, java.TrustStore, 0644},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := ioutil.WriteFile(path, file.contents, file.perm); err != nil {
+			return errors.Wrapf(err, "failed to write content for %s", path)
+		}
+	}
+
+	return nil
+}
@@ -2,30 +2,49 @@ package exec
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/gocardless/draupnir/pkg/certs"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/tracing"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/log"
 )
 
+// PgCtlPath is the path to the pg_ctl binary used by the scripts that the
+// executor runs
+const PgCtlPath = "/usr/lib/postgresql/14/bin/pg_ctl"
+
 type Executor interface {
 	CreateBtrfsSubvolume(ctx context.Context, id int) error
 	FinaliseImage(ctx context.Context, image models.Image) error
-	CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error
+	CreateInstance(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error
 	RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error)
+	RotateInstanceCredentials(ctx context.Context, id int, rotateCA bool) error
 	DestroyImage(ctx context.Context, id int) error
 	DestroyInstance(ctx context.Context, id int) error
+	InstanceDiskUsage(ctx context.Context, id int) (int64, error)
 }
 
 type OSExecutor struct {
 	DataPath string
+	// Certificates configures the keys and certificates generated for each
+	// instance
+	Certificates certs.Options
+	// ListenAddresses, if set, overrides the addresses that new instances
+	// listen on, e.g. localhost when they're only reached through the proxy
+	ListenAddresses string
 }
 
 func GetLogger(ctx context.Context) log.Logger {
@@ -38,9 +57,24 @@ func GetLogger(ctx context.Context) log.Logger {
 	return *logger
 }
 
-func runCommandAndLog(logger log.Logger, message string, command *exec.Cmd) error {
+// sudo returns a command that runs one of Draupnir's scripts as root. Draupnir
+// can't signal the script, so cancelling a context would only kill sudo,
+// leaving the script running unobserved. The command therefore isn't tied to a
+// context, and is always waited for: anything undoing a failed operation only
+// runs once its script has exited.
+func sudo(args ...string) *exec.Cmd {
+	return exec.Command("sudo", args...)
+}
+
+func runCommandAndLog(ctx context.Context, logger log.Logger, message string, command *exec.Cmd) error {
+	// Scripts announce each step on stderr, which is traced as a child span of
+	// the current operation
+	steps := newStepTracer(ctx)
+	command.Stderr = steps
+
 	// Execute our command, which gives us stdout and an exit error
 	outputBytes, err := command.Output()
+	steps.Finish(err)
 	// Always log stdout
 	logger = logger.With("stdout", string(outputBytes))
 
@@ -49,11 +83,7 @@ func runCommandAndLog(logger log.Logger, message string, command *exec.Cmd) erro
 		// there, output it here anyway so that we have all the relevant fields in
 		// a single log entry
 		logger = logger.With("error", err.Error())
-
-		// If we can get stderr, by casting to an exit error, then log that too
-		if ee, ok := err.(*exec.ExitError); ok {
-			logger = logger.With("stderr", string(ee.Stderr))
-		}
+		logger = logger.With("stderr", steps.Stderr())
 	}
 	logger.Info(message)
 
@@ -68,7 +98,7 @@ func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
 	logger := GetLogger(ctx).With("imageID", id).With("path", path)
 
 	cmd := exec.CommandContext(ctx, "btrfs", "subvolume", "create", path)
-	err := runCommandAndLog(logger, "Created btrfs subvolume", cmd)
+	err := runCommandAndLog(ctx, logger, "Created btrfs subvolume", cmd)
 	if err != nil {
 		return err
 	}
@@ -114,9 +144,7 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 
 	logger := GetLogger(ctx).With("imageID", image.ID)
 
-	cmd := exec.CommandContext(
-		ctx,
-		"sudo",
+	cmd := sudo(
 		"draupnir-finalise-image",
 		e.DataPath,
 		fmt.Sprintf("%d", image.ID),
@@ -124,7 +152,7 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 		anonFile.Name(),
 	)
 
-	err = runCommandAndLog(logger, "Finalised image", cmd)
+	err = runCommandAndLog(ctx, logger, "Finalised image", cmd)
 	if err != nil {
 		return err
 	}
@@ -133,23 +161,105 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 	return os.Remove(anonFile.Name())
 }
 
-func (e OSExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port)
+// CreateInstance generates the instance's certificates, then runs
+// draupnir-create-instance, which snapshots the image, installs the
+// certificates in the instance directory and starts Postgres.
+//
+// If passwordAuthentication is set, a password is generated for the draupnir
+// user too, and written alongside the certificates. Its presence tells
+// draupnir-create-instance to authenticate the user with it instead of a
+// client certificate.
+func (e OSExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port).
+		With("passwordAuthentication", passwordAuthentication)
+
+	certsPath, err := e.writeCertificates(ctx, instanceID, func() (certs.Bundle, error) {
+		return certs.GenerateInstanceBundle(instanceID, e.Certificates)
+	})
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(certsPath)
 
-	cmd := exec.Command(
-		"sudo",
+	if passwordAuthentication {
+		password, err := generatePassword()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate password")
+		}
+		if err := ioutil.WriteFile(filepath.Join(certsPath, "password"), []byte(password), 0600); err != nil {
+			return errors.Wrap(err, "failed to write password")
+		}
+	}
+
+	args := []string{
 		"draupnir-create-instance",
 		e.DataPath,
 		fmt.Sprintf("%d", imageID),
 		fmt.Sprintf("%d", instanceID),
 		fmt.Sprintf("%d", port),
-	)
+		certsPath,
+	}
+	if e.ListenAddresses != "" {
+		args = append(args, e.ListenAddresses)
+	}
+
+	cmd := sudo(args...)
 
-	return runCommandAndLog(logger, "Creating instance", cmd)
+	return runCommandAndLog(ctx, logger, "Creating instance", cmd)
+}
+
+// writeCertificates generates certificates for an instance, and writes them to
+// a private temporary directory. The instance directory isn't writable by
+// Draupnir, so scripts install them there.
+func (e OSExecutor) writeCertificates(ctx context.Context, instanceID int, generate func() (certs.Bundle, error)) (path string, err error) {
+	_, span := tracer.Start(ctx, "generate-certificates")
+	defer func() { tracing.End(span, err) }()
+
+	bundle, err := generate()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate certificates")
+	}
+
+	path, err = ioutil.TempDir("", fmt.Sprintf("draupnir-certs-%d-", instanceID))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create certificates directory")
+	}
+
+	if err := bundle.WriteFiles(path); err != nil {
+		os.RemoveAll(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// expiresBefore reports whether any of the PEM encoded certificates, keyed by
+// file name, expires before t or can't be parsed, and if so which
+func expiresBefore(t time.Time, certificates map[string][]byte) (bool, string) {
+	for name, certificate := range certificates {
+		expiresAt, err := certs.ExpiresAt(certificate)
+		if err != nil || expiresAt.Before(t) {
+			return true, name
+		}
+	}
+	return false, ""
+}
+
+// generatePassword returns a random password for the draupnir user of an
+// instance using password authentication. It only contains characters that
+// are safe to quote in SQL and shell.
+func generatePassword() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // RetrieveInstanceCredentials reads the certificate and key files from the
-// instance directory and returns them in a map
+// instance directory and returns them in a map. Instances using password
+// authentication have a password file too. The server certificate is included
+// if it can be read, so that its expiry can be checked.
 func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
 	logger := GetLogger(ctx).With("imageID", id)
 
@@ -167,33 +277,128 @@ func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (ma
 		fileContents[fileName] = bytes
 	}
 
+	password, err := ioutil.ReadFile(filepath.Join(basePath, "password"))
+	switch {
+	case err == nil:
+		fileContents["password"] = password
+	case !os.IsNotExist(err):
+		return nil, errors.Wrap(err, "failed to read credentials file password")
+	}
+
+	if serverCertificate, err := ioutil.ReadFile(filepath.Join(basePath, "server.crt")); err == nil {
+		fileContents["server.crt"] = serverCertificate
+	}
+
 	logger.Info("Successfully retrieved instance credentials")
 	return fileContents, nil
 }
 
+// RotateInstanceCredentials issues a new client certificate from the
+// instance's CA or, if rotateCA is set, a new CA, server and client
+// certificate, then runs draupnir-rotate-instance-credentials, which installs
+// them and reloads Postgres.
+//
+// The CA keys of instances created when certificates were generated by openssl
+// aren't readable by Draupnir, so their CA is always rotated. So is the CA of
+// an instance whose CA or server certificate would expire before the new
+// client certificate, as the client certificate would be useless once either
+// had expired.
+func (e OSExecutor) RotateInstanceCredentials(ctx context.Context, id int, rotateCA bool) error {
+	logger := GetLogger(ctx).With("instanceID", id).With("rotateCA", rotateCA)
+	basePath := filepath.Join(e.DataPath, "instances", fmt.Sprintf("%d", id))
+
+	var caCertificate, caKey []byte
+	if !rotateCA {
+		var err error
+		caCertificate, err = ioutil.ReadFile(filepath.Join(basePath, "ca.crt"))
+		if err == nil {
+			caKey, err = ioutil.ReadFile(filepath.Join(basePath, "ca.key"))
+		}
+		if err != nil {
+			logger.With("error", err.Error()).Info("Unable to read instance CA, rotating it")
+			rotateCA = true
+		}
+	}
+
+	if !rotateCA {
+		serverCertificate, err := ioutil.ReadFile(filepath.Join(basePath, "server.crt"))
+		if err != nil {
+			logger.With("error", err.Error()).Info("Unable to read instance server certificate, rotating CA")
+			rotateCA = true
+		} else if expiring, name := expiresBefore(
+			time.Now().Add(e.Certificates.WithDefaults().Validity),
+			map[string][]byte{"ca.crt": caCertificate, "server.crt": serverCertificate},
+		); expiring {
+			logger.With("certificate", name).Info("Certificate expires before a new client certificate would, rotating CA")
+			rotateCA = true
+		}
+	}
+
+	certsPath, err := e.writeCertificates(ctx, id, func() (certs.Bundle, error) {
+		if rotateCA {
+			return certs.GenerateInstanceBundle(id, e.Certificates)
+		}
+
+		var bundle certs.Bundle
+		var err error
+		bundle.ClientCertificate, bundle.ClientKey, err = certs.IssueClientCertificate(id, caCertificate, caKey, e.Certificates)
+		return bundle, err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(certsPath)
+
+	cmd := sudo(
+		"draupnir-rotate-instance-credentials",
+		e.DataPath,
+		fmt.Sprintf("%d", id),
+		certsPath,
+	)
+
+	return runCommandAndLog(ctx, logger, "Rotated instance credentials", cmd)
+}
+
 func (e OSExecutor) DestroyImage(ctx context.Context, id int) error {
 	logger := GetLogger(ctx).With("imageID", id)
 
-	cmd := exec.Command(
-		"sudo",
+	cmd := sudo(
 		"draupnir-destroy-image",
 		e.DataPath,
 		fmt.Sprintf("%d", id),
 	)
 
-	return runCommandAndLog(logger, "Destroyed image", cmd)
+	return runCommandAndLog(ctx, logger, "Destroyed image", cmd)
 }
 
 func (e OSExecutor) DestroyInstance(ctx context.Context, id int) error {
 	logger := GetLogger(ctx).With("instanceID", id)
 
-	cmd := exec.CommandContext(
-		ctx,
-		"sudo",
+	cmd := sudo(
 		"draupnir-destroy-instance",
 		e.DataPath,
 		fmt.Sprintf("%d", id),
 	)
 
-	return runCommandAndLog(logger, "Destroyed instance", cmd)
+	return runCommandAndLog(ctx, logger, "Destroyed instance", cmd)
+}
+
+// InstanceDiskUsage returns the number of bytes used exclusively by an
+// instance, excluding any data it still shares with its image
+func (e OSExecutor) InstanceDiskUsage(ctx context.Context, id int) (int64, error) {
+	logger := GetLogger(ctx).With("instanceID", id)
+
+	cmd := sudo(
+		"draupnir-instance-disk-usage",
+		e.DataPath,
+		fmt.Sprintf("%d", id),
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		logger.With("error", err.Error()).Info("Failed to measure instance disk usage")
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
 }
@@ -0,0 +1,86 @@
+package exec
+
+import (
+	"context"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/tracing"
+)
+
+// InstrumentedExecutor wraps an Executor, recording the duration and outcome
+// of each operation, and tracing each operation in its own span.
+type InstrumentedExecutor struct {
+	Executor Executor
+}
+
+// begin starts a span for the operation, returning a context carrying the span
+// and a function to be called with the outcome once the operation completes
+func begin(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "executor."+operation)
+
+	return ctx, func(err error) {
+		metrics.ExecutorOperationDuration.
+			WithLabelValues(operation, metrics.Outcome(err)).
+			Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}
+}
+
+func (e InstrumentedExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
+	ctx, finish := begin(ctx, "create_btrfs_subvolume")
+	err := e.Executor.CreateBtrfsSubvolume(ctx, id)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
+	ctx, finish := begin(ctx, "finalise_image")
+	err := e.Executor.FinaliseImage(ctx, image)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+	ctx, finish := begin(ctx, "create_instance")
+	err := e.Executor.CreateInstance(ctx, imageID, instanceID, port, passwordAuthentication)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
+	ctx, finish := begin(ctx, "retrieve_instance_credentials")
+	files, err := e.Executor.RetrieveInstanceCredentials(ctx, id)
+	finish(err)
+	return files, err
+}
+
+func (e InstrumentedExecutor) RotateInstanceCredentials(ctx context.Context, id int, rotateCA bool) error {
+	ctx, finish := begin(ctx, "rotate_instance_credentials")
+	err := e.Executor.RotateInstanceCredentials(ctx, id, rotateCA)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) DestroyImage(ctx context.Context, id int) error {
+	ctx, finish := begin(ctx, "destroy_image")
+	err := e.Executor.DestroyImage(ctx, id)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) DestroyInstance(ctx context.Context, id int) error {
+	ctx, finish := begin(ctx, "destroy_instance")
+	err := e.Executor.DestroyInstance(ctx, id)
+	finish(err)
+	return err
+}
+
+func (e InstrumentedExecutor) InstanceDiskUsage(ctx context.Context, id int) (int64, error) {
+	ctx, finish := begin(ctx, "instance_disk_usage")
+	usage, err := e.Executor.InstanceDiskUsage(ctx, id)
+	finish(err)
+	return usage, err
+}
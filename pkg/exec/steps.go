@@ -0,0 +1,72 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gocardless/draupnir/pkg/tracing"
+)
+
+var tracer = otel.Tracer("github.com/gocardless/draupnir/pkg/exec")
+
+// stepMarker prefixes the lines that scripts write to stderr as they begin
+// each step, e.g. "draupnir-step: snapshot"
+const stepMarker = "draupnir-step: "
+
+// stepTracer is used as the stderr of a script. It records everything written
+// to it, and starts a new span every time the script announces a step, ending
+// the span of the previous step.
+type stepTracer struct {
+	ctx     context.Context
+	span    trace.Span
+	output  bytes.Buffer
+	partial []byte
+}
+
+func newStepTracer(ctx context.Context) *stepTracer {
+	return &stepTracer{ctx: ctx}
+}
+
+func (s *stepTracer) Write(p []byte) (int, error) {
+	s.output.Write(p)
+	s.partial = append(s.partial, p...)
+
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := string(s.partial[:i])
+		s.partial = s.partial[i+1:]
+
+		if strings.HasPrefix(line, stepMarker) {
+			s.endStep(nil)
+			_, s.span = tracer.Start(s.ctx, strings.TrimSpace(strings.TrimPrefix(line, stepMarker)))
+		}
+	}
+
+	return len(p), nil
+}
+
+// Finish ends the span of the final step. As scripts exit on the first
+// failure, any error is attributed to that step.
+func (s *stepTracer) Finish(err error) {
+	s.endStep(err)
+}
+
+// Stderr returns everything the script wrote to stderr
+func (s *stepTracer) Stderr() string {
+	return s.output.String()
+}
+
+func (s *stepTracer) endStep(err error) {
+	if s.span != nil {
+		tracing.End(s.span, err)
+		s.span = nil
+	}
+}
@@ -0,0 +1,40 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStepTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	steps := newStepTracer(context.Background())
+
+	// Lines may be split across writes
+	io.WriteString(steps, "draupnir-step: snap")
+	io.WriteString(steps, "shot\nsome output\ndraupnir-step: start\n")
+	io.WriteString(steps, "pg_ctl: could not start server\n")
+	steps.Finish(errors.New("exit status 1"))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "snapshot", spans[0].Name())
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, "start", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+
+	assert.Equal(
+		t,
+		"draupnir-step: snapshot\nsome output\ndraupnir-step: start\npg_ctl: could not start server\n",
+		steps.Stderr(),
+	)
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// DatabaseCheck verifies that the database can be reached
+func DatabaseCheck(db *sql.DB) Check {
+	return Check{
+		Name: "database",
+		Check: func(ctx context.Context) error {
+			return db.PingContext(ctx)
+		},
+	}
+}
+
+// DiskSpaceCheck verifies that at least minFreePercent of the disk holding
+// path is available
+func DiskSpaceCheck(path string, minFreePercent float64) Check {
+	return Check{
+		Name: "disk_space",
+		Check: func(ctx context.Context) error {
+			var stat syscall.Statfs_t
+			if err := syscall.Statfs(path, &stat); err != nil {
+				return err
+			}
+
+			if stat.Blocks == 0 {
+				return fmt.Errorf("%s reports a size of zero", path)
+			}
+
+			free := 100 * float64(stat.Bavail) / float64(stat.Blocks)
+			if free < minFreePercent {
+				return fmt.Errorf("%.1f%% of %s is free, below the minimum of %.1f%%", free, path, minFreePercent)
+			}
+			return nil
+		},
+	}
+}
+
+// IPTablesChainCheck verifies that the named chain exists in the filter table
+func IPTablesChainCheck(chain string) Check {
+	return Check{
+		Name: "iptables_chain",
+		Check: func(ctx context.Context) error {
+			ipt, err := iptables.New()
+			if err != nil {
+				return err
+			}
+
+			exists, err := ipt.ChainExists("filter", chain)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("chain %s does not exist", chain)
+			}
+			return nil
+		},
+	}
+}
+
+// BinariesCheck verifies that each of the binaries is present and executable.
+// Binaries may be given as absolute paths, or names to be found in PATH.
+func BinariesCheck(binaries ...string) Check {
+	return Check{
+		Name: "binaries",
+		Check: func(ctx context.Context) error {
+			var missing []string
+			for _, binary := range binaries {
+				if !executable(binary) {
+					missing = append(missing, binary)
+				}
+			}
+
+			if len(missing) > 0 {
+				return fmt.Errorf("missing binaries: %s", strings.Join(missing, ", "))
+			}
+			return nil
+		},
+	}
+}
+
+func executable(binary string) bool {
+	if !filepath.IsAbs(binary) {
+		_, err := exec.LookPath(binary)
+		return err == nil
+	}
+
+	info, err := os.Stat(binary)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
@@ -0,0 +1,55 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	checks := []Check{
+		{Name: "passing", Check: func(ctx context.Context) error { return nil }},
+		{Name: "failing", Check: func(ctx context.Context) error { return errors.New("broken") }},
+		{Name: "hanging", Check: func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(time.Second)
+			return nil
+		}},
+	}
+
+	results := Run(context.Background(), checks, 50*time.Millisecond)
+
+	assert.Len(t, results, 3)
+	assert.Equal(t, "passing", results[0].Name)
+	assert.Equal(t, StatusOK, results[0].Status)
+	assert.Equal(t, "failing", results[1].Name)
+	assert.Equal(t, StatusFailing, results[1].Status)
+	assert.Equal(t, "broken", results[1].Error)
+	assert.Equal(t, "hanging", results[2].Name)
+	assert.Equal(t, StatusFailing, results[2].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), results[2].Error)
+
+	assert.False(t, Healthy(results))
+	assert.True(t, Healthy(results[:1]))
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Nil(t, DiskSpaceCheck(os.TempDir(), 0).Check(ctx))
+	assert.NotNil(t, DiskSpaceCheck(os.TempDir(), 101).Check(ctx))
+	assert.NotNil(t, DiskSpaceCheck("/does/not/exist", 0).Check(ctx))
+}
+
+func TestBinariesCheck(t *testing.T) {
+	ctx := context.Background()
+
+	assert.Nil(t, BinariesCheck("sh", "/bin/sh").Check(ctx))
+
+	err := BinariesCheck("sh", "draupnir-not-a-binary", "/bin/not-a-binary").Check(ctx)
+	assert.EqualError(t, err, "missing binaries: draupnir-not-a-binary, /bin/not-a-binary")
+}
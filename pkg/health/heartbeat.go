@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Heartbeat tracks the liveness of a background goroutine, which should call
+// Beat every time it completes a unit of work
+type Heartbeat struct {
+	name   string
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewHeartbeat returns a Heartbeat which is considered failing if it hasn't
+// been beaten within maxAge
+func NewHeartbeat(name string, maxAge time.Duration) *Heartbeat {
+	return &Heartbeat{name: name, maxAge: maxAge, now: time.Now}
+}
+
+// Beat records that the goroutine is alive
+func (h *Heartbeat) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = h.now()
+}
+
+// Check returns a readiness check for the heartbeat
+func (h *Heartbeat) Check() Check {
+	return Check{
+		Name: h.name,
+		Check: func(ctx context.Context) error {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			if h.last.IsZero() {
+				return fmt.Errorf("%s has not started", h.name)
+			}
+
+			if age := h.now().Sub(h.last); age > h.maxAge {
+				return fmt.Errorf("%s last ran %s ago", h.name, age.Round(time.Second))
+			}
+			return nil
+		},
+	}
+}
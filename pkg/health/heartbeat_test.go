@@ -0,0 +1,26 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeat(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	heartbeat := NewHeartbeat("cleaner", time.Minute)
+	heartbeat.now = func() time.Time { return now }
+	check := heartbeat.Check()
+
+	assert.Equal(t, "cleaner", check.Name)
+	assert.EqualError(t, check.Check(context.Background()), "cleaner has not started")
+
+	heartbeat.Beat()
+	now = now.Add(time.Minute)
+	assert.Nil(t, check.Check(context.Background()))
+
+	now = now.Add(time.Second)
+	assert.EqualError(t, check.Check(context.Background()), "cleaner last ran 1m1s ago")
+}
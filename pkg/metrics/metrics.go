@@ -0,0 +1,152 @@
+// Package metrics defines the Prometheus metrics exported by the draupnir
+// server on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "draupnir"
+
+var (
+	RequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served, by route and status code.",
+		},
+		[]string{"route", "method", "status"},
+	)
+
+	RequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route and status code.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"route", "method", "status"},
+	)
+
+	// Executor operations shell out to btrfs and Postgres, and can take minutes
+	ExecutorOperationDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "executor_operation_duration_seconds",
+			Help:      "Time taken by executor operations, by operation and outcome.",
+			Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"operation", "outcome"},
+	)
+
+	WhitelistReconcileDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "whitelist_reconcile_duration_seconds",
+			Help:      "Time taken to reconcile the IP whitelist with iptables.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+
+	WhitelistReconcileErrorsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "whitelist_reconcile_errors_total",
+			Help:      "Number of whitelist reconciliations that failed.",
+		},
+	)
+
+	WhitelistRules = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "whitelist_rules",
+			Help:      "Number of rules in the whitelist chain after the last reconciliation.",
+		},
+	)
+
+	WhitelistRuleChangesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "whitelist_rule_changes_total",
+			Help:      "Number of rules added to or removed from the whitelist chain.",
+		},
+		[]string{"change"},
+	)
+
+	CleanerRunsTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_runs_total",
+			Help:      "Number of times the cleaner has checked instances for invalid tokens.",
+		},
+	)
+
+	CleanerDeletionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cleaner_deletions_total",
+			Help:      "Number of instances the cleaner has destroyed, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+
+	InstancePoolClaimsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "instance_pool_claims_total",
+			Help:      "Number of instance creations, by whether a pooled instance could be claimed (hit) or one had to be created (miss).",
+		},
+		[]string{"result"},
+	)
+
+	InstancePoolSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "instance_pool_size",
+			Help:      "Number of pooled instances of the latest image after the last refill.",
+		},
+	)
+
+	ProxyConnectionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "proxy_connections_total",
+			Help:      "Number of connections accepted by the instance proxy, by result: proxied, denied, unknown_instance or error.",
+		},
+		[]string{"result"},
+	)
+
+	ProxyActiveConnections = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_active_connections",
+			Help:      "Number of connections currently being proxied to instances.",
+		},
+	)
+
+	TunnelsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tunnels_total",
+			Help:      "Number of tunnels to instances opened through the API, by result: tunnelled or error.",
+		},
+		[]string{"result"},
+	)
+
+	TunnelsActive = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tunnels_active",
+			Help:      "Number of tunnels to instances currently open.",
+		},
+	)
+)
+
+// Outcome returns the outcome label for an operation that returned err
+func Outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
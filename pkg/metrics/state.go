@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+var (
+	imagesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "images"),
+		"Number of images, by whether they are ready to create instances from.",
+		[]string{"ready"}, nil,
+	)
+	instancesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "instances"),
+		"Number of instances.",
+		nil, nil,
+	)
+	portsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "instance_ports"),
+		"Number of ports in the instance port range, by whether they are in use.",
+		[]string{"state"}, nil,
+	)
+	diskFreeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "data_disk_free_bytes"),
+		"Free space on the disk holding images and instances.",
+		nil, nil,
+	)
+	diskSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "data_disk_size_bytes"),
+		"Total size of the disk holding images and instances.",
+		nil, nil,
+	)
+)
+
+// StateCollector reports the current number of images and instances, port
+// range utilisation and free disk space. These are read at scrape time rather
+// than tracked as they change, so they can't drift from the truth.
+type StateCollector struct {
+	Logger          log.Logger
+	ImageStore      store.ImageStore
+	InstanceStore   store.InstanceStore
+	DataPath        string
+	MinInstancePort uint16
+	MaxInstancePort uint16
+}
+
+func (c StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- imagesDesc
+	ch <- instancesDesc
+	ch <- portsDesc
+	ch <- diskFreeDesc
+	ch <- diskSizeDesc
+}
+
+func (c StateCollector) Collect(ch chan<- prometheus.Metric) {
+	images, err := c.ImageStore.List(context.Background())
+	if err != nil {
+		c.Logger.With("error", err.Error()).Error("failed to list images for metrics")
+	} else {
+		ready, unready := 0, 0
+		for _, image := range images {
+			if image.Ready {
+				ready++
+			} else {
+				unready++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(imagesDesc, prometheus.GaugeValue, float64(ready), "true")
+		ch <- prometheus.MustNewConstMetric(imagesDesc, prometheus.GaugeValue, float64(unready), "false")
+	}
+
+	instances, err := c.InstanceStore.List(context.Background())
+	if err != nil {
+		c.Logger.With("error", err.Error()).Error("failed to list instances for metrics")
+	} else {
+		// The maximum port is exclusive
+		total := int(c.MaxInstancePort) - int(c.MinInstancePort)
+		used := 0
+		for _, instance := range instances {
+			if instance.Port >= c.MinInstancePort && instance.Port < c.MaxInstancePort {
+				used++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(len(instances)))
+		ch <- prometheus.MustNewConstMetric(portsDesc, prometheus.GaugeValue, float64(used), "used")
+		ch <- prometheus.MustNewConstMetric(portsDesc, prometheus.GaugeValue, float64(total-used), "free")
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(c.DataPath, &stat); err != nil {
+		c.Logger.With("error", err.Error()).Error("failed to stat data path for metrics")
+	} else {
+		blockSize := uint64(stat.Bsize)
+		ch <- prometheus.MustNewConstMetric(diskFreeDesc, prometheus.GaugeValue, float64(uint64(stat.Bavail)*blockSize))
+		ch <- prometheus.MustNewConstMetric(diskSizeDesc, prometheus.GaugeValue, float64(uint64(stat.Blocks)*blockSize))
+	}
+}
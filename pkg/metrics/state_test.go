@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The embedded interfaces satisfy the methods the collector doesn't use
+type fakeImageStore struct {
+	store.ImageStore
+	images []models.Image
+}
+
+func (s fakeImageStore) List(ctx context.Context) ([]models.Image, error) {
+	return s.images, nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances []models.Instance
+}
+
+func (s fakeInstanceStore) List(ctx context.Context) ([]models.Instance, error) {
+	return s.instances, nil
+}
+
+func TestStateCollector(t *testing.T) {
+	collector := StateCollector{
+		Logger: log.NewNopLogger(),
+		ImageStore: fakeImageStore{images: []models.Image{
+			{ID: 1, Ready: true},
+			{ID: 2, Ready: true},
+			{ID: 3, Ready: false},
+		}},
+		InstanceStore: fakeInstanceStore{instances: []models.Instance{
+			{ID: 1, Port: 7000},
+			{ID: 2, Port: 7001},
+		}},
+		DataPath:        os.TempDir(),
+		MinInstancePort: 7000,
+		MaxInstancePort: 7010,
+	}
+
+	expected := `
+# HELP draupnir_images Number of images, by whether they are ready to create instances from.
+# TYPE draupnir_images gauge
+draupnir_images{ready="false"} 1
+draupnir_images{ready="true"} 2
+# HELP draupnir_instance_ports Number of ports in the instance port range, by whether they are in use.
+# TYPE draupnir_instance_ports gauge
+draupnir_instance_ports{state="free"} 8
+draupnir_instance_ports{state="used"} 2
+# HELP draupnir_instances Number of instances.
+# TYPE draupnir_instances gauge
+draupnir_instances 2
+`
+
+	err := testutil.CollectAndCompare(
+		collector, strings.NewReader(expected),
+		"draupnir_images", "draupnir_instances", "draupnir_instance_ports",
+	)
+	assert.Nil(t, err)
+
+	// The disk metrics depend on the machine, so just check they're present
+	assert.Equal(t, 7, testutil.CollectAndCount(collector))
+}
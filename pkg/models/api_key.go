@@ -0,0 +1,43 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// APIKey authenticates automated clients, such as backup pipelines, which
+// can't complete the OAuth flow. Only a hash of the key is stored: the key
+// itself is returned once, when it's created.
+type APIKey struct {
+	ID          int        `jsonapi:"primary,api_keys"`
+	Description string     `jsonapi:"attr,description"`
+	Scopes      []string   `jsonapi:"attr,scopes"`
+	CreatedBy   string     `jsonapi:"attr,created_by"`
+	CreatedAt   time.Time  `jsonapi:"attr,created_at,iso8601"`
+	ExpiresAt   *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+	RevokedAt   *time.Time `jsonapi:"attr,revoked_at,iso8601,omitempty"`
+	Key         string     `jsonapi:"attr,key,omitempty"`
+	KeyHash     string
+}
+
+func NewAPIKey(description string, scopes []string, expiresAt *time.Time, createdBy string, keyHash string) APIKey {
+	return APIKey{
+		Description: description,
+		Scopes:      scopes,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+		KeyHash:     keyHash,
+	}
+}
+
+// Principal is who requests authenticated with the key are made by. It owns
+// the instances created with the key, and appears in the audit log.
+func (k APIKey) Principal() string {
+	return fmt.Sprintf("api-key:%d", k.ID)
+}
+
+// Expired reports whether the key had expired at the given time
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
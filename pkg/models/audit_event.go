@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomeDenied  = "denied"
+)
+
+// AuditEvent records a single state-changing operation: who did what to which
+// resource, from where, and whether it succeeded. Audit events are never
+// modified once written.
+type AuditEvent struct {
+	ID           int       `jsonapi:"primary,audit_events"`
+	Actor        string    `jsonapi:"attr,actor"`
+	Action       string    `jsonapi:"attr,action"`
+	ResourceType string    `jsonapi:"attr,resource_type"`
+	ResourceID   string    `jsonapi:"attr,resource_id"`
+	SourceIP     string    `jsonapi:"attr,source_ip,omitempty"`
+	Outcome      string    `jsonapi:"attr,outcome"`
+	Detail       string    `jsonapi:"attr,detail,omitempty"`
+	CreatedAt    time.Time `jsonapi:"attr,created_at,iso8601"`
+}
+
+func NewAuditEvent(actor, action, resourceType, resourceID, sourceIP string) AuditEvent {
+	return AuditEvent{
+		Actor:        actor,
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		SourceIP:     sourceIP,
+		CreatedAt:    time.Now(),
+	}
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// DeviceAuthorisation lets a client that can't open a browser authenticate.
+// The user visits the verification URL on any device and enters the user code,
+// while the client polls for an access token using the device code.
+type DeviceAuthorisation struct {
+	ID                      string    `jsonapi:"primary,device_authorisations"`
+	DeviceCode              string    `jsonapi:"attr,device_code"`
+	UserCode                string    `jsonapi:"attr,user_code"`
+	VerificationURL         string    `jsonapi:"attr,verification_url"`
+	VerificationURLComplete string    `jsonapi:"attr,verification_url_complete"`
+	Interval                int       `jsonapi:"attr,interval"`
+	ExpiresAt               time.Time `jsonapi:"attr,expires_at,iso8601"`
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+)
+
+// ImageAccessRule grants a single user, or every member of a group, access to
+// an image. An image without any rules is available to all users.
+type ImageAccessRule struct {
+	ID        int       `jsonapi:"primary,image_access_rules"`
+	ImageID   int       `jsonapi:"attr,image_id"`
+	UserEmail string    `jsonapi:"attr,user_email,omitempty"`
+	GroupName string    `jsonapi:"attr,group_name,omitempty"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt time.Time `jsonapi:"attr,updated_at,iso8601"`
+}
+
+func NewImageAccessRule(imageID int, userEmail, groupName string) ImageAccessRule {
+	return ImageAccessRule{
+		ImageID:   imageID,
+		UserEmail: userEmail,
+		GroupName: groupName,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+// Permits reports whether the rule grants access to a user with the given
+// email address and group memberships.
+func (r ImageAccessRule) Permits(email string, groups []string) bool {
+	if r.UserEmail != "" {
+		return r.UserEmail == email
+	}
+
+	for _, group := range groups {
+		if r.GroupName == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImageAccessible reports whether the given rules, which must all belong to
+// the same image, allow a user to access that image.
+func ImageAccessible(rules []ImageAccessRule, email string, groups []string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.Permits(email, groups) {
+			return true
+		}
+	}
+
+	return false
+}
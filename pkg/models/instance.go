@@ -2,28 +2,52 @@ package models
 
 import (
 	"time"
+
+	"github.com/gocardless/draupnir/pkg/certs"
 )
 
 type Instance struct {
-	ID           int    `jsonapi:"primary,instances"`
-	Hostname     string `jsonapi:"attr,hostname"`
-	ImageID      int    `jsonapi:"attr,image_id"`
-	UserEmail    string
-	RefreshToken string
-	CreatedAt    time.Time `jsonapi:"attr,created_at,iso8601"`
-	UpdatedAt    time.Time `jsonapi:"attr,updated_at,iso8601"`
-	Port         uint16    `jsonapi:"attr,port"`
+	ID        int    `jsonapi:"primary,instances"`
+	Hostname  string `jsonapi:"attr,hostname"`
+	ImageID   int    `jsonapi:"attr,image_id"`
+	UserEmail string
+	// SessionID is the session the instance was created in. If the session is
+	// revoked, the instance is destroyed.
+	SessionID string
+	// APIKeyID is the API key the instance was created with, or 0. If the key
+	// is revoked or expires, the instance is destroyed.
+	APIKeyID  int
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt time.Time `jsonapi:"attr,updated_at,iso8601"`
+	Port      uint16    `jsonapi:"attr,port"`
+	// Pooled instances have been created in advance, and are waiting to be
+	// claimed by a user
+	Pooled bool
+	// PasswordAuthentication instances authenticate the draupnir user with a
+	// password rather than a client certificate, for tools that can't use one
+	PasswordAuthentication bool `jsonapi:"attr,password_authentication"`
 
 	Credentials *InstanceCredentials `jsonapi:"relation,credentials"`
 }
 
-func NewInstance(imageID int, email, refreshToken string) Instance {
+func NewInstance(imageID int, email, sessionID string) Instance {
+	return Instance{
+		ImageID:   imageID,
+		UserEmail: email,
+		SessionID: sessionID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+// NewPooledInstance returns an instance of the image that belongs to nobody,
+// to be created in advance and claimed by a user later. It only joins the pool
+// once it has been created.
+func NewPooledInstance(imageID int) Instance {
 	return Instance{
-		ImageID:      imageID,
-		UserEmail:    email,
-		RefreshToken: refreshToken,
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		ImageID:   imageID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
 }
 
@@ -37,13 +61,40 @@ type InstanceCredentials struct {
 	CACertificate     string `jsonapi:"attr,ca_certificate"`
 	ClientCertificate string `jsonapi:"attr,client_certificate"`
 	ClientKey         string `jsonapi:"attr,client_key"`
+	// Password is only set for instances using password authentication
+	Password string `jsonapi:"attr,password,omitempty"`
+
+	// When a format is requested, Connection holds the connection details in
+	// that format, referring to the credentials by their file names. The client
+	// key and CA certificate are also given in the forms that Java expects,
+	// base64 encoded: the key as PKCS #8, and PKCS #12 key and trust stores.
+	Connection     string `jsonapi:"attr,connection,omitempty"`
+	ClientKeyPKCS8 string `jsonapi:"attr,client_key_pkcs8,omitempty"`
+	KeyStore       string `jsonapi:"attr,keystore,omitempty"`
+	TrustStore     string `jsonapi:"attr,truststore,omitempty"`
+
+	CACertificateExpiresAt     *time.Time `jsonapi:"attr,ca_certificate_expires_at,iso8601,omitempty"`
+	ClientCertificateExpiresAt *time.Time `jsonapi:"attr,client_certificate_expires_at,iso8601,omitempty"`
 }
 
-func NewInstanceCredentials(id int, caCert string, clientCert string, clientKey string) InstanceCredentials {
+func NewInstanceCredentials(id int, caCert string, clientCert string, clientKey string, password string) InstanceCredentials {
 	return InstanceCredentials{
-		ID:                id,
-		CACertificate:     caCert,
-		ClientCertificate: clientCert,
-		ClientKey:         clientKey,
+		ID:                         id,
+		CACertificate:              caCert,
+		ClientCertificate:          clientCert,
+		ClientKey:                  clientKey,
+		Password:                   password,
+		CACertificateExpiresAt:     expiresAt(caCert),
+		ClientCertificateExpiresAt: expiresAt(clientCert),
+	}
+}
+
+// expiresAt returns when a PEM encoded certificate expires, or nil if it can't
+// be parsed
+func expiresAt(certificate string) *time.Time {
+	t, err := certs.ExpiresAt([]byte(certificate))
+	if err != nil {
+		return nil
 	}
+	return &t
 }
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// InstanceDestruction records an admin destroying another user's instance, and
+// why. The instance itself no longer exists, so its details are copied here.
+type InstanceDestruction struct {
+	ID          int       `jsonapi:"primary,instance_destructions"`
+	InstanceID  int       `jsonapi:"attr,instance_id"`
+	ImageID     int       `jsonapi:"attr,image_id"`
+	UserEmail   string    `jsonapi:"attr,user_email"`
+	DestroyedBy string    `jsonapi:"attr,destroyed_by"`
+	Reason      string    `jsonapi:"attr,reason"`
+	CreatedAt   time.Time `jsonapi:"attr,created_at,iso8601"`
+}
+
+func NewInstanceDestruction(instance Instance, destroyedBy, reason string) InstanceDestruction {
+	return InstanceDestruction{
+		InstanceID:  instance.ID,
+		ImageID:     instance.ImageID,
+		UserEmail:   instance.UserEmail,
+		DestroyedBy: destroyedBy,
+		Reason:      reason,
+		CreatedAt:   time.Now(),
+	}
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// InstanceSummary is the view of an instance presented to admins. Unlike
+// Instance, it exposes the owner and never carries credentials.
+type InstanceSummary struct {
+	ID        int       `jsonapi:"primary,instances"`
+	ImageID   int       `jsonapi:"attr,image_id"`
+	UserEmail string    `jsonapi:"attr,user_email"`
+	Port      uint16    `jsonapi:"attr,port"`
+	Pooled    bool      `jsonapi:"attr,pooled"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	// DiskUsage is the number of bytes used exclusively by the instance, i.e.
+	// not shared with its image. It is -1 if the usage could not be determined.
+	DiskUsage int64 `jsonapi:"attr,disk_usage_bytes"`
+}
+
+func NewInstanceSummary(instance Instance, diskUsage int64) InstanceSummary {
+	return InstanceSummary{
+		ID:        instance.ID,
+		ImageID:   instance.ImageID,
+		UserEmail: instance.UserEmail,
+		Port:      instance.Port,
+		Pooled:    instance.Pooled,
+		CreatedAt: instance.CreatedAt,
+		DiskUsage: diskUsage,
+	}
+}
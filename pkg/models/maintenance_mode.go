@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaintenanceMode stops users from creating images and instances, e.g. while
+// the data volume is resized. Existing instances are unaffected.
+type MaintenanceMode struct {
+	ID        int        `jsonapi:"primary,maintenance_mode"`
+	Enabled   bool       `jsonapi:"attr,enabled"`
+	Message   string     `jsonapi:"attr,message,omitempty"`
+	EndsAt    *time.Time `jsonapi:"attr,ends_at,iso8601,omitempty"`
+	EnabledBy string     `jsonapi:"attr,enabled_by,omitempty"`
+	CreatedAt *time.Time `jsonapi:"attr,created_at,iso8601,omitempty"`
+}
+
+func NewMaintenanceMode(message string, endsAt *time.Time, enabledBy string) MaintenanceMode {
+	now := time.Now()
+	return MaintenanceMode{
+		ID:        1,
+		Enabled:   true,
+		Message:   message,
+		EndsAt:    endsAt,
+		EnabledBy: enabledBy,
+		CreatedAt: &now,
+	}
+}
+
+// Description is a human readable explanation of the maintenance, for users
+// whose requests are refused
+func (m MaintenanceMode) Description() string {
+	description := "Draupnir is down for maintenance: " + m.Message
+	if m.EndsAt != nil {
+		description += fmt.Sprintf(" (expected to end at %s)", m.EndsAt.Format(time.RFC3339))
+	}
+	return description
+}
@@ -0,0 +1,14 @@
+package models
+
+import (
+	"golang.org/x/oauth2"
+)
+
+// OAuthHandshake is the outcome of an OAuth flow that a client is waiting on,
+// identified by the flow's state parameter
+type OAuthHandshake struct {
+	State string
+	Token oauth2.Token
+	// Error describes why the flow failed, in which case there's no token
+	Error string
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+)
+
+// RoleAssignment grants a role to a principal. The principal is either a
+// user's email address, or a group name prefixed with "group:".
+type RoleAssignment struct {
+	Principal string    `jsonapi:"primary,role_assignments"`
+	Role      string    `jsonapi:"attr,role"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt time.Time `jsonapi:"attr,updated_at,iso8601"`
+}
+
+func NewRoleAssignment(principal string, role string) RoleAssignment {
+	return RoleAssignment{
+		Principal: principal,
+		Role:      role,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is created when a user authenticates, and is identified by the
+// session tokens that draupnir issues to them. The user's refresh token from
+// the identity provider never leaves the server: it's only used to check, in
+// the background, that the user is still allowed to authenticate.
+type Session struct {
+	ID               string
+	UserEmail        string
+	RefreshToken     string
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+	RevokedAt        *time.Time
+	RevocationReason string
+}
+
+func NewSession(id, email, refreshToken string, duration time.Duration) Session {
+	now := time.Now()
+	return Session{
+		ID:           id,
+		UserEmail:    email,
+		RefreshToken: refreshToken,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(duration),
+	}
+}
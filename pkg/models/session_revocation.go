@@ -0,0 +1,10 @@
+package models
+
+// SessionRevocation is the outcome of an admin revoking every session of a
+// user, identified by their email address
+type SessionRevocation struct {
+	ID                  string `jsonapi:"primary,session_revocations"`
+	RevokedSessions     int    `jsonapi:"attr,revoked_sessions"`
+	DestroyedInstances  int    `jsonapi:"attr,destroyed_instances"`
+	ReassignedInstances int    `jsonapi:"attr,reassigned_instances"`
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Request codes that a Postgres client may send in place of a protocol version
+// in its first message:
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	cancelRequestCode = 80877102
+
+	// maxStartupPacketLength is the largest startup packet Postgres accepts
+	maxStartupPacketLength = 10000
+)
+
+// errTLSRequired is returned when a client starts a session without TLS, which
+// the proxy can't route as there's no server name
+var errTLSRequired = errors.New("client did not request TLS")
+
+// negotiateTLS reads startup packets from the client until it requests TLS,
+// and tells the client to go ahead. GSSAPI encryption isn't supported, and
+// clients fall back to TLS when it's declined. Any other request can't be
+// routed, and is refused with a Postgres error where the client is able to
+// display it.
+func negotiateTLS(conn io.ReadWriter) error {
+	// A client asks for GSSAPI encryption at most once before TLS
+	for attempt := 0; attempt < 2; attempt++ {
+		code, err := readStartupPacket(conn)
+		if err != nil {
+			return err
+		}
+
+		switch code {
+		case sslRequestCode:
+			_, err = conn.Write([]byte{'S'})
+			return errors.Wrap(err, "failed to accept SSL request")
+		case gssEncRequestCode:
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return errors.Wrap(err, "failed to decline GSSAPI encryption request")
+			}
+		case cancelRequestCode:
+			// Cancellation requests are sent without TLS, so there's no way of
+			// knowing which instance they're for
+			return errors.New("cancel requests are not supported")
+		default:
+			writeError(conn, "28000", "connections to Draupnir instances must use SSL")
+			return errTLSRequired
+		}
+	}
+
+	return errors.New("client did not request SSL")
+}
+
+// requestTLS asks an instance to start a TLS session on conn
+func requestTLS(conn io.ReadWriter) error {
+	packet := make([]byte, 8)
+	binary.BigEndian.PutUint32(packet[0:4], 8)
+	binary.BigEndian.PutUint32(packet[4:8], sslRequestCode)
+	if _, err := conn.Write(packet); err != nil {
+		return errors.Wrap(err, "failed to send SSL request")
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return errors.Wrap(err, "failed to read SSL response")
+	}
+	if response[0] != 'S' {
+		return fmt.Errorf("instance refused SSL request: %q", response[0])
+	}
+	return nil
+}
+
+// readStartupPacket reads a packet sent by the client before a session has
+// started, and returns its request code or protocol version. The remainder of
+// the packet is discarded.
+func readStartupPacket(r io.Reader) (uint32, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, errors.Wrap(err, "failed to read startup packet")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 8 || length > maxStartupPacketLength {
+		return 0, fmt.Errorf("invalid startup packet length: %d", length)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, int64(length-8)); err != nil {
+		return 0, errors.Wrap(err, "failed to read startup packet")
+	}
+
+	return binary.BigEndian.Uint32(header[4:8]), nil
+}
+
+// writeError sends a fatal ErrorResponse to the client, which psql and other
+// clients display to the user
+func writeError(w io.Writer, code, message string) {
+	var fields bytes.Buffer
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', "FATAL"},
+		{'V', "FATAL"},
+		{'C', code},
+		{'M', message},
+	} {
+		fields.WriteByte(field.kind)
+		fields.WriteString(field.value)
+		fields.WriteByte(0)
+	}
+	fields.WriteByte(0)
+
+	header := make([]byte, 5)
+	header[0] = 'E'
+	binary.BigEndian.PutUint32(header[1:5], uint32(fields.Len()+4))
+
+	w.Write(append(header, fields.Bytes()...))
+}
@@ -0,0 +1,425 @@
+// Package proxy exposes every instance on a single port. Clients connect with
+// TLS, as they would to the instance directly, and the proxy routes them to
+// the instance named by the server name (SNI) in their TLS handshake, e.g.
+// instance-42.draupnir.example.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/certs"
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tracing"
+	"github.com/gocardless/draupnir/pkg/tunnel"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/gocardless/draupnir/pkg/proxy")
+
+const (
+	// ModePassthrough forwards the client's TLS session to the instance
+	// untouched, so the proxy never sees the traffic
+	ModePassthrough = "passthrough"
+	// ModeTerminate ends the client's TLS session at the proxy, which verifies
+	// the client's certificate and opens its own TLS session to the instance
+	ModeTerminate = "terminate"
+
+	// handshakeTimeout bounds how long a client has to choose an instance
+	handshakeTimeout = 10 * time.Second
+	// dialTimeout bounds how long the proxy waits to connect to an instance
+	dialTimeout = 5 * time.Second
+
+	// instanceHost is where instances listen, as they always run on the same
+	// host as Draupnir
+	instanceHost = "localhost"
+	// hostnamePrefix precedes the instance ID in the hostname clients connect to
+	hostnamePrefix = "instance-"
+)
+
+// Hostname returns the hostname that clients connect to the instance with,
+// via the proxy
+func Hostname(instanceID int, domain string) string {
+	return fmt.Sprintf("%s%d.%s", hostnamePrefix, instanceID, domain)
+}
+
+// InstanceID returns the ID of the instance that hostname refers to
+func InstanceID(hostname, domain string) (int, bool) {
+	hostname = strings.ToLower(hostname)
+	suffix := "." + strings.ToLower(domain)
+	if !strings.HasSuffix(hostname, suffix) {
+		return 0, false
+	}
+
+	label := strings.TrimSuffix(hostname, suffix)
+	if !strings.HasPrefix(label, hostnamePrefix) {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(label, hostnamePrefix))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// CredentialsFunc returns the certificates of an instance. Only the CA
+// certificate and key, and client certificate and key, are used.
+type CredentialsFunc func(ctx context.Context, instanceID int) (certs.Bundle, error)
+
+type Proxy struct {
+	logger                  log.Logger
+	instanceStore           store.InstanceStore
+	whitelistedAddressStore store.WhitelistedAddressStore
+	credentials             CredentialsFunc
+	domain                  string
+	mode                    string
+	whitelist               bool
+	trustedProxies          []*net.IPNet
+	proxyProtocol           bool
+	proxyCertificates       *proxyCertificates
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// New returns a proxy routing connections for instances under domain. If
+// whitelist is set, connections are only accepted from IP addresses in the
+// instance's whitelist. Connections from trustedProxies, such as a load
+// balancer, must begin with a PROXY protocol header giving the client's
+// address if proxyProtocol is set, and are refused by the whitelist if it
+// isn't. credentials is only used when mode is ModeTerminate.
+func New(logger log.Logger, instanceStore store.InstanceStore, whitelistedAddressStore store.WhitelistedAddressStore, credentials CredentialsFunc, domain, mode string, whitelist bool, trustedProxies []*net.IPNet, proxyProtocol bool, certificateOptions certs.Options) (*Proxy, error) {
+	if domain == "" {
+		return nil, errors.New("a domain is required")
+	}
+
+	switch mode {
+	case "":
+		mode = ModePassthrough
+	case ModePassthrough, ModeTerminate:
+	default:
+		return nil, fmt.Errorf("unknown mode: %s", mode)
+	}
+
+	return &Proxy{
+		logger:                  logger,
+		instanceStore:           instanceStore,
+		whitelistedAddressStore: whitelistedAddressStore,
+		credentials:             credentials,
+		domain:                  domain,
+		mode:                    mode,
+		whitelist:               whitelist,
+		trustedProxies:          trustedProxies,
+		proxyProtocol:           proxyProtocol,
+		proxyCertificates:       newProxyCertificates(certificateOptions),
+		conns:                   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve accepts connections on listener until Shutdown is called
+func (p *Proxy) Serve(listener net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	p.listener = listener
+	p.mu.Unlock()
+
+	p.logger.With("address", listener.Addr().String()).With("mode", p.mode).Info("Proxying instance connections")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				p.logger.With("error", err.Error()).Info("Failed to accept connection")
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+
+		go p.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections, and closes those being proxied.
+// Clients reconnect once Draupnir has restarted.
+func (p *Proxy) Shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// track records a connection so that it's closed on shutdown, and reports
+// whether the proxy is still running
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, conn)
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	if !p.track(conn) {
+		conn.Close()
+		return
+	}
+	defer p.untrack(conn)
+	defer conn.Close()
+
+	logger := p.logger.With("remote_addr", conn.RemoteAddr().String())
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	client, backend, instance, result, err := p.connect(conn)
+	metrics.ProxyConnectionsTotal.WithLabelValues(result).Inc()
+	if err != nil {
+		if err == errTLSRequired {
+			logger.Info(err.Error())
+		} else {
+			logger.With("result", result).Info(errors.Wrap(err, "failed to proxy connection").Error())
+		}
+		return
+	}
+	defer backend.Close()
+	conn.SetDeadline(time.Time{})
+
+	logger = logger.With("instance", instance.ID).With("user", instance.UserEmail)
+	logger.Info("Proxying connection")
+
+	metrics.ProxyActiveConnections.Inc()
+	defer metrics.ProxyActiveConnections.Dec()
+
+	tunnel.Splice(client, backend)
+	logger.Info("Connection closed")
+}
+
+// connect negotiates TLS with the client, routes it to an instance, and
+// returns the connections to relay between, along with the result recorded
+// in metrics
+func (p *Proxy) connect(conn net.Conn) (client net.Conn, backend net.Conn, instance models.Instance, result string, err error) {
+	ctx, span := tracer.Start(context.Background(), "Proxy.connect", trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		span.SetAttributes(attribute.String("result", result))
+		tracing.End(span, err)
+	}()
+
+	clientIP, err := p.clientIP(conn)
+	if err != nil {
+		return nil, nil, instance, "error", err
+	}
+
+	if err := negotiateTLS(conn); err != nil {
+		return nil, nil, instance, "error", err
+	}
+
+	serverName, hello, err := readClientHello(conn)
+	if err != nil {
+		return nil, nil, instance, "error", err
+	}
+
+	id, ok := InstanceID(serverName, p.domain)
+	if !ok {
+		return nil, nil, instance, "unknown_instance", fmt.Errorf("no instance for server name %q", serverName)
+	}
+	span.SetAttributes(attribute.Int("instance_id", id))
+
+	instance, err = p.instanceStore.Get(ctx, id)
+	if err != nil {
+		return nil, nil, instance, "unknown_instance", errors.Wrapf(err, "failed to get instance %d", id)
+	}
+
+	if p.whitelist {
+		if clientIP == nil {
+			return nil, nil, instance, "denied", fmt.Errorf("address of client connecting from %s is unknown, so can't be whitelisted", conn.RemoteAddr())
+		}
+
+		whitelisted, err := p.whitelistedAddressStore.IsWhitelisted(ctx, instance.ID, clientIP.String())
+		if err != nil {
+			return nil, nil, instance, "error", errors.Wrap(err, "failed to check whitelist")
+		}
+		if !whitelisted {
+			return nil, nil, instance, "denied", fmt.Errorf("%s is not whitelisted for instance %d", clientIP, instance.ID)
+		}
+	}
+
+	// Terminating TLS needs the instance's certificates, which are loaded
+	// before connecting to it, in case they can't be
+	var bundle certs.Bundle
+	if p.mode == ModeTerminate {
+		bundle, err = p.credentials(ctx, instance.ID)
+		if err != nil {
+			return nil, nil, instance, "error", errors.Wrap(err, "failed to load instance credentials")
+		}
+	}
+
+	backend, err = net.DialTimeout("tcp", net.JoinHostPort(instanceHost, strconv.Itoa(int(instance.Port))), dialTimeout)
+	if err != nil {
+		return nil, nil, instance, "error", errors.Wrap(err, "failed to connect to instance")
+	}
+	backend.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	if err := requestTLS(backend); err != nil {
+		backend.Close()
+		return nil, nil, instance, "error", err
+	}
+
+	if p.mode == ModePassthrough {
+		if _, err := backend.Write(hello); err != nil {
+			backend.Close()
+			return nil, nil, instance, "error", errors.Wrap(err, "failed to forward client hello")
+		}
+		backend.SetDeadline(time.Time{})
+		return conn, backend, instance, "proxied", nil
+	}
+
+	client, backend, err = p.terminate(newReplayConn(conn, hello), backend, serverName, instance, bundle)
+	if err != nil {
+		return nil, nil, instance, "error", err
+	}
+	return client, backend, instance, "proxied", nil
+}
+
+// clientIP returns the address of the client, which is checked against the
+// whitelist. A load balancer hides the client's address behind its own, so
+// it's read from the PROXY protocol header that trusted proxies send. Without
+// it, every client would appear to have the balancer's address, so nil is
+// returned, and the whitelist refuses the connection.
+func (p *Proxy) clientIP(conn net.Conn) (net.IP, error) {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid remote address: %s", host)
+	}
+
+	if !p.trustedProxy(ip) {
+		return ip, nil
+	}
+
+	if !p.proxyProtocol {
+		return nil, nil
+	}
+
+	return readProxyHeader(conn)
+}
+
+func (p *Proxy) trustedProxy(ip net.IP) bool {
+	for _, network := range p.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// terminate completes the client's TLS handshake with a certificate for the
+// server name signed by the instance's CA, requiring a client certificate
+// signed by the same CA unless the instance uses password authentication,
+// then opens a TLS session to the instance with the instance's own client
+// certificate
+func (p *Proxy) terminate(conn net.Conn, backend net.Conn, serverName string, instance models.Instance, bundle certs.Bundle) (net.Conn, net.Conn, error) {
+	if len(bundle.CAKey) == 0 {
+		backend.Close()
+		return nil, nil, errors.New("instance CA key is not readable: rotate its credentials, including the CA")
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle.CACertificate) {
+		backend.Close()
+		return nil, nil, errors.New("failed to parse instance CA certificate")
+	}
+
+	proxyCertificate, err := p.proxyCertificates.get(instance.ID, serverName, bundle)
+	if err != nil {
+		backend.Close()
+		return nil, nil, errors.Wrap(err, "failed to issue proxy certificate")
+	}
+
+	clientCertificate, err := tls.X509KeyPair(bundle.ClientCertificate, bundle.ClientKey)
+	if err != nil {
+		backend.Close()
+		return nil, nil, errors.Wrap(err, "failed to load instance client certificate")
+	}
+
+	// Clients of instances using password authentication don't have a client
+	// certificate, and authenticate to Postgres itself with their password
+	clientAuth := tls.RequireAndVerifyClientCert
+	if instance.PasswordAuthentication {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	client := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{proxyCertificate},
+		ClientAuth:   clientAuth,
+		ClientCAs:    roots,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err := client.Handshake(); err != nil {
+		backend.Close()
+		return nil, nil, errors.Wrap(err, "TLS handshake with client failed")
+	}
+
+	server := tls.Client(backend, &tls.Config{
+		Certificates: []tls.Certificate{clientCertificate},
+		// The instance's certificate is verified against its CA below, as it
+		// doesn't include a hostname
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCA(roots, x509.ExtKeyUsageServerAuth),
+		MinVersion:            tls.VersionTLS12,
+	})
+	if err := server.Handshake(); err != nil {
+		backend.Close()
+		return nil, nil, errors.Wrap(err, "TLS handshake with instance failed")
+	}
+
+	client.SetDeadline(time.Time{})
+	server.SetDeadline(time.Time{})
+	return client, server, nil
+}
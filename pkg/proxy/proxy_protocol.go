@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Load balancers that forward connections at the TCP level hide the client's
+// address, which they can pass on by sending a PROXY protocol header before
+// the client's data:
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// maxProxyProtocolV1Length is the longest a version 1 header can be,
+	// including the CRLF
+	maxProxyProtocolV1Length = 107
+
+	proxyProtocolV2CommandLocal = 0x0
+	proxyProtocolV2CommandProxy = 0x1
+	proxyProtocolV2FamilyTCP4   = 0x11
+	proxyProtocolV2FamilyTCP6   = 0x21
+)
+
+// readProxyHeader reads a PROXY protocol header of either version, returning
+// the address of the client. The header is read without reading past it, so
+// the client's data follows. Headers for connections that the load balancer
+// made itself, e.g. for health checks, have no client address, in which case
+// nil is returned.
+func readProxyHeader(r io.Reader) (net.IP, error) {
+	prefix := make([]byte, len(proxyProtocolV2Signature))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyProtocolV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(prefix, proxyProtocolV1Prefix):
+		return readProxyHeaderV1(r, prefix)
+	default:
+		return nil, errors.New("connection did not begin with a PROXY protocol header")
+	}
+}
+
+// readProxyHeaderV1 reads the rest of a header such as
+// "PROXY TCP4 203.0.113.7 192.0.2.1 51234 5432\r\n"
+func readProxyHeaderV1(r io.Reader, prefix []byte) (net.IP, error) {
+	header := prefix
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) >= maxProxyProtocolV1Length {
+			return nil, errors.New("PROXY protocol header is too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+		}
+		header = append(header, b[0])
+	}
+
+	fields := strings.Fields(string(header))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %q", strings.TrimSpace(string(header)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address in PROXY protocol header: %q", fields[2])
+	}
+	return ip, nil
+}
+
+// readProxyHeaderV2 reads the rest of a binary header, following the
+// signature
+func readProxyHeaderV2(r io.Reader) (net.IP, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol header")
+	}
+
+	version, command, family := header[0]>>4, header[0]&0x0f, header[1]
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", version)
+	}
+
+	// The addresses may be followed by extensions, which are skipped
+	addresses := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, errors.Wrap(err, "failed to read PROXY protocol addresses")
+	}
+
+	switch command {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command: %d", command)
+	}
+
+	switch family {
+	case proxyProtocolV2FamilyTCP4:
+		if len(addresses) < 12 {
+			return nil, errors.New("PROXY protocol addresses are too short")
+		}
+		return net.IP(addresses[0:4]), nil
+	case proxyProtocolV2FamilyTCP6:
+		if len(addresses) < 36 {
+			return nil, errors.New("PROXY protocol addresses are too short")
+		}
+		return net.IP(addresses[0:16]), nil
+	default:
+		// Other families, such as UNIX sockets, have no client address
+		return nil, nil
+	}
+}
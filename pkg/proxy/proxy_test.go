@@ -0,0 +1,482 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/certs"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const domain = "draupnir.example"
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances map[int]models.Instance
+}
+
+func (s fakeInstanceStore) Get(ctx context.Context, id int) (models.Instance, error) {
+	instance, ok := s.instances[id]
+	if !ok {
+		return instance, sql.ErrNoRows
+	}
+	return instance, nil
+}
+
+type fakeWhitelistedAddressStore struct {
+	store.WhitelistedAddressStore
+	whitelisted bool
+	// addresses, if set, are the only addresses whitelisted
+	addresses map[string]bool
+}
+
+func (s fakeWhitelistedAddressStore) IsWhitelisted(ctx context.Context, instanceID int, ipAddress string) (bool, error) {
+	if s.addresses != nil {
+		return s.addresses[ipAddress], nil
+	}
+	return s.whitelisted, nil
+}
+
+// startInstance runs a fake instance, which accepts TLS connections in the
+// same way as Postgres does, and echoes lines back to the client prefixed with
+// the common name of the client's certificate
+func startInstance(t *testing.T, bundle certs.Bundle) uint16 {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	serverCertificate, err := tls.X509KeyPair(bundle.ServerCertificate, bundle.ServerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(bundle.CACertificate)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if _, err := readStartupPacket(conn); err != nil {
+					return
+				}
+				conn.Write([]byte{'S'})
+
+				server := tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{serverCertificate},
+					ClientAuth:   tls.RequireAndVerifyClientCert,
+					ClientCAs:    roots,
+				})
+				if err := server.Handshake(); err != nil {
+					return
+				}
+
+				commonName := server.ConnectionState().PeerCertificates[0].Subject.CommonName
+				scanner := bufio.NewScanner(server)
+				for scanner.Scan() {
+					server.Write([]byte(commonName + ": " + scanner.Text() + "\n"))
+				}
+			}()
+		}
+	}()
+
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func startProxy(t *testing.T, mode string, whitelisted bool, instances map[int]models.Instance, bundle certs.Bundle) string {
+	return startProxyBehind(t, nil, false, fakeWhitelistedAddressStore{whitelisted: whitelisted}, mode, instances, bundle)
+}
+
+// startProxyBehind runs a proxy that trusts the given load balancers
+func startProxyBehind(t *testing.T, trustedProxies []*net.IPNet, proxyProtocol bool, whitelist fakeWhitelistedAddressStore, mode string, instances map[int]models.Instance, bundle certs.Bundle) string {
+	logger := log.NewLogger(os.Stderr)
+	credentials := func(ctx context.Context, instanceID int) (certs.Bundle, error) {
+		return bundle, nil
+	}
+
+	proxy, err := New(
+		logger,
+		fakeInstanceStore{instances: instances},
+		whitelist,
+		credentials,
+		domain,
+		mode,
+		true,
+		trustedProxies,
+		proxyProtocol,
+		certs.Options{KeyType: certs.KeyTypeECDSA},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve(listener)
+	t.Cleanup(proxy.Shutdown)
+
+	return listener.Addr().String()
+}
+
+// connect connects to the proxy as libpq does, and returns the TLS session
+func connect(address string, config *tls.Config) (*tls.Conn, error) {
+	return connectVia(address, "", config)
+}
+
+// connectVia connects to the proxy as a load balancer would, sending header
+// before the client's data
+func connectVia(address string, header string, config *tls.Config) (*tls.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte(header)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := requestTLS(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client := tls.Client(conn, config)
+	if err := client.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func echo(t *testing.T, conn io.ReadWriter, line string) string {
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func generateBundle(t *testing.T, instanceID int) (certs.Bundle, tls.Certificate, *x509.CertPool) {
+	bundle, err := certs.GenerateInstanceBundle(instanceID, certs.Options{KeyType: certs.KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCertificate, err := tls.X509KeyPair(bundle.ClientCertificate, bundle.ClientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(bundle.CACertificate)
+
+	return bundle, clientCertificate, roots
+}
+
+func TestHostname(t *testing.T) {
+	assert.Equal(t, "instance-42.draupnir.example", Hostname(42, domain))
+}
+
+func TestInstanceID(t *testing.T) {
+	testCases := []struct {
+		hostname string
+		id       int
+		ok       bool
+	}{
+		{"instance-42.draupnir.example", 42, true},
+		{"INSTANCE-42.Draupnir.Example", 42, true},
+		{"instance-42.other.example", 0, false},
+		{"instance-42.sub.draupnir.example", 0, false},
+		{"instance-abc.draupnir.example", 0, false},
+		{"instance--1.draupnir.example", 0, false},
+		{"draupnir.example", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hostname, func(t *testing.T) {
+			id, ok := InstanceID(tc.hostname, domain)
+			assert.Equal(t, tc.id, id)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	bundle, clientCertificate, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModePassthrough, true, map[int]models.Instance{42: {ID: 42, Port: port}}, certs.Bundle{})
+
+	conn, err := connect(address, &tls.Config{
+		ServerName:            Hostname(42, domain),
+		Certificates:          []tls.Certificate{clientCertificate},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCA(roots, x509.ExtKeyUsageServerAuth),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "Draupnir instance 42 server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName,
+		"the client's TLS session is with the instance")
+	assert.Equal(t, "Draupnir instance 42 client: hello\n", echo(t, conn, "hello"))
+}
+
+func TestProxyTerminate(t *testing.T) {
+	bundle, clientCertificate, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModeTerminate, true, map[int]models.Instance{42: {ID: 42, Port: port}}, bundle)
+
+	// The proxy's certificate is valid for the hostname, so clients can use
+	// sslmode=verify-full as well as verify-ca
+	conn, err := connect(address, &tls.Config{
+		ServerName:   Hostname(42, domain),
+		Certificates: []tls.Certificate{clientCertificate},
+		RootCAs:      roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "Draupnir instance 42 proxy", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	assert.Equal(t, "Draupnir instance 42 client: hello\n", echo(t, conn, "hello"))
+}
+
+func TestProxyTerminateRequiresClientCertificate(t *testing.T) {
+	bundle, _, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModeTerminate, true, map[int]models.Instance{42: {ID: 42, Port: port}}, bundle)
+
+	// A certificate from another instance's CA isn't accepted
+	_, otherCertificate, _ := generateBundle(t, 43)
+
+	conn, err := connect(address, &tls.Config{
+		ServerName:   Hostname(42, domain),
+		Certificates: []tls.Certificate{otherCertificate},
+		RootCAs:      roots,
+	})
+	if err == nil {
+		// TLS 1.3 clients only learn that their certificate was rejected when
+		// they next read
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+}
+
+func TestProxyTerminateWithPasswordAuthentication(t *testing.T) {
+	bundle, _, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModeTerminate, true, map[int]models.Instance{42: {ID: 42, Port: port, PasswordAuthentication: true}}, bundle)
+
+	// Clients of instances using password authentication have no certificate
+	conn, err := connect(address, &tls.Config{
+		ServerName: Hostname(42, domain),
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "Draupnir instance 42 client: hello\n", echo(t, conn, "hello"))
+}
+
+func TestProxyRejectsAddressesNotWhitelisted(t *testing.T) {
+	bundle, clientCertificate, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModePassthrough, false, map[int]models.Instance{42: {ID: 42, Port: port}}, certs.Bundle{})
+
+	_, err := connect(address, &tls.Config{
+		ServerName:            Hostname(42, domain),
+		Certificates:          []tls.Certificate{clientCertificate},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCA(roots, x509.ExtKeyUsageServerAuth),
+	})
+	assert.NotNil(t, err)
+}
+
+func TestProxyBehindLoadBalancer(t *testing.T) {
+	bundle, clientCertificate, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+
+	// The test's connections come from localhost, as they would from a load
+	// balancer
+	_, loadBalancer, _ := net.ParseCIDR("127.0.0.0/8")
+	whitelist := fakeWhitelistedAddressStore{addresses: map[string]bool{"203.0.113.7": true}}
+	instances := map[int]models.Instance{42: {ID: 42, Port: port}}
+	config := &tls.Config{
+		ServerName:            Hostname(42, domain),
+		Certificates:          []tls.Certificate{clientCertificate},
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyCA(roots, x509.ExtKeyUsageServerAuth),
+	}
+
+	t.Run("with PROXY protocol", func(t *testing.T) {
+		address := startProxyBehind(t, []*net.IPNet{loadBalancer}, true, whitelist, ModePassthrough, instances, certs.Bundle{})
+
+		// The client's address is whitelisted, rather than the balancer's
+		conn, err := connectVia(address, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 5432\r\n", config)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "Draupnir instance 42 client: hello\n", echo(t, conn, "hello"))
+			conn.Close()
+		}
+
+		_, err = connectVia(address, "PROXY TCP4 198.51.100.1 127.0.0.1 51234 5432\r\n", config)
+		assert.NotNil(t, err, "the client's address isn't whitelisted")
+	})
+
+	t.Run("without PROXY protocol", func(t *testing.T) {
+		// Every client would have the balancer's address, so none are accepted,
+		// even if the balancer's address is whitelisted
+		whitelist := fakeWhitelistedAddressStore{whitelisted: true}
+		address := startProxyBehind(t, []*net.IPNet{loadBalancer}, false, whitelist, ModePassthrough, instances, certs.Bundle{})
+
+		_, err := connect(address, config)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command byte, family byte, addresses []byte) string {
+		header := append([]byte{}, proxyProtocolV2Signature...)
+		header = append(header, 0x20|command, family, 0, byte(len(addresses)))
+		return string(append(header, addresses...))
+	}
+	tcp4Addresses := []byte{203, 0, 113, 7, 127, 0, 0, 1, 0xc8, 0x22, 0x15, 0x38}
+
+	testCases := []struct {
+		name   string
+		header string
+		ip     string
+		err    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 127.0.0.1 51234 5432\r\n", "203.0.113.7", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 ::1 51234 5432\r\n", "2001:db8::7", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 invalid address", "PROXY TCP4 nonsense 127.0.0.1 51234 5432\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 TCP4", v2(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP4, tcp4Addresses), "203.0.113.7", false},
+		{"v2 LOCAL", v2(proxyProtocolV2CommandLocal, 0, nil), "", false},
+		{"v2 truncated", v2(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP4, tcp4Addresses[:4]), "", true},
+		{"no header", "\x00\x00\x00\x08\x04\xd2\x16\x2f", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The client's data follows the header, and isn't read
+			r := strings.NewReader(tc.header + "data")
+			ip, err := readProxyHeader(r)
+
+			if tc.err {
+				assert.NotNil(t, err)
+				return
+			}
+			if assert.Nil(t, err) {
+				if tc.ip == "" {
+					assert.Nil(t, ip)
+				} else {
+					assert.Equal(t, tc.ip, ip.String())
+				}
+				rest, _ := ioutil.ReadAll(r)
+				assert.Equal(t, "data", string(rest))
+			}
+		})
+	}
+}
+
+func TestProxyRejectsUnknownInstances(t *testing.T) {
+	bundle, clientCertificate, roots := generateBundle(t, 42)
+	port := startInstance(t, bundle)
+	address := startProxy(t, ModePassthrough, true, map[int]models.Instance{42: {ID: 42, Port: port}}, certs.Bundle{})
+
+	for _, serverName := range []string{Hostname(43, domain), "instance-42.other.example", ""} {
+		_, err := connect(address, &tls.Config{
+			ServerName:            serverName,
+			Certificates:          []tls.Certificate{clientCertificate},
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: verifyCA(roots, x509.ExtKeyUsageServerAuth),
+		})
+		assert.NotNil(t, err, serverName)
+	}
+}
+
+func TestProxyRejectsConnectionsWithoutTLS(t *testing.T) {
+	address := startProxy(t, ModePassthrough, true, map[int]models.Instance{}, certs.Bundle{})
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A StartupMessage for protocol 3.0, with user=draupnir
+	params := []byte("user\x00draupnir\x00\x00")
+	startup := make([]byte, 8)
+	binary.BigEndian.PutUint32(startup[0:4], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(startup[4:8], 196608)
+	conn.Write(append(startup, params...))
+
+	response, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotEmpty(t, response) {
+		assert.Equal(t, byte('E'), response[0])
+		assert.Contains(t, string(response), "connections to Draupnir instances must use SSL")
+	}
+}
+
+func TestNegotiateTLSDeclinesGSSAPIEncryption(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() { errs <- negotiateTLS(server) }()
+
+	for _, code := range []uint32{gssEncRequestCode, sslRequestCode} {
+		packet := make([]byte, 8)
+		binary.BigEndian.PutUint32(packet[0:4], 8)
+		binary.BigEndian.PutUint32(packet[4:8], code)
+		client.Write(packet)
+
+		response := make([]byte, 1)
+		if _, err := io.ReadFull(client, response); err != nil {
+			t.Fatal(err)
+		}
+		if code == gssEncRequestCode {
+			assert.Equal(t, byte('N'), response[0])
+		} else {
+			assert.Equal(t, byte('S'), response[0])
+		}
+	}
+
+	assert.Nil(t, <-errs)
+}
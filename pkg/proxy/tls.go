@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/certs"
+	"github.com/pkg/errors"
+)
+
+var errClientHelloRead = errors.New("client hello read")
+
+// readClientHello reads the TLS ClientHello that starts a handshake, and
+// returns the server name it requests along with the bytes read, so that the
+// handshake can be replayed to whichever end completes it
+func readClientHello(r io.Reader) (string, []byte, error) {
+	var read bytes.Buffer
+	var serverName string
+	var found bool
+
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(r, &read)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			found = true
+			// Abandon the handshake before anything is written to the client
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if !found {
+		return "", nil, errors.Wrap(err, "failed to read TLS client hello")
+	}
+	return serverName, read.Bytes(), nil
+}
+
+// readOnlyConn is a net.Conn that can only be read from, which lets the TLS
+// package parse a ClientHello without responding to it
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.reader.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn is a net.Conn which returns data that has already been read from
+// it before reading any more
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func newReplayConn(conn net.Conn, read []byte) net.Conn {
+	return replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(read), conn)}
+}
+
+func (c replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// proxyCertificates issues and caches the certificates presented to clients
+// when TLS is terminated by the proxy. Each is signed by its instance's CA, so
+// clients verify the proxy in the same way as they would the instance. A
+// certificate is reissued when the instance's CA is rotated, or when it is
+// close to expiry.
+type proxyCertificates struct {
+	opts certs.Options
+
+	mu    sync.Mutex
+	cache map[int]cachedCertificate
+}
+
+type cachedCertificate struct {
+	caCertificate []byte
+	certificate   tls.Certificate
+	expiresAt     time.Time
+}
+
+// renewBefore is how long before a proxy certificate expires that it is
+// replaced
+const renewBefore = time.Hour
+
+func newProxyCertificates(opts certs.Options) *proxyCertificates {
+	return &proxyCertificates{opts: opts, cache: make(map[int]cachedCertificate)}
+}
+
+func (p *proxyCertificates) get(instanceID int, hostname string, bundle certs.Bundle) (tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cached, ok := p.cache[instanceID]
+	if ok && bytes.Equal(cached.caCertificate, bundle.CACertificate) && time.Until(cached.expiresAt) > renewBefore {
+		return cached.certificate, nil
+	}
+
+	certificate, key, err := certs.IssueProxyCertificate(instanceID, hostname, bundle.CACertificate, bundle.CAKey, p.opts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pair, err := tls.X509KeyPair(certificate, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	expiresAt, err := certs.ExpiresAt(certificate)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	p.cache[instanceID] = cachedCertificate{
+		caCertificate: bundle.CACertificate,
+		certificate:   pair,
+		expiresAt:     expiresAt,
+	}
+	return pair, nil
+}
+
+// verifyCA returns a function that verifies a peer's certificate is signed by
+// the CA, without checking its hostname. This is what libpq does with
+// sslmode=verify-ca, and instance certificates don't include a hostname.
+func verifyCA(roots *x509.CertPool, usage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate presented")
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, raw := range rawCerts[1:] {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			intermediates.AddCert(cert)
+		}
+
+		_, err = leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		})
+		return err
+	}
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// APIKeyPrefix begins every API key, which distinguishes them from session
+// tokens, and makes them easy to find if they're leaked
+const APIKeyPrefix = "draupnir_"
+
+// Scope limits what an API key can be used for. Unlike users, API keys hold no
+// roles: they're granted only the permissions of their scopes.
+type Scope string
+
+const (
+	// ScopeReadOnly can list and fetch images and instances
+	ScopeReadOnly Scope = "read-only"
+	// ScopeImagesWrite can additionally create, finalise and destroy images
+	ScopeImagesWrite Scope = "images:write"
+	// ScopeInstancesWrite can additionally create and destroy instances
+	ScopeInstancesWrite Scope = "instances:write"
+)
+
+var scopePermissions = map[Scope][]Permission{
+	ScopeReadOnly: {
+		PermissionReadImages,
+		PermissionReadInstances,
+	},
+	ScopeImagesWrite: {
+		PermissionReadImages,
+		PermissionManageImages,
+	},
+	ScopeInstancesWrite: {
+		PermissionReadImages,
+		PermissionReadInstances,
+		PermissionManageInstances,
+	},
+}
+
+// ParseScope converts a string into a Scope, returning an error if it is not
+// one of the known scopes.
+func ParseScope(s string) (Scope, error) {
+	scope := Scope(s)
+	if _, ok := scopePermissions[scope]; !ok {
+		return "", fmt.Errorf("unknown scope: %s", s)
+	}
+	return scope, nil
+}
+
+// PermissionsForScopes returns the union of the permissions granted by each
+// scope. Unknown scopes grant nothing.
+func PermissionsForScopes(scopes []string) PermissionSet {
+	permissions := make(PermissionSet)
+	for _, scope := range scopes {
+		for _, permission := range scopePermissions[Scope(scope)] {
+			permissions[permission] = true
+		}
+	}
+	return permissions
+}
+
+// GenerateAPIKey returns a new random API key, and the hash of it that's
+// stored
+func GenerateAPIKey() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	key := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hash that the key is stored and looked up by. Keys are
+// random, so a fast hash is enough to make them useless to anyone who reads
+// the database.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey reports whether the bearer token is an API key, rather than a
+// session token
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
@@ -2,13 +2,15 @@ package auth
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"golang.org/x/oauth2"
-	google "google.golang.org/api/oauth2/v1"
+
+	"github.com/gocardless/draupnir/pkg/store"
 )
 
 const UPLOAD_USER_EMAIL = "upload"
@@ -17,41 +19,53 @@ type Authenticator interface {
 	// AuthenticateRequest takes an HTTP request and
 	// attempts to authenticate it.
 	// It returns the email address of the authenticated
-	// user, or an error.
+	// user and the ID of their session, or an error.
 	// TODO: maybe this should be Authenticate(string) (string, error)
 	// Taking the Authorization header and returning the email address
 	AuthenticateRequest(*http.Request) (string, string, error)
 	IsRefreshTokenValid(string) (bool, error, error)
 }
 
-type GoogleAuthenticator struct {
-	OAuthClient            OAuthClient
-	SharedSecret           string
-	TrustedUserEmailDomain string
+// OIDCAuthenticator authenticates requests using the session tokens that
+// draupnir issues once users have authenticated with the OpenID Connect
+// identity provider. Tokens are verified locally: the identity provider is only
+// consulted in the background, by the cleaner, through IsRefreshTokenValid.
+// Each token's session is checked in the database, so that a revoked session
+// is rejected by every server straight away.
+type OIDCAuthenticator struct {
+	OAuthClient  OAuthClient
+	SharedSecret string
+	Tokens       SessionTokens
+	Sessions     store.SessionStore
 }
 
-func (g GoogleAuthenticator) AuthenticateRequest(r *http.Request) (string, string, error) {
-	var refreshToken string
-	_, err := fmt.Sscanf(r.Header.Get("Authorization"), "Bearer %s", &refreshToken)
+func (g OIDCAuthenticator) AuthenticateRequest(r *http.Request) (string, string, error) {
+	var token string
+	_, err := fmt.Sscanf(r.Header.Get("Authorization"), "Bearer %s", &token)
 	if err != nil {
 		return "", "", fmt.Errorf("Error extracting token from Authorization header: %s", err.Error())
 	}
 
-	// abr uses a shared secret to authenticate
-	if refreshToken == g.SharedSecret {
+	// The shared secret predates API keys, and is only accepted for backward
+	// compatibility
+	if g.SharedSecret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(g.SharedSecret)) == 1 {
 		return UPLOAD_USER_EMAIL, "", nil
 	}
 
-	email, err := g.OAuthClient.LookupAccessToken(refreshToken)
+	claims, err := g.Tokens.Verify(token)
 	if err != nil {
-		return "", "", fmt.Errorf("Error looking up access token: %s", err.Error())
+		return "", "", fmt.Errorf("Error verifying session token: %s", err.Error())
 	}
 
-	if !strings.HasSuffix(email, g.TrustedUserEmailDomain) {
-		return "", "", errors.New("Email not valid")
+	reason, revoked, err := g.Sessions.RevocationReason(r.Context(), claims.SessionID)
+	if err != nil {
+		return "", "", fmt.Errorf("Error checking session: %s", err.Error())
+	}
+	if revoked {
+		return "", "", fmt.Errorf("Session has been revoked: %s", reason)
 	}
 
-	return email, refreshToken, nil
+	return claims.Email, claims.SessionID, nil
 }
 
 // IsRefreshTokenValid checks if a refresh token is valid by requesting a new
@@ -62,7 +76,7 @@ func (g GoogleAuthenticator) AuthenticateRequest(r *http.Request) (string, strin
 // been an error when attempting to determine if the token is valid.
 // The third return parameter is an error that is populated only if the token
 // is not currently valid, so can be used to determine the reason for its invalidity.
-func (g GoogleAuthenticator) IsRefreshTokenValid(refreshToken string) (bool, error, error) {
+func (g OIDCAuthenticator) IsRefreshTokenValid(refreshToken string) (bool, error, error) {
 	_, err := g.OAuthClient.LookupAccessToken(refreshToken)
 	if err != nil {
 		// invalid_grant is the error code returned when a user is deleted,
@@ -75,40 +89,43 @@ func (g GoogleAuthenticator) IsRefreshTokenValid(refreshToken string) (bool, err
 	return true, nil, nil
 }
 
+// Identity is a user, as described by the identity provider
+type Identity struct {
+	Email  string
+	Groups []string
+}
+
 type OAuthClient interface {
-	// LookupAccessToken takes an access token
+	// Identify returns the identity of the user that
+	// the identity provider issued the token to
+	Identify(context.Context, *oauth2.Token) (Identity, error)
+	// LookupAccessToken takes a refresh token
 	// and returns the email address associated
 	// with it
 	LookupAccessToken(string) (string, error)
 }
 
-type GoogleOAuthClient struct {
-	Config *oauth2.Config
+// IntegrationTestAuthenticator is used for integration tests. It accepts the
+// integration test access token in place of a session token.
+type IntegrationTestAuthenticator struct {
+	Authenticator
 }
 
-func (g GoogleOAuthClient) LookupAccessToken(refreshToken string) (string, error) {
-	// Use the refresh token to obtain an access token
-	token := &oauth2.Token{RefreshToken: refreshToken}
-	tokenSource := g.Config.TokenSource(context.Background(), token)
-	token, err := tokenSource.Token()
-	if err != nil {
-		return "", fmt.Errorf("Error acquiring access token: %s", err.Error())
+func (a IntegrationTestAuthenticator) AuthenticateRequest(r *http.Request) (string, string, error) {
+	if r.Header.Get("Authorization") == "Bearer the-integration-access-token" {
+		return "integration-test@gocardless.com", "", nil
 	}
-
-	service, err := google.New(http.DefaultClient)
-	if err != nil {
-		return "", fmt.Errorf("Error initialising google oauth client: %s", err.Error())
-	}
-	tokenInfo, err := service.Tokeninfo().AccessToken(token.AccessToken).Do()
-	if err != nil {
-		return "", fmt.Errorf("Error getting info from Google: %s", err.Error())
-	}
-	return tokenInfo.Email, nil
+	return a.Authenticator.AuthenticateRequest(r)
 }
 
 // IntegrationTestOAuthClient is used for integration tests
 type IntegrationTestOAuthClient struct{}
 
+func (f IntegrationTestOAuthClient) Identify(ctx context.Context, token *oauth2.Token) (Identity, error) {
+	email, err := f.LookupAccessToken(token.RefreshToken)
+	return Identity{Email: email, Groups: []string{}}, err
+}
+
 func (f IntegrationTestOAuthClient) LookupAccessToken(refreshToken string) (string, error) {
 	if refreshToken == "the-integration-access-token" {
 		return "integration-test@gocardless.com", nil
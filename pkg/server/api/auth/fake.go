@@ -23,18 +23,25 @@ func (f FakeAuthenticator) IsRefreshTokenValid(refreshToken string) (bool, error
 type FakeOAuthClient struct {
 	MockAuthCodeURL func(string, ...oauth2.AuthCodeOption) string
 	MockExchange    func(context.Context, string) (*oauth2.Token, error)
+	MockRevoke      func(context.Context, string) error
 }
 
 func (c *FakeOAuthClient) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
 	return c.MockAuthCodeURL(state, opts...)
 }
 
-func (c *FakeOAuthClient) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
+func (c *FakeOAuthClient) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	return c.MockExchange(ctx, code)
 }
 
-func FakeOauthConfig() *oauth2.Config {
-	return &oauth2.Config{
+func (c *FakeOAuthClient) Revoke(ctx context.Context, token string) error {
+	return c.MockRevoke(ctx, token)
+}
+
+// FakeOIDCClient returns a client for a provider that hasn't been discovered,
+// which can only be used to start the OAuth flow
+func FakeOIDCClient() *OIDCClient {
+	return &OIDCClient{Config: &oauth2.Config{
 		ClientID:     "the-client-id",
 		ClientSecret: "the-client-secret",
 		Scopes:       []string{"the-scope"},
@@ -43,5 +50,5 @@ func FakeOauthConfig() *oauth2.Config {
 			TokenURL: "https://example.org/token",
 		},
 		RedirectURL: "https://draupnir.org/redirect",
-	}
+	}}
 }
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// DefaultIssuerURL is the OpenID Connect issuer used if oauth.issuer_url isn't
+// configured
+const DefaultIssuerURL = "https://accounts.google.com"
+
+// DefaultScopes are requested if oauth.scopes isn't configured
+var DefaultScopes = []string{oidc.ScopeOpenID, "email"}
+
+// DefaultEmailClaim and DefaultGroupsClaim are the ID token claims that hold
+// the user's email address and groups, if others aren't configured
+const DefaultEmailClaim = "email"
+const DefaultGroupsClaim = "groups"
+
+// OIDCClient authenticates users with an OpenID Connect identity provider, such
+// as Google, Okta, Keycloak or Dex. The provider's endpoints and signing keys
+// are discovered from its issuer URL.
+type OIDCClient struct {
+	Config   *oauth2.Config
+	Provider *oidc.Provider
+	Verifier *oidc.IDTokenVerifier
+	// RevocationURL is the provider's token revocation endpoint, if it has one
+	RevocationURL string
+	EmailClaim    string
+	GroupsClaim   string
+}
+
+// NewOIDCClient discovers the provider at the issuer URL, and configures the
+// OAuth flow to use its endpoints. The context is used to fetch the provider's
+// signing keys for as long as the client is used.
+func NewOIDCClient(ctx context.Context, issuerURL string, config oauth2.Config, emailClaim, groupsClaim string) (*OIDCClient, error) {
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("Error discovering OpenID Connect provider: %s", err.Error())
+	}
+
+	var metadata struct {
+		RevocationURL string `json:"revocation_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, fmt.Errorf("Error decoding OpenID Connect provider metadata: %s", err.Error())
+	}
+
+	config.Endpoint = provider.Endpoint()
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultScopes
+	}
+	if emailClaim == "" {
+		emailClaim = DefaultEmailClaim
+	}
+	if groupsClaim == "" {
+		groupsClaim = DefaultGroupsClaim
+	}
+
+	return &OIDCClient{
+		Config:        &config,
+		Provider:      provider,
+		Verifier:      provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		RevocationURL: metadata.RevocationURL,
+		EmailClaim:    emailClaim,
+		GroupsClaim:   groupsClaim,
+	}, nil
+}
+
+func (c *OIDCClient) AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string {
+	return c.Config.AuthCodeURL(state, opts...)
+}
+
+func (c *OIDCClient) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	return c.Config.Exchange(ctx, code, opts...)
+}
+
+// Identify verifies the ID token that was issued alongside the token, and
+// returns the identity in its claims
+func (c *OIDCClient) Identify(ctx context.Context, token *oauth2.Token) (Identity, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Identity{}, errors.New("the identity provider didn't issue an ID token")
+	}
+
+	idToken, err := c.Verifier.Verify(ctx, raw)
+	if err != nil {
+		return Identity{}, fmt.Errorf("Error verifying ID token: %s", err.Error())
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return Identity{}, fmt.Errorf("Error decoding ID token claims: %s", err.Error())
+	}
+	return c.identity(claims)
+}
+
+// LookupAccessToken uses the refresh token to obtain a new token, and returns
+// the email address of the user it was issued to. Providers that don't issue
+// ID tokens when refreshing are asked for the user's info instead.
+func (c *OIDCClient) LookupAccessToken(refreshToken string) (string, error) {
+	ctx := context.Background()
+
+	token, err := c.Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		return "", fmt.Errorf("Error acquiring access token: %s", err.Error())
+	}
+
+	if _, ok := token.Extra("id_token").(string); ok {
+		identity, err := c.Identify(ctx, token)
+		return identity.Email, err
+	}
+
+	userInfo, err := c.Provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return "", fmt.Errorf("Error getting user info: %s", err.Error())
+	}
+
+	var claims map[string]interface{}
+	if err := userInfo.Claims(&claims); err != nil {
+		return "", fmt.Errorf("Error decoding user info: %s", err.Error())
+	}
+	identity, err := c.identity(claims)
+	return identity.Email, err
+}
+
+// Revoke revokes the token with the provider, as described in RFC 7009
+func (c *OIDCClient) Revoke(ctx context.Context, token string) error {
+	if c.RevocationURL == "" {
+		return errors.New("the identity provider doesn't support token revocation")
+	}
+
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.RevocationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("Error constructing token revocation request: %s", err.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.Config.ClientID), url.QueryEscape(c.Config.ClientSecret))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error sending token revocation request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token revocation failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// identity reads the user's email address and groups from the claims
+func (c *OIDCClient) identity(claims map[string]interface{}) (Identity, error) {
+	email, _ := claims[c.EmailClaim].(string)
+	if email == "" {
+		return Identity{}, fmt.Errorf("the %s claim is missing", c.EmailClaim)
+	}
+
+	// Providers that let users choose their email address say whether they've
+	// proven they own it
+	if verified, ok := claims["email_verified"].(bool); ok && !verified && c.EmailClaim == DefaultEmailClaim {
+		return Identity{}, errors.New("the email address has not been verified")
+	}
+
+	identity := Identity{Email: email, Groups: []string{}}
+	switch groups := claims[c.GroupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = append(identity.Groups, groups)
+	}
+
+	return identity, nil
+}
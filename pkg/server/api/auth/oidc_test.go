@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// fakeProvider is an OpenID Connect identity provider that serves discovery
+// and its signing keys, and signs ID tokens on demand
+type fakeProvider struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	revoked []string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.server.URL,
+			"authorization_endpoint": provider.server.URL + "/auth",
+			"token_endpoint":         provider.server.URL + "/token",
+			"jwks_uri":               provider.server.URL + "/keys",
+			"revocation_endpoint":    provider.server.URL + "/revoke",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "the-key", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		provider.revoked = append(provider.revoked, r.PostForm.Get("token"))
+	})
+
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+// token returns an OAuth token carrying an ID token with the given claims
+func (p *fakeProvider) token(t *testing.T, claims map[string]interface{}) *oauth2.Token {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: p.key},
+		(&jose.SignerOptions{}).WithHeader("kid", "the-key"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := map[string]interface{}{
+		"iss": p.server.URL,
+		"aud": "the-client-id",
+		"sub": "1234",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	for claim, value := range claims {
+		payload[claim] = value
+	}
+	body, _ := json.Marshal(payload)
+
+	signed, err := signer.Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := signed.CompactSerialize()
+
+	return (&oauth2.Token{AccessToken: "the-access-token"}).WithExtra(map[string]interface{}{"id_token": raw})
+}
+
+func newTestOIDCClient(t *testing.T, provider *fakeProvider) *OIDCClient {
+	client, err := NewOIDCClient(
+		context.Background(),
+		provider.server.URL,
+		oauth2.Config{ClientID: "the-client-id", ClientSecret: "the-client-secret"},
+		"",
+		"",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestNewOIDCClient(t *testing.T) {
+	provider := newFakeProvider(t)
+	client := newTestOIDCClient(t, provider)
+
+	assert.Equal(t, provider.server.URL+"/auth", client.Config.Endpoint.AuthURL)
+	assert.Equal(t, provider.server.URL+"/token", client.Config.Endpoint.TokenURL)
+	assert.Equal(t, provider.server.URL+"/revoke", client.RevocationURL)
+	assert.Equal(t, DefaultScopes, client.Config.Scopes)
+}
+
+func TestIdentify(t *testing.T) {
+	provider := newFakeProvider(t)
+	client := newTestOIDCClient(t, provider)
+
+	identity, err := client.Identify(context.Background(), provider.token(t, map[string]interface{}{
+		"email":          "someone@example.com",
+		"email_verified": true,
+		"groups":         []string{"engineering", "platform"},
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "someone@example.com", identity.Email)
+	assert.Equal(t, []string{"engineering", "platform"}, identity.Groups)
+}
+
+func TestIdentifyWithConfiguredClaims(t *testing.T) {
+	provider := newFakeProvider(t)
+	client := newTestOIDCClient(t, provider)
+	client.EmailClaim = "preferred_username"
+	client.GroupsClaim = "roles"
+
+	identity, err := client.Identify(context.Background(), provider.token(t, map[string]interface{}{
+		"preferred_username": "someone@example.com",
+		"roles":              "admin",
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "someone@example.com", identity.Email)
+	assert.Equal(t, []string{"admin"}, identity.Groups)
+}
+
+func TestIdentifyRejectsInvalidTokens(t *testing.T) {
+	provider := newFakeProvider(t)
+	client := newTestOIDCClient(t, provider)
+	ctx := context.Background()
+
+	_, err := client.Identify(ctx, &oauth2.Token{AccessToken: "the-access-token"})
+	assert.EqualError(t, err, "the identity provider didn't issue an ID token")
+
+	_, err = client.Identify(ctx, provider.token(t, map[string]interface{}{}))
+	assert.EqualError(t, err, "the email claim is missing")
+
+	_, err = client.Identify(ctx, provider.token(t, map[string]interface{}{
+		"email":          "someone@example.com",
+		"email_verified": false,
+	}))
+	assert.EqualError(t, err, "the email address has not been verified")
+
+	_, err = client.Identify(ctx, provider.token(t, map[string]interface{}{
+		"email": "someone@example.com",
+		"aud":   "another-client-id",
+	}))
+	assert.Contains(t, err.Error(), "Error verifying ID token")
+
+	// Tokens signed by anyone else are rejected
+	impostor := newFakeProvider(t)
+	impostor.server.URL = provider.server.URL
+	_, err = client.Identify(ctx, impostor.token(t, map[string]interface{}{"email": "someone@example.com"}))
+	assert.Contains(t, err.Error(), "Error verifying ID token")
+}
+
+func TestRevoke(t *testing.T) {
+	provider := newFakeProvider(t)
+	client := newTestOIDCClient(t, provider)
+
+	assert.Nil(t, client.Revoke(context.Background(), "the-access-token"))
+	assert.Equal(t, []string{"the-access-token"}, provider.revoked)
+
+	client.RevocationURL = ""
+	assert.EqualError(t, client.Revoke(context.Background(), "the-access-token"), "the identity provider doesn't support token revocation")
+}
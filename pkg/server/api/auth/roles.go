@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Role is a named collection of permissions that can be assigned to a
+// principal: either a user, identified by their email address, or a group.
+type Role string
+
+const (
+	// RoleViewer can see images and their own instances, but not change anything
+	RoleViewer Role = "viewer"
+	// RoleUser can additionally create and destroy their own instances
+	RoleUser Role = "user"
+	// RoleImagePublisher can create, finalise and destroy images. This is the
+	// role intended for automated backup pipelines.
+	RoleImagePublisher Role = "image-publisher"
+	// RoleAdmin can do everything, including managing other users' instances
+	// and access to the service.
+	RoleAdmin Role = "admin"
+
+	// roleSharedSecret is held by the principal authenticated by the deprecated
+	// shared secret, unless another role is assigned to it. It can publish
+	// images and manage every instance, as the shared secret always could, but
+	// not access to the service. It can't be assigned.
+	roleSharedSecret Role = "shared-secret"
+)
+
+// Permission is a single capability that routes can require.
+type Permission string
+
+const (
+	PermissionReadImages   Permission = "images:read"
+	PermissionManageImages Permission = "images:write"
+	// PermissionReadInstances and PermissionManageInstances apply to the user's
+	// own instances only.
+	PermissionReadInstances   Permission = "instances:read"
+	PermissionManageInstances Permission = "instances:write"
+	// PermissionManageAllInstances grants access to instances regardless of
+	// which user they belong to.
+	PermissionManageAllInstances Permission = "instances:admin"
+	// PermissionManageAccess grants management of image access rules and role
+	// assignments.
+	PermissionManageAccess Permission = "access:admin"
+	// PermissionReadAuditLog grants access to the audit log
+	PermissionReadAuditLog Permission = "audit:read"
+	// PermissionManageMaintenance grants enabling and disabling maintenance mode
+	PermissionManageMaintenance Permission = "maintenance:admin"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {
+		PermissionReadImages,
+		PermissionReadInstances,
+	},
+	RoleUser: {
+		PermissionReadImages,
+		PermissionReadInstances,
+		PermissionManageInstances,
+	},
+	RoleImagePublisher: {
+		PermissionReadImages,
+		PermissionManageImages,
+	},
+	RoleAdmin: {
+		PermissionReadImages,
+		PermissionManageImages,
+		PermissionReadInstances,
+		PermissionManageInstances,
+		PermissionManageAllInstances,
+		PermissionManageAccess,
+		PermissionReadAuditLog,
+		PermissionManageMaintenance,
+	},
+	roleSharedSecret: {
+		PermissionReadImages,
+		PermissionManageImages,
+		PermissionReadInstances,
+		PermissionManageInstances,
+		PermissionManageAllInstances,
+	},
+}
+
+// ParseRole converts a string into a Role, returning an error if it is not
+// one of the known roles.
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := rolePermissions[role]; !ok || role == roleSharedSecret {
+		return "", fmt.Errorf("unknown role: %s", s)
+	}
+	return role, nil
+}
+
+// PermissionSet is the set of permissions held by a principal
+type PermissionSet map[Permission]bool
+
+// PermissionsFor returns the union of the permissions granted by each role
+func PermissionsFor(roles []Role) PermissionSet {
+	permissions := make(PermissionSet)
+	for _, role := range roles {
+		for _, permission := range rolePermissions[role] {
+			permissions[permission] = true
+		}
+	}
+	return permissions
+}
+
+// Has reports whether the set contains the given permission
+func (p PermissionSet) Has(permission Permission) bool {
+	return p[permission]
+}
+
+// GroupPrincipal returns the principal used to assign a role to every member
+// of a group.
+func GroupPrincipal(group string) string {
+	return "group:" + group
+}
+
+// ResolveRoles determines the roles held by a user from the role assignments
+// for the user and the groups they belong to.
+// A user without a role assigned directly to them receives the default role,
+// except for the principal authenticated by the shared secret, which can
+// publish images and manage every instance unless assigned a different role.
+func ResolveRoles(email string, assignments []models.RoleAssignment, defaultRole Role) []Role {
+	roles := make([]Role, 0)
+	assignedDirectly := false
+
+	for _, assignment := range assignments {
+		role, err := ParseRole(assignment.Role)
+		if err != nil {
+			continue
+		}
+
+		if assignment.Principal == email {
+			assignedDirectly = true
+		}
+		roles = append(roles, role)
+	}
+
+	if !assignedDirectly {
+		if email == UPLOAD_USER_EMAIL {
+			roles = append(roles, roleSharedSecret)
+		} else {
+			roles = append(roles, defaultRole)
+		}
+	}
+
+	return roles
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"golang.org/x/oauth2"
+)
+
+// DefaultSessionDuration is how long session tokens are valid for, if
+// sessions.duration isn't configured
+const DefaultSessionDuration = 7 * 24 * time.Hour
+
+// SessionTokens signs and verifies the session tokens that draupnir issues to
+// authenticated users. Tokens are verified without contacting the identity
+// provider or the database.
+type SessionTokens struct {
+	Key []byte
+}
+
+// SessionClaims are the contents of a session token
+type SessionClaims struct {
+	SessionID string `json:"sid"`
+	Email     string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Issue returns a session token for the session, which expires with it. The
+// token is the base64 encoded claims, followed by their HMAC-SHA256 signature.
+func (t SessionTokens) Issue(session models.Session) (string, error) {
+	claims, err := json.Marshal(SessionClaims{
+		SessionID: session.ID,
+		Email:     session.UserEmail,
+		ExpiresAt: session.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload)), nil
+}
+
+// Verify checks the token's signature and expiry, and returns its claims
+func (t SessionTokens) Verify(token string) (SessionClaims, error) {
+	var claims SessionClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return claims, errors.New("malformed session token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, t.sign(parts[0])) {
+		return claims, errors.New("invalid session token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errors.New("malformed session token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed session token")
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errors.New("session token has expired")
+	}
+
+	return claims, nil
+}
+
+func (t SessionTokens) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, t.Key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// Sessions creates a session for each user that completes the OAuth flow, and
+// issues them a session token for it
+type Sessions struct {
+	OAuthClient            OAuthClient
+	Store                  store.SessionStore
+	Tokens                 SessionTokens
+	TrustedUserEmailDomain string
+	// AllowedGroups, if set, restricts sessions to members of these groups in
+	// the identity provider
+	AllowedGroups []string
+	Duration      time.Duration
+}
+
+// Create identifies the user that the identity provider issued the token to,
+// and returns a session token for them. The identity provider's token is kept
+// in the session, so that the user's access can be checked in the background.
+func (s Sessions) Create(ctx context.Context, upstream oauth2.Token) (oauth2.Token, error) {
+	identity, err := s.OAuthClient.Identify(ctx, &upstream)
+	if err != nil {
+		return oauth2.Token{}, fmt.Errorf("Error identifying user: %s", err.Error())
+	}
+	email := identity.Email
+
+	if !strings.HasSuffix(email, s.TrustedUserEmailDomain) {
+		return oauth2.Token{}, errors.New("Email not valid")
+	}
+
+	if !s.allowed(identity) {
+		return oauth2.Token{}, errors.New("User is not a member of an allowed group")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return oauth2.Token{}, fmt.Errorf("Error generating session ID: %s", err.Error())
+	}
+
+	session := models.NewSession(hex.EncodeToString(id), email, upstream.RefreshToken, s.Duration)
+	session, err = s.Store.Create(ctx, session)
+	if err != nil {
+		return oauth2.Token{}, fmt.Errorf("Error creating session: %s", err.Error())
+	}
+
+	token, err := s.Tokens.Issue(session)
+	if err != nil {
+		return oauth2.Token{}, fmt.Errorf("Error issuing session token: %s", err.Error())
+	}
+
+	return oauth2.Token{AccessToken: token, TokenType: "Bearer", Expiry: session.ExpiresAt}, nil
+}
+
+// allowed reports whether the user belongs to one of the allowed groups, if
+// any are configured
+func (s Sessions) allowed(identity Identity) bool {
+	if len(s.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, allowed := range s.AllowedGroups {
+		for _, group := range identity.Groups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestSessionTokens(t *testing.T) {
+	tokens := SessionTokens{Key: []byte("the-key")}
+	session := models.NewSession("abc", "someone@example.com", "refresh-token", time.Hour)
+
+	token, err := tokens.Issue(session)
+	assert.Nil(t, err)
+	assert.NotContains(t, token, "refresh-token")
+
+	claims, err := tokens.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", claims.SessionID)
+	assert.Equal(t, "someone@example.com", claims.Email)
+	assert.Equal(t, session.ExpiresAt.Unix(), claims.ExpiresAt)
+}
+
+func TestSessionTokensRejectsInvalidTokens(t *testing.T) {
+	tokens := SessionTokens{Key: []byte("the-key")}
+
+	valid, _ := tokens.Issue(models.NewSession("abc", "someone@example.com", "", time.Hour))
+	otherKey, _ := SessionTokens{Key: []byte("another-key")}.Issue(models.NewSession("abc", "someone@example.com", "", time.Hour))
+	expired, _ := tokens.Issue(models.NewSession("abc", "someone@example.com", "", -time.Minute))
+
+	parts := strings.Split(valid, ".")
+	forged, _ := SessionTokens{Key: []byte("the-key")}.Issue(models.NewSession("abc", "admin@example.com", "", time.Hour))
+	tampered := strings.Split(forged, ".")[0] + "." + parts[1]
+
+	testCases := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"malformed", "not-a-token", "malformed session token"},
+		{"signed with another key", otherKey, "invalid session token signature"},
+		{"tampered", tampered, "invalid session token signature"},
+		{"expired", expired, "session token has expired"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tokens.Verify(tc.token)
+			assert.EqualError(t, err, tc.err)
+		})
+	}
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	tokens := SessionTokens{Key: []byte("the-key")}
+	sessions := &fakeSessionStore{}
+	authenticator := OIDCAuthenticator{SharedSecret: "the-secret", Tokens: tokens, Sessions: sessions}
+
+	session := models.NewSession("abc", "someone@example.com", "", time.Hour)
+	token, _ := tokens.Issue(session)
+
+	r := httptest.NewRequest("GET", "/instances", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	email, sessionID, err := authenticator.AuthenticateRequest(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "someone@example.com", email)
+	assert.Equal(t, "abc", sessionID)
+
+	// Revocations are checked on every request, so they take effect straight
+	// away
+	sessions.revoked = map[string]string{"abc": "invalid_grant"}
+
+	_, _, err = authenticator.AuthenticateRequest(r)
+	assert.EqualError(t, err, "Session has been revoked: invalid_grant")
+
+	r.Header.Set("Authorization", "Bearer the-secret")
+	email, _, err = authenticator.AuthenticateRequest(r)
+	assert.Nil(t, err)
+	assert.Equal(t, UPLOAD_USER_EMAIL, email)
+
+	// The shared secret is optional, and isn't accepted when it's not set
+	authenticator.SharedSecret = ""
+	r.Header.Set("Authorization", "Bearer ")
+	_, _, err = authenticator.AuthenticateRequest(r)
+	assert.NotNil(t, err)
+}
+
+type fakeOAuthClient struct {
+	email  string
+	groups []string
+	err    error
+}
+
+func (c fakeOAuthClient) Identify(ctx context.Context, token *oauth2.Token) (Identity, error) {
+	return Identity{Email: c.email, Groups: c.groups}, c.err
+}
+
+func (c fakeOAuthClient) LookupAccessToken(refreshToken string) (string, error) {
+	return c.email, c.err
+}
+
+type fakeSessionStore struct {
+	created []models.Session
+	revoked map[string]string
+}
+
+func (s *fakeSessionStore) Create(ctx context.Context, session models.Session) (models.Session, error) {
+	s.created = append(s.created, session)
+	return session, nil
+}
+
+func (s *fakeSessionStore) ListToVerify(ctx context.Context) ([]models.Session, error) {
+	return s.created, nil
+}
+
+func (s *fakeSessionStore) ListRevoked(ctx context.Context) ([]models.Session, error) {
+	return nil, nil
+}
+
+func (s *fakeSessionStore) RevocationReason(ctx context.Context, id string) (string, bool, error) {
+	reason, revoked := s.revoked[id]
+	return reason, revoked, nil
+}
+
+func (s *fakeSessionStore) Revoke(ctx context.Context, id string, reason string) error {
+	return nil
+}
+
+func (s *fakeSessionStore) LogOut(ctx context.Context, id string) (models.Session, error) {
+	return models.Session{}, nil
+}
+
+func (s *fakeSessionStore) RevokeUser(ctx context.Context, email string, reason string) ([]models.Session, error) {
+	return nil, nil
+}
+
+func TestCreateSession(t *testing.T) {
+	store := &fakeSessionStore{}
+	sessions := Sessions{
+		OAuthClient:            fakeOAuthClient{email: "someone@example.com"},
+		Store:                  store,
+		Tokens:                 SessionTokens{Key: []byte("the-key")},
+		TrustedUserEmailDomain: "@example.com",
+		Duration:               time.Hour,
+	}
+
+	token, err := sessions.Create(context.Background(), oauth2.Token{RefreshToken: "refresh-token"})
+	assert.Nil(t, err)
+	assert.Empty(t, token.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+
+	assert.Len(t, store.created, 1)
+	assert.Equal(t, "someone@example.com", store.created[0].UserEmail)
+	assert.Equal(t, "refresh-token", store.created[0].RefreshToken)
+
+	claims, err := sessions.Tokens.Verify(token.AccessToken)
+	assert.Nil(t, err)
+	assert.Equal(t, store.created[0].ID, claims.SessionID)
+}
+
+func TestCreateSessionForUntrustedUser(t *testing.T) {
+	store := &fakeSessionStore{}
+	sessions := Sessions{
+		OAuthClient:            fakeOAuthClient{email: "someone@elsewhere.com"},
+		Store:                  store,
+		TrustedUserEmailDomain: "@example.com",
+	}
+
+	_, err := sessions.Create(context.Background(), oauth2.Token{RefreshToken: "refresh-token"})
+	assert.EqualError(t, err, "Email not valid")
+	assert.Empty(t, store.created)
+
+	sessions.OAuthClient = fakeOAuthClient{err: errors.New("invalid_grant")}
+	_, err = sessions.Create(context.Background(), oauth2.Token{RefreshToken: "refresh-token"})
+	assert.EqualError(t, err, "Error identifying user: invalid_grant")
+}
+
+func TestCreateSessionForAllowedGroups(t *testing.T) {
+	store := &fakeSessionStore{}
+	sessions := Sessions{
+		OAuthClient:            fakeOAuthClient{email: "someone@example.com", groups: []string{"engineering"}},
+		Store:                  store,
+		Tokens:                 SessionTokens{Key: []byte("the-key")},
+		TrustedUserEmailDomain: "@example.com",
+		AllowedGroups:          []string{"platform", "engineering"},
+	}
+
+	_, err := sessions.Create(context.Background(), oauth2.Token{RefreshToken: "refresh-token"})
+	assert.Nil(t, err)
+	assert.Len(t, store.created, 1)
+
+	sessions.AllowedGroups = []string{"platform"}
+	_, err = sessions.Create(context.Background(), oauth2.Token{RefreshToken: "refresh-token"})
+	assert.EqualError(t, err, "User is not a member of an allowed group")
+	assert.Len(t, store.created, 1)
+}
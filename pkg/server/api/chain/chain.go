@@ -48,9 +48,14 @@ func New(errorHandler TerminatingMiddleware) Chain {
 }
 
 // Add adds a middleware to a Chain
+// The receiver is left untouched, so a single Chain can be safely extended in
+// several different directions.
 func (c Chain) Add(m Middleware) Chain {
+	middlewares := make([]Middleware, len(c.middlewares), len(c.middlewares)+1)
+	copy(middlewares, c.middlewares)
+
 	return Chain{
-		middlewares:  append(c.middlewares, m),
+		middlewares:  append(middlewares, m),
 		errorHandler: c.errorHandler,
 	}
 }
@@ -118,3 +118,29 @@ func TestErrorHandler(t *testing.T) {
 		log,
 	)
 }
+
+func TestAddDoesNotModifySharedChain(t *testing.T) {
+	log := make([]int, 0)
+
+	logging := func(n int) Middleware {
+		return func(next Handler) Handler {
+			return func(w http.ResponseWriter, r *http.Request) error {
+				log = append(log, n)
+				return next(w, r)
+			}
+		}
+	}
+
+	// Grow the base chain so that its backing array has spare capacity
+	base := New(testErrorHandler(t)).Add(logging(1)).Add(logging(2))
+
+	first := base.Add(logging(3))
+	second := base.Add(logging(4))
+
+	first.Resolve(nullHandler)(nil, nil)
+	assert.Equal(t, []int{1, 2, 3}, log)
+
+	log = log[:0]
+	second.Resolve(nullHandler)(nil, nil)
+	assert.Equal(t, []int{1, 2, 4}, log)
+}
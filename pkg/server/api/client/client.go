@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"reflect"
 	"sort"
 	"strconv"
@@ -19,6 +20,7 @@ import (
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/tunnel"
 	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/google/jsonapi"
 )
@@ -28,7 +30,7 @@ type Client struct {
 	// The URL of the draupnir server
 	// e.g. "https://draupnir-server.my-infra.com"
 	url string
-	// OAuth Access Token
+	// The session token issued by the server when the user authenticated
 	token  oauth2.Token
 	client *http.Client
 }
@@ -52,7 +54,7 @@ type DraupnirClient interface {
 	GetInstance(id string) (models.Instance, error)
 	ListImages() ([]models.Image, error)
 	ListInstances() ([]models.Instance, error)
-	CreateInstance(image models.Image) (models.Instance, error)
+	CreateInstance(image models.Image, passwordAuthentication bool) (models.Instance, error)
 	DestroyInstance(instance models.Instance) error
 	DestroyImage(image models.Image) error
 	CreateAccessToken(string) (string, error)
@@ -112,6 +114,74 @@ func (c Client) GetInstance(id string) (models.Instance, error) {
 	return instance, err
 }
 
+// RotateInstanceCredentials issues a new client certificate for the instance,
+// and a new certificate authority and server certificate if rotateCA is set.
+// It returns the instance with its new credentials.
+func (c Client) RotateInstanceCredentials(instance models.Instance, rotateCA bool) (models.Instance, error) {
+	var rotated models.Instance
+	request := routes.RotateInstanceCredentialsRequest{RotateCA: rotateCA}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return rotated, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/instances/%d/credentials/rotate", instance.ID), &payload)
+	if err != nil {
+		return rotated, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return rotated, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &rotated)
+	return rotated, err
+}
+
+// OpenTunnel opens a tunnel to the instance, which carries a single Postgres
+// connection
+func (c Client) OpenTunnel(instance models.Instance) (io.ReadWriteCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/instances/%d/tunnel", c.url, instance.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", c.authorizationHeader())
+	req.Header.Set("Draupnir-Version", version.Version)
+	tunnel.SetUpgrade(req.Header)
+
+	resp, err := c.upgradeClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		return nil, parseError(resp.Body)
+	}
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, errors.New("server did not upgrade the connection")
+	}
+	return conn, nil
+}
+
+// upgradeClient returns a client that only speaks HTTP/1.1, as connections
+// can't be upgraded over HTTP/2
+func (c Client) upgradeClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if t, ok := c.client.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	}
+	transport.ForceAttemptHTTP2 = false
+	transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	return &http.Client{Transport: transport}
+}
+
 // ListImages returns a list of all images
 func (c Client) ListImages() ([]models.Image, error) {
 	var images []models.Image
@@ -166,10 +236,14 @@ func (c Client) ListInstances() ([]models.Instance, error) {
 	return instances, nil
 }
 
-// CreateInstance creates a new instance
-func (c Client) CreateInstance(image models.Image) (models.Instance, error) {
+// CreateInstance creates a new instance. If passwordAuthentication is set, the
+// instance authenticates with a password rather than a client certificate.
+func (c Client) CreateInstance(image models.Image, passwordAuthentication bool) (models.Instance, error) {
 	var instance models.Instance
-	request := routes.CreateInstanceRequest{ImageID: strconv.Itoa(image.ID)}
+	request := routes.CreateInstanceRequest{
+		ImageID:                strconv.Itoa(image.ID),
+		PasswordAuthentication: passwordAuthentication,
+	}
 
 	var payload bytes.Buffer
 	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
@@ -264,8 +338,421 @@ func (c Client) DestroyImage(image models.Image) error {
 	return nil
 }
 
+// ListImageAccessRules returns the access rules for an image
+func (c Client) ListImageAccessRules(imageID int) ([]models.ImageAccessRule, error) {
+	var rules []models.ImageAccessRule
+	resp, err := c.get(fmt.Sprintf("/admin/images/%d/access_rules", imageID))
+	if err != nil {
+		return rules, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return rules, parseError(resp.Body)
+	}
+
+	maybeRules, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(rules))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []ImageAccessRule
+	rules = make([]models.ImageAccessRule, 0)
+	for _, rule := range maybeRules {
+		r := rule.(*models.ImageAccessRule)
+		rules = append(rules, *r)
+	}
+
+	return rules, nil
+}
+
+// CreateImageAccessRule grants a user or a group access to an image. Exactly
+// one of userEmail and groupName should be set.
+func (c Client) CreateImageAccessRule(imageID int, userEmail, groupName string) (models.ImageAccessRule, error) {
+	var rule models.ImageAccessRule
+	request := routes.CreateImageAccessRuleRequest{UserEmail: userEmail, GroupName: groupName}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return rule, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/admin/images/%d/access_rules", imageID), &payload)
+	if err != nil {
+		return rule, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return rule, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &rule)
+	return rule, err
+}
+
+// DestroyImageAccessRule removes an access rule from an image
+func (c Client) DestroyImageAccessRule(imageID int, ruleID int) error {
+	resp, err := c.delete(fmt.Sprintf("/admin/images/%d/access_rules/%d", imageID, ruleID))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// ListAllInstances returns every user's instances, along with their disk usage
+func (c Client) ListAllInstances() ([]models.InstanceSummary, error) {
+	var instances []models.InstanceSummary
+	resp, err := c.get("/admin/instances")
+	if err != nil {
+		return instances, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return instances, parseError(resp.Body)
+	}
+
+	maybeInstances, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(instances))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []InstanceSummary
+	instances = make([]models.InstanceSummary, 0)
+	for _, instance := range maybeInstances {
+		i := instance.(*models.InstanceSummary)
+		instances = append(instances, *i)
+	}
+
+	return instances, nil
+}
+
+// AdminDestroyInstance destroys any user's instance, recording the reason
+func (c Client) AdminDestroyInstance(id int, reason string) error {
+	request := routes.DestroyInstanceRequest{Reason: reason}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/admin/instances/%d/destroy", id), &payload)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// ReassignInstance transfers ownership of an instance to another user
+func (c Client) ReassignInstance(id int, userEmail string) (models.InstanceSummary, error) {
+	var instance models.InstanceSummary
+	request := routes.ReassignInstanceRequest{UserEmail: userEmail}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return instance, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/admin/instances/%d/reassign", id), &payload)
+	if err != nil {
+		return instance, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return instance, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &instance)
+	return instance, err
+}
+
+// ListInstanceDestructions returns the record of instances destroyed by admins
+func (c Client) ListInstanceDestructions() ([]models.InstanceDestruction, error) {
+	var destructions []models.InstanceDestruction
+	resp, err := c.get("/admin/instance_destructions")
+	if err != nil {
+		return destructions, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return destructions, parseError(resp.Body)
+	}
+
+	maybeDestructions, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(destructions))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []InstanceDestruction
+	destructions = make([]models.InstanceDestruction, 0)
+	for _, destruction := range maybeDestructions {
+		d := destruction.(*models.InstanceDestruction)
+		destructions = append(destructions, *d)
+	}
+
+	return destructions, nil
+}
+
+// ListAuditEvents returns the most recent audit events matching the filters,
+// which are passed to the server as query parameters
+func (c Client) ListAuditEvents(filters url.Values) ([]models.AuditEvent, error) {
+	var events []models.AuditEvent
+	resp, err := c.get("/admin/audit_events?" + filters.Encode())
+	if err != nil {
+		return events, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return events, parseError(resp.Body)
+	}
+
+	maybeEvents, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(events))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []AuditEvent
+	events = make([]models.AuditEvent, 0)
+	for _, event := range maybeEvents {
+		e := event.(*models.AuditEvent)
+		events = append(events, *e)
+	}
+
+	return events, nil
+}
+
+// ListRoleAssignments returns every role assignment
+func (c Client) ListRoleAssignments() ([]models.RoleAssignment, error) {
+	var assignments []models.RoleAssignment
+	resp, err := c.get("/admin/role_assignments")
+	if err != nil {
+		return assignments, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return assignments, parseError(resp.Body)
+	}
+
+	maybeAssignments, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(assignments))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []RoleAssignment
+	assignments = make([]models.RoleAssignment, 0)
+	for _, assignment := range maybeAssignments {
+		a := assignment.(*models.RoleAssignment)
+		assignments = append(assignments, *a)
+	}
+
+	return assignments, nil
+}
+
+// AssignRole grants a role to a principal, replacing any role it held before
+func (c Client) AssignRole(principal string, role string) (models.RoleAssignment, error) {
+	var assignment models.RoleAssignment
+	request := routes.AssignRoleRequest{Role: role}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return assignment, err
+	}
+
+	resp, err := c.put(fmt.Sprintf("/admin/role_assignments/%s", url.PathEscape(principal)), &payload)
+	if err != nil {
+		return assignment, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return assignment, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &assignment)
+	return assignment, err
+}
+
+// UnassignRole removes the role assigned to a principal
+func (c Client) UnassignRole(principal string) error {
+	resp, err := c.delete(fmt.Sprintf("/admin/role_assignments/%s", url.PathEscape(principal)))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// ListAPIKeys returns every API key, including those that have been revoked.
+// The keys themselves aren't included.
+func (c Client) ListAPIKeys() ([]models.APIKey, error) {
+	var keys []models.APIKey
+	resp, err := c.get("/admin/api_keys")
+	if err != nil {
+		return keys, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return keys, parseError(resp.Body)
+	}
+
+	maybeKeys, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []APIKey
+	keys = make([]models.APIKey, 0)
+	for _, key := range maybeKeys {
+		k := key.(*models.APIKey)
+		keys = append(keys, *k)
+	}
+
+	return keys, nil
+}
+
+// CreateAPIKey creates an API key with the given scopes, which expires at
+// expiresAt if it's set. The key is only ever returned here.
+func (c Client) CreateAPIKey(description string, scopes []string, expiresAt *time.Time) (models.APIKey, error) {
+	var key models.APIKey
+	request := routes.CreateAPIKeyRequest{Description: description, Scopes: scopes, ExpiresAt: expiresAt}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return key, err
+	}
+
+	resp, err := c.post("/admin/api_keys", &payload)
+	if err != nil {
+		return key, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return key, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &key)
+	return key, err
+}
+
+// RevokeAPIKey revokes an API key, after which it's no longer accepted
+func (c Client) RevokeAPIKey(id string) error {
+	resp, err := c.delete(fmt.Sprintf("/admin/api_keys/%s", url.PathEscape(id)))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user, and destroys or
+// reassigns their instances if instances is "destroy" or "reassign"
+func (c Client) RevokeUserSessions(email, reason, instances, reassignTo string) (models.SessionRevocation, error) {
+	var revocation models.SessionRevocation
+	request := routes.RevokeSessionsRequest{Reason: reason, Instances: instances, ReassignTo: reassignTo}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return revocation, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/admin/users/%s/revoke_sessions", url.PathEscape(email)), &payload)
+	if err != nil {
+		return revocation, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return revocation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &revocation)
+	return revocation, err
+}
+
+// GetMaintenanceMode returns whether maintenance mode is enabled, and why
+func (c Client) GetMaintenanceMode() (models.MaintenanceMode, error) {
+	var mode models.MaintenanceMode
+
+	resp, err := c.get("/maintenance")
+	if err != nil {
+		return mode, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return mode, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &mode)
+	return mode, err
+}
+
+// EnableMaintenanceMode prevents images and instances from being created
+// until maintenance mode is disabled. The message, and the time at which the
+// maintenance is expected to end, are shown to anyone who tries.
+func (c Client) EnableMaintenanceMode(message string, endsAt *time.Time) (models.MaintenanceMode, error) {
+	var mode models.MaintenanceMode
+	request := routes.EnableMaintenanceModeRequest{Message: message, EndsAt: endsAt}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return mode, err
+	}
+
+	resp, err := c.put("/admin/maintenance", &payload)
+	if err != nil {
+		return mode, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return mode, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &mode)
+	return mode, err
+}
+
+// DisableMaintenanceMode allows images and instances to be created again
+func (c Client) DisableMaintenanceMode() error {
+	resp, err := c.delete("/admin/maintenance")
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// ErrAuthorizationPending is returned while polling for the access token of a
+// device authorisation that the user hasn't yet completed
+var ErrAuthorizationPending = errors.New("authorization pending")
+
 type createAccessTokenRequest struct {
-	State string `jsonapi:"attr,state"`
+	State      string `jsonapi:"attr,state"`
+	DeviceCode string `jsonapi:"attr,device_code,omitempty"`
 }
 
 // CreateAccessToken creates an oauth access token
@@ -292,6 +779,71 @@ func (c Client) CreateAccessToken(state string) (oauth2.Token, error) {
 	return token, err
 }
 
+// LogOut ends the session that the client is authenticated with, after which
+// its token is no longer accepted
+func (c Client) LogOut() error {
+	resp, err := c.delete("/access_tokens/current")
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
+
+// CreateDeviceAuthorisation starts authenticating without a browser. The user
+// completes the authorisation on any device, while the client polls for the
+// access token.
+func (c Client) CreateDeviceAuthorisation() (models.DeviceAuthorisation, error) {
+	var authorisation models.DeviceAuthorisation
+	resp, err := c.post("/device_authorisations", &bytes.Buffer{})
+	if err != nil {
+		return authorisation, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return authorisation, parseError(resp.Body)
+	}
+
+	err = jsonapi.UnmarshalPayload(resp.Body, &authorisation)
+	return authorisation, err
+}
+
+// CreateDeviceAccessToken returns the access token for a device authorisation,
+// or ErrAuthorizationPending if the user hasn't yet completed it
+func (c Client) CreateDeviceAccessToken(deviceCode string) (oauth2.Token, error) {
+	var token oauth2.Token
+	request := createAccessTokenRequest{DeviceCode: deviceCode}
+
+	var payload bytes.Buffer
+	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	if err != nil {
+		return token, err
+	}
+
+	resp, err := c.post("/access_tokens", &payload)
+	if err != nil {
+		return token, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		var apiError api.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiError); err != nil {
+			return token, err
+		}
+		if apiError.Code == api.AuthorizationPendingError.Code {
+			return token, ErrAuthorizationPending
+		}
+		return token, fmt.Errorf("%s (%s)", apiError.Title, apiError.Detail)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	return token, err
+}
+
 func (c Client) do(req *http.Request) (*http.Response, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", c.authorizationHeader())
@@ -318,6 +870,15 @@ func (c Client) post(path string, payload *bytes.Buffer) (*http.Response, error)
 	return c.do(req)
 }
 
+func (c Client) put(path string, payload *bytes.Buffer) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPut, c.url+path, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
 func (c Client) delete(path string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodDelete, c.url+path, strings.NewReader(""))
 	if err != nil {
@@ -328,7 +889,7 @@ func (c Client) delete(path string) (*http.Response, error) {
 }
 
 func (c Client) authorizationHeader() string {
-	return fmt.Sprintf("Bearer %s", c.token.RefreshToken)
+	return fmt.Sprintf("Bearer %s", c.token.AccessToken)
 }
 
 // parseError takes an io.Reader containing an API error response
@@ -122,3 +122,146 @@ var OauthError = Error{
 	Title:  "OAuth Error",
 	Detail: "There was some oauth error",
 }
+
+var AuthorizationPendingError = Error{
+	ID:     "authorization_pending",
+	Code:   "authorization_pending",
+	Status: "400",
+	Title:  "Authorization Pending",
+	Detail: "The user hasn't yet entered the code for this device",
+}
+
+var ExpiredDeviceCodeError = Error{
+	ID:     "expired_token",
+	Code:   "expired_token",
+	Status: "400",
+	Title:  "Expired Device Code",
+	Detail: "The device code has expired or has already been used, please authenticate again",
+}
+
+var ForbiddenError = Error{
+	ID:     "forbidden",
+	Code:   "forbidden",
+	Status: "403",
+	Title:  "Forbidden",
+	Detail: "You do not have permission to perform this action",
+}
+
+var InvalidFormatError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Format",
+	Detail: "The format must be one of libpq-env, database-url, pg-service, pgpass, jdbc or json",
+	Source: ErrorSource{
+		Parameter: "format",
+	},
+}
+
+var UpgradeRequiredError = Error{
+	ID:     "upgrade_required",
+	Code:   "upgrade_required",
+	Status: "426",
+	Title:  "Upgrade Required",
+	Detail: "Tunnels must be opened with the headers Connection: Upgrade and Upgrade: draupnir-tunnel",
+}
+
+var InstanceUnreachableError = Error{
+	ID:     "instance_unreachable",
+	Code:   "instance_unreachable",
+	Status: "502",
+	Title:  "Instance Unreachable",
+	Detail: "The instance is not accepting connections",
+}
+
+var InvalidImageAccessRuleError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Access Rule",
+	Detail: "An access rule must specify exactly one of user_email or group_name",
+}
+
+var InvalidRoleError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Role",
+	Detail: "Role must be one of viewer, user, image-publisher or admin",
+}
+
+var InvalidAPIKeyError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid API Key",
+	Detail: "An API key must have a description, one or more of the scopes read-only, images:write or instances:write, and an expiry in the future if any",
+}
+
+var MissingReasonError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Missing Reason",
+	Detail: "A reason must be given for destroying another user's instance",
+}
+
+var MissingUserEmailError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Missing User Email",
+	Detail: "The email address of the new owner must be given",
+}
+
+var InvalidAuditEventFilterError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Filter",
+	Detail: "since and until must be RFC 3339 timestamps, and limit a number between 1 and 1000",
+}
+
+var ShuttingDownError = Error{
+	ID:     "shutting_down",
+	Code:   "shutting_down",
+	Status: "503",
+	Title:  "Shutting Down",
+	Detail: "The server is shutting down. Please retry your request shortly.",
+}
+
+var MissingMaintenanceMessageError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Missing Message",
+	Detail: "A message explaining the maintenance must be given",
+}
+
+// UnderMaintenanceError is rendered when a request is refused because the
+// server is in maintenance mode. The detail explains the maintenance.
+func UnderMaintenanceError(detail string) Error {
+	return Error{
+		ID:     "under_maintenance",
+		Code:   "under_maintenance",
+		Status: "503",
+		Title:  "Under Maintenance",
+		Detail: detail,
+	}
+}
+
+var NotASessionError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Not A Session",
+	Detail: "Only session tokens can be revoked by logging out. API keys are revoked by an admin.",
+}
+
+var InvalidSessionRevocationError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Session Revocation",
+	Detail: "A reason must be given, and instances must be empty, destroy or reassign, with reassign_to given if reassigning",
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+const AuditEventKey key = 7
+
+// auditRecord holds the events that will be written once a request completes.
+// The first event describes the request itself; handlers may add more.
+type auditRecord struct {
+	events []*models.AuditEvent
+}
+
+// Audit records an audit event for every request passing through it,
+// describing the authenticated user performing the action against the resource
+// identified by the route's {id} variable, and the outcome. It must come after
+// Authenticate in the chain, and before RequirePermission so that denied
+// requests are recorded too.
+func Audit(auditStore store.AuditEventStore, action string, resourceType string) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			logger, err := GetLogger(r)
+			if err != nil {
+				return err
+			}
+
+			email, err := GetAuthenticatedUser(r)
+			if err != nil {
+				return err
+			}
+
+			// The IP address is only missing in tests, so we don't fail the request
+			// because of it
+			ipAddress, _ := GetUserIPAddress(r)
+
+			event := models.NewAuditEvent(email, action, resourceType, mux.Vars(r)["id"], ipAddress)
+			record := &auditRecord{events: []*models.AuditEvent{&event}}
+			r = r.WithContext(context.WithValue(r.Context(), AuditEventKey, record))
+
+			// Only the status is captured, to determine the outcome. A handler that
+			// returns an error leaves the response to be rendered further up the
+			// chain, and fails regardless of the status.
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			err = next(recorder, r)
+			recordAuditEvents(logger, auditStore, r, record, auditOutcome(recorder.status, err))
+			return err
+		}
+	}
+}
+
+// auditOutcome returns the outcome of a request that responded with status
+func auditOutcome(status int, err error) string {
+	switch {
+	case status == http.StatusForbidden:
+		return models.AuditOutcomeDenied
+	case err != nil || status >= 400:
+		return models.AuditOutcomeFailure
+	default:
+		return models.AuditOutcomeSuccess
+	}
+}
+
+// recordAuditEvents writes the request's events, with the outcome of the
+// request
+func recordAuditEvents(logger log.Logger, auditStore store.AuditEventStore, r *http.Request, record *auditRecord, outcome string) {
+	for _, e := range record.events {
+		e.Outcome = outcome
+		if _, auditErr := auditStore.Create(r.Context(), *e); auditErr != nil {
+			logger.
+				With("action", e.Action).
+				With("resource_id", e.ResourceID).
+				With("error", auditErr.Error()).
+				Error("failed to record audit event")
+		}
+	}
+}
+
+// SetAuditResource sets the ID of the resource affected by the request, for
+// routes such as creation where it isn't known until the handler has run. The
+// detail is free text describing anything else an auditor might need, and may
+// be empty.
+func SetAuditResource(r *http.Request, resourceID string, detail string) {
+	record, ok := r.Context().Value(AuditEventKey).(*auditRecord)
+	if !ok {
+		return
+	}
+
+	record.events[0].ResourceID = resourceID
+	if detail != "" {
+		record.events[0].Detail = detail
+	}
+}
+
+// AddAuditEvent records an additional event caused by the request, such as a
+// change to the IP whitelist. It shares the actor, source IP and outcome of
+// the request.
+func AddAuditEvent(r *http.Request, action, resourceType, resourceID, detail string) {
+	record, ok := r.Context().Value(AuditEventKey).(*auditRecord)
+	if !ok {
+		return
+	}
+
+	primary := record.events[0]
+	event := models.NewAuditEvent(primary.Actor, action, resourceType, resourceID, primary.SourceIP)
+	event.Detail = detail
+	record.events = append(record.events, &event)
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tunnel"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeAuditEventStore struct {
+	events *[]models.AuditEvent
+}
+
+func (s FakeAuditEventStore) Create(ctx context.Context, event models.AuditEvent) (models.AuditEvent, error) {
+	*s.events = append(*s.events, event)
+	return event, nil
+}
+
+func (s FakeAuditEventStore) List(ctx context.Context, filter store.AuditEventFilter) ([]models.AuditEvent, error) {
+	return *s.events, nil
+}
+
+func auditedRequest() *http.Request {
+	logger := log.NewNopLogger()
+	req := httptest.NewRequest("POST", "/instances", nil)
+	req = req.WithContext(context.WithValue(req.Context(), LoggerKey, &logger))
+	req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, "some_user@domain.org"))
+	req = req.WithContext(context.WithValue(req.Context(), UserIPAddressKey, "1.2.3.4"))
+	return req
+}
+
+func TestAuditRecordsSuccessfulRequest(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	events := make([]models.AuditEvent, 0)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		SetAuditResource(r, "4", "image 42")
+		AddAuditEvent(r, "whitelist.add", "instance", "4", "1.2.3.4")
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	err := Audit(FakeAuditEventStore{&events}, "instance.create", "instance")(handler)(recorder, auditedRequest())
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, 2, len(events))
+
+	assert.Equal(t, "some_user@domain.org", events[0].Actor)
+	assert.Equal(t, "instance.create", events[0].Action)
+	assert.Equal(t, "instance", events[0].ResourceType)
+	assert.Equal(t, "4", events[0].ResourceID)
+	assert.Equal(t, "1.2.3.4", events[0].SourceIP)
+	assert.Equal(t, "image 42", events[0].Detail)
+	assert.Equal(t, models.AuditOutcomeSuccess, events[0].Outcome)
+
+	assert.Equal(t, "whitelist.add", events[1].Action)
+	assert.Equal(t, "some_user@domain.org", events[1].Actor)
+	assert.Equal(t, models.AuditOutcomeSuccess, events[1].Outcome)
+}
+
+func TestAuditRecordsDeniedRequest(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	events := make([]models.AuditEvent, 0)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	Audit(FakeAuditEventStore{&events}, "image.create", "image")(handler)(recorder, auditedRequest())
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, models.AuditOutcomeDenied, events[0].Outcome)
+}
+
+func TestAuditRecordsFailedRequest(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	events := make([]models.AuditEvent, 0)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("btrfs exploded")
+	}
+
+	err := Audit(FakeAuditEventStore{&events}, "instance.destroy", "instance")(handler)(recorder, auditedRequest())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, models.AuditOutcomeFailure, events[0].Outcome)
+}
+
+// hijackableRecorder is a response recorder that can be hijacked, like the
+// response writers of a real server
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	return nil, nil, nil
+}
+
+func TestAuditLetsUpgradedRequestsBeHijacked(t *testing.T) {
+	recorder := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	events := make([]models.AuditEvent, 0)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		hijacker, ok := w.(http.Hijacker)
+		if !assert.True(t, ok, "the response should be hijackable") {
+			return nil
+		}
+		_, _, err := hijacker.Hijack()
+		return err
+	}
+
+	req := auditedRequest()
+	tunnel.SetUpgrade(req.Header)
+	err := Audit(FakeAuditEventStore{&events}, "instance.tunnel", "instance")(handler)(recorder, req)
+
+	assert.Nil(t, err)
+	assert.True(t, recorder.hijacked)
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, models.AuditOutcomeSuccess, events[0].Outcome)
+	}
+}
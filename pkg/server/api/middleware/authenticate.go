@@ -8,12 +8,13 @@ import (
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // This, sadly is exported so we can inject fake loggers in tests.
 // See routes.createRequest in server/api/routes/fakes.go
 const AuthUserKey key = 2
-const RefreshTokenKey key = 3
+const SessionIDKey key = 3
 
 // Authenticate uses the provided authenticator to authenticate the request.
 // On success, it yields to the next handler in the chain.
@@ -21,20 +22,31 @@ const RefreshTokenKey key = 3
 func Authenticate(authenticator auth.Authenticator) chain.Middleware {
 	return func(next chain.Handler) chain.Handler {
 		return func(w http.ResponseWriter, r *http.Request) error {
+			// Requests made with an API key have already been authenticated
+			if _, ok := GetAPIKeyScopes(r); ok {
+				return next(w, r)
+			}
+
 			logger, err := GetLogger(r)
 			if err != nil {
 				return err
 			}
 
-			email, refreshToken, err := authenticator.AuthenticateRequest(r)
+			email, sessionID, err := authenticator.AuthenticateRequest(r)
 			if err != nil {
 				logger.Info(err.Error())
 				api.UnauthorizedError.Render(w, http.StatusUnauthorized)
 				return nil
 			}
 
+			if email == auth.UPLOAD_USER_EMAIL {
+				logger.Warn("authenticated with shared_secret, which is deprecated: use an API key instead")
+			}
+
+			annotateSpan(r, attribute.String("enduser.id", email))
+
 			r = r.WithContext(context.WithValue(r.Context(), AuthUserKey, email))
-			r = r.WithContext(context.WithValue(r.Context(), RefreshTokenKey, refreshToken))
+			r = r.WithContext(context.WithValue(r.Context(), SessionIDKey, sessionID))
 			return next(w, r)
 		}
 	}
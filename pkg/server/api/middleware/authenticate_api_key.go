@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+const APIKeyScopesKey key = 8
+const APIKeyIDKey key = 9
+
+// AuthenticateAPIKey authenticates requests made with an API key, which is
+// looked up by its hash. The key's principal becomes the authenticated user,
+// and its scopes are stored in the request context for LoadPermissions.
+// Requests made with any other token are left to Authenticate, which must come
+// after it in the chain.
+func AuthenticateAPIKey(apiKeyStore store.APIKeyStore) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			var token string
+			fmt.Sscanf(r.Header.Get("Authorization"), "Bearer %s", &token)
+			if !auth.IsAPIKey(token) {
+				return next(w, r)
+			}
+
+			logger, err := GetLogger(r)
+			if err != nil {
+				return err
+			}
+
+			key, err := apiKeyStore.GetByHash(r.Context(), auth.HashAPIKey(token))
+			if err == sql.ErrNoRows {
+				logger.Info("unknown API key")
+				api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to get API key")
+			}
+
+			if key.RevokedAt != nil {
+				logger.With("api_key", key.ID).Info("API key has been revoked")
+				api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+				return nil
+			}
+
+			if key.Expired(time.Now()) {
+				logger.With("api_key", key.ID).Info("API key has expired")
+				api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+				return nil
+			}
+
+			annotateSpan(r, attribute.String("enduser.id", key.Principal()))
+
+			r = r.WithContext(context.WithValue(r.Context(), AuthUserKey, key.Principal()))
+			r = r.WithContext(context.WithValue(r.Context(), SessionIDKey, ""))
+			r = r.WithContext(context.WithValue(r.Context(), APIKeyScopesKey, key.Scopes))
+			r = r.WithContext(context.WithValue(r.Context(), APIKeyIDKey, key.ID))
+			return next(w, r)
+		}
+	}
+}
+
+// GetAPIKeyID returns the ID of the API key that the request was authenticated
+// with, or 0 if it wasn't
+func GetAPIKeyID(r *http.Request) int {
+	id, _ := r.Context().Value(APIKeyIDKey).(int)
+	return id
+}
+
+// GetAPIKeyScopes returns the scopes of the API key that the request was
+// authenticated with, if it was
+func GetAPIKeyScopes(r *http.Request) ([]string, bool) {
+	scopes, ok := r.Context().Value(APIKeyScopesKey).([]string)
+	return scopes, ok
+}
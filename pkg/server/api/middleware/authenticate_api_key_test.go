@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeAPIKeyStore struct {
+	keys []models.APIKey
+}
+
+func (s FakeAPIKeyStore) List(ctx context.Context) ([]models.APIKey, error) {
+	return s.keys, nil
+}
+
+func (s FakeAPIKeyStore) Get(ctx context.Context, id int) (models.APIKey, error) {
+	return models.APIKey{}, sql.ErrNoRows
+}
+
+func (s FakeAPIKeyStore) GetByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	for _, key := range s.keys {
+		if key.KeyHash == keyHash {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, sql.ErrNoRows
+}
+
+func (s FakeAPIKeyStore) Create(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	return key, nil
+}
+
+func (s FakeAPIKeyStore) Revoke(ctx context.Context, id int) error {
+	return nil
+}
+
+func authenticateWithAPIKey(t *testing.T, token string, keys []models.APIKey) (*httptest.ResponseRecorder, *http.Request) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	logger := log.NewNopLogger()
+	req = req.WithContext(context.WithValue(req.Context(), LoggerKey, &logger))
+
+	var authenticated *http.Request
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		authenticated = r
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// Only API keys are accepted: anything else reaches Authenticate, which
+	// rejects it
+	authenticator := auth.FakeAuthenticator{
+		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
+			return "", "", sql.ErrNoRows
+		},
+	}
+
+	chained := AuthenticateAPIKey(FakeAPIKeyStore{keys: keys})(Authenticate(authenticator)(handler))
+	assert.Nil(t, chained(recorder, req))
+	return recorder, authenticated
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	key, keyHash, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiKey := models.NewAPIKey("backups", []string{"images:write"}, nil, "admin@domain.org", keyHash)
+	apiKey.ID = 3
+
+	recorder, req := authenticateWithAPIKey(t, key, []models.APIKey{apiKey})
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	email, _ := GetAuthenticatedUser(req)
+	assert.Equal(t, "api-key:3", email)
+	scopes, ok := GetAPIKeyScopes(req)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"images:write"}, scopes)
+	assert.Equal(t, 3, GetAPIKeyID(req))
+}
+
+func TestAuthenticateAPIKeyRejectsInvalidKeys(t *testing.T) {
+	key, keyHash, _ := auth.GenerateAPIKey()
+	past := time.Now().Add(-time.Minute)
+
+	revoked := models.NewAPIKey("backups", []string{"read-only"}, nil, "admin@domain.org", keyHash)
+	revoked.RevokedAt = &past
+	expired := models.NewAPIKey("backups", []string{"read-only"}, &past, "admin@domain.org", keyHash)
+
+	testCases := []struct {
+		name string
+		keys []models.APIKey
+	}{
+		{"unknown", nil},
+		{"revoked", []models.APIKey{revoked}},
+		{"expired", []models.APIKey{expired}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder, _ := authenticateWithAPIKey(t, key, tc.keys)
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		})
+	}
+}
+
+func TestLoadPermissionsForAPIKey(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, "api-key:3"))
+	req = req.WithContext(context.WithValue(req.Context(), AuthGroupsKey, []string{}))
+	req = req.WithContext(context.WithValue(req.Context(), APIKeyScopesKey, []string{"read-only"}))
+
+	var permissions auth.PermissionSet
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		permissions = r.Context().Value(PermissionsKey).(auth.PermissionSet)
+		return nil
+	}
+
+	// Roles assigned to the key's principal are ignored
+	store := FakeRoleAssignmentStore{assignments: []models.RoleAssignment{
+		models.NewRoleAssignment("api-key:3", "admin"),
+	}}
+	err := LoadPermissions(store, auth.RoleUser)(handler)(recorder, req)
+
+	assert.Nil(t, err)
+	assert.True(t, permissions.Has(auth.PermissionReadImages))
+	assert.True(t, permissions.Has(auth.PermissionReadInstances))
+	assert.False(t, permissions.Has(auth.PermissionManageInstances))
+	assert.False(t, permissions.Has(auth.PermissionManageAccess))
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+const PermissionsKey key = 6
+
+// LoadPermissions resolves the roles held by the authenticated user and stores
+// the permissions they grant in the request context. Requests made with an API
+// key are granted the permissions of its scopes instead. It must come after
+// Authenticate and ResolveGroups in the chain.
+func LoadPermissions(roleStore store.RoleAssignmentStore, defaultRole auth.Role) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if scopes, ok := GetAPIKeyScopes(r); ok {
+				permissions := auth.PermissionsForScopes(scopes)
+				r = r.WithContext(context.WithValue(r.Context(), PermissionsKey, permissions))
+				return next(w, r)
+			}
+
+			email, err := GetAuthenticatedUser(r)
+			if err != nil {
+				return err
+			}
+
+			groups, err := GetAuthenticatedGroups(r)
+			if err != nil {
+				return err
+			}
+
+			principals := []string{email}
+			for _, group := range groups {
+				principals = append(principals, auth.GroupPrincipal(group))
+			}
+
+			assignments, err := roleStore.ListForPrincipals(r.Context(), principals)
+			if err != nil {
+				return errors.Wrap(err, "failed to get role assignments")
+			}
+
+			permissions := auth.PermissionsFor(auth.ResolveRoles(email, assignments, defaultRole))
+
+			r = r.WithContext(context.WithValue(r.Context(), PermissionsKey, permissions))
+			return next(w, r)
+		}
+	}
+}
+
+// RequirePermission renders 403 Forbidden unless the authenticated user holds
+// the given permission. It must come after LoadPermissions in the chain.
+func RequirePermission(permission auth.Permission) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			if !HasPermission(r, permission) {
+				logger, err := GetLogger(r)
+				if err != nil {
+					return err
+				}
+
+				logger.With("permission", permission).Info("request denied: missing permission")
+				api.ForbiddenError.Render(w, http.StatusForbidden)
+				return nil
+			}
+
+			return next(w, r)
+		}
+	}
+}
+
+// HasPermission reports whether the authenticated user holds the given
+// permission. It returns false if permissions have not been loaded.
+func HasPermission(r *http.Request, permission auth.Permission) bool {
+	permissions, ok := r.Context().Value(PermissionsKey).(auth.PermissionSet)
+	if !ok {
+		return false
+	}
+	return permissions.Has(permission)
+}
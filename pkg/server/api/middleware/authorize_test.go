@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeRoleAssignmentStore struct {
+	assignments []models.RoleAssignment
+}
+
+func (s FakeRoleAssignmentStore) List(ctx context.Context) ([]models.RoleAssignment, error) {
+	return s.assignments, nil
+}
+
+func (s FakeRoleAssignmentStore) ListForPrincipals(ctx context.Context, principals []string) ([]models.RoleAssignment, error) {
+	matching := make([]models.RoleAssignment, 0)
+	for _, assignment := range s.assignments {
+		for _, principal := range principals {
+			if assignment.Principal == principal {
+				matching = append(matching, assignment)
+			}
+		}
+	}
+	return matching, nil
+}
+
+func (s FakeRoleAssignmentStore) Upsert(ctx context.Context, assignment models.RoleAssignment) (models.RoleAssignment, error) {
+	return assignment, nil
+}
+
+func (s FakeRoleAssignmentStore) Destroy(ctx context.Context, principal string) error {
+	return nil
+}
+
+func loadPermissionsFor(t *testing.T, email string, groups []string, assignments []models.RoleAssignment) auth.PermissionSet {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, email))
+	req = req.WithContext(context.WithValue(req.Context(), AuthGroupsKey, groups))
+
+	var permissions auth.PermissionSet
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		permissions = r.Context().Value(PermissionsKey).(auth.PermissionSet)
+		return nil
+	}
+
+	store := FakeRoleAssignmentStore{assignments: assignments}
+	err := LoadPermissions(store, auth.RoleUser)(handler)(recorder, req)
+
+	assert.Nil(t, err)
+	return permissions
+}
+
+func TestLoadPermissionsWithDefaultRole(t *testing.T) {
+	permissions := loadPermissionsFor(t, "some_user@domain.org", []string{}, nil)
+
+	assert.True(t, permissions.Has(auth.PermissionManageInstances))
+	assert.False(t, permissions.Has(auth.PermissionManageImages))
+}
+
+func TestLoadPermissionsWithDirectAssignment(t *testing.T) {
+	permissions := loadPermissionsFor(t, "some_user@domain.org", []string{}, []models.RoleAssignment{
+		models.NewRoleAssignment("some_user@domain.org", "viewer"),
+	})
+
+	assert.True(t, permissions.Has(auth.PermissionReadInstances))
+	assert.False(t, permissions.Has(auth.PermissionManageInstances))
+}
+
+func TestLoadPermissionsWithGroupAssignment(t *testing.T) {
+	permissions := loadPermissionsFor(t, "some_user@domain.org", []string{"data-team"}, []models.RoleAssignment{
+		models.NewRoleAssignment("group:data-team", "image-publisher"),
+	})
+
+	assert.True(t, permissions.Has(auth.PermissionManageInstances))
+	assert.True(t, permissions.Has(auth.PermissionManageImages))
+	assert.False(t, permissions.Has(auth.PermissionManageAccess))
+}
+
+func TestLoadPermissionsForUploadUser(t *testing.T) {
+	permissions := loadPermissionsFor(t, auth.UPLOAD_USER_EMAIL, []string{}, nil)
+	assert.True(t, permissions.Has(auth.PermissionManageImages))
+	assert.True(t, permissions.Has(auth.PermissionManageInstances))
+	assert.True(t, permissions.Has(auth.PermissionManageAllInstances))
+	assert.False(t, permissions.Has(auth.PermissionManageAccess))
+	assert.False(t, permissions.Has(auth.PermissionReadAuditLog))
+	assert.False(t, permissions.Has(auth.PermissionManageMaintenance))
+
+	permissions = loadPermissionsFor(t, auth.UPLOAD_USER_EMAIL, []string{}, []models.RoleAssignment{
+		models.NewRoleAssignment(auth.UPLOAD_USER_EMAIL, "image-publisher"),
+	})
+	assert.True(t, permissions.Has(auth.PermissionManageImages))
+	assert.False(t, permissions.Has(auth.PermissionManageAccess))
+}
+
+func TestRequirePermissionAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	permissions := auth.PermissionsFor([]auth.Role{auth.RoleAdmin})
+	req = req.WithContext(context.WithValue(req.Context(), PermissionsKey, permissions))
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	err := RequirePermission(auth.PermissionManageAccess)(handler)(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestRequirePermissionDenied(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	permissions := auth.PermissionsFor([]auth.Role{auth.RoleUser})
+	req = req.WithContext(context.WithValue(req.Context(), PermissionsKey, permissions))
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		t.Fatal("this route should never be called")
+		return nil
+	}
+
+	NewRequestLogger(log.NewNopLogger())(RequirePermission(auth.PermissionManageAccess)(handler))(recorder, req)
+
+	var response api.Error
+	err := json.NewDecoder(recorder.Body).Decode(&response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.ForbiddenError, response)
+}
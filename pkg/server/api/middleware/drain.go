@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// RollbackTimeout bounds how long undoing a failed or abandoned operation may
+// take, including once the server has abandoned in-flight requests as it shuts
+// down
+const RollbackTimeout = time.Minute
+
+// Drainer tracks in-flight mutating requests, so that the server can wait for
+// them to complete before shutting down. Once draining has started, new
+// mutating requests are refused.
+type Drainer struct {
+	mu       sync.Mutex
+	inFlight int
+	// idle is created when draining starts, and closed once there are no
+	// mutating requests in flight
+	idle chan struct{}
+}
+
+// Drain stops new mutating requests from being accepted, and waits until those
+// in flight have completed or the context is done
+func (d *Drainer) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	if d.idle == nil {
+		d.idle = make(chan struct{})
+		if d.inFlight == 0 {
+			close(d.idle)
+		}
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Draining returns true once Drain has been called
+func (d *Drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.idle != nil
+}
+
+func (d *Drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.idle != nil {
+		return false
+	}
+	d.inFlight++
+	return true
+}
+
+func (d *Drainer) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight--
+	if d.idle != nil && d.inFlight == 0 {
+		close(d.idle)
+	}
+}
+
+// RejectWhenDraining tracks mutating requests with the drainer, and renders 503
+// Service Unavailable for any that arrive once the server has begun draining.
+// Read-only requests are always served.
+func RejectWhenDraining(drainer *Drainer) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(w, r)
+			}
+
+			if !drainer.begin() {
+				w.Header().Set("Retry-After", "30")
+				api.ShuttingDownError.Render(w, http.StatusServiceUnavailable)
+				return nil
+			}
+			defer drainer.end()
+
+			return next(w, r)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+func TestRejectWhenDraining(t *testing.T) {
+	drainer := &Drainer{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slowHandler := func(w http.ResponseWriter, r *http.Request) error {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	// A mutating request is in flight when draining starts
+	inFlight := httptest.NewRecorder()
+	go RejectWhenDraining(drainer)(slowHandler)(inFlight, httptest.NewRequest("POST", "/instances", nil))
+	<-started
+
+	drained := make(chan error)
+	go func() { drained <- drainer.Drain(context.Background()) }()
+
+	assert.Eventually(t, drainer.Draining, time.Second, time.Millisecond)
+
+	// New mutating requests are refused
+	recorder := httptest.NewRecorder()
+	err := RejectWhenDraining(drainer)(shouldNeverBeCalled(t))(recorder, httptest.NewRequest("DELETE", "/instances/1", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+
+	var response api.Error
+	json.NewDecoder(recorder.Body).Decode(&response)
+	assert.Equal(t, api.ShuttingDownError, response)
+
+	// Reads are still served
+	recorder = httptest.NewRecorder()
+	RejectWhenDraining(drainer)(respondsWithStatus(http.StatusOK))(recorder, httptest.NewRequest("GET", "/instances", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	// Draining completes once the in-flight request does
+	select {
+	case <-drained:
+		t.Fatal("drain completed while a request was in flight")
+	default:
+	}
+
+	close(release)
+	assert.Nil(t, <-drained)
+	assert.Equal(t, http.StatusCreated, inFlight.Code)
+}
+
+func TestDrainTimesOut(t *testing.T) {
+	drainer := &Drainer{}
+	assert.True(t, drainer.begin())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, drainer.Drain(ctx))
+}
@@ -9,7 +9,9 @@ import (
 	"time"
 
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/tunnel"
 	"github.com/prometheus/common/log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type key int
@@ -46,12 +48,28 @@ func NewRequestLogger(logger log.Logger) chain.Middleware {
 					With("client_ip_address", userIPAddress)
 			}
 
+			// Allow logs to be correlated with the request's trace
+			if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+				scopedLogger = scopedLogger.
+					With("trace_id", spanContext.TraceID().String())
+			}
+
 			// Inject the logger into the request's context
 			r = r.WithContext(context.WithValue(r.Context(), LoggerKey, &scopedLogger))
 
-			// Call the next middleware and time it
+			// Call the next middleware and time it. An upgraded connection is taken
+			// over by the handler, so its response can't be captured, and is
+			// written straight to the client instead.
+			upgrade := tunnel.IsUpgrade(r)
+
 			start := time.Now()
-			err = next(recorder, r)
+			if upgrade {
+				upgradeRecorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+				err = next(upgradeRecorder, r)
+				recorder.Code = upgradeRecorder.status
+			} else {
+				err = next(recorder, r)
+			}
 			duration := time.Since(start)
 
 			requestLine := fmt.Sprintf(
@@ -71,6 +89,10 @@ func NewRequestLogger(logger log.Logger) chain.Middleware {
 				With("duration", duration.Seconds()).
 				Info(requestLine)
 
+			if upgrade {
+				return err
+			}
+
 			// Copy the headers and body from the recorder to the response writer
 			for k, v := range recorder.HeaderMap {
 				w.Header()[k] = v
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// RejectDuringMaintenance renders 503 Service Unavailable, explaining the
+// maintenance, if maintenance mode is enabled
+func RejectDuringMaintenance(maintenanceStore store.MaintenanceModeStore) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			mode, err := maintenanceStore.Get(r.Context())
+			if err != nil {
+				return errors.Wrap(err, "failed to get maintenance mode")
+			}
+
+			if mode.Enabled {
+				api.UnderMaintenanceError(mode.Description()).Render(w, http.StatusServiceUnavailable)
+				return nil
+			}
+
+			return next(w, r)
+		}
+	}
+}
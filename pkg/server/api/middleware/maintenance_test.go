@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+type FakeMaintenanceModeStore struct {
+	mode models.MaintenanceMode
+}
+
+func (s FakeMaintenanceModeStore) Get(ctx context.Context) (models.MaintenanceMode, error) {
+	return s.mode, nil
+}
+
+func (s FakeMaintenanceModeStore) Enable(ctx context.Context, mode models.MaintenanceMode) (models.MaintenanceMode, error) {
+	return mode, nil
+}
+
+func (s FakeMaintenanceModeStore) Disable(ctx context.Context) error {
+	return nil
+}
+
+func TestRejectDuringMaintenance(t *testing.T) {
+	endsAt := time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC)
+	store := FakeMaintenanceModeStore{models.NewMaintenanceMode("Resizing the data volume", &endsAt, "admin@draupnir")}
+
+	recorder := httptest.NewRecorder()
+	err := RejectDuringMaintenance(store)(shouldNeverBeCalled(t))(recorder, httptest.NewRequest("POST", "/instances", nil))
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	var response api.Error
+	json.NewDecoder(recorder.Body).Decode(&response)
+	assert.Equal(t, "under_maintenance", response.Code)
+	assert.Equal(
+		t,
+		"Draupnir is down for maintenance: Resizing the data volume (expected to end at 2026-10-18T14:00:00Z)",
+		response.Detail,
+	)
+}
+
+func TestRejectDuringMaintenanceWhenDisabled(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	err := RejectDuringMaintenance(FakeMaintenanceModeStore{})(respondsWithStatus(http.StatusCreated))(recorder, httptest.NewRequest("POST", "/instances", nil))
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// statusRecorder remembers the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets handlers take over the connection, which they do to switch
+// protocols
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// InstrumentRequests records the number and duration of requests, labelled by
+// the route's path template so that IDs in paths don't create new series.
+func InstrumentRequests(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		err := next(recorder, r)
+		duration := time.Since(start)
+
+		// An error that hasn't been rendered will end up as a 500
+		status := recorder.status
+		if err != nil && status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+
+		labels := []string{route, r.Method, strconv.Itoa(status)}
+		metrics.RequestsTotal.WithLabelValues(labels...).Inc()
+		metrics.RequestDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+
+		return err
+	}
+}
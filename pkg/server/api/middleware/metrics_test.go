@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+func TestInstrumentRequests(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", chain.New(func(next chain.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { next(w, r) }
+	}).Add(InstrumentRequests).Resolve(handler))
+
+	counter := metrics.RequestsTotal.WithLabelValues("/instances/{id}", "GET", "404")
+	before := testutil.ToFloat64(counter)
+
+	for _, path := range []string{"/instances/1", "/instances/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, before+2, testutil.ToFloat64(counter))
+}
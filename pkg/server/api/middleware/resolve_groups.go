@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+const AuthGroupsKey key = 5
+
+// ResolveGroups looks up the groups that the authenticated user belongs to,
+// using the group definitions from the server configuration, and stores them
+// in the request context. It must come after Authenticate in the chain.
+func ResolveGroups(groups map[string][]string) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			email, err := GetAuthenticatedUser(r)
+			if err != nil {
+				return err
+			}
+
+			memberships := make([]string, 0)
+			for group, members := range groups {
+				for _, member := range members {
+					if member == email {
+						memberships = append(memberships, group)
+						break
+					}
+				}
+			}
+			sort.Strings(memberships)
+
+			r = r.WithContext(context.WithValue(r.Context(), AuthGroupsKey, memberships))
+			return next(w, r)
+		}
+	}
+}
+
+func GetAuthenticatedGroups(r *http.Request) ([]string, error) {
+	groups, ok := r.Context().Value(AuthGroupsKey).([]string)
+	if !ok {
+		return nil, errors.New("Could not acquire authenticated user's groups")
+	}
+	return groups, nil
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveGroups(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), AuthUserKey, "some_user@domain.org"))
+
+	groups := map[string][]string{
+		"data-team":    {"other_user@domain.org", "some_user@domain.org"},
+		"analytics":    {"some_user@domain.org"},
+		"payments-ops": {"other_user@domain.org"},
+	}
+
+	var resolved []string
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		var err error
+		resolved, err = GetAuthenticatedGroups(r)
+		assert.Nil(t, err)
+		return nil
+	}
+
+	err := ResolveGroups(groups)(handler)(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"analytics", "data-team"}, resolved)
+}
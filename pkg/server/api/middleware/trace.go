@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+	"github.com/gocardless/draupnir/pkg/tracing"
+)
+
+var tracer = otel.Tracer("github.com/gocardless/draupnir/pkg/server/api")
+
+// Trace starts a server span for each request, continuing any trace context
+// propagated by the client. The span is carried in the request's context, so
+// store and executor operations become children of it.
+func Trace(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(
+			ctx,
+			r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.Path),
+			),
+		)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		err := next(recorder, r.WithContext(ctx))
+
+		// An error that hasn't been rendered will end up as a 500
+		status := recorder.status
+		if err != nil && status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		tracing.End(span, err)
+
+		return err
+	}
+}
+
+// annotateSpan adds attributes to the request's span, if it is being traced
+func annotateSpan(r *http.Request, attributes ...attribute.KeyValue) {
+	trace.SpanFromContext(r.Context()).SetAttributes(attributes...)
+}
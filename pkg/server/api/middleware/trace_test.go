@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+func TestTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var handlerSpan trace.SpanContext
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		handlerSpan = trace.SpanContextFromContext(r.Context())
+		return errors.New("something went wrong")
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", chain.New(func(next chain.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { next(w, r) }
+	}).Add(Trace).Resolve(handler))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/instances/1", nil))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+
+	span := spans[0]
+	assert.Equal(t, "DELETE /instances/{id}", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, codes.Error, span.Status().Code)
+	assert.Equal(t, span.SpanContext().SpanID(), handlerSpan.SpanID())
+	assert.Contains(t, span.Attributes(), attribute.String("http.route", "/instances/{id}"))
+	assert.Contains(t, span.Attributes(), attribute.Int("http.status_code", 500))
+}
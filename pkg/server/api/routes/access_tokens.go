@@ -1,17 +1,20 @@
 package routes
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
+	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 	"github.com/google/jsonapi"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 )
@@ -20,13 +23,17 @@ const TOKEN_EXCHANGE_TIMEOUT = time.Second * 5
 const OAUTH_CALLBACK_TIMEOUT = time.Minute
 
 type AccessTokens struct {
-	Callbacks map[string]chan OAuthCallback
-	Client    OAuthClient
-}
-
-type OAuthCallback struct {
-	Token oauth2.Token
-	Error error
+	// Handshakes holds the OAuth flows that clients are waiting on, and the
+	// pending device authorisations, which may be completed by another replica
+	Handshakes store.OAuthHandshakeStore
+	Client     OAuthClient
+	// Sessions exchanges the token from the identity provider for a draupnir
+	// session token, which is what the client receives
+	Sessions SessionCreator
+	// VerificationURL is where users complete device authorisations
+	VerificationURL string
+	// SessionStore ends sessions when users log out
+	SessionStore store.SessionStore
 }
 
 // OAuthClient is the abstract interface for handling OAuth.
@@ -34,7 +41,15 @@ type OAuthCallback struct {
 // will implement this interface
 type OAuthClient interface {
 	AuthCodeURL(string, ...oauth2.AuthCodeOption) string
-	Exchange(context.Context, string) (*oauth2.Token, error)
+	Exchange(context.Context, string, ...oauth2.AuthCodeOption) (*oauth2.Token, error)
+	// Revoke revokes the token with the identity provider
+	Revoke(context.Context, string) error
+}
+
+// SessionCreator starts a session for the user that the identity provider
+// issued the token to, returning a session token
+type SessionCreator interface {
+	Create(context.Context, oauth2.Token) (oauth2.Token, error)
 }
 
 func (a AccessTokens) Authenticate(w http.ResponseWriter, r *http.Request) error {
@@ -49,24 +64,28 @@ func (a AccessTokens) Authenticate(w http.ResponseWriter, r *http.Request) error
 }
 
 type createAccessTokenRequest struct {
-	State string `jsonapi:"attr,state"`
+	State      string `jsonapi:"attr,state"`
+	DeviceCode string `jsonapi:"attr,device_code,omitempty"`
 }
 
 // Create completes the OAuth flow and returns an access token
 //
 // The flow for this is a bit tricky, so it's worth going through.
-// When we receive a request to create an access token, we create a channel and
-// store it in the Callbacks map, keyed by the state parameter provided in the
-// request. We then block on the channel, waiting to receive an OAuthCallback
-// through it.
+// When we receive a request to create an access token, we begin a handshake in
+// the Handshakes store, keyed by the state parameter provided in the request.
+// We then block, waiting for the handshake to be completed.
 // The client will send the user through the OAuth flow, providing the same
 // state parameter. When the user finishes the flow, they'll be redirected to
-// the Callback handler, which is also in this route set.
+// the Callback handler, which is also in this route set, but may be served by
+// another replica.
 // The Callback handler will handle the redirect, exchanging the authorisation
-// code for an access token if it was successful, and will send the outcome
-// through the same channel (looking it up by the state).
-// Create will then receive the result through the channel, remove the channel
-// from the map, and serialise a result back to the client.
+// code for an access token if it was successful, and will complete the
+// handshake with the outcome (looking it up by the state).
+// Create will then collect the outcome from the store, which removes the
+// handshake, and serialise a result back to the client.
+//
+// Clients using the device authorisation flow send a device code instead of a
+// state, and poll until the user has authenticated rather than blocking.
 func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 	var req createAccessTokenRequest
 
@@ -80,13 +99,18 @@ func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	state := req.State
+	if req.DeviceCode != "" {
+		return a.createFromDevice(w, r, req.DeviceCode)
+	}
 
-	callback := make(chan OAuthCallback)
-	a.Callbacks[state] = callback
+	if err := a.Handshakes.Begin(r.Context(), req.State, time.Now().Add(OAUTH_CALLBACK_TIMEOUT)); err != nil {
+		return errors.Wrap(err, "failed to begin oauth handshake")
+	}
 
-	token, err := waitForCallback(callback)
-	delete(a.Callbacks, state)
+	handshake, err := a.Handshakes.Wait(r.Context(), req.State)
+	if err == nil && handshake.Error != "" {
+		err = errors.New(handshake.Error)
+	}
 
 	if err != nil {
 		logger.With("error", err.Error()).Info("oauth request failed")
@@ -94,26 +118,18 @@ func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	return renderAccessToken(w, handshake.Token)
+}
+
+func renderAccessToken(w http.ResponseWriter, token oauth2.Token) error {
 	w.WriteHeader(http.StatusCreated)
-	err = json.NewEncoder(w).Encode(token)
+	err := json.NewEncoder(w).Encode(token)
 	if err != nil {
 		return errors.Wrap(err, "failed to encode access token")
 	}
 	return nil
 }
 
-func waitForCallback(callbackChan chan OAuthCallback) (oauth2.Token, error) {
-	select {
-	case c := <-callbackChan:
-		if c.Error != nil {
-			return oauth2.Token{}, c.Error
-		}
-		return c.Token, nil
-	case <-time.After(OAUTH_CALLBACK_TIMEOUT):
-		return oauth2.Token{}, errors.New("Callback timed out")
-	}
-}
-
 func (a AccessTokens) Callback(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
@@ -126,21 +142,31 @@ func (a AccessTokens) Callback(w http.ResponseWriter, r *http.Request) error {
 	respCode := r.Form.Get("code")
 	state := r.Form.Get("state")
 
-	callback := a.Callbacks[state]
-	if callback == nil {
-		logger.With("state", state).Info("cannot find oauth callback for state")
-		return nil
+	pending, err := a.Handshakes.Pending(r.Context(), state)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up oauth handshake")
+	}
+	if !pending {
+		devicePending, err := a.Handshakes.DevicePending(r.Context(), state)
+		if err != nil {
+			return errors.Wrap(err, "failed to look up device authorisation")
+		}
+		if !devicePending {
+			logger.With("state", state).Info("cannot find oauth callback for state")
+			return nil
+		}
+		return a.deviceCallback(w, r, state, respError, respCode)
 	}
 
 	if respError != "" {
 		err := errors.New(respError)
-		callback <- OAuthCallback{Error: err}
+		a.completeHandshake(logger, models.OAuthHandshake{State: state, Error: err.Error()})
 		return err
 	}
 
 	if respCode == "" {
 		err := fmt.Errorf("OAuth callback response code is empty")
-		callback <- OAuthCallback{Error: err}
+		a.completeHandshake(logger, models.OAuthHandshake{State: state, Error: err.Error()})
 		// TODO: remove this and log the state earlier?
 		logger.With("state", state).Error("empty oauth response code")
 		return err
@@ -149,21 +175,50 @@ func (a AccessTokens) Callback(w http.ResponseWriter, r *http.Request) error {
 	ctx, cancel := context.WithTimeout(r.Context(), TOKEN_EXCHANGE_TIMEOUT)
 	defer cancel()
 
-	token, err := ExchangeAuthCodeForToken(ctx, respCode, a.Client)
+	token, err := a.createSession(ctx, respCode)
 	if err != nil {
-		callback <- OAuthCallback{Error: err}
+		a.completeHandshake(logger, models.OAuthHandshake{State: state, Error: err.Error()})
+		return err
+	}
+
+	if err := a.completeHandshake(logger, models.OAuthHandshake{State: state, Token: token}); err != nil {
 		return err
 	}
 
-	callback <- OAuthCallback{Token: *token}
+	renderCallbackSuccess(w)
+	return nil
+}
+
+// completeHandshake passes the outcome of the OAuth flow to the client waiting
+// on it. This is done even if the callback request has been cancelled, as the
+// client is still waiting.
+func (a AccessTokens) completeHandshake(logger log.Logger, handshake models.OAuthHandshake) error {
+	completed, err := a.Handshakes.Complete(context.Background(), handshake)
+	if err != nil {
+		return errors.Wrap(err, "failed to complete oauth handshake")
+	}
+	if !completed {
+		logger.With("state", handshake.State).Info("oauth handshake expired before it was completed")
+	}
+	return nil
+}
 
+// createSession exchanges the authorisation code for a token from the
+// identity provider, and starts a session with it
+func (a AccessTokens) createSession(ctx context.Context, code string) (oauth2.Token, error) {
+	token, err := ExchangeAuthCodeForToken(ctx, code, a.Client)
+	if err != nil {
+		return oauth2.Token{}, err
+	}
+
+	return a.Sessions.Create(ctx, *token)
+}
+
+func renderCallbackSuccess(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte("<h1>Success!</h1><h3>You can close this tab</h3><script>window.close()</script>"))
-	return nil
 }
 
-// TODO: push token revocation into the oauthClient - right now this code is
-// Google-specific.
 func ExchangeAuthCodeForToken(ctx context.Context, code string, oauthClient OAuthClient) (*oauth2.Token, error) {
 	var token *oauth2.Token
 	token, err := oauthClient.Exchange(ctx, code)
@@ -179,30 +234,60 @@ func ExchangeAuthCodeForToken(ctx context.Context, code string, oauthClient OAut
 	// but you can't use an auth code more than once. Instead, we return an error to the
 	// user and ask them to try authenticating a second time.
 	if token.RefreshToken == "" {
-		path := fmt.Sprintf("https://accounts.google.com/o/oauth2/revoke?token=%s", token.AccessToken)
-		req, err := http.NewRequest("GET", path, strings.NewReader(""))
-
-		if err != nil {
-			err := errors.Wrap(err, "error constructing token revocation request")
-			return token, err
+		if err := oauthClient.Revoke(ctx, token.AccessToken); err != nil {
+			return token, errors.Wrap(err, "existing access token was not revoked")
 		}
+		return token, errors.New("existing token revoked - please try authenticating again")
+	}
+	return token, err
+}
 
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		client := &http.Client{}
-		resp, err := client.Do(req)
+// Destroy logs the user out of the session they authenticated with. The
+// session's token is no longer accepted, and its refresh token is revoked with
+// the identity provider. Instances created in the session are kept while the
+// user has another session, which the cleaner checks in place of this one.
+func (a AccessTokens) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			err := errors.Wrap(err, "error sending token revocation request")
-			return token, err
-		}
+	sessionID, _ := r.Context().Value(middleware.SessionIDKey).(string)
+	if sessionID == "" {
+		api.NotASessionError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	middleware.SetAuditResource(r, sessionID, "")
 
-		if resp.StatusCode != 200 {
-			err := errors.New("existing access token was not revoked")
-			return token, err
-		}
-		return token, errors.New("existing token revoked - please try authenticating again")
+	session, err := a.SessionStore.LogOut(r.Context(), sessionID)
+	if err == sql.ErrNoRows {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke session")
+	}
+
+	revokeRefreshToken(r.Context(), logger, a.Client, session)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// revokeRefreshToken revokes the session's refresh token with the identity
+// provider. The session has already been revoked, so a failure is only logged:
+// not every provider supports revocation.
+func revokeRefreshToken(ctx context.Context, logger log.Logger, client OAuthClient, session models.Session) {
+	if session.RefreshToken == "" {
+		return
+	}
+
+	if err := client.Revoke(ctx, session.RefreshToken); err != nil {
+		logger.
+			With("session", session.ID).
+			With("error", err.Error()).
+			Info("failed to revoke refresh token with identity provider")
 	}
-	return token, err
 }
 
 func OauthErrorRenderer(next chain.Handler) chain.Handler {
@@ -2,13 +2,20 @@ package routes
 
 import (
 	"bytes"
+	"database/sql"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 
@@ -20,8 +27,8 @@ func TestAuthenticate(t *testing.T) {
 	req, recorder, _ := createRequest(t, "GET", "/authenticate?state=foo", nil)
 
 	routeSet := AccessTokens{
-		Callbacks: make(map[string]chan OAuthCallback),
-		Client:    auth.FakeOauthConfig(),
+		Handshakes: store.NewMemoryOAuthHandshakeStore(),
+		Client:     auth.FakeOIDCClient(),
 	}
 
 	errorHandler := FakeErrorHandler{}
@@ -54,9 +61,7 @@ func TestCallback(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	handshakes := beginHandshake(t, state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -67,7 +72,7 @@ func TestCallback(t *testing.T) {
 
 	errorHandler := FakeErrorHandler{}
 
-	routeSet := AccessTokens{Callbacks: callbacks, Client: &oauthClient}
+	routeSet := AccessTokens{Handshakes: handshakes, Client: &oauthClient, Sessions: FakeSessions{}}
 
 	router := mux.NewRouter()
 	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
@@ -85,12 +90,10 @@ func TestCallback(t *testing.T) {
 	assert.Empty(t, logs.String())
 	assert.Nil(t, errorHandler.Error)
 
-	select {
-	case result := <-callback:
-		assert.Equal(t, OAuthCallback{Token: oauth2.Token{RefreshToken: "the-access-token"}, Error: nil}, result)
-	default:
-		t.Fatal("Received nothing in channel")
-	}
+	result := completedHandshake(t, handshakes, state)
+	assert.Empty(t, result.Error)
+	assert.Equal(t, "session-for-the-access-token", result.Token.AccessToken)
+	assert.Empty(t, result.Token.RefreshToken)
 }
 
 func TestCallbackWithResponseError(t *testing.T) {
@@ -102,13 +105,11 @@ func TestCallbackWithResponseError(t *testing.T) {
 
 	req, recorder, _ := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	handshakes := beginHandshake(t, state)
 
 	errorHandler := FakeErrorHandler{}
 
-	routeSet := AccessTokens{Callbacks: callbacks}
+	routeSet := AccessTokens{Handshakes: handshakes}
 	router := mux.NewRouter()
 	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
 	router.ServeHTTP(recorder, req)
@@ -123,13 +124,8 @@ func TestCallbackWithResponseError(t *testing.T) {
 	assert.Empty(t, responseBody.String())
 	assert.Equal(t, "some_error", errorHandler.Error.Error())
 
-	select {
-	case result := <-callback:
-		err := result.Error
-		assert.Equal(t, _error, err.Error())
-	default:
-		t.Fatal("Received nothing in channel")
-	}
+	result := completedHandshake(t, handshakes, state)
+	assert.Equal(t, _error, result.Error)
 }
 
 func TestCallbackWithEmptyResponseCode(t *testing.T) {
@@ -141,13 +137,11 @@ func TestCallbackWithEmptyResponseCode(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	handshakes := beginHandshake(t, state)
 
 	errorHandler := FakeErrorHandler{}
 
-	routeSet := AccessTokens{Callbacks: callbacks}
+	routeSet := AccessTokens{Handshakes: handshakes}
 	router := mux.NewRouter()
 	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
 	router.ServeHTTP(recorder, req)
@@ -163,13 +157,8 @@ func TestCallbackWithEmptyResponseCode(t *testing.T) {
 	assert.Contains(t, logs.String(), "msg=\"empty oauth response code\"")
 	assert.Equal(t, "OAuth callback response code is empty", errorHandler.Error.Error())
 
-	select {
-	case result := <-callback:
-		err := result.Error
-		assert.Equal(t, "OAuth callback response code is empty", err.Error())
-	default:
-		t.Fatal("Received nothing in channel")
-	}
+	result := completedHandshake(t, handshakes, state)
+	assert.Equal(t, "OAuth callback response code is empty", result.Error)
 }
 
 func TestCallbackWithFailedTokenExchange(t *testing.T) {
@@ -181,9 +170,7 @@ func TestCallbackWithFailedTokenExchange(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	handshakes := beginHandshake(t, state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -194,7 +181,7 @@ func TestCallbackWithFailedTokenExchange(t *testing.T) {
 
 	errorHandler := FakeErrorHandler{}
 
-	routeSet := AccessTokens{Callbacks: callbacks, Client: &oauthClient}
+	routeSet := AccessTokens{Handshakes: handshakes, Client: &oauthClient}
 	router := mux.NewRouter()
 	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
 	router.ServeHTTP(recorder, req)
@@ -210,13 +197,33 @@ func TestCallbackWithFailedTokenExchange(t *testing.T) {
 	assert.Empty(t, logs.String())
 	assert.Equal(t, "token exchange error: token exchange failed", errorHandler.Error.Error())
 
-	select {
-	case result := <-callback:
-		err := result.Error
-		assert.Equal(t, "token exchange error: token exchange failed", err.Error())
-	default:
-		t.Fatal("Received nothing in channel")
+	result := completedHandshake(t, handshakes, state)
+	assert.Equal(t, "token exchange error: token exchange failed", result.Error)
+}
+
+func TestExchangeAuthCodeForTokenWithoutRefreshToken(t *testing.T) {
+	var revoked string
+	oauthClient := auth.FakeOAuthClient{
+		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
+			return &oauth2.Token{AccessToken: "the-access-token"}, nil
+		},
+		MockRevoke: func(ctx context.Context, token string) error {
+			revoked = token
+			return nil
+		},
+	}
+
+	_, err := ExchangeAuthCodeForToken(context.Background(), "some_code", &oauthClient)
+
+	assert.Equal(t, "existing token revoked - please try authenticating again", err.Error())
+	assert.Equal(t, "the-access-token", revoked)
+
+	oauthClient.MockRevoke = func(ctx context.Context, token string) error {
+		return errors.New("revocation failed")
 	}
+	_, err = ExchangeAuthCodeForToken(context.Background(), "some_code", &oauthClient)
+
+	assert.Equal(t, "existing access token was not revoked: revocation failed", err.Error())
 }
 
 func TestCallbackWithTimedOutTokenExchange(t *testing.T) {
@@ -232,9 +239,7 @@ func TestCallbackWithTimedOutTokenExchange(t *testing.T) {
 	ctx, _ := context.WithTimeout(req.Context(), 0)
 	req = req.WithContext(ctx)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	handshakes := beginHandshake(t, state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -248,7 +253,7 @@ func TestCallbackWithTimedOutTokenExchange(t *testing.T) {
 
 	errorHandler := FakeErrorHandler{}
 
-	routeSet := AccessTokens{Callbacks: callbacks, Client: &oauthClient}
+	routeSet := AccessTokens{Handshakes: handshakes, Client: &oauthClient}
 	router := mux.NewRouter()
 	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
 	router.ServeHTTP(recorder, req)
@@ -264,13 +269,197 @@ func TestCallbackWithTimedOutTokenExchange(t *testing.T) {
 	assert.Empty(t, logs.String())
 	assert.Equal(t, errorHandler.Error.Error(), "token exchange error: timeout")
 
-	select {
-	case result := <-callback:
-		err := result.Error
-		assert.Equal(t, "token exchange error: timeout", err.Error())
-	default:
-		t.Fatal("Received nothing in channel")
+	result := completedHandshake(t, handshakes, state)
+	assert.Equal(t, "token exchange error: timeout", result.Error)
+}
+
+func TestCreate(t *testing.T) {
+	state := "foo"
+	handshakes := store.NewMemoryOAuthHandshakeStore()
+	routeSet := AccessTokens{Handshakes: handshakes}
+
+	// Complete the handshake as the callback would, once the client is waiting
+	go func() {
+		for {
+			completed, _ := handshakes.Complete(context.Background(), models.OAuthHandshake{
+				State: state,
+				Token: oauth2.Token{AccessToken: "the-session-token"},
+			})
+			if completed {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &createAccessTokenRequest{State: state})
+	req, recorder, _ := createRequest(t, "POST", "/access_tokens", body)
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/access_tokens", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	var token oauth2.Token
+	decodeJSON(t, recorder.Body, &token)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "the-session-token", token.AccessToken)
+	assert.Nil(t, errorHandler.Error)
+
+	// The handshake is removed once it's been collected
+	pending, _ := handshakes.Pending(context.Background(), state)
+	assert.False(t, pending)
+	_, err := handshakes.Wait(context.Background(), state)
+	assert.Equal(t, store.ErrOAuthHandshakeNotFound, err)
+}
+
+func TestCreateWithFailedHandshake(t *testing.T) {
+	state := "foo"
+	handshakes := store.NewMemoryOAuthHandshakeStore()
+	routeSet := AccessTokens{Handshakes: handshakes}
+
+	go func() {
+		for {
+			completed, _ := handshakes.Complete(context.Background(), models.OAuthHandshake{
+				State: state,
+				Error: "access_denied",
+			})
+			if completed {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &createAccessTokenRequest{State: state})
+	req, recorder, logs := createRequest(t, "POST", "/access_tokens", body)
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/access_tokens", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, logs.String(), "access_denied")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestCallbackWithUnknownState(t *testing.T) {
+	req, recorder, logs := createRequest(t, "GET", oauthCallbackPath("foo", "some_code", ""), nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := AccessTokens{Handshakes: store.NewMemoryOAuthHandshakeStore()}
+	router := mux.NewRouter()
+	router.HandleFunc("/oauth_callback", errorHandler.Handle(routeSet.Callback))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, logs.String(), "cannot find oauth callback for state")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestDestroyAccessToken(t *testing.T) {
+	req, recorder, logs := createRequest(t, "DELETE", "/access_tokens/current", nil)
+
+	var revokedToken string
+	routeSet := AccessTokens{
+		Client: &auth.FakeOAuthClient{
+			MockRevoke: func(ctx context.Context, token string) error {
+				revokedToken = token
+				return nil
+			},
+		},
+		SessionStore: FakeSessionStore{
+			_LogOut: func(id string) (models.Session, error) {
+				assert.Equal(t, "session-id", id)
+				return models.Session{ID: id, RefreshToken: "the-refresh-token", RevocationReason: "logged out"}, nil
+			},
+		},
+	}
+
+	err := routeSet.Destroy(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "the-refresh-token", revokedToken)
+	assert.Empty(t, logs.String())
+}
+
+func TestDestroyAccessTokenWhenRevocationFails(t *testing.T) {
+	req, recorder, logs := createRequest(t, "DELETE", "/access_tokens/current", nil)
+
+	routeSet := AccessTokens{
+		Client: &auth.FakeOAuthClient{
+			MockRevoke: func(ctx context.Context, token string) error {
+				return errors.New("the identity provider doesn't support token revocation")
+			},
+		},
+		SessionStore: FakeSessionStore{
+			_LogOut: func(id string) (models.Session, error) {
+				return models.Session{ID: id, RefreshToken: "the-refresh-token"}, nil
+			},
+		},
+	}
+
+	err := routeSet.Destroy(recorder, req)
+
+	// The session is still ended
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Contains(t, logs.String(), "failed to revoke refresh token with identity provider")
+}
+
+func TestDestroyAccessTokenWhenAlreadyRevoked(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/access_tokens/current", nil)
+
+	routeSet := AccessTokens{
+		SessionStore: FakeSessionStore{
+			_LogOut: func(id string) (models.Session, error) {
+				return models.Session{}, sql.ErrNoRows
+			},
+		},
+	}
+
+	err := routeSet.Destroy(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestDestroyAccessTokenWithoutSession(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/access_tokens/current", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.SessionIDKey, ""))
+
+	err := AccessTokens{}.Destroy(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.NotASessionError, decodeAPIError(t, recorder.Body))
+}
+
+// beginHandshake returns a store in which a client is waiting on the state
+func beginHandshake(t *testing.T, state string) store.OAuthHandshakeStore {
+	handshakes := store.NewMemoryOAuthHandshakeStore()
+	if err := handshakes.Begin(context.Background(), state, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	return handshakes
+}
+
+// completedHandshake collects the handshake, failing if the callback didn't
+// complete it
+func completedHandshake(t *testing.T, handshakes store.OAuthHandshakeStore, state string) models.OAuthHandshake {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	handshake, err := handshakes.Wait(ctx, state)
+	if err != nil {
+		t.Fatalf("handshake wasn't completed: %s", err)
 	}
+	return handshake
 }
 
 func oauthCallbackPath(state string, code string, _error string) string {
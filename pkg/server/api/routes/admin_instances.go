@@ -0,0 +1,237 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+)
+
+// diskUsageConcurrency bounds how many instances' disk usage is measured at
+// once when listing every instance
+const diskUsageConcurrency = 8
+
+// AdminInstances is the admin route set for viewing and managing every user's
+// instances.
+type AdminInstances struct {
+	InstanceStore            store.InstanceStore
+	InstanceDestructionStore store.InstanceDestructionStore
+	ApplyWhitelist           func(string)
+	Executor                 exec.Executor
+}
+
+type DestroyInstanceRequest struct {
+	Reason string `jsonapi:"attr,reason"`
+}
+
+type ReassignInstanceRequest struct {
+	UserEmail string `jsonapi:"attr,user_email"`
+}
+
+func (a AdminInstances) List(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	instances, err := a.InstanceStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+
+	// Measuring an instance runs a script, so instances are measured in
+	// parallel, a few at a time
+	summaries := make([]*models.InstanceSummary, len(instances))
+	slots := make(chan struct{}, diskUsageConcurrency)
+	var wg sync.WaitGroup
+	for idx, instance := range instances {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(idx int, instance models.Instance) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			// A failure to measure one instance shouldn't prevent an operator
+			// from seeing the rest
+			usage, err := a.Executor.InstanceDiskUsage(r.Context(), instance.ID)
+			if err != nil {
+				logger.With("instance", instance.ID).Info(err.Error())
+				usage = -1
+			}
+
+			summary := models.NewInstanceSummary(instance, usage)
+			summaries[idx] = &summary
+		}(idx, instance)
+	}
+	wg.Wait()
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, summaries),
+		"failed to marshal instances",
+	)
+}
+
+func (a AdminInstances) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	instance, found := a.getInstance(w, r, logger)
+	if !found {
+		return nil
+	}
+
+	req := DestroyInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.Reason == "" {
+		api.MissingReasonError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	middleware.SetAuditResource(r, strconv.Itoa(instance.ID), req.Reason)
+
+	if err := a.destroy(r, logger, instance, email, req.Reason); err != nil {
+		return err
+	}
+
+	a.ApplyWhitelist("api")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// destroy records who destroyed the instance and why, then destroys it. The
+// destruction is recorded first, so that the reason is never lost for an
+// instance that has been destroyed.
+func (a AdminInstances) destroy(r *http.Request, logger log.Logger, instance models.Instance, destroyedBy, reason string) error {
+	logger.
+		With("instance", instance.ID).
+		With("owner", instance.UserEmail).
+		With("reason", reason).
+		Info("destroying instance")
+
+	destruction := models.NewInstanceDestruction(instance, destroyedBy, reason)
+	_, err := a.InstanceDestructionStore.Create(r.Context(), destruction)
+	if err != nil {
+		return errors.Wrap(err, "failed to record instance destruction")
+	}
+
+	err = a.Executor.DestroyInstance(r.Context(), instance.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to destroy instance on disk")
+	}
+
+	err = a.InstanceStore.Destroy(r.Context(), instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove instance from table")
+	}
+
+	return nil
+}
+
+func (a AdminInstances) Reassign(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	instance, found := a.getInstance(w, r, logger)
+	if !found {
+		return nil
+	}
+
+	req := ReassignInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.UserEmail == "" {
+		api.MissingUserEmailError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	middleware.SetAuditResource(
+		r, strconv.Itoa(instance.ID), fmt.Sprintf("from %s to %s", instance.UserEmail, req.UserEmail),
+	)
+
+	previousOwner := instance.UserEmail
+	instance, err = a.InstanceStore.UpdateOwner(r.Context(), instance, req.UserEmail)
+	if err != nil {
+		return errors.Wrap(err, "failed to reassign instance")
+	}
+
+	logger.
+		With("instance", instance.ID).
+		With("from", previousOwner).
+		With("to", instance.UserEmail).
+		Info("reassigned instance")
+
+	usage, err := a.Executor.InstanceDiskUsage(r.Context(), instance.ID)
+	if err != nil {
+		logger.With("instance", instance.ID).Info(err.Error())
+		usage = -1
+	}
+
+	summary := models.NewInstanceSummary(instance, usage)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &summary),
+		"failed to marshal instance",
+	)
+}
+
+func (a AdminInstances) ListDestructions(w http.ResponseWriter, r *http.Request) error {
+	destructions, err := a.InstanceDestructionStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get instance destructions")
+	}
+
+	_destructions := make([]*models.InstanceDestruction, 0)
+	for idx := range destructions {
+		_destructions = append(_destructions, &destructions[idx])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _destructions),
+		"failed to marshal instance destructions",
+	)
+}
+
+func (a AdminInstances) getInstance(w http.ResponseWriter, r *http.Request, logger log.Logger) (models.Instance, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.Instance{}, false
+	}
+
+	instance, err := a.InstanceStore.Get(r.Context(), id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.Instance{}, false
+	}
+
+	return instance, true
+}
@@ -0,0 +1,243 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminInstanceList(t *testing.T) {
+	req, recorder, logs := createRequest(t, "GET", "/admin/instances", nil)
+
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				models.Instance{ID: 1, ImageID: 1, Port: 5432, CreatedAt: timestamp(), UserEmail: "test@draupnir"},
+				models.Instance{ID: 2, ImageID: 1, Port: 5433, CreatedAt: timestamp(), UserEmail: "otheruser@draupnir"},
+			}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InstanceDiskUsage: func(ctx context.Context, id int) (int64, error) {
+			if id == 2 {
+				return 0, errors.New("no such subvolume")
+			}
+			return 1048576, nil
+		},
+	}
+
+	routeSet := AdminInstances{InstanceStore: store, Executor: executor}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	payload, err := jsonapi.UnmarshalManyPayload(recorder.Body, reflect.TypeOf(&models.InstanceSummary{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(payload))
+
+	first := payload[0].(*models.InstanceSummary)
+	assert.Equal(t, "test@draupnir", first.UserEmail)
+	assert.Equal(t, int64(1048576), first.DiskUsage)
+
+	second := payload[1].(*models.InstanceSummary)
+	assert.Equal(t, "otheruser@draupnir", second.UserEmail)
+	assert.Equal(t, int64(-1), second.DiskUsage)
+	assert.Contains(t, logs.String(), "no such subvolume")
+}
+
+func TestAdminInstanceListMeasuresEveryInstance(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/instances", nil)
+
+	instances := make([]models.Instance, 0)
+	for id := 1; id <= 3*diskUsageConcurrency; id++ {
+		instances = append(instances, models.Instance{ID: id, ImageID: 1, CreatedAt: timestamp(), UserEmail: "test@draupnir"})
+	}
+	store := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) { return instances, nil },
+	}
+
+	executor := FakeExecutor{
+		_InstanceDiskUsage: func(ctx context.Context, id int) (int64, error) {
+			return int64(id * 1024), nil
+		},
+	}
+
+	routeSet := AdminInstances{InstanceStore: store, Executor: executor}
+	err := routeSet.List(recorder, req)
+	assert.Nil(t, err)
+
+	payload, err := jsonapi.UnmarshalManyPayload(recorder.Body, reflect.TypeOf(&models.InstanceSummary{}))
+	assert.Nil(t, err)
+	assert.Equal(t, len(instances), len(payload))
+
+	// Summaries are in the same order as the instances, whichever order they
+	// were measured in
+	for idx, item := range payload {
+		summary := item.(*models.InstanceSummary)
+		assert.Equal(t, int64((idx+1)*1024), summary.DiskUsage)
+	}
+}
+
+func TestAdminInstanceDestroyRecordsReason(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := DestroyInstanceRequest{Reason: "disk full"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/instances/1/destroy", body)
+
+	destroyed := false
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 3, UserEmail: "otheruser@draupnir"}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			destroyed = true
+			return nil
+		},
+	}
+
+	var recorded models.InstanceDestruction
+	destructionStore := FakeInstanceDestructionStore{
+		_Create: func(destruction models.InstanceDestruction) (models.InstanceDestruction, error) {
+			recorded = destruction
+			return destruction, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, id int) error {
+			assert.Equal(t, 1, id)
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := AdminInstances{
+		InstanceStore:            store,
+		InstanceDestructionStore: destructionStore,
+		ApplyWhitelist:           func(string) {},
+		Executor:                 executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/instances/{id}/destroy", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.True(t, destroyed)
+	assert.Equal(t, 1, recorded.InstanceID)
+	assert.Equal(t, 3, recorded.ImageID)
+	assert.Equal(t, "otheruser@draupnir", recorded.UserEmail)
+	assert.Equal(t, "test@draupnir", recorded.DestroyedBy)
+	assert.Equal(t, "disk full", recorded.Reason)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestAdminInstanceDestroyNotRecorded(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := DestroyInstanceRequest{Reason: "disk full"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/instances/1/destroy", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 3, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	destructionStore := FakeInstanceDestructionStore{
+		_Create: func(destruction models.InstanceDestruction) (models.InstanceDestruction, error) {
+			return destruction, errors.New("database unavailable")
+		},
+	}
+
+	// The instance isn't destroyed unless its destruction has been recorded, so
+	// neither the executor nor the store is called
+	errorHandler := FakeErrorHandler{}
+	routeSet := AdminInstances{
+		InstanceStore:            store,
+		InstanceDestructionStore: destructionStore,
+		Executor:                 FakeExecutor{},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/instances/{id}/destroy", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	assert.EqualError(t, errorHandler.Error, "failed to record instance destruction: database unavailable")
+}
+
+func TestAdminInstanceDestroyWithoutReason(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := DestroyInstanceRequest{}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/instances/1/destroy", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := AdminInstances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/instances/{id}/destroy", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.MissingReasonError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestAdminInstanceReassign(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := ReassignInstanceRequest{UserEmail: "newowner@draupnir"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "POST", "/admin/instances/1/reassign", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir", SessionID: "session-id"}, nil
+		},
+		_UpdateOwner: func(instance models.Instance, email string) (models.Instance, error) {
+			assert.Equal(t, "newowner@draupnir", email)
+			instance.UserEmail = email
+			instance.SessionID = ""
+			return instance, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InstanceDiskUsage: func(ctx context.Context, id int) (int64, error) {
+			return 4096, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := AdminInstances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/instances/{id}/reassign", errorHandler.Handle(routeSet.Reassign))
+	router.ServeHTTP(recorder, req)
+
+	var response models.InstanceSummary
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "newowner@draupnir", response.UserEmail)
+	assert.Equal(t, int64(4096), response.DiskUsage)
+	assert.Contains(t, logs.String(), "reassigned instance")
+	assert.Nil(t, errorHandler.Error)
+}
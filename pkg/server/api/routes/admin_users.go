@@ -0,0 +1,155 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+// AdminUsers is the admin route set for ending a user's access, e.g. when they
+// leave, without waiting for the cleaner to notice.
+type AdminUsers struct {
+	SessionStore store.SessionStore
+	Client       OAuthClient
+	Instances    AdminInstances
+}
+
+const (
+	// DestroyInstances destroys the user's instances along with their sessions
+	DestroyInstances = "destroy"
+	// ReassignInstances transfers the user's instances to another user
+	ReassignInstances = "reassign"
+)
+
+type RevokeSessionsRequest struct {
+	Reason string `jsonapi:"attr,reason"`
+	// Instances is what's done with the user's instances straight away:
+	// DestroyInstances or ReassignInstances. If it's empty, the instances
+	// created in the revoked sessions are destroyed by the cleaner.
+	Instances  string `jsonapi:"attr,instances,omitempty"`
+	ReassignTo string `jsonapi:"attr,reassign_to,omitempty"`
+}
+
+// RevokeSessions revokes every session of the user, and their refresh tokens
+// with the identity provider, then destroys or reassigns their instances if
+// asked to
+func (a AdminUsers) RevokeSessions(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	actor, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	email := mux.Vars(r)["email"]
+
+	req := RevokeSessionsRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if !validRevokeSessionsRequest(req) {
+		api.InvalidSessionRevocationError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	// Destroying and reassigning instances needs the same permission as doing
+	// so one instance at a time
+	if req.Instances != "" && !middleware.HasPermission(r, auth.PermissionManageAllInstances) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	detail := req.Reason
+	if req.Instances != "" {
+		detail = fmt.Sprintf("%s, instances: %s", req.Reason, req.Instances)
+	}
+	middleware.SetAuditResource(r, email, detail)
+
+	sessions, err := a.SessionStore.RevokeUser(r.Context(), email, req.Reason)
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke sessions")
+	}
+
+	for _, session := range sessions {
+		revokeRefreshToken(r.Context(), logger, a.Client, session)
+	}
+
+	logger.
+		With("user", email).
+		With("sessions", len(sessions)).
+		With("reason", req.Reason).
+		Info("revoked sessions")
+
+	revocation := models.SessionRevocation{ID: email, RevokedSessions: len(sessions)}
+
+	if req.Instances != "" {
+		instances, err := a.Instances.InstanceStore.List(r.Context())
+		if err != nil {
+			return errors.Wrap(err, "failed to get instances")
+		}
+
+		for _, instance := range instances {
+			if instance.UserEmail != email {
+				continue
+			}
+
+			id := strconv.Itoa(instance.ID)
+			switch req.Instances {
+			case DestroyInstances:
+				if err := a.Instances.destroy(r, logger, instance, actor, req.Reason); err != nil {
+					return err
+				}
+				middleware.AddAuditEvent(r, "instance.destroy", "instance", id, req.Reason)
+				revocation.DestroyedInstances++
+			case ReassignInstances:
+				if _, err := a.Instances.InstanceStore.UpdateOwner(r.Context(), instance, req.ReassignTo); err != nil {
+					return errors.Wrap(err, "failed to reassign instance")
+				}
+				middleware.AddAuditEvent(
+					r, "instance.reassign", "instance", id, fmt.Sprintf("from %s to %s", email, req.ReassignTo),
+				)
+				revocation.ReassignedInstances++
+			}
+		}
+
+		if revocation.DestroyedInstances > 0 {
+			a.Instances.ApplyWhitelist("api")
+		}
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &revocation),
+		"failed to marshal session revocation",
+	)
+}
+
+func validRevokeSessionsRequest(req RevokeSessionsRequest) bool {
+	if req.Reason == "" {
+		return false
+	}
+
+	switch req.Instances {
+	case "", DestroyInstances:
+		return req.ReassignTo == ""
+	case ReassignInstances:
+		return req.ReassignTo != ""
+	default:
+		return false
+	}
+}
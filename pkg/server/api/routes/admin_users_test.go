@@ -0,0 +1,181 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// revokeSessions requests that every session of otheruser@draupnir is revoked
+func revokeSessions(t *testing.T, routeSet AdminUsers, request RevokeSessionsRequest, admin bool) (*bytes.Buffer, int, error) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/users/otheruser@draupnir/revoke_sessions", body)
+	if admin {
+		req = asAdmin(req)
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/users/{email}/revoke_sessions", errorHandler.Handle(routeSet.RevokeSessions))
+	router.ServeHTTP(recorder, req)
+
+	return recorder.Body, recorder.Code, errorHandler.Error
+}
+
+func newAdminUserRouteSet(t *testing.T, revokedTokens *[]string) AdminUsers {
+	return AdminUsers{
+		SessionStore: FakeSessionStore{
+			_RevokeUser: func(email string, reason string) ([]models.Session, error) {
+				assert.Equal(t, "otheruser@draupnir", email)
+				return []models.Session{
+					{ID: "abc", UserEmail: email, RefreshToken: "first-refresh-token", RevocationReason: reason},
+					{ID: "def", UserEmail: email, RefreshToken: "second-refresh-token", RevocationReason: reason},
+				}, nil
+			},
+		},
+		Client: &auth.FakeOAuthClient{
+			MockRevoke: func(ctx context.Context, token string) error {
+				*revokedTokens = append(*revokedTokens, token)
+				return nil
+			},
+		},
+		Instances: AdminInstances{
+			InstanceStore: FakeInstanceStore{
+				_List: func() ([]models.Instance, error) {
+					return []models.Instance{
+						{ID: 1, ImageID: 3, UserEmail: "otheruser@draupnir", SessionID: "abc"},
+						{ID: 2, ImageID: 3, UserEmail: "test@draupnir", SessionID: "ghi"},
+						{ID: 3, ImageID: 3, UserEmail: "otheruser@draupnir"},
+					}, nil
+				},
+			},
+			ApplyWhitelist: func(string) {},
+		},
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	var revokedTokens []string
+	routeSet := newAdminUserRouteSet(t, &revokedTokens)
+
+	body, code, err := revokeSessions(t, routeSet, RevokeSessionsRequest{Reason: "left the company"}, true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	var revocation models.SessionRevocation
+	assert.Nil(t, jsonapi.UnmarshalPayload(body, &revocation))
+	assert.Equal(t, "otheruser@draupnir", revocation.ID)
+	assert.Equal(t, 2, revocation.RevokedSessions)
+	assert.Equal(t, 0, revocation.DestroyedInstances)
+
+	assert.Equal(t, []string{"first-refresh-token", "second-refresh-token"}, revokedTokens)
+}
+
+func TestRevokeSessionsDestroyingInstances(t *testing.T) {
+	var revokedTokens []string
+	routeSet := newAdminUserRouteSet(t, &revokedTokens)
+
+	var destroyed []int
+	var recorded []models.InstanceDestruction
+	routeSet.Instances.Executor = FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, id int) error {
+			return nil
+		},
+	}
+	instances := routeSet.Instances.InstanceStore.(FakeInstanceStore)
+	instances._Destroy = func(instance models.Instance) error {
+		destroyed = append(destroyed, instance.ID)
+		return nil
+	}
+	routeSet.Instances.InstanceStore = instances
+	routeSet.Instances.InstanceDestructionStore = FakeInstanceDestructionStore{
+		_Create: func(destruction models.InstanceDestruction) (models.InstanceDestruction, error) {
+			recorded = append(recorded, destruction)
+			return destruction, nil
+		},
+	}
+
+	request := RevokeSessionsRequest{Reason: "left the company", Instances: DestroyInstances}
+	body, code, err := revokeSessions(t, routeSet, request, true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	var revocation models.SessionRevocation
+	assert.Nil(t, jsonapi.UnmarshalPayload(body, &revocation))
+	assert.Equal(t, 2, revocation.DestroyedInstances)
+
+	// Only the user's instances are destroyed, including those created before
+	// sessions were recorded against them
+	assert.Equal(t, []int{1, 3}, destroyed)
+	assert.Equal(t, 2, len(recorded))
+	assert.Equal(t, "test@draupnir", recorded[0].DestroyedBy)
+	assert.Equal(t, "left the company", recorded[0].Reason)
+}
+
+func TestRevokeSessionsReassigningInstances(t *testing.T) {
+	var revokedTokens []string
+	routeSet := newAdminUserRouteSet(t, &revokedTokens)
+
+	var reassigned []int
+	instances := routeSet.Instances.InstanceStore.(FakeInstanceStore)
+	instances._UpdateOwner = func(instance models.Instance, email string) (models.Instance, error) {
+		assert.Equal(t, "manager@draupnir", email)
+		reassigned = append(reassigned, instance.ID)
+		instance.UserEmail = email
+		return instance, nil
+	}
+	routeSet.Instances.InstanceStore = instances
+
+	request := RevokeSessionsRequest{Reason: "left the company", Instances: ReassignInstances, ReassignTo: "manager@draupnir"}
+	body, code, err := revokeSessions(t, routeSet, request, true)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, code)
+
+	var revocation models.SessionRevocation
+	assert.Nil(t, jsonapi.UnmarshalPayload(body, &revocation))
+	assert.Equal(t, 2, revocation.ReassignedInstances)
+	assert.Equal(t, []int{1, 3}, reassigned)
+}
+
+func TestRevokeSessionsWithInvalidRequest(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request RevokeSessionsRequest
+	}{
+		{"without a reason", RevokeSessionsRequest{Instances: DestroyInstances}},
+		{"with an unknown instances option", RevokeSessionsRequest{Reason: "left", Instances: "keep"}},
+		{"reassigning without a new owner", RevokeSessionsRequest{Reason: "left", Instances: ReassignInstances}},
+		{"destroying with a new owner", RevokeSessionsRequest{Reason: "left", Instances: DestroyInstances, ReassignTo: "manager@draupnir"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, code, err := revokeSessions(t, AdminUsers{}, tc.request, true)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, code)
+			assert.Equal(t, api.InvalidSessionRevocationError, decodeAPIError(t, body))
+		})
+	}
+}
+
+func TestRevokeSessionsDestroyingInstancesRequiresPermission(t *testing.T) {
+	// The session store would panic if the sessions were revoked
+	request := RevokeSessionsRequest{Reason: "left the company", Instances: DestroyInstances}
+	_, code, err := revokeSessions(t, AdminUsers{SessionStore: FakeSessionStore{}}, request, false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, code)
+}
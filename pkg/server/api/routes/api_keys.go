@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+// APIKeys is the admin route set for managing the API keys that automated
+// clients authenticate with
+type APIKeys struct {
+	APIKeyStore store.APIKeyStore
+}
+
+type CreateAPIKeyRequest struct {
+	Description string     `jsonapi:"attr,description"`
+	Scopes      []string   `jsonapi:"attr,scopes"`
+	ExpiresAt   *time.Time `jsonapi:"attr,expires_at,iso8601,omitempty"`
+}
+
+func (a APIKeys) List(w http.ResponseWriter, r *http.Request) error {
+	keys, err := a.APIKeyStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get API keys")
+	}
+
+	_keys := make([]*models.APIKey, 0)
+	for idx := range keys {
+		_keys = append(_keys, &keys[idx])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _keys),
+		"failed to marshal API keys",
+	)
+}
+
+// Create generates a new API key. The key is only ever included in this
+// response: the server keeps just its hash.
+func (a APIKeys) Create(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	req := CreateAPIKeyRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if !validAPIKeyRequest(req) {
+		api.InvalidAPIKeyError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	key, keyHash, err := auth.GenerateAPIKey()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate API key")
+	}
+
+	apiKey, err := a.APIKeyStore.Create(r.Context(), models.NewAPIKey(req.Description, req.Scopes, req.ExpiresAt, email, keyHash))
+	if err != nil {
+		return errors.Wrap(err, "failed to create API key")
+	}
+
+	middleware.SetAuditResource(r, strconv.Itoa(apiKey.ID), strings.Join(apiKey.Scopes, ", "))
+	logger.With("api_key", apiKey.ID).With("scopes", apiKey.Scopes).Info("created API key")
+
+	apiKey.Key = key
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &apiKey),
+		"failed to marshal API key",
+	)
+}
+
+func (a APIKeys) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	middleware.SetAuditResource(r, strconv.Itoa(id), "")
+
+	if _, err := a.APIKeyStore.Get(r.Context(), id); err == sql.ErrNoRows {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get API key")
+	}
+
+	if err := a.APIKeyStore.Revoke(r.Context(), id); err != nil {
+		return errors.Wrap(err, "failed to revoke API key")
+	}
+
+	logger.With("api_key", id).Info("revoked API key")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// validAPIKeyRequest reports whether the key has a description and one or more
+// known scopes, and hasn't already expired
+func validAPIKeyRequest(req CreateAPIKeyRequest) bool {
+	if strings.TrimSpace(req.Description) == "" || len(req.Scopes) == 0 {
+		return false
+	}
+
+	for _, scope := range req.Scopes {
+		if _, err := auth.ParseScope(scope); err != nil {
+			return false
+		}
+	}
+
+	return req.ExpiresAt == nil || req.ExpiresAt.After(time.Now())
+}
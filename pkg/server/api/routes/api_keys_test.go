@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateAPIKeyRequest{Description: "backups", Scopes: []string{"images:write"}}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "POST", "/admin/api_keys", body)
+
+	var stored models.APIKey
+	store := FakeAPIKeyStore{
+		_Create: func(key models.APIKey) (models.APIKey, error) {
+			assert.Equal(t, "backups", key.Description)
+			assert.Equal(t, []string{"images:write"}, key.Scopes)
+			assert.Equal(t, "test@draupnir", key.CreatedBy)
+			assert.Nil(t, key.ExpiresAt)
+			assert.Empty(t, key.Key)
+			key.ID = 1
+			stored = key
+			return key, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := APIKeys{APIKeyStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/api_keys", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	var response models.APIKey
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, 1, response.ID)
+	assert.True(t, auth.IsAPIKey(response.Key))
+	assert.Equal(t, auth.HashAPIKey(response.Key), stored.KeyHash)
+	assert.Contains(t, logs.String(), "created API key")
+	assert.NotContains(t, logs.String(), response.Key)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestCreateInvalidAPIKey(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+
+	testCases := []struct {
+		name    string
+		request CreateAPIKeyRequest
+	}{
+		{"without a description", CreateAPIKeyRequest{Scopes: []string{"read-only"}}},
+		{"without scopes", CreateAPIKeyRequest{Description: "backups"}},
+		{"with an unknown scope", CreateAPIKeyRequest{Description: "backups", Scopes: []string{"access:admin"}}},
+		{"that has expired", CreateAPIKeyRequest{Description: "backups", Scopes: []string{"read-only"}, ExpiresAt: &past}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			jsonapi.MarshalOnePayload(body, &tc.request)
+			req, recorder, _ := createRequest(t, "POST", "/admin/api_keys", body)
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := APIKeys{}
+			router := mux.NewRouter()
+			router.HandleFunc("/admin/api_keys", errorHandler.Handle(routeSet.Create))
+			router.ServeHTTP(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, api.InvalidAPIKeyError, response)
+			assert.Nil(t, errorHandler.Error)
+		})
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/api_keys", nil)
+
+	key := models.NewAPIKey("backups", []string{"images:write"}, nil, "admin@draupnir", "the-hash")
+	key.ID = 1
+	key.CreatedAt = timestamp()
+	store := FakeAPIKeyStore{
+		_List: func() ([]models.APIKey, error) {
+			return []models.APIKey{key}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := APIKeys{APIKeyStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/api_keys", errorHandler.Handle(routeSet.List))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), `"description":"backups"`)
+	assert.NotContains(t, recorder.Body.String(), "the-hash")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	req, recorder, logs := createRequest(t, "DELETE", "/admin/api_keys/1", nil)
+
+	revoked := 0
+	store := FakeAPIKeyStore{
+		_Get: func(id int) (models.APIKey, error) {
+			return models.APIKey{ID: id}, nil
+		},
+		_Revoke: func(id int) error {
+			revoked = id
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := APIKeys{APIKeyStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/api_keys/{id}", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 1, revoked)
+	assert.Contains(t, logs.String(), "revoked API key")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestRevokeUnknownAPIKey(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/admin/api_keys/1", nil)
+
+	store := FakeAPIKeyStore{
+		_Get: func(id int) (models.APIKey, error) {
+			return models.APIKey{}, sql.ErrNoRows
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := APIKeys{APIKeyStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/api_keys/{id}", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
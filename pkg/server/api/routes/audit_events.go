@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+)
+
+const (
+	defaultAuditEventLimit = 100
+	maxAuditEventLimit     = 1000
+)
+
+// AuditEvents is the admin route set for querying the audit log
+type AuditEvents struct {
+	AuditEventStore store.AuditEventStore
+}
+
+// List returns the most recent audit events, optionally filtered by the query
+// parameters actor, action, resource_type, resource_id, since and until.
+func (a AuditEvents) List(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	filter, err := parseAuditEventFilter(r)
+	if err != nil {
+		logger.Info(err.Error())
+		api.InvalidAuditEventFilterError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	events, err := a.AuditEventStore.List(r.Context(), filter)
+	if err != nil {
+		return errors.Wrap(err, "failed to get audit events")
+	}
+
+	_events := make([]*models.AuditEvent, 0)
+	for idx := range events {
+		_events = append(_events, &events[idx])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _events),
+		"failed to marshal audit events",
+	)
+}
+
+func parseAuditEventFilter(r *http.Request) (store.AuditEventFilter, error) {
+	query := r.URL.Query()
+	filter := store.AuditEventFilter{
+		Actor:        query.Get("actor"),
+		Action:       query.Get("action"),
+		ResourceType: query.Get("resource_type"),
+		ResourceID:   query.Get("resource_id"),
+		Limit:        defaultAuditEventLimit,
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, err
+		}
+		if filter.Limit < 1 || filter.Limit > maxAuditEventLimit {
+			return filter, errors.Errorf("limit out of range: %d", filter.Limit)
+		}
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditEventList(t *testing.T) {
+	req, recorder, _ := createRequest(
+		t, "GET", "/admin/audit_events?action=instance.create&resource_type=instance&since=2016-01-01T00:00:00Z&limit=10", nil,
+	)
+
+	auditStore := FakeAuditEventStore{
+		_List: func(filter store.AuditEventFilter) ([]models.AuditEvent, error) {
+			assert.Equal(t, "instance.create", filter.Action)
+			assert.Equal(t, "instance", filter.ResourceType)
+			assert.Equal(t, "", filter.Actor)
+			assert.Equal(t, time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), filter.Since)
+			assert.True(t, filter.Until.IsZero())
+			assert.Equal(t, 10, filter.Limit)
+
+			return []models.AuditEvent{
+				models.AuditEvent{
+					ID:           1,
+					Actor:        "test@draupnir",
+					Action:       "instance.create",
+					ResourceType: "instance",
+					ResourceID:   "4",
+					SourceIP:     "1.2.3.4",
+					Outcome:      models.AuditOutcomeSuccess,
+					Detail:       "image 42",
+					CreatedAt:    timestamp(),
+				},
+			}, nil
+		},
+	}
+
+	routeSet := AuditEvents{AuditEventStore: auditStore}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	events, err := jsonapi.UnmarshalManyPayload(recorder.Body, reflect.TypeOf(&models.AuditEvent{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "image 42", events[0].(*models.AuditEvent).Detail)
+}
+
+func TestAuditEventListWithInvalidFilter(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/audit_events?since=yesterday", nil)
+
+	routeSet := AuditEvents{}
+	err := routeSet.List(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidAuditEventFilterError, response)
+}
@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const DEVICE_CODE_EXPIRY = time.Minute * 10
+const DEVICE_POLL_INTERVAL = time.Second * 5
+
+// userCodeAlphabet leaves out vowels, so that codes don't spell words, and
+// characters that are easily confused with each other
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+const userCodeLength = 8
+
+var errDeviceAuthorisationExpired = errors.New("device authorisation has expired")
+
+// createDeviceAuthorisation starts a new device authorisation in the
+// Handshakes store, which the user completes at the verification URL
+func (a AccessTokens) createDeviceAuthorisation(ctx context.Context) (models.DeviceAuthorisation, error) {
+	deviceCode, err := randomDeviceCode()
+	if err != nil {
+		return models.DeviceAuthorisation{}, err
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		return models.DeviceAuthorisation{}, err
+	}
+
+	expiresAt := time.Now().Add(DEVICE_CODE_EXPIRY)
+	if err := a.Handshakes.CreateDevice(ctx, deviceCode, userCode, expiresAt); err != nil {
+		return models.DeviceAuthorisation{}, err
+	}
+
+	return models.DeviceAuthorisation{
+		ID:                      userCode,
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURL:         a.VerificationURL,
+		VerificationURLComplete: a.VerificationURL + "?user_code=" + url.QueryEscape(userCode),
+		Interval:                int(DEVICE_POLL_INTERVAL.Seconds()),
+		ExpiresAt:               expiresAt,
+	}, nil
+}
+
+// beginDeviceAuthorisation returns the OAuth state to authenticate the user
+// with, for the authorisation with the given user code
+func (a AccessTokens) beginDeviceAuthorisation(ctx context.Context, userCode string) (string, bool, error) {
+	state, err := randomDeviceCode()
+	if err != nil {
+		return "", false, err
+	}
+
+	ok, err := a.Handshakes.BeginDevice(ctx, normaliseUserCode(userCode), state)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	return state, true, nil
+}
+
+// CreateDeviceAuthorisation starts the device authorisation flow, for clients
+// that can't open a browser on the user's machine
+func (a AccessTokens) CreateDeviceAuthorisation(w http.ResponseWriter, r *http.Request) error {
+	authorisation, err := a.createDeviceAuthorisation(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to create device authorisation")
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &authorisation),
+		"failed to marshal device authorisation",
+	)
+}
+
+// Device is the verification page of the device authorisation flow. It asks
+// the user for their user code, then sends them through the OAuth flow.
+func (a AccessTokens) Device(w http.ResponseWriter, r *http.Request) error {
+	r.ParseForm()
+	userCode := r.Form.Get("user_code")
+
+	if userCode == "" {
+		renderDevicePage(w, "")
+		return nil
+	}
+
+	state, ok, err := a.beginDeviceAuthorisation(r.Context(), userCode)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin device authorisation")
+	}
+	if !ok {
+		renderDevicePage(w, "That code is invalid or has expired. Run draupnir authenticate again to get a new one.")
+		return nil
+	}
+
+	w.Header().Add("Location", a.Client.AuthCodeURL(state, oauth2.AccessTypeOffline))
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
+
+// deviceCallback completes the device authorisation that the OAuth flow was
+// started for. Failed token exchanges leave it pending, so that the user can
+// enter their code and try again before it expires.
+func (a AccessTokens) deviceCallback(w http.ResponseWriter, r *http.Request, state, respError, respCode string) error {
+	if respError != "" {
+		if _, err := a.completeDevice(models.OAuthHandshake{State: state, Error: respError}); err != nil {
+			return errors.Wrap(err, respError)
+		}
+		return errors.New(respError)
+	}
+
+	if respCode == "" {
+		return errors.New("OAuth callback response code is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), TOKEN_EXCHANGE_TIMEOUT)
+	defer cancel()
+
+	token, err := a.createSession(ctx, respCode)
+	if err != nil {
+		return err
+	}
+
+	completed, err := a.completeDevice(models.OAuthHandshake{State: state, Token: token})
+	if err != nil {
+		return err
+	}
+	if !completed {
+		return errDeviceAuthorisationExpired
+	}
+
+	renderCallbackSuccess(w)
+	return nil
+}
+
+// completeDevice records the outcome of the OAuth flow for the client polling
+// on it. This is done even if the callback request has been cancelled, as the
+// client is still polling.
+func (a AccessTokens) completeDevice(handshake models.OAuthHandshake) (bool, error) {
+	completed, err := a.Handshakes.CompleteDevice(context.Background(), handshake)
+	return completed, errors.Wrap(err, "failed to complete device authorisation")
+}
+
+// createFromDevice returns the access token for a device authorisation, or an
+// error telling the client to keep polling
+func (a AccessTokens) createFromDevice(w http.ResponseWriter, r *http.Request, deviceCode string) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	handshake, completed, err := a.Handshakes.PollDevice(r.Context(), deviceCode)
+	if err == store.ErrOAuthHandshakeNotFound {
+		api.ExpiredDeviceCodeError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to poll device authorisation")
+	}
+
+	if !completed {
+		api.AuthorizationPendingError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if handshake.Error != "" {
+		logger.With("error", handshake.Error).Info("oauth request failed")
+		api.OauthError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	return renderAccessToken(w, handshake.Token)
+}
+
+func renderDevicePage(w http.ResponseWriter, message string) {
+	if message != "" {
+		message = fmt.Sprintf("<p><strong>%s</strong></p>", html.EscapeString(message))
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(fmt.Sprintf(
+		`<h1>Authenticate a device</h1>
+		 %s
+		 <p>Enter the code shown by draupnir authenticate. Only enter a code that you generated yourself.</p>
+		 <form method="get">
+		   <input name="user_code" autocomplete="off" autofocus>
+		   <button type="submit">Continue</button>
+		 </form>`,
+		message,
+	)))
+}
+
+func randomDeviceCode() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate device code")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// randomUserCode returns a code that's easy to read and type, such as
+// BDFG-HJKL
+func randomUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to generate user code")
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+// normaliseUserCode lets users type codes in lower case, and with or without
+// the separator
+func normaliseUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
@@ -0,0 +1,252 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+func newDeviceRouteSet(client OAuthClient) AccessTokens {
+	return AccessTokens{
+		Handshakes:      store.NewMemoryOAuthHandshakeStore(),
+		Client:          client,
+		Sessions:        FakeSessions{},
+		VerificationURL: "https://draupnir.org/device",
+	}
+}
+
+// pollDevice requests an access token for the device code
+func pollDevice(t *testing.T, routeSet AccessTokens, deviceCode string) *bytes.Buffer {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &createAccessTokenRequest{DeviceCode: deviceCode})
+	req, recorder, _ := createRequest(t, "POST", "/access_tokens", body)
+
+	err := routeSet.Create(recorder, req)
+	assert.Nil(t, err)
+
+	if recorder.Code != http.StatusCreated {
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	}
+	return recorder.Body
+}
+
+func decodeAPIError(t *testing.T, body *bytes.Buffer) api.Error {
+	var apiError api.Error
+	if err := json.NewDecoder(body).Decode(&apiError); err != nil {
+		t.Fatal(err)
+	}
+	return apiError
+}
+
+func TestCreateDeviceAuthorisation(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/device_authorisations", nil)
+
+	routeSet := newDeviceRouteSet(auth.FakeOIDCClient())
+	err := routeSet.CreateDeviceAuthorisation(recorder, req)
+
+	var response models.DeviceAuthorisation
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &response))
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Regexp(t, "^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$", response.UserCode)
+	assert.NotEmpty(t, response.DeviceCode)
+	assert.Equal(t, "https://draupnir.org/device", response.VerificationURL)
+	assert.Equal(t, "https://draupnir.org/device?user_code="+response.UserCode, response.VerificationURLComplete)
+	assert.Equal(t, 5, response.Interval)
+	assert.WithinDuration(t, time.Now().Add(DEVICE_CODE_EXPIRY), response.ExpiresAt, time.Minute)
+}
+
+func TestDevicePage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/device", nil)
+
+	err := newDeviceRouteSet(auth.FakeOIDCClient()).Device(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/html", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), `<input name="user_code"`)
+}
+
+func TestDevicePageWithUnknownCode(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/device?user_code=BBBB-BBBB", nil)
+
+	err := newDeviceRouteSet(auth.FakeOIDCClient()).Device(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "That code is invalid or has expired")
+}
+
+func TestDevicePageRedirectsToOAuth(t *testing.T) {
+	routeSet := newDeviceRouteSet(auth.FakeOIDCClient())
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Users can type the code in lower case, with a space for the separator
+	userCode := url.QueryEscape(strings.ToLower(authorisation.UserCode[:4] + " " + authorisation.UserCode[5:]))
+	req, recorder, _ := createRequest(t, "GET", "/device?user_code="+userCode, nil)
+
+	err = routeSet.Device(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	assert.Equal(t, "example.org", location.Host)
+	assert.NotEmpty(t, state)
+	assert.NotEqual(t, authorisation.DeviceCode, state)
+	pending, err := routeSet.Handshakes.DevicePending(context.Background(), state)
+	assert.Nil(t, err)
+	assert.True(t, pending)
+}
+
+func TestDeviceAuthorisation(t *testing.T) {
+	code := "some_code"
+	oauthClient := auth.FakeOAuthClient{
+		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
+			assert.Equal(t, code, _code)
+			return &oauth2.Token{RefreshToken: "the-access-token"}, nil
+		},
+	}
+
+	routeSet := newDeviceRouteSet(&oauthClient)
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, api.AuthorizationPendingError.Code, decodeAPIError(t, pollDevice(t, routeSet, authorisation.DeviceCode)).Code)
+
+	state, ok, err := routeSet.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	req, recorder, _ := createRequest(t, "GET", oauthCallbackPath(state, code, ""), nil)
+	err = routeSet.Callback(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Contains(t, recorder.Body.String(), "Success!")
+
+	var token oauth2.Token
+	assert.Nil(t, json.NewDecoder(pollDevice(t, routeSet, authorisation.DeviceCode)).Decode(&token))
+	assert.Equal(t, "session-for-the-access-token", token.AccessToken)
+
+	// The token can only be collected once
+	assert.Equal(t, api.ExpiredDeviceCodeError.Code, decodeAPIError(t, pollDevice(t, routeSet, authorisation.DeviceCode)).Code)
+}
+
+func TestDeviceAuthorisationWithResponseError(t *testing.T) {
+	routeSet := newDeviceRouteSet(&auth.FakeOAuthClient{})
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _, _ := routeSet.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+
+	req, recorder, _ := createRequest(t, "GET", oauthCallbackPath(state, "", "access_denied"), nil)
+	err = routeSet.Callback(recorder, req)
+
+	assert.Equal(t, "access_denied", err.Error())
+	assert.Equal(t, api.OauthError.Code, decodeAPIError(t, pollDevice(t, routeSet, authorisation.DeviceCode)).Code)
+}
+
+// failingDeviceStore can't record the outcome of device authorisations
+type failingDeviceStore struct {
+	store.OAuthHandshakeStore
+}
+
+func (s failingDeviceStore) CompleteDevice(ctx context.Context, handshake models.OAuthHandshake) (bool, error) {
+	return false, errors.New("database is unavailable")
+}
+
+func TestDeviceAuthorisationWithResponseErrorWhenStoreFails(t *testing.T) {
+	routeSet := newDeviceRouteSet(&auth.FakeOAuthClient{})
+	routeSet.Handshakes = failingDeviceStore{OAuthHandshakeStore: routeSet.Handshakes}
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _, _ := routeSet.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+
+	req, recorder, _ := createRequest(t, "GET", oauthCallbackPath(state, "", "access_denied"), nil)
+	err = routeSet.Callback(recorder, req)
+
+	assert.Equal(t, "access_denied: failed to complete device authorisation: database is unavailable", err.Error())
+}
+
+func TestDeviceAuthorisationWithFailedTokenExchange(t *testing.T) {
+	oauthClient := auth.FakeOAuthClient{
+		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
+			return &oauth2.Token{}, errors.New("token exchange failed")
+		},
+	}
+
+	routeSet := newDeviceRouteSet(&oauthClient)
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _, _ := routeSet.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+
+	req, recorder, _ := createRequest(t, "GET", oauthCallbackPath(state, "some_code", ""), nil)
+	err = routeSet.Callback(recorder, req)
+
+	assert.Equal(t, "token exchange error: token exchange failed", err.Error())
+
+	// The user can enter their code again
+	assert.Equal(t, api.AuthorizationPendingError.Code, decodeAPIError(t, pollDevice(t, routeSet, authorisation.DeviceCode)).Code)
+	_, ok, _ := routeSet.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+	assert.True(t, ok)
+}
+
+func TestDeviceAuthorisationCompletedByAnotherReplica(t *testing.T) {
+	oauthClient := auth.FakeOAuthClient{
+		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
+			return &oauth2.Token{RefreshToken: "the-access-token"}, nil
+		},
+	}
+
+	// Device authorisations are held in the Handshakes store, which replicas
+	// share
+	routeSet := newDeviceRouteSet(&oauthClient)
+	otherReplica := newDeviceRouteSet(&oauthClient)
+	otherReplica.Handshakes = routeSet.Handshakes
+
+	authorisation, err := routeSet.createDeviceAuthorisation(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, ok, err := otherReplica.beginDeviceAuthorisation(context.Background(), authorisation.UserCode)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	req, recorder, _ := createRequest(t, "GET", oauthCallbackPath(state, "some_code", ""), nil)
+	err = otherReplica.Callback(recorder, req)
+	assert.Nil(t, err)
+
+	var token oauth2.Token
+	assert.Nil(t, json.NewDecoder(pollDevice(t, routeSet, authorisation.DeviceCode)).Decode(&token))
+	assert.Equal(t, "session-for-the-access-token", token.AccessToken)
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -9,11 +10,13 @@ import (
 	"testing"
 
 	"github.com/prometheus/common/log"
-	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 
 	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 )
 
 func NewFakeLogger() (log.Logger, *bytes.Buffer) {
@@ -30,69 +33,278 @@ type FakeImageStore struct {
 	_MarkAsReady func(models.Image) (models.Image, error)
 }
 
-func (s FakeImageStore) List() ([]models.Image, error) {
+func (s FakeImageStore) List(ctx context.Context) ([]models.Image, error) {
 	return s._List()
 }
 
-func (s FakeImageStore) Get(id int) (models.Image, error) {
+func (s FakeImageStore) Get(ctx context.Context, id int) (models.Image, error) {
 	return s._Get(id)
 }
 
-func (s FakeImageStore) Create(image models.Image) (models.Image, error) {
+func (s FakeImageStore) Create(ctx context.Context, image models.Image) (models.Image, error) {
 	return s._Create(image)
 }
 
-func (s FakeImageStore) Destroy(image models.Image) error {
+func (s FakeImageStore) Destroy(ctx context.Context, image models.Image) error {
 	return s._Destroy(image)
 }
 
-func (s FakeImageStore) MarkAsReady(image models.Image) (models.Image, error) {
+func (s FakeImageStore) MarkAsReady(ctx context.Context, image models.Image) (models.Image, error) {
 	return s._MarkAsReady(image)
 }
 
 type FakeInstanceStore struct {
-	_Create  func(models.Instance) (models.Instance, error)
-	_List    func() ([]models.Instance, error)
-	_Get     func(int) (models.Instance, error)
-	_Destroy func(instance models.Instance) error
+	_Create         func(models.Instance) (models.Instance, error)
+	_List           func() ([]models.Instance, error)
+	_Get            func(int) (models.Instance, error)
+	_Destroy        func(instance models.Instance) error
+	_UpdateOwner    func(instance models.Instance, email string) (models.Instance, error)
+	_MarkAsPooled   func(instance models.Instance) (models.Instance, error)
+	_Claim          func(imageID int, email, sessionID string, apiKeyID int) (models.Instance, error)
+	_DestroyUnowned func(instance models.Instance) (bool, error)
 }
 
-func (s FakeInstanceStore) Create(image models.Instance) (models.Instance, error) {
+func (s FakeInstanceStore) Create(ctx context.Context, image models.Instance) (models.Instance, error) {
 	return s._Create(image)
 }
 
-func (s FakeInstanceStore) List() ([]models.Instance, error) {
+func (s FakeInstanceStore) List(ctx context.Context) ([]models.Instance, error) {
 	return s._List()
 }
 
-func (s FakeInstanceStore) Get(id int) (models.Instance, error) {
+func (s FakeInstanceStore) Get(ctx context.Context, id int) (models.Instance, error) {
 	return s._Get(id)
 }
 
-func (s FakeInstanceStore) Destroy(instance models.Instance) error {
+func (s FakeInstanceStore) Destroy(ctx context.Context, instance models.Instance) error {
 	return s._Destroy(instance)
 }
 
+func (s FakeInstanceStore) UpdateOwner(ctx context.Context, instance models.Instance, email string) (models.Instance, error) {
+	return s._UpdateOwner(instance, email)
+}
+
+func (s FakeInstanceStore) MarkAsPooled(ctx context.Context, instance models.Instance) (models.Instance, error) {
+	return s._MarkAsPooled(instance)
+}
+
+func (s FakeInstanceStore) Claim(ctx context.Context, imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+	return s._Claim(imageID, email, sessionID, apiKeyID)
+}
+
+func (s FakeInstanceStore) DestroyUnowned(ctx context.Context, instance models.Instance) (bool, error) {
+	return s._DestroyUnowned(instance)
+}
+
+type FakeInstanceDestructionStore struct {
+	_List   func() ([]models.InstanceDestruction, error)
+	_Create func(models.InstanceDestruction) (models.InstanceDestruction, error)
+}
+
+func (s FakeInstanceDestructionStore) List(ctx context.Context) ([]models.InstanceDestruction, error) {
+	return s._List()
+}
+
+func (s FakeInstanceDestructionStore) Create(ctx context.Context, destruction models.InstanceDestruction) (models.InstanceDestruction, error) {
+	return s._Create(destruction)
+}
+
 type FakeWhitelistedAddressStore struct {
-	_Create func(models.WhitelistedAddress) (models.WhitelistedAddress, error)
-	_List   func() ([]models.WhitelistedAddress, error)
+	_Create        func(models.WhitelistedAddress) (models.WhitelistedAddress, error)
+	_List          func() ([]models.WhitelistedAddress, error)
+	_IsWhitelisted func(instanceID int, ipAddress string) (bool, error)
 }
 
-func (s FakeWhitelistedAddressStore) Create(image models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+func (s FakeWhitelistedAddressStore) Create(ctx context.Context, image models.WhitelistedAddress) (models.WhitelistedAddress, error) {
 	return s._Create(image)
 }
 
-func (s FakeWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
+func (s FakeWhitelistedAddressStore) List(ctx context.Context) ([]models.WhitelistedAddress, error) {
+	return s._List()
+}
+
+func (s FakeWhitelistedAddressStore) IsWhitelisted(ctx context.Context, instanceID int, ipAddress string) (bool, error) {
+	return s._IsWhitelisted(instanceID, ipAddress)
+}
+
+type FakeImageAccessRuleStore struct {
+	_List         func() ([]models.ImageAccessRule, error)
+	_ListForImage func(int) ([]models.ImageAccessRule, error)
+	_Get          func(int) (models.ImageAccessRule, error)
+	_Create       func(models.ImageAccessRule) (models.ImageAccessRule, error)
+	_Destroy      func(models.ImageAccessRule) error
+}
+
+func (s FakeImageAccessRuleStore) List(ctx context.Context) ([]models.ImageAccessRule, error) {
+	return s._List()
+}
+
+func (s FakeImageAccessRuleStore) ListForImage(ctx context.Context, imageID int) ([]models.ImageAccessRule, error) {
+	return s._ListForImage(imageID)
+}
+
+func (s FakeImageAccessRuleStore) Get(ctx context.Context, id int) (models.ImageAccessRule, error) {
+	return s._Get(id)
+}
+
+func (s FakeImageAccessRuleStore) Create(ctx context.Context, rule models.ImageAccessRule) (models.ImageAccessRule, error) {
+	return s._Create(rule)
+}
+
+func (s FakeImageAccessRuleStore) Destroy(ctx context.Context, rule models.ImageAccessRule) error {
+	return s._Destroy(rule)
+}
+
+// openImageAccessRuleStore returns a fake store in which no image has any
+// access rules, so every image is available to every user.
+func openImageAccessRuleStore() FakeImageAccessRuleStore {
+	return FakeImageAccessRuleStore{
+		_List: func() ([]models.ImageAccessRule, error) {
+			return []models.ImageAccessRule{}, nil
+		},
+		_ListForImage: func(int) ([]models.ImageAccessRule, error) {
+			return []models.ImageAccessRule{}, nil
+		},
+	}
+}
+
+type FakeRoleAssignmentStore struct {
+	_List              func() ([]models.RoleAssignment, error)
+	_ListForPrincipals func([]string) ([]models.RoleAssignment, error)
+	_Upsert            func(models.RoleAssignment) (models.RoleAssignment, error)
+	_Destroy           func(string) error
+}
+
+func (s FakeRoleAssignmentStore) List(ctx context.Context) ([]models.RoleAssignment, error) {
+	return s._List()
+}
+
+func (s FakeRoleAssignmentStore) ListForPrincipals(ctx context.Context, principals []string) ([]models.RoleAssignment, error) {
+	return s._ListForPrincipals(principals)
+}
+
+func (s FakeRoleAssignmentStore) Upsert(ctx context.Context, assignment models.RoleAssignment) (models.RoleAssignment, error) {
+	return s._Upsert(assignment)
+}
+
+func (s FakeRoleAssignmentStore) Destroy(ctx context.Context, principal string) error {
+	return s._Destroy(principal)
+}
+
+type FakeAPIKeyStore struct {
+	_List      func() ([]models.APIKey, error)
+	_Get       func(int) (models.APIKey, error)
+	_GetByHash func(string) (models.APIKey, error)
+	_Create    func(models.APIKey) (models.APIKey, error)
+	_Revoke    func(int) error
+}
+
+func (s FakeAPIKeyStore) List(ctx context.Context) ([]models.APIKey, error) {
 	return s._List()
 }
 
+func (s FakeAPIKeyStore) Get(ctx context.Context, id int) (models.APIKey, error) {
+	return s._Get(id)
+}
+
+func (s FakeAPIKeyStore) GetByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	return s._GetByHash(keyHash)
+}
+
+func (s FakeAPIKeyStore) Create(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	return s._Create(key)
+}
+
+func (s FakeAPIKeyStore) Revoke(ctx context.Context, id int) error {
+	return s._Revoke(id)
+}
+
+type FakeAuditEventStore struct {
+	_Create func(models.AuditEvent) (models.AuditEvent, error)
+	_List   func(store.AuditEventFilter) ([]models.AuditEvent, error)
+}
+
+func (s FakeAuditEventStore) Create(ctx context.Context, event models.AuditEvent) (models.AuditEvent, error) {
+	return s._Create(event)
+}
+
+func (s FakeAuditEventStore) List(ctx context.Context, filter store.AuditEventFilter) ([]models.AuditEvent, error) {
+	return s._List(filter)
+}
+
+type FakeMaintenanceModeStore struct {
+	_Get     func() (models.MaintenanceMode, error)
+	_Enable  func(models.MaintenanceMode) (models.MaintenanceMode, error)
+	_Disable func() error
+}
+
+func (s FakeMaintenanceModeStore) Get(ctx context.Context) (models.MaintenanceMode, error) {
+	return s._Get()
+}
+
+func (s FakeMaintenanceModeStore) Enable(ctx context.Context, mode models.MaintenanceMode) (models.MaintenanceMode, error) {
+	return s._Enable(mode)
+}
+
+func (s FakeMaintenanceModeStore) Disable(ctx context.Context) error {
+	return s._Disable()
+}
+
+type FakeSessionStore struct {
+	_Create           func(models.Session) (models.Session, error)
+	_ListToVerify     func() ([]models.Session, error)
+	_ListRevoked      func() ([]models.Session, error)
+	_RevocationReason func(id string) (string, bool, error)
+	_Revoke           func(id string, reason string) error
+	_LogOut           func(id string) (models.Session, error)
+	_RevokeUser       func(email string, reason string) ([]models.Session, error)
+}
+
+func (s FakeSessionStore) Create(ctx context.Context, session models.Session) (models.Session, error) {
+	return s._Create(session)
+}
+
+func (s FakeSessionStore) ListToVerify(ctx context.Context) ([]models.Session, error) {
+	return s._ListToVerify()
+}
+
+func (s FakeSessionStore) ListRevoked(ctx context.Context) ([]models.Session, error) {
+	return s._ListRevoked()
+}
+
+func (s FakeSessionStore) RevocationReason(ctx context.Context, id string) (string, bool, error) {
+	return s._RevocationReason(id)
+}
+
+func (s FakeSessionStore) Revoke(ctx context.Context, id string, reason string) error {
+	return s._Revoke(id, reason)
+}
+
+func (s FakeSessionStore) LogOut(ctx context.Context, id string) (models.Session, error) {
+	return s._LogOut(id)
+}
+
+func (s FakeSessionStore) RevokeUser(ctx context.Context, email string, reason string) ([]models.Session, error) {
+	return s._RevokeUser(email, reason)
+}
+
+// FakeSessions issues session tokens that name the refresh token they were
+// created from
+type FakeSessions struct{}
+
+func (FakeSessions) Create(ctx context.Context, token oauth2.Token) (oauth2.Token, error) {
+	return oauth2.Token{AccessToken: "session-for-" + token.RefreshToken, TokenType: "Bearer"}, nil
+}
+
 type FakeExecutor struct {
 	_CreateBtrfsSubvolume        func(ctx context.Context, id int) error
 	_FinaliseImage               func(ctx context.Context, image models.Image) error
-	_CreateInstance              func(ctx context.Context, imageID int, instanceID int, port int) error
+	_CreateInstance              func(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error
 	_RetrieveInstanceCredentials func(ctx context.Context, id int) (map[string][]byte, error)
 	_DestroyImage                func(ctx context.Context, id int) error
 	_DestroyInstance             func(ctx context.Context, id int) error
+	_InstanceDiskUsage           func(ctx context.Context, id int) (int64, error)
+	_RotateInstanceCredentials   func(ctx context.Context, id int, rotateCA bool) error
 }
 
 func (e FakeExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
@@ -103,8 +315,8 @@ func (e FakeExecutor) FinaliseImage(ctx context.Context, image models.Image) err
 	return e._FinaliseImage(ctx, image)
 }
 
-func (e FakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	return e._CreateInstance(ctx, imageID, instanceID, port)
+func (e FakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+	return e._CreateInstance(ctx, imageID, instanceID, port, passwordAuthentication)
 }
 
 func (e FakeExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
@@ -119,6 +331,14 @@ func (e FakeExecutor) DestroyInstance(ctx context.Context, id int) error {
 	return e._DestroyInstance(ctx, id)
 }
 
+func (e FakeExecutor) InstanceDiskUsage(ctx context.Context, id int) (int64, error) {
+	return e._InstanceDiskUsage(ctx, id)
+}
+
+func (e FakeExecutor) RotateInstanceCredentials(ctx context.Context, id int, rotateCA bool) error {
+	return e._RotateInstanceCredentials(ctx, id, rotateCA)
+}
+
 type FakeErrorHandler struct {
 	Error error
 }
@@ -142,7 +362,9 @@ func createRequest(t *testing.T, method string, path string, body io.Reader) (*h
 	logger, output := NewFakeLogger()
 	req = req.WithContext(context.WithValue(req.Context(), middleware.LoggerKey, &logger))
 	req = req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, "test@draupnir"))
-	req = req.WithContext(context.WithValue(req.Context(), middleware.RefreshTokenKey, "refresh-token"))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.AuthGroupsKey, []string{}))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.PermissionsKey, auth.PermissionsFor([]auth.Role{auth.RoleUser})))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.SessionIDKey, "session-id"))
 	req = req.WithContext(context.WithValue(req.Context(), middleware.UserIPAddressKey, "1.2.3.4"))
 
 	return req, recorder, output
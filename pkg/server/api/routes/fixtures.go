@@ -61,11 +61,12 @@ var createInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"updated_at": "2016-01-01T12:33:44Z",
-			"port":       float64(0),
+			"image_id":                float64(1),
+			"hostname":                "draupnir-server.example.com",
+			"created_at":              "2016-01-01T12:33:44Z",
+			"updated_at":              "2016-01-01T12:33:44Z",
+			"port":                    float64(0),
+			"password_authentication": false,
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -78,11 +79,12 @@ var listInstancesFixture = jsonapi.ManyPayload{
 			Type: "instances",
 			ID:   "1",
 			Attributes: map[string]interface{}{
-				"image_id":   float64(1),
-				"hostname":   "draupnir-server.example.com",
-				"created_at": "2016-01-01T12:33:44Z",
-				"port":       float64(5432),
-				"updated_at": "2016-01-01T12:33:44Z",
+				"image_id":                float64(1),
+				"hostname":                "draupnir-server.example.com",
+				"created_at":              "2016-01-01T12:33:44Z",
+				"port":                    float64(5432),
+				"password_authentication": false,
+				"updated_at":              "2016-01-01T12:33:44Z",
 			},
 		},
 	},
@@ -93,11 +95,12 @@ var getInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"port":       float64(5432),
-			"updated_at": "2016-01-01T12:33:44Z",
+			"image_id":                float64(1),
+			"hostname":                "draupnir-server.example.com",
+			"created_at":              "2016-01-01T12:33:44Z",
+			"port":                    float64(5432),
+			"password_authentication": false,
+			"updated_at":              "2016-01-01T12:33:44Z",
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -0,0 +1,187 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/log"
+)
+
+// ImageAccessRules is the admin route set for managing which users and groups
+// may access an image.
+type ImageAccessRules struct {
+	ImageStore           store.ImageStore
+	ImageAccessRuleStore store.ImageAccessRuleStore
+}
+
+type CreateImageAccessRuleRequest struct {
+	UserEmail string `jsonapi:"attr,user_email"`
+	GroupName string `jsonapi:"attr,group_name"`
+}
+
+func (a ImageAccessRules) List(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	image, found := a.getImage(w, r, logger)
+	if !found {
+		return nil
+	}
+
+	rules, err := a.ImageAccessRuleStore.ListForImage(r.Context(), image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get image access rules")
+	}
+
+	_rules := make([]*models.ImageAccessRule, 0)
+	for idx := range rules {
+		_rules = append(_rules, &rules[idx])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _rules),
+		"failed to marshal image access rules",
+	)
+}
+
+func (a ImageAccessRules) Create(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	image, found := a.getImage(w, r, logger)
+	if !found {
+		return nil
+	}
+
+	req := CreateImageAccessRuleRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if (req.UserEmail == "") == (req.GroupName == "") {
+		api.InvalidImageAccessRuleError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	middleware.SetAuditResource(r, strconv.Itoa(image.ID), accessRulePrincipal(req.UserEmail, req.GroupName))
+
+	rule := models.NewImageAccessRule(image.ID, req.UserEmail, req.GroupName)
+	rule, err = a.ImageAccessRuleStore.Create(r.Context(), rule)
+	if err != nil {
+		return errors.Wrap(err, "failed to create image access rule")
+	}
+
+	logger.
+		With("image", image.ID).
+		With("user_email", rule.UserEmail).
+		With("group_name", rule.GroupName).
+		Info("created image access rule")
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &rule),
+		"failed to marshal image access rule",
+	)
+}
+
+func (a ImageAccessRules) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	image, found := a.getImage(w, r, logger)
+	if !found {
+		return nil
+	}
+
+	ruleID, err := strconv.Atoi(mux.Vars(r)["rule_id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	rule, err := a.ImageAccessRuleStore.Get(r.Context(), ruleID)
+	if err != nil || rule.ImageID != image.ID {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	middleware.SetAuditResource(r, strconv.Itoa(image.ID), accessRulePrincipal(rule.UserEmail, rule.GroupName))
+
+	if err := a.ImageAccessRuleStore.Destroy(r.Context(), rule); err != nil {
+		return errors.Wrap(err, "failed to destroy image access rule")
+	}
+
+	logger.With("image", image.ID).With("rule", rule.ID).Info("destroyed image access rule")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a ImageAccessRules) getImage(w http.ResponseWriter, r *http.Request, logger log.Logger) (models.Image, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.Image{}, false
+	}
+
+	image, err := a.ImageStore.Get(r.Context(), id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.ImageNotFoundError.Render(w, http.StatusNotFound)
+		return models.Image{}, false
+	}
+
+	return image, true
+}
+
+// accessRulePrincipal describes who an access rule applies to, for the audit log
+func accessRulePrincipal(userEmail, groupName string) string {
+	if groupName != "" {
+		return auth.GroupPrincipal(groupName)
+	}
+	return userEmail
+}
+
+// canAccessImage reports whether the authenticated user may see and use the
+// given image, according to its access rules. Users who may manage images can
+// access every image.
+func canAccessImage(r *http.Request, ruleStore store.ImageAccessRuleStore, imageID int) (bool, error) {
+	if middleware.HasPermission(r, auth.PermissionManageImages) {
+		return true, nil
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return false, err
+	}
+
+	groups, err := middleware.GetAuthenticatedGroups(r)
+	if err != nil {
+		return false, err
+	}
+
+	rules, err := ruleStore.ListForImage(r.Context(), imageID)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to get image access rules")
+	}
+
+	return models.ImageAccessible(rules, email, groups), nil
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func asAdmin(req *http.Request) *http.Request {
+	permissions := auth.PermissionsFor([]auth.Role{auth.RoleAdmin})
+	return req.WithContext(context.WithValue(req.Context(), middleware.PermissionsKey, permissions))
+}
+
+func TestCreateImageAccessRule(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageAccessRuleRequest{GroupName: "data-team"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/images/1/access_rules", body)
+	req = asAdmin(req)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	ruleStore := FakeImageAccessRuleStore{
+		_Create: func(rule models.ImageAccessRule) (models.ImageAccessRule, error) {
+			assert.Equal(t, 1, rule.ImageID)
+			assert.Equal(t, "data-team", rule.GroupName)
+			assert.Equal(t, "", rule.UserEmail)
+			rule.ID = 3
+			rule.CreatedAt = timestamp()
+			rule.UpdatedAt = timestamp()
+			return rule, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAccessRules{ImageStore: imageStore, ImageAccessRuleStore: ruleStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/images/{id}/access_rules", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, jsonapi.OnePayload{
+		Data: &jsonapi.Node{
+			Type: "image_access_rules",
+			ID:   "3",
+			Attributes: map[string]interface{}{
+				"image_id":   float64(1),
+				"group_name": "data-team",
+				"created_at": "2016-01-01T12:33:44Z",
+				"updated_at": "2016-01-01T12:33:44Z",
+			},
+		},
+	}, response)
+}
+
+func TestCreateImageAccessRuleWithUserAndGroup(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageAccessRuleRequest{UserEmail: "someone@draupnir", GroupName: "data-team"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/admin/images/1/access_rules", body)
+	req = asAdmin(req)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAccessRules{ImageStore: imageStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/images/{id}/access_rules", errorHandler.Handle(routeSet.Create))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidImageAccessRuleError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestDestroyImageAccessRuleForDifferentImage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/admin/images/1/access_rules/3", nil)
+	req = asAdmin(req)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	ruleStore := FakeImageAccessRuleStore{
+		_Get: func(id int) (models.ImageAccessRule, error) {
+			assert.Equal(t, 3, id)
+			return models.ImageAccessRule{ID: 3, ImageID: 2, GroupName: "data-team"}, nil
+		},
+		_Destroy: func(rule models.ImageAccessRule) error {
+			t.Fatal("rule belonging to another image should not be destroyed")
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := ImageAccessRules{ImageStore: imageStore, ImageAccessRuleStore: ruleStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/images/{id}/access_rules/{rule_id}", errorHandler.Handle(routeSet.Destroy))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
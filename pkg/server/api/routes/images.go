@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"fmt"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -19,9 +20,11 @@ import (
 )
 
 type Images struct {
-	ImageStore    store.ImageStore
-	InstanceStore store.InstanceStore
-	Executor      exec.Executor
+	ImageStore           store.ImageStore
+	InstanceStore        store.InstanceStore
+	ImageAccessRuleStore store.ImageAccessRuleStore
+	Executor             exec.Executor
+	RefillPool           func(string)
 }
 
 func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
@@ -37,13 +40,25 @@ func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image, err := i.ImageStore.Get(id)
+	image, err := i.ImageStore.Get(r.Context(), id)
 	if err != nil {
 		logger.Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
+	accessible, err := canAccessImage(r, i.ImageAccessRuleStore, image.ID)
+	if err != nil {
+		return err
+	}
+
+	// Images that the user cannot access are indistinguishable from images that
+	// don't exist
+	if !accessible {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
 	err = jsonapi.MarshalOnePayload(w, &image)
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal payload")
@@ -53,15 +68,41 @@ func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (i Images) List(w http.ResponseWriter, r *http.Request) error {
-	images, err := i.ImageStore.List()
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	groups, err := middleware.GetAuthenticatedGroups(r)
+	if err != nil {
+		return err
+	}
+
+	images, err := i.ImageStore.List(r.Context())
 	if err != nil {
 		return errors.Wrap(err, "failed to get images")
 	}
 
+	rules, err := i.ImageAccessRuleStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get image access rules")
+	}
+
+	// Image publishers need to see every image in order to manage them
+	canSeeAll := middleware.HasPermission(r, auth.PermissionManageImages)
+
+	rulesByImage := make(map[int][]models.ImageAccessRule)
+	for _, rule := range rules {
+		rulesByImage[rule.ImageID] = append(rulesByImage[rule.ImageID], rule)
+	}
+
 	// Build a slice of pointers to our images, because this is what jsonapi wants
+	// At the same time, filter out images that this user cannot access
 	_images := make([]*models.Image, 0)
-	for i := range images {
-		_images = append(_images, &images[i])
+	for idx, image := range images {
+		if canSeeAll || models.ImageAccessible(rulesByImage[image.ID], email, groups) {
+			_images = append(_images, &images[idx])
+		}
 	}
 
 	return errors.Wrap(
@@ -89,12 +130,18 @@ func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	image := models.NewImage(req.BackedUpAt, req.Anon)
-	image, err = i.ImageStore.Create(image)
+	image, err = i.ImageStore.Create(r.Context(), image)
 	if err != nil {
 		return errors.Wrap(err, "failed to create new image")
 	}
+	middleware.SetAuditResource(r, strconv.Itoa(image.ID), "")
 
 	if err := i.Executor.CreateBtrfsSubvolume(r.Context(), image.ID); err != nil {
+		ctx, cancel := rollbackContext(r)
+		defer cancel()
+		if destroyErr := i.ImageStore.Destroy(ctx, image); destroyErr != nil {
+			logger.Error(errors.Wrap(destroyErr, "failed to delete image during rollback").Error())
+		}
 		return errors.Wrap(err, "failed to create btrfs subvolume")
 	}
 
@@ -119,7 +166,7 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image, err := i.ImageStore.Get(id)
+	image, err := i.ImageStore.Get(r.Context(), id)
 	if err != nil {
 		logger.Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
@@ -132,10 +179,13 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 			return errors.Wrap(err, "failed to finalise image")
 		}
 
-		image, err = i.ImageStore.MarkAsReady(image)
+		image, err = i.ImageStore.MarkAsReady(r.Context(), image)
 		if err != nil {
 			return errors.Wrap(err, "failed to mark image as ready")
 		}
+
+		// Replace the pool's instances of the previous image
+		i.RefillPool("image")
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -152,11 +202,6 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	email, err := middleware.GetAuthenticatedUser(r)
-	if err != nil {
-		return err
-	}
-
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
@@ -164,33 +209,37 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image, err := i.ImageStore.Get(id)
+	image, err := i.ImageStore.Get(r.Context(), id)
 	if err != nil {
 		logger.Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
-	if email == auth.UPLOAD_USER_EMAIL {
-		// Destroy all instances of this image, if there are any
-		instances, err := i.InstanceStore.List()
-		for _, instance := range instances {
-			if instance.ImageID != id {
-				continue
-			}
-			logger.With("instance", instance.ID).Info("destroying instance")
-			err = i.InstanceStore.Destroy(instance)
-			if err == nil {
-				err = i.Executor.DestroyInstance(r.Context(), instance.ID)
-			}
-			if err != nil {
-				return errors.Wrap(err, "failed to destroy instance")
-			}
+	// Destroy all instances of this image, if there are any. Pooled instances
+	// belong to nobody, so are destroyed by anyone who can destroy the image.
+	destroyAllInstances := middleware.HasPermission(r, auth.PermissionManageAllInstances)
+	instances, err := i.InstanceStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+	for _, instance := range instances {
+		if instance.ImageID != id || !(destroyAllInstances || instance.Pooled) {
+			continue
+		}
+		logger.With("instance", instance.ID).Info("destroying instance")
+		middleware.AddAuditEvent(r, "instance.destroy", "instance", strconv.Itoa(instance.ID), fmt.Sprintf("image %d destroyed", id))
+		err = i.InstanceStore.Destroy(r.Context(), instance)
+		if err == nil {
+			err = i.Executor.DestroyInstance(r.Context(), instance.ID)
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to destroy instance")
 		}
 	}
 
 	logger.With("image", id).Info("destroying image")
-	err = i.ImageStore.Destroy(image)
+	err = i.ImageStore.Destroy(r.Context(), image)
 	if err != nil {
 		match, err := regexp.MatchString("instances_image_id_fkey", err.Error())
 		if err == nil && match == true {
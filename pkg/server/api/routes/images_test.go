@@ -43,7 +43,7 @@ func TestGetImage(t *testing.T) {
 	}
 
 	errorHandler := FakeErrorHandler{}
-	routeSet := Images{ImageStore: store}
+	routeSet := Images{ImageStore: store, ImageAccessRuleStore: openImageAccessRuleStore()}
 	router := mux.NewRouter()
 	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Get))
 	router.ServeHTTP(recorder, req)
@@ -73,7 +73,7 @@ func TestListImages(t *testing.T) {
 		},
 	}
 
-	handler := Images{ImageStore: store}.List
+	handler := Images{ImageStore: store, ImageAccessRuleStore: openImageAccessRuleStore()}.List
 	err := handler(recorder, req)
 
 	var response jsonapi.ManyPayload
@@ -84,6 +84,76 @@ func TestListImages(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestListImagesFiltersInaccessibleImages(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.AuthGroupsKey, []string{"data-team"}))
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1, BackedUpAt: timestamp(), CreatedAt: timestamp(), UpdatedAt: timestamp()},
+				{ID: 2, BackedUpAt: timestamp(), CreatedAt: timestamp(), UpdatedAt: timestamp()},
+				{ID: 3, BackedUpAt: timestamp(), CreatedAt: timestamp(), UpdatedAt: timestamp()},
+			}, nil
+		},
+	}
+
+	ruleStore := FakeImageAccessRuleStore{
+		_List: func() ([]models.ImageAccessRule, error) {
+			return []models.ImageAccessRule{
+				{ID: 1, ImageID: 2, UserEmail: "otheruser@draupnir"},
+				{ID: 2, ImageID: 3, UserEmail: "otheruser@draupnir"},
+				{ID: 3, ImageID: 3, GroupName: "data-team"},
+			}, nil
+		},
+	}
+
+	handler := Images{ImageStore: store, ImageAccessRuleStore: ruleStore}.List
+	err := handler(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, err)
+
+	var ids []string
+	for _, node := range response.Data {
+		ids = append(ids, node.ID)
+	}
+	assert.Equal(t, []string{"1", "3"}, ids)
+}
+
+func TestGetImageWithoutAccess(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	ruleStore := FakeImageAccessRuleStore{
+		_ListForImage: func(imageID int) ([]models.ImageAccessRule, error) {
+			assert.Equal(t, 1, imageID)
+			return []models.ImageAccessRule{{ID: 1, ImageID: 1, GroupName: "data-team"}}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, ImageAccessRuleStore: ruleStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
 func TestCreateImage(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateImageRequest{
@@ -159,6 +229,13 @@ func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 		},
 	}
 
+	destroyed := false
+	store._Destroy = func(image models.Image) error {
+		assert.Equal(t, 1, image.ID)
+		destroyed = true
+		return nil
+	}
+
 	executor := FakeExecutor{
 		_CreateBtrfsSubvolume: func(context.Context, int) error {
 			return errors.New("some btrfs error")
@@ -175,6 +252,7 @@ func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 	assert.Empty(t, recorder.Body.String())
 	assert.Empty(t, logs.String())
 	assert.Equal(t, "failed to create btrfs subvolume: some btrfs error", err.Error())
+	assert.True(t, destroyed, "the image is deleted")
 }
 
 func TestImageDone(t *testing.T) {
@@ -210,8 +288,13 @@ func TestImageDone(t *testing.T) {
 		},
 	}
 
+	refills := make([]string, 0)
 	errorHandler := FakeErrorHandler{}
-	routeSet := Images{ImageStore: store, Executor: executor}
+	routeSet := Images{
+		ImageStore: store,
+		Executor:   executor,
+		RefillPool: func(s string) { refills = append(refills, s) },
+	}
 	router := mux.NewRouter()
 	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
 	router.ServeHTTP(recorder, req)
@@ -221,6 +304,7 @@ func TestImageDone(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, recorder.Code)
 	assert.Equal(t, doneImageFixture, response)
+	assert.Equal(t, []string{"image"}, refills, "the pool is refilled with the new image")
 	assert.Nil(t, errorHandler.Error)
 }
 
@@ -265,23 +349,44 @@ func TestImageDestroy(t *testing.T) {
 		},
 	}
 
+	// Only the pooled instance is destroyed, as the user can't destroy other
+	// users' instances
+	destroyedInstances := make([]int, 0)
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				{ID: 1, ImageID: 1, Pooled: true},
+				{ID: 2, ImageID: 1, UserEmail: "other@draupnir"},
+				{ID: 3, ImageID: 2, Pooled: true},
+			}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			destroyedInstances = append(destroyedInstances, instance.ID)
+			return nil
+		},
+	}
+
 	executor := FakeExecutor{
 		_DestroyImage: func(ctx context.Context, imageID int) error {
 			assert.Equal(t, 1, imageID)
 			return nil
 		},
+		_DestroyInstance: func(ctx context.Context, id int) error {
+			return nil
+		},
 	}
 
 	errorHandler := FakeErrorHandler{}
 
 	router := mux.NewRouter()
-	routeSet := Images{ImageStore: store, Executor: executor}
+	routeSet := Images{ImageStore: store, InstanceStore: instanceStore, Executor: executor}
 	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
 
 	assert.Equal(t, http.StatusNoContent, recorder.Code)
 	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 	assert.Contains(t, logs.String(), "destroying image")
+	assert.Equal(t, []int{1}, destroyedInstances)
 	assert.Nil(t, errorHandler.Error)
 }
 
@@ -339,6 +444,12 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 		},
 	}
 
+	roleStore := FakeRoleAssignmentStore{
+		_ListForPrincipals: func([]string) ([]models.RoleAssignment, error) {
+			return []models.RoleAssignment{}, nil
+		},
+	}
+
 	errorHandler := FakeErrorHandler{}
 
 	router := mux.NewRouter()
@@ -349,6 +460,7 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 	}
 	route := chain.New(errorHandler.Handle).
 		Add(middleware.Authenticate(authenticator)).
+		Add(middleware.LoadPermissions(roleStore, auth.RoleUser)).
 		Resolve(routeSet.Destroy)
 	router.HandleFunc("/images/{id}", route).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
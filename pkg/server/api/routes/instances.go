@@ -1,8 +1,11 @@
 package routes
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -10,28 +13,46 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/gocardless/draupnir/pkg/connection"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/proxy"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
 	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tunnel"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
 )
 
+// tunnelDialTimeout bounds how long a tunnel waits to connect to its instance
+const tunnelDialTimeout = 10 * time.Second
+
 type Instances struct {
 	InstanceStore           store.InstanceStore
 	ImageStore              store.ImageStore
+	ImageAccessRuleStore    store.ImageAccessRuleStore
 	WhitelistedAddressStore store.WhitelistedAddressStore
 	ApplyWhitelist          func(string)
+	RefillPool              func(string)
 	Executor                exec.Executor
 	MinInstancePort         uint16
 	MaxInstancePort         uint16
+	// ProxyDomain and ProxyPort, when set, are where clients connect to
+	// instances through the proxy, instead of to each instance's own port
+	ProxyDomain string
+	ProxyPort   uint16
 }
 
 type CreateInstanceRequest struct {
-	ImageID string `jsonapi:"attr,image_id"`
+	ImageID                string `jsonapi:"attr,image_id"`
+	PasswordAuthentication bool   `jsonapi:"attr,password_authentication"`
+}
+
+type RotateInstanceCredentialsRequest struct {
+	RotateCA bool `jsonapi:"attr,rotate_ca"`
 }
 
 func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
@@ -59,49 +80,73 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image, err := i.ImageStore.Get(imageID)
+	image, err := i.ImageStore.Get(r.Context(), imageID)
 	if err != nil {
 		api.ImageNotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
+	accessible, err := canAccessImage(r, i.ImageAccessRuleStore, image.ID)
+	if err != nil {
+		return err
+	}
+
+	if !accessible {
+		api.ImageNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
 	if !image.Ready {
 		api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
 		return nil
 	}
 
-	refreshToken, ok := r.Context().Value(middleware.RefreshTokenKey).(string)
+	sessionID, ok := r.Context().Value(middleware.SessionIDKey).(string)
 	if !ok {
-		log.Fatal("Access token key is missing from context")
+		log.Fatal("Session ID key is missing from context")
 	}
+	// Instances created with an API key are destroyed once it's revoked
+	apiKeyID := middleware.GetAPIKeyID(r)
 
-	instance := models.NewInstance(imageID, email, refreshToken)
-	port, err := generateRandomFreePort(i.InstanceStore, i.MinInstancePort, i.MaxInstancePort)
+	ipaddr, err := middleware.GetUserIPAddress(r)
 	if err != nil {
 		return err
 	}
-	instance.Port = port
 
-	instance, err = i.InstanceStore.Create(instance)
+	// Claim an instance that was created in advance, if the pool has one,
+	// rather than making the user wait for one to be created. Pooled instances
+	// use certificate authentication, so instances using a password are always
+	// created.
+	var instance models.Instance
+	if req.PasswordAuthentication {
+		err = sql.ErrNoRows
+	} else {
+		instance, err = i.InstanceStore.Claim(r.Context(), imageID, email, sessionID, apiKeyID)
+	}
+	switch {
+	case err == nil:
+		metrics.InstancePoolClaimsTotal.WithLabelValues("hit").Inc()
+		logger.With("instance", instance.ID).Info("claimed pooled instance")
+		middleware.SetAuditResource(r, strconv.Itoa(instance.ID), fmt.Sprintf("image %d, from pool", imageID))
+		i.RefillPool("claim")
+	case err == sql.ErrNoRows:
+		metrics.InstancePoolClaimsTotal.WithLabelValues("miss").Inc()
+		instance = models.NewInstance(imageID, email, sessionID)
+		instance.APIKeyID = apiKeyID
+		instance.PasswordAuthentication = req.PasswordAuthentication
+		instance, err = i.create(r, instance)
+		if err != nil {
+			match, matchErr := regexp.MatchString("instances_image_id_fkey", err.Error())
+			if matchErr == nil && match == true {
+				logger.Info(err.Error())
+				api.ImageNotFoundError.Render(w, http.StatusNotFound)
+				return nil
+			}
 
-	if err != nil {
-		match, err := regexp.MatchString("instances_image_id_fkey", err.Error())
-		if err == nil && match == true {
-			logger.Info(err.Error())
-			api.ImageNotFoundError.Render(w, http.StatusNotFound)
-			return nil
+			return err
 		}
-
-		return errors.Wrap(err, "failed to create instance")
-	}
-
-	ipaddr, err := middleware.GetUserIPAddress(r)
-	if err != nil {
-		return err
-	}
-
-	if err := i.Executor.CreateInstance(r.Context(), imageID, instance.ID, int(instance.Port)); err != nil {
-		return errors.Wrap(err, "failed to create instance")
+	default:
+		return errors.Wrap(err, "failed to claim pooled instance")
 	}
 
 	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
@@ -116,17 +161,20 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 	creds := models.NewInstanceCredentials(
 		instance.ID,
 		string(files["ca.crt"]), string(files["client.crt"]), string(files["client.key"]),
+		string(files["password"]),
 	)
 	instance.Credentials = &creds
 
 	// Add the user's IP address to the whitelist
 	address := models.NewWhitelistedAddress(ipaddr, &instance)
-	address, err = i.WhitelistedAddressStore.Create(address)
+	address, err = i.WhitelistedAddressStore.Create(r.Context(), address)
 	if err != nil {
 		return errors.Wrap(err, "failed to record whitelisted IP address")
 	}
+	middleware.AddAuditEvent(r, "whitelist.add", "instance", strconv.Itoa(instance.ID), ipaddr)
 	i.ApplyWhitelist("api")
 
+	instance = i.viaProxy(instance)
 	w.WriteHeader(http.StatusCreated)
 	err = jsonapi.MarshalOnePayload(w, &instance)
 	if err != nil {
@@ -136,13 +184,53 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// create allocates a port to the instance, records it and creates it on disk
+func (i Instances) create(r *http.Request, instance models.Instance) (models.Instance, error) {
+	port, err := store.GenerateRandomFreePort(r.Context(), i.InstanceStore, i.MinInstancePort, i.MaxInstancePort)
+	if err != nil {
+		return instance, err
+	}
+	instance.Port = port
+
+	instance, err = i.InstanceStore.Create(r.Context(), instance)
+	if err != nil {
+		return instance, errors.Wrap(err, "failed to create instance")
+	}
+	middleware.SetAuditResource(r, strconv.Itoa(instance.ID), fmt.Sprintf("image %d", instance.ImageID))
+
+	if err := i.Executor.CreateInstance(r.Context(), instance.ImageID, instance.ID, int(instance.Port), instance.PasswordAuthentication); err != nil {
+		i.rollbackCreate(r, instance)
+		return instance, errors.Wrap(err, "failed to create instance")
+	}
+
+	return instance, nil
+}
+
+// rollbackCreate removes an instance whose creation failed part way through,
+// so that neither its row nor a half-created subvolume is left behind
+func (i Instances) rollbackCreate(r *http.Request, instance models.Instance) {
+	ctx, cancel := rollbackContext(r)
+	defer cancel()
+
+	logger := exec.GetLogger(ctx).With("instance", instance.ID)
+
+	// The subvolume may not have been created, in which case this fails
+	if err := i.Executor.DestroyInstance(ctx, instance.ID); err != nil {
+		logger.Info(errors.Wrap(err, "failed to destroy instance during rollback").Error())
+	}
+
+	if err := i.InstanceStore.Destroy(ctx, instance); err != nil {
+		logger.Error(errors.Wrap(err, "failed to delete instance during rollback").Error())
+	}
+}
+
 func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
 	email, err := middleware.GetAuthenticatedUser(r)
 	if err != nil {
 		return err
 	}
 
-	instances, err := i.InstanceStore.List()
+	instances, err := i.InstanceStore.List(r.Context())
 	if err != nil {
 		return errors.Wrap(err, "failed to get instances")
 	}
@@ -152,6 +240,7 @@ func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
 	_instances := make([]*models.Instance, 0)
 	for idx, instance := range instances {
 		if instance.UserEmail == email {
+			instances[idx] = i.viaProxy(instance)
 			_instances = append(_instances, &instances[idx])
 		}
 	}
@@ -168,11 +257,6 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	email, err := middleware.GetAuthenticatedUser(r)
-	if err != nil {
-		return err
-	}
-
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
@@ -180,14 +264,20 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	instance, err := i.InstanceStore.Get(id)
+	format := r.URL.Query().Get("format")
+	if format != "" && !connection.ValidFormat(format) {
+		api.InvalidFormatError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(r.Context(), id)
 	if err != nil {
 		logger.With("instance", id).Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
-	if email != instance.UserEmail {
+	if !canManageInstance(r, instance) {
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
@@ -209,17 +299,26 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 	creds := models.NewInstanceCredentials(
 		instance.ID,
 		string(files["ca.crt"]), string(files["client.crt"]), string(files["client.key"]),
+		string(files["password"]),
 	)
 	instance.Credentials = &creds
 
 	// Add the user's IP address to the whitelist
 	address := models.NewWhitelistedAddress(ipaddr, &instance)
-	address, err = i.WhitelistedAddressStore.Create(address)
+	address, err = i.WhitelistedAddressStore.Create(r.Context(), address)
 	if err != nil {
 		return errors.Wrap(err, "failed to record whitelisted IP address")
 	}
+	middleware.AddAuditEvent(r, "whitelist.add", "instance", strconv.Itoa(instance.ID), ipaddr)
 	i.ApplyWhitelist("api")
 
+	instance = i.viaProxy(instance)
+	if format != "" {
+		if err := addConnection(&creds, instance, format, r.URL.Query().Get("database")); err != nil {
+			return err
+		}
+	}
+
 	return errors.Wrap(
 		jsonapi.MarshalOnePayload(w, &instance),
 		"failed to marshal instance",
@@ -232,11 +331,6 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	email, err := middleware.GetAuthenticatedUser(r)
-	if err != nil {
-		return err
-	}
-
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
@@ -244,14 +338,14 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	instance, err := i.InstanceStore.Get(id)
+	instance, err := i.InstanceStore.Get(r.Context(), id)
 	if err != nil {
 		logger.With("instance", id).Info(err.Error())
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
-	if email != auth.UPLOAD_USER_EMAIL && email != instance.UserEmail {
+	if !canManageInstance(r, instance) {
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
@@ -262,7 +356,7 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return errors.Wrap(err, "failed to destroy instance on disk")
 	}
 
-	err = i.InstanceStore.Destroy(instance)
+	err = i.InstanceStore.Destroy(r.Context(), instance)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove instance from table")
 	}
@@ -276,33 +370,183 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func generateRandomFreePort(store store.InstanceStore, minPort uint16, maxPort uint16) (uint16, error) {
-	attempts := 0
-	port := uint16(0)
-	portAvailable := false
+// RotateCredentials issues the instance a new client certificate, and
+// optionally a new certificate authority and server certificate, and returns
+// the new credentials. Connections made with the old client certificate are
+// refused once Postgres has reloaded, unless only the client certificate was
+// rotated, in which case the old one remains valid until it expires.
+func (i Instances) RotateCredentials(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
 
-GetNewPort:
-	for !portAvailable {
-		attempts++
-		if attempts >= 100 {
-			return port, errors.Errorf("No free port found after %d attempts", attempts)
-		}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
 
-		rand.Seed(time.Now().Unix() + int64(time.Now().Nanosecond()))
-		port = minPort + uint16(rand.Intn(int(maxPort-minPort)))
+	instance, err := i.InstanceStore.Get(r.Context(), id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
 
-		instances, err := store.List()
-		if err != nil {
-			return port, errors.Wrap(err, "failed to list instances to determine free port")
-		}
+	if !canManageInstance(r, instance) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
 
-		for _, instance := range instances {
-			if instance.Port == port {
-				goto GetNewPort
-			}
-		}
-		portAvailable = true
+	req := RotateInstanceCredentialsRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.RotateCA {
+		middleware.SetAuditResource(r, strconv.Itoa(instance.ID), "including certificate authority")
+	}
+
+	logger.With("instance", id).With("rotate_ca", req.RotateCA).Info("rotating instance credentials")
+	err = i.Executor.RotateInstanceCredentials(r.Context(), instance.ID, req.RotateCA)
+	if err != nil {
+		return errors.Wrap(err, "failed to rotate instance credentials")
+	}
+
+	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve instance credentials")
+	}
+
+	creds := models.NewInstanceCredentials(
+		instance.ID,
+		string(files["ca.crt"]), string(files["client.crt"]), string(files["client.key"]),
+		string(files["password"]),
+	)
+	instance.Credentials = &creds
+
+	instance = i.viaProxy(instance)
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// viaProxy replaces the hostname and port of the instance with those that
+// clients use to connect to it through the proxy, if it's enabled
+func (i Instances) viaProxy(instance models.Instance) models.Instance {
+	if i.ProxyDomain == "" {
+		return instance
+	}
+
+	instance.Hostname = proxy.Hostname(instance.ID, i.ProxyDomain)
+	instance.Port = i.ProxyPort
+	return instance
+}
+
+// Tunnel relays a connection to the instance over the request's connection,
+// once it has been upgraded. The instance is reached on localhost, so the
+// client needn't be whitelisted, nor the instance's port reachable. Tunnels
+// carry Postgres' own TLS, and are closed when the server exits.
+func (i Instances) Tunnel(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !tunnel.IsUpgrade(r) {
+		api.UpgradeRequiredError.Render(w, http.StatusUpgradeRequired)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(r.Context(), id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !canManageInstance(r, instance) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	address := net.JoinHostPort("localhost", strconv.Itoa(int(instance.Port)))
+	backend, err := net.DialTimeout("tcp", address, tunnelDialTimeout)
+	if err != nil {
+		metrics.TunnelsTotal.WithLabelValues("error").Inc()
+		logger.With("instance", id).Info(errors.Wrap(err, "failed to connect to instance"))
+		api.InstanceUnreachableError.Render(w, http.StatusBadGateway)
+		return nil
+	}
+
+	conn, err := tunnel.Accept(w)
+	if err != nil {
+		metrics.TunnelsTotal.WithLabelValues("error").Inc()
+		backend.Close()
+		return err
+	}
+	metrics.TunnelsTotal.WithLabelValues("tunnelled").Inc()
+
+	logger = logger.With("instance", id)
+	logger.Info("Tunnel opened")
+
+	// The request completes once the tunnel is open, so that it's logged and
+	// audited straight away
+	go func() {
+		metrics.TunnelsActive.Inc()
+		defer metrics.TunnelsActive.Dec()
+
+		tunnel.Splice(conn, backend)
+		logger.Info("Tunnel closed")
+	}()
+
+	return nil
+}
+
+// addConnection adds the instance's connection details, rendered in format, to
+// its credentials, along with the credentials in the forms that Java expects
+func addConnection(creds *models.InstanceCredentials, instance models.Instance, format, database string) error {
+	if database == "" {
+		database = "postgres"
+	}
+
+	rendered, err := connection.Render(format, connection.New(instance, database, ""))
+	if err != nil {
+		return err
+	}
+
+	java, err := connection.ConvertForJava(*creds)
+	if err != nil {
+		return errors.Wrap(err, "failed to convert credentials")
+	}
+
+	creds.Connection = rendered
+	creds.ClientKeyPKCS8 = base64.StdEncoding.EncodeToString(java.ClientKeyPKCS8)
+	creds.KeyStore = base64.StdEncoding.EncodeToString(java.KeyStore)
+	creds.TrustStore = base64.StdEncoding.EncodeToString(java.TrustStore)
+	return nil
+}
+
+// canManageInstance reports whether the authenticated user may access the given
+// instance: either they own it, or they may manage every user's instances.
+func canManageInstance(r *http.Request, instance models.Instance) bool {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return false
 	}
 
-	return port, nil
+	return email == instance.UserEmail ||
+		middleware.HasPermission(r, auth.PermissionManageAllInstances)
 }
@@ -1,18 +1,25 @@
 package routes
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/gocardless/draupnir/pkg/certs"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/tunnel"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
@@ -31,6 +38,7 @@ func TestInstanceCreate(t *testing.T) {
 	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
 	instanceStore := FakeInstanceStore{
+		_Claim: emptyPool,
 		_Create: func(instance models.Instance) (models.Instance, error) {
 			assert.Equal(t, 1, instance.ImageID)
 			assert.Equal(t, uint16(5434), instance.Port, "port is 5434 (the only free port)")
@@ -85,7 +93,7 @@ func TestInstanceCreate(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, passwordAuthentication bool) error {
 			assert.Equal(t, 1, instanceID)
 			assert.Equal(t, 1, imageID)
 			return nil
@@ -99,6 +107,7 @@ func TestInstanceCreate(t *testing.T) {
 	routeSet := Instances{
 		InstanceStore:           instanceStore,
 		ImageStore:              imageStore,
+		ImageAccessRuleStore:    openImageAccessRuleStore(),
 		WhitelistedAddressStore: whitelistedAddressStore,
 		Executor:                executor,
 		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
@@ -116,6 +125,264 @@ func TestInstanceCreate(t *testing.T) {
 
 }
 
+// emptyPool is a FakeInstanceStore claim function for a pool with no instances
+func emptyPool(imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+	return models.Instance{}, sql.ErrNoRows
+}
+
+func TestInstanceCreateClaimsPooledInstance(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Claim: func(imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+			assert.Equal(t, 1, imageID)
+			assert.Equal(t, "test@draupnir", email)
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+			}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			assert.Equal(t, 1, addr.Instance.ID)
+			assert.Equal(t, "1.2.3.4", addr.IPAddress)
+			return addr, nil
+		},
+	}
+
+	// The instance already exists, so isn't created
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			assert.Equal(t, 1, id)
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	refills := make([]string, 0)
+	routeSet := Instances{
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		ImageAccessRuleStore:    openImageAccessRuleStore(),
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		RefillPool:              func(s string) { refills = append(refills, s) },
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"claim"}, refills, "the pool is refilled")
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, createInstanceFixture, response)
+}
+
+func TestInstanceCreateWithAPIKey(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.SessionIDKey, ""))
+	req = req.WithContext(context.WithValue(req.Context(), middleware.APIKeyIDKey, 3))
+
+	// The key is recorded on the instance, so that it's destroyed once the key
+	// is revoked
+	instanceStore := FakeInstanceStore{
+		_Claim: func(imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+			assert.Equal(t, 3, apiKeyID)
+			return models.Instance{}, sql.ErrNoRows
+		},
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, 3, instance.APIKeyID)
+			assert.Equal(t, "", instance.SessionID)
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: instanceStore,
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: 1, Ready: true}, nil
+			},
+		},
+		ImageAccessRuleStore: openImageAccessRuleStore(),
+		WhitelistedAddressStore: FakeWhitelistedAddressStore{
+			_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+				return addr, nil
+			},
+		},
+		Executor: FakeExecutor{
+			_CreateInstance: func(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+				return nil
+			},
+			_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+				return fakeCredentialsMap, nil
+			},
+		},
+		ApplyWhitelist:  func(s string) {},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5435,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+}
+
+func TestInstanceCreateWithPasswordAuthentication(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", PasswordAuthentication: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Claim: func(imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+			t.Fatal("pooled instances use certificate authentication, so can't be claimed")
+			return models.Instance{}, nil
+		},
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.True(t, instance.PasswordAuthentication)
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	credentials := map[string][]byte{"password": []byte("secret")}
+	for name, contents := range fakeCredentialsMap {
+		credentials[name] = contents
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+			assert.True(t, passwordAuthentication)
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return credentials, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		ImageAccessRuleStore:    openImageAccessRuleStore(),
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		MinInstancePort:         5432,
+		MaxInstancePort:         5435,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, true, response.Data.Attributes["password_authentication"])
+	if assert.Len(t, response.Included, 1) {
+		assert.Equal(t, "secret", response.Included[0].Attributes["password"])
+	}
+}
+
+func TestInstanceCreateRollsBackWhenCreationFails(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	// The request is cancelled, e.g. because the server is shutting down
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+
+	deleted := false
+	instanceStore := FakeInstanceStore{
+		_Claim: emptyPool,
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			instance.ID = 1
+			return instance, nil
+		},
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			assert.Equal(t, 1, instance.ID)
+			deleted = true
+			return nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	destroyed := false
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, passwordAuthentication bool) error {
+			cancel()
+			return ctx.Err()
+		},
+		_DestroyInstance: func(ctx context.Context, id int) error {
+			assert.Equal(t, 1, id)
+			assert.Nil(t, ctx.Err(), "the rollback isn't cancelled with the request")
+			destroyed = true
+			return nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:        instanceStore,
+		ImageStore:           imageStore,
+		ImageAccessRuleStore: openImageAccessRuleStore(),
+		Executor:             executor,
+		MinInstancePort:      5432,
+		MaxInstancePort:      5435,
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.EqualError(t, err, "failed to create instance: context canceled")
+	assert.True(t, destroyed, "the instance's subvolume is destroyed")
+	assert.True(t, deleted, "the instance's row is deleted")
+}
+
 func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateInstanceRequest{ImageID: "1"}
@@ -141,15 +408,16 @@ func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, passwordAuthentication bool) error {
 			return nil
 		},
 	}
 
 	routeSet := Instances{
-		InstanceStore: instanceStore,
-		ImageStore:    imageStore,
-		Executor:      executor,
+		InstanceStore:        instanceStore,
+		ImageStore:           imageStore,
+		ImageAccessRuleStore: openImageAccessRuleStore(),
+		Executor:             executor,
 	}
 	err := routeSet.Create(recorder, req)
 
@@ -161,6 +429,39 @@ func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestInstanceCreateWithInaccessibleImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	ruleStore := FakeImageAccessRuleStore{
+		_ListForImage: func(imageID int) ([]models.ImageAccessRule, error) {
+			return []models.ImageAccessRule{{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}}, nil
+		},
+	}
+
+	routeSet := Instances{
+		ImageStore:           imageStore,
+		ImageAccessRuleStore: ruleStore,
+		Executor:             FakeExecutor{},
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.ImageNotFoundError, response)
+	assert.Nil(t, err)
+}
+
 func TestInstanceCreateReturnsErrorWithInvalidPayload(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := map[string]string{"this is": "not a valid JSON API request payload"}
@@ -294,6 +595,144 @@ func TestInstanceGet(t *testing.T) {
 	assert.Equal(t, getInstanceFixture, response)
 }
 
+func TestInstanceGetViaProxy(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      6543,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			assert.Equal(t, uint16(6543), addr.Instance.Port, "the whitelist records the instance's own port")
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:           store,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		ApplyWhitelist:          func(s string) {},
+		Executor:                executor,
+		ProxyDomain:             "draupnir.example.com",
+		ProxyPort:               5432,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, "instance-1.draupnir.example.com", response.Data.Attributes["hostname"])
+	assert.Equal(t, float64(5432), response.Data.Attributes["port"])
+}
+
+func TestInstanceGetWithFormat(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1?format=jdbc&database=myapp", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	bundle, err := certs.GenerateInstanceBundle(1, certs.Options{KeyType: certs.KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return map[string][]byte{
+				"ca.crt":     bundle.CACertificate,
+				"client.crt": bundle.ClientCertificate,
+				"client.key": bundle.ClientKey,
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:           store,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		ApplyWhitelist:          func(s string) {},
+		Executor:                executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	if assert.Len(t, response.Included, 1) {
+		attributes := response.Included[0].Attributes
+		assert.Equal(
+			t,
+			"jdbc:postgresql://draupnir-server.example.com:5432/myapp?user=draupnir&sslmode=verify-ca&sslrootcert=ca.crt&sslkey=client.p12&sslpassword=changeit\n",
+			attributes["connection"],
+		)
+		assert.NotEmpty(t, attributes["client_key_pkcs8"])
+		assert.NotEmpty(t, attributes["keystore"])
+		assert.NotEmpty(t, attributes["truststore"])
+	}
+}
+
+func TestInstanceGetWithInvalidFormat(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1?format=yaml", nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.InvalidFormatError, response)
+}
+
 func TestInstanceGetFromWrongUser(t *testing.T) {
 	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
 
@@ -445,6 +884,12 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 		},
 	}
 
+	roleStore := FakeRoleAssignmentStore{
+		_ListForPrincipals: func([]string) ([]models.RoleAssignment, error) {
+			return []models.RoleAssignment{}, nil
+		},
+	}
+
 	errorHandler := FakeErrorHandler{}
 	routeSet := Instances{
 		InstanceStore:  store,
@@ -454,6 +899,7 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 	router := mux.NewRouter()
 	route := chain.New(errorHandler.Handle).
 		Add(middleware.Authenticate(authenticator)).
+		Add(middleware.LoadPermissions(roleStore, auth.RoleUser)).
 		Resolve(routeSet.Destroy)
 	router.HandleFunc("/instances/{id}", route).Methods("DELETE")
 	router.ServeHTTP(recorder, req)
@@ -462,3 +908,200 @@ func TestInstanceDestroyFromUploadUser(t *testing.T) {
 	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 	assert.Nil(t, errorHandler.Error)
 }
+
+func TestInstanceTunnel(t *testing.T) {
+	// The instance echoes everything sent to it
+	instance, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	go func() {
+		conn, err := instance.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+			return models.Instance{
+				ID:        1,
+				Port:      uint16(instance.Addr().(*net.TCPAddr).Port),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+	}
+
+	// The handler returns while the tunnel is still open, so we collect its
+	// error from the server's goroutine
+	errs := make(chan error, 1)
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		errs <- routeSet.Tunnel(w, r)
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _, _ := createRequest(t, r.Method, r.URL.String(), nil)
+		router.ServeHTTP(w, r.WithContext(req.Context()))
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/instances/1/tunnel", nil)
+	tunnel.SetUpgrade(req.Header)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len("hello"))
+	if _, err := io.ReadFull(reader, echoed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(echoed))
+	assert.Nil(t, <-errs)
+}
+
+func TestInstanceTunnelRequiresUpgrade(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/tunnel", nil)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/tunnel", errorHandler.Handle(routeSet.Tunnel))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusUpgradeRequired, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.UpgradeRequiredError, response)
+}
+
+func TestInstanceTunnelToUnreachableInstance(t *testing.T) {
+	// Find a port that nothing is listening on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/tunnel", nil)
+	tunnel.SetUpgrade(req.Header)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, Port: uint16(port), UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/tunnel", errorHandler.Handle(routeSet.Tunnel))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusBadGateway, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceRotateCredentials(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := RotateInstanceCredentialsRequest{RotateCA: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/credentials/rotate", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+	}
+
+	rotated := false
+	executor := FakeExecutor{
+		_RotateInstanceCredentials: func(ctx context.Context, id int, rotateCA bool) error {
+			assert.Equal(t, 1, id)
+			assert.True(t, rotateCA)
+			rotated = true
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			assert.True(t, rotated, "credentials are retrieved after they're rotated")
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/credentials/rotate", errorHandler.Handle(routeSet.RotateCredentials)).Methods("POST")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.True(t, rotated)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, getInstanceFixture, response)
+}
+
+func TestInstanceRotateCredentialsFromWrongUser(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := RotateInstanceCredentialsRequest{}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/credentials/rotate", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				UserEmail: "otheruser@draupnir",
+			}, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store, Executor: FakeExecutor{}}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/credentials/rotate", errorHandler.Handle(routeSet.RotateCredentials)).Methods("POST")
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
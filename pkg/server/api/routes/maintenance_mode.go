@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+)
+
+// MaintenanceModes is the route set for viewing, enabling and disabling
+// maintenance mode
+type MaintenanceModes struct {
+	MaintenanceModeStore store.MaintenanceModeStore
+}
+
+type EnableMaintenanceModeRequest struct {
+	Message string     `jsonapi:"attr,message"`
+	EndsAt  *time.Time `jsonapi:"attr,ends_at,iso8601,omitempty"`
+}
+
+func (m MaintenanceModes) Get(w http.ResponseWriter, r *http.Request) error {
+	mode, err := m.MaintenanceModeStore.Get(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get maintenance mode")
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &mode),
+		"failed to marshal maintenance mode",
+	)
+}
+
+func (m MaintenanceModes) Update(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	req := EnableMaintenanceModeRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.Message == "" {
+		api.MissingMaintenanceMessageError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	middleware.SetAuditResource(r, "", req.Message)
+
+	mode, err := m.MaintenanceModeStore.Enable(r.Context(), models.NewMaintenanceMode(req.Message, req.EndsAt, email))
+	if err != nil {
+		return errors.Wrap(err, "failed to enable maintenance mode")
+	}
+
+	logger.With("message", mode.Message).Info("enabled maintenance mode")
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &mode),
+		"failed to marshal maintenance mode",
+	)
+}
+
+func (m MaintenanceModes) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if err := m.MaintenanceModeStore.Disable(r.Context()); err != nil {
+		return errors.Wrap(err, "failed to disable maintenance mode")
+	}
+
+	logger.Info("disabled maintenance mode")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+func TestGetMaintenanceModeWhenDisabled(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/maintenance", nil)
+
+	store := FakeMaintenanceModeStore{
+		_Get: func() (models.MaintenanceMode, error) {
+			return models.MaintenanceMode{}, nil
+		},
+	}
+
+	err := MaintenanceModes{MaintenanceModeStore: store}.Get(recorder, req)
+
+	var response models.MaintenanceMode
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &response))
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.False(t, response.Enabled)
+}
+
+func TestEnableMaintenanceMode(t *testing.T) {
+	endsAt := time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC)
+
+	body := bytes.NewBuffer([]byte{})
+	request := EnableMaintenanceModeRequest{Message: "Resizing the data volume", EndsAt: &endsAt}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "PUT", "/admin/maintenance", body)
+
+	store := FakeMaintenanceModeStore{
+		_Enable: func(mode models.MaintenanceMode) (models.MaintenanceMode, error) {
+			assert.Equal(t, "Resizing the data volume", mode.Message)
+			assert.Equal(t, "test@draupnir", mode.EnabledBy)
+			assert.True(t, endsAt.Equal(*mode.EndsAt))
+			return mode, nil
+		},
+	}
+
+	err := MaintenanceModes{MaintenanceModeStore: store}.Update(recorder, req)
+
+	var response models.MaintenanceMode
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &response))
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, response.Enabled)
+	assert.Equal(t, "Resizing the data volume", response.Message)
+	assert.Contains(t, logs.String(), "enabled maintenance mode")
+}
+
+func TestEnableMaintenanceModeWithoutMessage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &EnableMaintenanceModeRequest{})
+	req, recorder, _ := createRequest(t, "PUT", "/admin/maintenance", body)
+
+	err := MaintenanceModes{}.Update(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.MissingMaintenanceMessageError, response)
+}
+
+func TestDisableMaintenanceMode(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/admin/maintenance", nil)
+
+	disabled := false
+	store := FakeMaintenanceModeStore{
+		_Disable: func() error {
+			disabled = true
+			return nil
+		},
+	}
+
+	err := MaintenanceModes{MaintenanceModeStore: store}.Destroy(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.True(t, disabled)
+}
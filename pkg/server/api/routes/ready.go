@@ -0,0 +1,35 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/health"
+)
+
+// Ready runs deeper checks than HealthCheck, to determine whether the server
+// is able to serve requests. It responds with 503 if any check fails.
+type Ready struct {
+	Checks  []health.Check
+	Timeout time.Duration
+}
+
+type readyResponse struct {
+	Status string          `json:"status"`
+	Checks []health.Result `json:"checks"`
+}
+
+func (rd Ready) Get(w http.ResponseWriter, r *http.Request) error {
+	results := health.Run(r.Context(), rd.Checks, rd.Timeout)
+
+	response := readyResponse{Status: health.StatusOK, Checks: results}
+	status := http.StatusOK
+	if !health.Healthy(results) {
+		response.Status = health.StatusFailing
+		status = http.StatusServiceUnavailable
+	}
+
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(response)
+}
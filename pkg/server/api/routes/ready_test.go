@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/health"
+)
+
+func TestReady(t *testing.T) {
+	passing := health.Check{Name: "database", Check: func(ctx context.Context) error { return nil }}
+	failing := health.Check{Name: "disk_space", Check: func(ctx context.Context) error { return errors.New("disk full") }}
+
+	testCases := []struct {
+		name           string
+		checks         []health.Check
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "all checks passing",
+			checks:         []health.Check{passing},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "ok",
+		},
+		{
+			name:           "a check failing",
+			checks:         []health.Check{passing, failing},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "failing",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/ready", nil)
+
+			errorHandler := FakeErrorHandler{}
+			handler := http.HandlerFunc(errorHandler.Handle(Ready{Checks: tc.checks, Timeout: time.Second}.Get))
+			handler.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+
+			var response readyResponse
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.expectedBody, response.Status)
+			assert.Len(t, response.Checks, len(tc.checks))
+		})
+	}
+
+	t.Run("failures are reported per check", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		Ready{Checks: []health.Check{passing, failing}, Timeout: time.Second}.Get(recorder, httptest.NewRequest("GET", "/ready", nil))
+
+		var response readyResponse
+		decodeJSON(t, recorder.Body, &response)
+		assert.Equal(t, health.StatusOK, response.Checks[0].Status)
+		assert.Equal(t, "disk_space", response.Checks[1].Name)
+		assert.Equal(t, "disk full", response.Checks[1].Error)
+	})
+}
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+)
+
+// RoleAssignments is the admin route set for managing which roles are granted
+// to users and groups.
+type RoleAssignments struct {
+	RoleAssignmentStore store.RoleAssignmentStore
+}
+
+type AssignRoleRequest struct {
+	Role string `jsonapi:"attr,role"`
+}
+
+func (a RoleAssignments) List(w http.ResponseWriter, r *http.Request) error {
+	assignments, err := a.RoleAssignmentStore.List(r.Context())
+	if err != nil {
+		return errors.Wrap(err, "failed to get role assignments")
+	}
+
+	_assignments := make([]*models.RoleAssignment, 0)
+	for idx := range assignments {
+		_assignments = append(_assignments, &assignments[idx])
+	}
+
+	return errors.Wrap(
+		jsonapi.MarshalManyPayload(w, _assignments),
+		"failed to marshal role assignments",
+	)
+}
+
+func (a RoleAssignments) Update(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	principal := mux.Vars(r)["principal"]
+
+	req := AssignRoleRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	middleware.SetAuditResource(r, principal, req.Role)
+
+	role, err := auth.ParseRole(req.Role)
+	if err != nil {
+		logger.Info(err.Error())
+		api.InvalidRoleError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	assignment, err := a.RoleAssignmentStore.Upsert(r.Context(), models.NewRoleAssignment(principal, string(role)))
+	if err != nil {
+		return errors.Wrap(err, "failed to assign role")
+	}
+
+	logger.With("principal", principal).With("role", role).Info("assigned role")
+
+	return errors.Wrap(
+		jsonapi.MarshalOnePayload(w, &assignment),
+		"failed to marshal role assignment",
+	)
+}
+
+func (a RoleAssignments) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	principal := mux.Vars(r)["principal"]
+	middleware.SetAuditResource(r, principal, "")
+
+	if err := a.RoleAssignmentStore.Destroy(r.Context(), principal); err != nil {
+		return errors.Wrap(err, "failed to remove role assignment")
+	}
+
+	logger.With("principal", principal).Info("removed role assignment")
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
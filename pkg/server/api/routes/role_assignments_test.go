@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignRole(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := AssignRoleRequest{Role: "image-publisher"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "PUT", "/admin/role_assignments/group:data-team", body)
+
+	store := FakeRoleAssignmentStore{
+		_Upsert: func(assignment models.RoleAssignment) (models.RoleAssignment, error) {
+			assert.Equal(t, "group:data-team", assignment.Principal)
+			assert.Equal(t, "image-publisher", assignment.Role)
+			assignment.CreatedAt = timestamp()
+			assignment.UpdatedAt = timestamp()
+			return assignment, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := RoleAssignments{RoleAssignmentStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/role_assignments/{principal}", errorHandler.Handle(routeSet.Update))
+	router.ServeHTTP(recorder, req)
+
+	var response models.RoleAssignment
+	err := jsonapi.UnmarshalPayload(recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "group:data-team", response.Principal)
+	assert.Equal(t, "image-publisher", response.Role)
+	assert.Contains(t, logs.String(), "assigned role")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestAssignUnknownRole(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := AssignRoleRequest{Role: "superuser"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "PUT", "/admin/role_assignments/test@draupnir", body)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := RoleAssignments{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/role_assignments/{principal}", errorHandler.Handle(routeSet.Update))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidRoleError, response)
+	assert.Nil(t, errorHandler.Error)
+}
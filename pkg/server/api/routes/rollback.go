@@ -0,0 +1,20 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// rollbackContext returns a context for undoing the effects of a failed
+// operation. The request's context may have been cancelled, by the client going
+// away or the server abandoning in-flight operations as it shuts down, so this
+// context is detached from it. It keeps the request's logger and span.
+func rollbackContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, r.Context().Value(middleware.LoggerKey))
+	ctx = trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+	return context.WithTimeout(ctx, middleware.RollbackTimeout)
+}
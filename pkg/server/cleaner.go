@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/certs"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/health"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
@@ -20,62 +25,285 @@ type InstanceCleaner struct {
 	instanceStore store.InstanceStore
 	executor      exec.Executor
 	authenticator auth.Authenticator
+	sessionStore  store.SessionStore
+	apiKeyStore   store.APIKeyStore
+	auditStore    store.AuditEventStore
+	heartbeat     *health.Heartbeat
+	// expiryWarning is how long before an instance's certificates expire that
+	// the cleaner starts warning about them
+	expiryWarning time.Duration
 }
 
-func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, authenticator auth.Authenticator) *InstanceCleaner {
+// CleanerAuditActor is the actor recorded in the audit log for instances
+// destroyed by the cleaner
+const CleanerAuditActor = "system:cleaner"
+
+// DefaultCertificateExpiryWarning is how long before an instance's
+// certificates expire that the cleaner warns about them, if
+// certificates.expiry_warning isn't configured
+const DefaultCertificateExpiryWarning = 7 * 24 * time.Hour
+
+func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, authenticator auth.Authenticator, sessionStore store.SessionStore, apiKeyStore store.APIKeyStore, auditStore store.AuditEventStore, heartbeat *health.Heartbeat, expiryWarning time.Duration) *InstanceCleaner {
 	return &InstanceCleaner{
 		logger:        logger,
 		sentryClient:  sentryClient,
 		instanceStore: instanceStore,
 		executor:      executor,
 		authenticator: authenticator,
+		sessionStore:  sessionStore,
+		apiKeyStore:   apiKeyStore,
+		auditStore:    auditStore,
+		heartbeat:     heartbeat,
+		expiryWarning: expiryWarning,
 	}
 }
 
-func (ic *InstanceCleaner) Start(ctx context.Context, interval time.Duration) error {
+// Start runs the cleaner every interval until stop is closed. Closing stop
+// doesn't interrupt an instance that is being destroyed: ctx is passed to the
+// cleaner's operations, and should only be cancelled if they must be abandoned.
+func (ic *InstanceCleaner) Start(ctx context.Context, stop <-chan struct{}, interval time.Duration) error {
 	// We need to add a logger to the context, as the exec package depends on one
 	// being present in order to log
 	ctx = context.WithValue(ctx, middleware.LoggerKey, &ic.logger)
+	ic.heartbeat.Beat()
 	for {
 		select {
 		case <-time.After(interval):
-			ic.logger.Info("Cleaning old instances with invalid tokens")
-			instances, err := ic.instanceStore.List()
-			if err != nil {
-				err = errors.Wrap(err, "cannot clean instances: unable to list instances")
-				ic.logger.Error(err.Error())
-				ic.sentryClient.CaptureError(err, map[string]string{})
-			} else {
-				for _, instance := range instances {
-					if instance.RefreshToken != "" {
-						valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(instance.RefreshToken)
-						if err != nil {
-							err = errors.Wrap(err, "failed to validate token")
-							ic.logger.With("instance", instance.ID).Error(err.Error())
-							ic.sentryClient.CaptureError(err, map[string]string{})
-						} else if !valid {
-							logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
-							logger.Infof("Token for instance invalid: destroying instance: %s", validityErr.Error())
-							err = ic.destroyInstance(ctx, instance)
-							if err != nil {
-								err = errors.Wrap(err, "failed to destroy instance")
-								logger.Error(err.Error())
-								ic.sentryClient.CaptureError(err, map[string]string{})
-							}
-						}
-					}
-				}
-			}
-		case <-ctx.Done():
+			ic.clean(ctx, stop)
+			ic.heartbeat.Beat()
+		case <-stop:
 			return nil
 		}
 	}
 }
 
-func (ic *InstanceCleaner) destroyInstance(ctx context.Context, instance models.Instance) error {
+func (ic *InstanceCleaner) clean(ctx context.Context, stop <-chan struct{}) {
+	ctx, span := tracer.Start(ctx, "InstanceCleaner.clean")
+	defer span.End()
+
+	ic.logger.Info("Cleaning old instances with invalid tokens")
+	metrics.CleanerRunsTotal.Inc()
+
+	verified := ic.verifySessions(ctx, stop)
+	revoked := ic.revokedSessions(ctx, verified)
+	revokedKeys := ic.revokedAPIKeys(ctx)
+
+	instances, err := ic.instanceStore.List(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "cannot clean instances: unable to list instances")
+		ic.logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+		return
+	}
+
+	for _, instance := range instances {
+		select {
+		case <-stop:
+			ic.logger.Info("Cleaner stopped, skipping remaining instances")
+			return
+		default:
+		}
+
+		if ic.destroyIfSessionRevoked(ctx, instance, revoked) {
+			continue
+		}
+
+		if ic.destroyIfAPIKeyRevoked(ctx, instance, revokedKeys) {
+			continue
+		}
+
+		ic.warnIfCertificatesExpiring(ctx, instance)
+	}
+}
+
+// verifySessions checks with the identity provider that each session's user
+// is still allowed to authenticate, and revokes the sessions of those who
+// aren't, e.g. because they've been suspended or have revoked their token. It
+// returns the users with a session that wasn't revoked, or nil if not every
+// session was checked.
+func (ic *InstanceCleaner) verifySessions(ctx context.Context, stop <-chan struct{}) map[string]bool {
+	sessions, err := ic.sessionStore.ListToVerify(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "cannot verify sessions: unable to list sessions")
+		ic.logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+		return nil
+	}
+
+	verified := make(map[string]bool)
+	for _, session := range sessions {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		logger := ic.logger.With("user", session.UserEmail)
+
+		valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(session.RefreshToken)
+		if err != nil {
+			// The session is left as it is until it can be checked
+			err = errors.Wrap(err, "failed to validate token")
+			logger.Error(err.Error())
+			ic.sentryClient.CaptureError(err, map[string]string{})
+			verified[session.UserEmail] = true
+			continue
+		}
+		if valid {
+			verified[session.UserEmail] = true
+			continue
+		}
+
+		logger.Infof("Token for session invalid: revoking session: %s", validityErr.Error())
+		if err := ic.sessionStore.Revoke(ctx, session.ID, validityErr.Error()); err != nil {
+			err = errors.Wrap(err, "failed to revoke session")
+			logger.Error(err.Error())
+			ic.sentryClient.CaptureError(err, map[string]string{})
+		}
+	}
+	return verified
+}
+
+// revokedSessions returns why each revoked session was revoked, keyed by the
+// session's ID. The refresh token of a session that has been logged out of is
+// revoked, so its instances are only kept while its user has a verified
+// session, and are left alone if verified is nil. If the sessions can't be
+// listed, none are returned.
+func (ic *InstanceCleaner) revokedSessions(ctx context.Context, verified map[string]bool) map[string]string {
+	reasons := make(map[string]string)
+
+	sessions, err := ic.sessionStore.ListRevoked(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "unable to list revoked sessions")
+		ic.logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+		return reasons
+	}
+
+	for _, session := range sessions {
+		if session.RevocationReason != store.LoggedOutReason {
+			reasons[session.ID] = session.RevocationReason
+			continue
+		}
+		if verified != nil && !verified[session.UserEmail] {
+			reasons[session.ID] = "logged out, with no other session to verify the user"
+		}
+	}
+	return reasons
+}
+
+// revokedAPIKeys returns why each API key that's no longer accepted isn't,
+// keyed by the key's ID. If the keys can't be listed, none are returned.
+func (ic *InstanceCleaner) revokedAPIKeys(ctx context.Context) map[int]string {
+	reasons := make(map[int]string)
+
+	keys, err := ic.apiKeyStore.List(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "unable to list API keys")
+		ic.logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+		return reasons
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		switch {
+		case key.RevokedAt != nil:
+			reasons[key.ID] = "API key revoked"
+		case key.Expired(now):
+			reasons[key.ID] = "API key expired"
+		}
+	}
+	return reasons
+}
+
+// destroyIfSessionRevoked destroys the instance if the session it was created
+// in has been revoked, and reports whether it did
+func (ic *InstanceCleaner) destroyIfSessionRevoked(ctx context.Context, instance models.Instance, revoked map[string]string) bool {
+	if instance.SessionID == "" {
+		return false
+	}
+
+	reason, ok := revoked[instance.SessionID]
+	if !ok {
+		return false
+	}
+
+	ic.destroyRevokedInstance(ctx, instance, "Session for instance revoked", reason)
+	return true
+}
+
+// destroyIfAPIKeyRevoked destroys the instance if the API key it was created
+// with has been revoked or has expired, and reports whether it did
+func (ic *InstanceCleaner) destroyIfAPIKeyRevoked(ctx context.Context, instance models.Instance, revoked map[int]string) bool {
+	if instance.APIKeyID == 0 {
+		return false
+	}
+
+	reason, ok := revoked[instance.APIKeyID]
+	if !ok {
+		return false
+	}
+
+	ic.destroyRevokedInstance(ctx, instance, "API key for instance revoked", reason)
+	return true
+}
+
+func (ic *InstanceCleaner) destroyRevokedInstance(ctx context.Context, instance models.Instance, message, reason string) {
+	logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
+	logger.Infof("%s: destroying instance: %s", message, reason)
+	err := ic.destroyInstance(ctx, instance, reason)
+	metrics.CleanerDeletionsTotal.WithLabelValues(metrics.Outcome(err)).Inc()
+	if err != nil {
+		err = errors.Wrap(err, "failed to destroy instance")
+		logger.Error(err.Error())
+		ic.sentryClient.CaptureError(err, map[string]string{})
+	}
+}
+
+// warnIfCertificatesExpiring logs a warning for each of the instance's
+// certificates that expires within the warning period, so that they can be
+// rotated before connections start failing
+func (ic *InstanceCleaner) warnIfCertificatesExpiring(ctx context.Context, instance models.Instance) {
+	logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
+
+	files, err := ic.executor.RetrieveInstanceCredentials(ctx, instance.ID)
+	if err != nil {
+		logger.Info(errors.Wrap(err, "failed to retrieve instance credentials").Error())
+		return
+	}
+
+	for _, name := range []string{"ca.crt", "server.crt", "client.crt"} {
+		expiresAt, err := certs.ExpiresAt(files[name])
+		if err != nil {
+			logger.With("certificate", name).Info(errors.Wrap(err, "failed to parse certificate").Error())
+			continue
+		}
+
+		if time.Until(expiresAt) < ic.expiryWarning {
+			logger.
+				With("certificate", name).
+				With("expires_at", expiresAt.Format(time.RFC3339)).
+				Warn("Instance certificate expires soon: rotate its credentials")
+		}
+	}
+}
+
+func (ic *InstanceCleaner) destroyInstance(ctx context.Context, instance models.Instance, reason string) error {
 	err := ic.executor.DestroyInstance(ctx, instance.ID)
 	if err == nil {
-		err = ic.instanceStore.Destroy(instance)
+		err = ic.instanceStore.Destroy(ctx, instance)
 	}
+
+	event := models.NewAuditEvent(CleanerAuditActor, "instance.destroy", "instance", strconv.Itoa(instance.ID), "")
+	event.Detail = fmt.Sprintf("owner %s: %s", instance.UserEmail, reason)
+	event.Outcome = models.AuditOutcomeSuccess
+	if err != nil {
+		event.Outcome = models.AuditOutcomeFailure
+	}
+	if _, auditErr := ic.auditStore.Create(ctx, event); auditErr != nil {
+		ic.logger.With("instance", instance.ID).Error(errors.Wrap(auditErr, "failed to record audit event").Error())
+	}
+
 	return err
 }
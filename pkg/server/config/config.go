@@ -22,6 +22,89 @@ type OAuthConfig struct {
 	RedirectURL  string `toml:"redirect_url"`
 	ClientID     string `toml:"client_id"`
 	ClientSecret string `toml:"client_secret"`
+	// IssuerURL is the OpenID Connect identity provider that users
+	// authenticate with, whose endpoints and keys are discovered from it.
+	// Defaults to "https://accounts.google.com".
+	IssuerURL string `toml:"issuer_url" required:"false"`
+	// Scopes are requested from the identity provider. Defaults to "openid"
+	// and "email". Providers other than Google generally need
+	// "offline_access" to issue refresh tokens.
+	Scopes []string `toml:"scopes" required:"false"`
+	// EmailClaim is the ID token claim that holds the user's email address.
+	// Defaults to "email".
+	EmailClaim string `toml:"email_claim" required:"false"`
+	// GroupsClaim is the ID token claim that lists the user's groups. Defaults
+	// to "groups".
+	GroupsClaim string `toml:"groups_claim" required:"false"`
+	// AllowedGroups, if set, only lets members of these groups authenticate
+	AllowedGroups []string `toml:"allowed_groups" required:"false"`
+	// HandshakeStore is where OAuth flows that clients are waiting on are
+	// held: "memory" or "postgres". Servers running more than one replica must
+	// use "postgres", as the callback may be served by any of them. Defaults
+	// to "memory".
+	HandshakeStore string `toml:"handshake_store" required:"false"`
+}
+
+// SessionConfig configures the session tokens that draupnir issues once users
+// have authenticated
+type SessionConfig struct {
+	// Secret is the key that session tokens are signed with. It must be shared
+	// by every server behind the same domain. It's required, except in the
+	// test environment, where a key is generated at startup if it's unset.
+	Secret string `toml:"secret" required:"false"`
+	// Duration is how long session tokens are valid for. Defaults to 168h.
+	Duration string `toml:"duration" required:"false"`
+}
+
+// TracingConfig holds Draupnir's OpenTelemetry tracing configuration
+type TracingConfig struct {
+	// Exporter is either "otlp" or "stdout". Tracing is disabled if unset.
+	Exporter string `toml:"exporter" required:"false"`
+	// Endpoint is the host:port of the OTLP/HTTP collector. If unset, the
+	// standard OTEL_EXPORTER_OTLP_* environment variables are respected.
+	Endpoint string `toml:"endpoint" required:"false"`
+	Insecure bool   `toml:"insecure" required:"false"`
+	// SampleRatio is the fraction of traces that are sampled. Defaults to 1.
+	SampleRatio float64 `toml:"sample_ratio" required:"false"`
+}
+
+// CertificatesConfig configures the certificates generated for each instance
+type CertificatesConfig struct {
+	// KeyType is "rsa", "ecdsa" or "ed25519". Defaults to "rsa".
+	KeyType string `toml:"key_type" required:"false"`
+	// KeySize is the size of RSA keys in bits, or of the ECDSA curve. Defaults
+	// to 2048 for RSA and 256 for ECDSA.
+	KeySize int `toml:"key_size" required:"false"`
+	// Validity is how long client certificates are valid for. Defaults to 720h.
+	Validity string `toml:"validity" required:"false"`
+	// AuthorityValidity is how long each instance's CA and server certificate
+	// are valid for. Defaults to 87600h.
+	AuthorityValidity string `toml:"authority_validity" required:"false"`
+	// ExpiryWarning is how long before certificates expire that the cleaner
+	// warns about them. Defaults to 168h.
+	ExpiryWarning string `toml:"expiry_warning" required:"false"`
+}
+
+// ProxyConfig configures the proxy that exposes every instance on one port
+type ProxyConfig struct {
+	// ListenAddress is the address the proxy listens on, e.g. ":5432". The
+	// proxy is disabled if it's unset.
+	ListenAddress string `toml:"listen_address" required:"false"`
+	// Domain is the domain instances are reached under, as
+	// instance-<id>.<domain>. Required if the proxy is enabled.
+	Domain string `toml:"domain" required:"false"`
+	// PublicPort is the port clients connect to the proxy on. Defaults to the
+	// port of ListenAddress.
+	PublicPort uint16 `toml:"public_port" required:"false"`
+	// Mode is "passthrough" or "terminate". Defaults to "passthrough".
+	Mode string `toml:"mode" required:"false"`
+	// BindInstancesToLocalhost makes new instances only accept connections
+	// from localhost, i.e. the proxy
+	BindInstancesToLocalhost bool `toml:"bind_instances_to_localhost" required:"false"`
+	// ProxyProtocol reads the client's address from the PROXY protocol header
+	// sent by load balancers in TrustedProxyCIDRs. Without it, connections
+	// from those addresses are refused when whitelisting is enabled.
+	ProxyProtocol bool `toml:"proxy_protocol" required:"false"`
 }
 
 // Config holds all Draupnir configuration
@@ -29,7 +112,7 @@ type Config struct {
 	DatabaseURL            string      `toml:"database_url"`
 	DataPath               string      `toml:"data_path"`
 	Environment            string      `toml:"environment"`
-	SharedSecret           string      `toml:"shared_secret"`
+	SharedSecret           string      `toml:"shared_secret" required:"false"`
 	TrustedUserEmailDomain string      `toml:"trusted_user_email_domain"`
 	PublicHostname         string      `toml:"public_hostname"`
 	SentryDsn              string      `toml:"sentry_dsn" required:"false"`
@@ -42,6 +125,28 @@ type Config struct {
 	WhitelisterInterval    string      `toml:"whitelist_reconcile_interval"`
 	TrustedProxyCIDRs      []string    `toml:"trusted_proxy_cidrs" required:"false"`
 	UseXForwardedFor       bool        `toml:"use_x_forwarded_for" required:"false"`
+	// AccessGroups maps a group name to the email addresses of its members.
+	// Groups can be referenced by image access rules.
+	AccessGroups map[string][]string `toml:"access_groups" required:"false"`
+	// DefaultRole is granted to users who have no role assigned directly to
+	// them. Defaults to "user".
+	DefaultRole string `toml:"default_role" required:"false"`
+	// MinFreeDiskPercent is the free space on the data volume below which the
+	// server reports itself as not ready. Defaults to 5.
+	MinFreeDiskPercent float64       `toml:"min_free_disk_percent" required:"false"`
+	TracingConfig      TracingConfig `toml:"tracing" required:"false"`
+	// ShutdownTimeout is how long in-flight requests are given to complete
+	// when the server receives SIGTERM. Defaults to 2m.
+	ShutdownTimeout string `toml:"shutdown_timeout" required:"false"`
+	// InstancePoolSize is the number of instances of the latest image that are
+	// created in advance, ready to be claimed. Defaults to 0, disabling the pool.
+	InstancePoolSize int `toml:"instance_pool_size" required:"false"`
+	// InstancePoolInterval is how often the pool is refilled, in addition to
+	// whenever an instance is claimed. Defaults to 1m.
+	InstancePoolInterval string             `toml:"instance_pool_refill_interval" required:"false"`
+	CertificatesConfig   CertificatesConfig `toml:"certificates" required:"false"`
+	ProxyConfig          ProxyConfig        `toml:"proxy" required:"false"`
+	SessionConfig        SessionConfig      `toml:"sessions" required:"false"`
 }
 
 // Load parses and validates the server config file located at `path`
@@ -69,6 +174,11 @@ func validateConfig(cfg Config) error {
 	cfgValue := reflect.ValueOf(&cfg).Elem()
 	cfgType := reflect.TypeOf(cfg)
 	emptyFields := emptyConfigFields(cfgValue, cfgType)
+	// Sessions signed with a generated key are rejected by other replicas, and
+	// after a restart, so the secret can only be left out in tests
+	if cfg.SessionConfig.Secret == "" && cfg.Environment != "test" {
+		emptyFields = append(emptyFields, "sessions.secret")
+	}
 	if len(emptyFields) > 0 {
 		return fmt.Errorf("Missing required fields: %v", emptyFields)
 	}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/health"
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultInstancePoolInterval is how often the instance pool is refilled, if
+// instance_pool_refill_interval isn't configured
+const DefaultInstancePoolInterval = time.Minute
+
+// InstancePool keeps a number of instances of the latest image created in
+// advance, so that users don't have to wait for an instance to be created.
+// Pooled instances belong to nobody until they're claimed, at which point
+// they're indistinguishable from an instance created for the user.
+//
+// Instances are created one at a time, and only join the pool once they have
+// been created. The pool is the only creator of instances without an owner, so
+// any unpooled instance without an owner was left behind by a refill that was
+// interrupted, and is discarded.
+//
+// The pool isn't refilled while maintenance mode is enabled, so that instances
+// are neither created nor destroyed during maintenance.
+type InstancePool struct {
+	logger               log.Logger
+	sentryClient         *raven.Client
+	imageStore           store.ImageStore
+	instanceStore        store.InstanceStore
+	maintenanceModeStore store.MaintenanceModeStore
+	executor             exec.Executor
+	size                 int
+	minInstancePort      uint16
+	maxInstancePort      uint16
+	refillTrigger        chan string
+	heartbeat            *health.Heartbeat
+}
+
+func NewInstancePool(logger log.Logger, sentryClient *raven.Client, imageStore store.ImageStore, instanceStore store.InstanceStore, maintenanceModeStore store.MaintenanceModeStore, executor exec.Executor, size int, minInstancePort, maxInstancePort uint16, heartbeat *health.Heartbeat) *InstancePool {
+	return &InstancePool{
+		logger:               logger,
+		sentryClient:         sentryClient,
+		imageStore:           imageStore,
+		instanceStore:        instanceStore,
+		maintenanceModeStore: maintenanceModeStore,
+		executor:             executor,
+		size:                 size,
+		minInstancePort:      minInstancePort,
+		maxInstancePort:      maxInstancePort,
+		// A refill covers every request made before it starts, so there's no
+		// need to queue more than one
+		refillTrigger: make(chan string, 1),
+		heartbeat:     heartbeat,
+	}
+}
+
+// Start refills the pool immediately, then every interval and whenever a
+// refill is triggered, until stop is closed. Closing stop doesn't interrupt an
+// instance that is being created: ctx is passed to the pool's operations, and
+// should only be cancelled if they must be abandoned.
+func (p *InstancePool) Start(ctx context.Context, stop <-chan struct{}, interval time.Duration) error {
+	// The exec package depends on a logger being present in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &p.logger)
+	p.heartbeat.Beat()
+	for {
+		p.refill(ctx, stop)
+		p.heartbeat.Beat()
+
+		select {
+		case <-time.After(interval):
+		case source := <-p.refillTrigger:
+			p.logger.With("source", source).Debug("Pool refill triggered")
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// TriggerRefill requests that the pool is refilled, e.g. because an instance
+// has just been claimed from it. It never blocks.
+func (p *InstancePool) TriggerRefill(source string) {
+	select {
+	case p.refillTrigger <- source:
+	default:
+		// A refill is already pending
+	}
+}
+
+func (p *InstancePool) refill(ctx context.Context, stop <-chan struct{}) {
+	ctx, span := tracer.Start(ctx, "InstancePool.refill")
+	defer span.End()
+
+	if p.underMaintenance(ctx) {
+		return
+	}
+
+	images, err := p.imageStore.List(ctx)
+	if err != nil {
+		p.reportError(errors.Wrap(err, "cannot refill pool: unable to list images"))
+		return
+	}
+	latest, found := latestReadyImage(images)
+
+	instances, err := p.instanceStore.List(ctx)
+	if err != nil {
+		p.reportError(errors.Wrap(err, "cannot refill pool: unable to list instances"))
+		return
+	}
+
+	// Keep up to size instances of the latest image, and discard the rest:
+	// those of older images, any in excess of the pool's size, and any left
+	// behind by an interrupted refill.
+	pooled := 0
+	for _, instance := range instances {
+		if instance.UserEmail != "" {
+			continue
+		}
+		if instance.Pooled && found && instance.ImageID == latest.ID && pooled < p.size {
+			pooled++
+			continue
+		}
+		if err := p.discard(ctx, instance); err != nil {
+			p.reportError(errors.Wrap(err, "failed to discard pooled instance"))
+		}
+	}
+
+	for found && pooled < p.size {
+		select {
+		case <-stop:
+			p.logger.Info("Pool stopped, skipping remaining instances")
+			metrics.InstancePoolSize.Set(float64(pooled))
+			return
+		default:
+		}
+
+		// Maintenance mode may have been enabled since the refill started
+		if p.underMaintenance(ctx) {
+			break
+		}
+
+		if err := p.create(ctx, latest.ID); err != nil {
+			// Retry at the next refill, rather than repeatedly failing now
+			p.reportError(errors.Wrap(err, "failed to create pooled instance"))
+			break
+		}
+		pooled++
+		p.heartbeat.Beat()
+	}
+
+	metrics.InstancePoolSize.Set(float64(pooled))
+}
+
+// create creates an instance of the image and adds it to the pool
+func (p *InstancePool) create(ctx context.Context, imageID int) error {
+	port, err := store.GenerateRandomFreePort(ctx, p.instanceStore, p.minInstancePort, p.maxInstancePort)
+	if err != nil {
+		return err
+	}
+
+	instance := models.NewPooledInstance(imageID)
+	instance.Port = port
+	instance, err = p.instanceStore.Create(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to record instance")
+	}
+
+	logger := p.logger.With("instance", instance.ID).With("image", imageID)
+
+	if err := p.executor.CreateInstance(ctx, imageID, instance.ID, int(instance.Port), false); err != nil {
+		// ctx may have been cancelled, so the rollback is detached from it
+		rollbackCtx, cancel := context.WithTimeout(context.Background(), middleware.RollbackTimeout)
+		defer cancel()
+		rollbackCtx = context.WithValue(rollbackCtx, middleware.LoggerKey, &p.logger)
+		rollbackCtx = trace.ContextWithSpan(rollbackCtx, trace.SpanFromContext(ctx))
+
+		if discardErr := p.discard(rollbackCtx, instance); discardErr != nil {
+			logger.Error(errors.Wrap(discardErr, "failed to discard instance during rollback").Error())
+		}
+		return errors.Wrap(err, "failed to create instance")
+	}
+
+	if _, err := p.instanceStore.MarkAsPooled(ctx, instance); err != nil {
+		return errors.Wrap(err, "failed to add instance to pool")
+	}
+
+	logger.Info("Created pooled instance")
+	return nil
+}
+
+// underMaintenance reports whether maintenance mode is enabled, in which case
+// the pool mustn't be refilled. If it can't be determined, the pool isn't
+// refilled either.
+func (p *InstancePool) underMaintenance(ctx context.Context) bool {
+	mode, err := p.maintenanceModeStore.Get(ctx)
+	if err != nil {
+		p.reportError(errors.Wrap(err, "cannot refill pool: unable to get maintenance mode"))
+		return true
+	}
+
+	if mode.Enabled {
+		p.logger.Info("Maintenance mode enabled, skipping pool refill")
+	}
+	return mode.Enabled
+}
+
+// discard destroys an instance that nobody owns. The instance is removed from
+// the pool before it's destroyed, so that it can't be claimed in the meantime.
+// If it has been claimed since it was listed, it's left alone.
+func (p *InstancePool) discard(ctx context.Context, instance models.Instance) error {
+	logger := p.logger.With("instance", instance.ID).With("image", instance.ImageID)
+
+	removed, err := p.instanceStore.DestroyUnowned(ctx, instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove instance from pool")
+	}
+	if !removed {
+		logger.Info("Pooled instance has been claimed, not discarding it")
+		return nil
+	}
+
+	logger.Info("Discarding pooled instance")
+
+	if err := p.executor.DestroyInstance(ctx, instance.ID); err != nil {
+		// An instance that never joined the pool may never have been created,
+		// in which case there's nothing to destroy
+		if instance.Pooled {
+			return errors.Wrap(err, "failed to destroy instance")
+		}
+		logger.Info(errors.Wrap(err, "failed to destroy instance").Error())
+	}
+
+	return nil
+}
+
+func (p *InstancePool) reportError(err error) {
+	p.logger.Error(err.Error())
+	p.sentryClient.CaptureError(err, map[string]string{})
+}
+
+// latestReadyImage returns the most recently updated image that is ready,
+// which is the image the CLI creates instances from by default
+func latestReadyImage(images []models.Image) (models.Image, bool) {
+	sorted := make([]models.Image, len(images))
+	copy(sorted, images)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].UpdatedAt.After(sorted[j].UpdatedAt)
+	})
+
+	for _, image := range sorted {
+		if image.Ready {
+			return image, true
+		}
+	}
+
+	return models.Image{}, false
+}
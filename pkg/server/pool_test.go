@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/health"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// fakePoolInstanceStore holds instances in memory, claiming and destroying
+// them with the same guarantees as the database store
+type fakePoolInstanceStore struct {
+	mutex     sync.Mutex
+	nextID    int
+	instances map[int]models.Instance
+	// beforeDestroyUnowned, if set, is called before an instance is destroyed,
+	// e.g. to claim it in the meantime
+	beforeDestroyUnowned func(models.Instance)
+}
+
+func newFakePoolInstanceStore(instances ...models.Instance) *fakePoolInstanceStore {
+	s := &fakePoolInstanceStore{nextID: 100, instances: map[int]models.Instance{}}
+	for _, instance := range instances {
+		s.instances[instance.ID] = instance
+	}
+	return s
+}
+
+func (s *fakePoolInstanceStore) Create(ctx context.Context, instance models.Instance) (models.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextID++
+	instance.ID = s.nextID
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s *fakePoolInstanceStore) List(ctx context.Context) ([]models.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instances := make([]models.Instance, 0, len(s.instances))
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances, nil
+}
+
+func (s *fakePoolInstanceStore) Get(ctx context.Context, id int) (models.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instance, ok := s.instances[id]
+	if !ok {
+		return instance, sql.ErrNoRows
+	}
+	return instance, nil
+}
+
+func (s *fakePoolInstanceStore) Destroy(ctx context.Context, instance models.Instance) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.instances, instance.ID)
+	return nil
+}
+
+func (s *fakePoolInstanceStore) UpdateOwner(ctx context.Context, instance models.Instance, email string) (models.Instance, error) {
+	return instance, errors.New("not implemented")
+}
+
+func (s *fakePoolInstanceStore) MarkAsPooled(ctx context.Context, instance models.Instance) (models.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instance = s.instances[instance.ID]
+	instance.Pooled = true
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s *fakePoolInstanceStore) Claim(ctx context.Context, imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ids := make([]int, 0)
+	for id, instance := range s.instances {
+		if instance.Pooled && instance.ImageID == imageID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return models.Instance{}, sql.ErrNoRows
+	}
+	sort.Ints(ids)
+
+	instance := s.instances[ids[0]]
+	instance.Pooled = false
+	instance.UserEmail = email
+	instance.SessionID = sessionID
+	instance.APIKeyID = apiKeyID
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s *fakePoolInstanceStore) DestroyUnowned(ctx context.Context, instance models.Instance) (bool, error) {
+	if s.beforeDestroyUnowned != nil {
+		s.beforeDestroyUnowned(instance)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, ok := s.instances[instance.ID]
+	if !ok || current.UserEmail != "" {
+		return false, nil
+	}
+	delete(s.instances, instance.ID)
+	return true, nil
+}
+
+// fakePoolExecutor records the instances created and destroyed by the pool
+type fakePoolExecutor struct {
+	exec.Executor
+	mutex     sync.Mutex
+	created   []int
+	destroyed []int
+}
+
+func (e *fakePoolExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, passwordAuthentication bool) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.created = append(e.created, instanceID)
+	return nil
+}
+
+func (e *fakePoolExecutor) DestroyInstance(ctx context.Context, id int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.destroyed = append(e.destroyed, id)
+	return nil
+}
+
+type fakeMaintenanceModeStore struct {
+	enabled bool
+}
+
+func (s *fakeMaintenanceModeStore) Get(ctx context.Context) (models.MaintenanceMode, error) {
+	return models.MaintenanceMode{ID: 1, Enabled: s.enabled}, nil
+}
+
+func (s *fakeMaintenanceModeStore) Enable(ctx context.Context, mode models.MaintenanceMode) (models.MaintenanceMode, error) {
+	s.enabled = true
+	return mode, nil
+}
+
+func (s *fakeMaintenanceModeStore) Disable(ctx context.Context) error {
+	s.enabled = false
+	return nil
+}
+
+// fakePoolImageStore only lists images, which is all the pool needs
+type fakePoolImageStore struct {
+	store.ImageStore
+	images []models.Image
+}
+
+func (s fakePoolImageStore) List(ctx context.Context) ([]models.Image, error) {
+	return s.images, nil
+}
+
+func poolImages() fakePoolImageStore {
+	return fakePoolImageStore{images: []models.Image{
+		models.Image{ID: 1, Ready: true, UpdatedAt: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+		models.Image{ID: 2, Ready: true, UpdatedAt: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)},
+		// The newest image isn't ready, so instances can't be created from it
+		models.Image{ID: 3, Ready: false, UpdatedAt: time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC)},
+	}}
+}
+
+func newTestInstancePool(instanceStore *fakePoolInstanceStore, maintenance *fakeMaintenanceModeStore, executor *fakePoolExecutor, size int) *InstancePool {
+	logger, _ := routes.NewFakeLogger()
+	return NewInstancePool(
+		logger, nil, poolImages(), instanceStore, maintenance, executor, size, 5432, 6432,
+		health.NewHeartbeat("instance_pool", time.Minute),
+	)
+}
+
+func TestInstancePoolRefillCreatesInstancesOfLatestImage(t *testing.T) {
+	instanceStore := newFakePoolInstanceStore()
+	executor := &fakePoolExecutor{}
+	pool := newTestInstancePool(instanceStore, &fakeMaintenanceModeStore{}, executor, 2)
+
+	pool.refill(context.Background(), make(chan struct{}))
+
+	instances, _ := instanceStore.List(context.Background())
+	assert.Equal(t, 2, len(instances))
+	for _, instance := range instances {
+		assert.Equal(t, 2, instance.ImageID)
+		assert.True(t, instance.Pooled)
+		assert.Equal(t, "", instance.UserEmail)
+	}
+	assert.Equal(t, 2, len(executor.created))
+	assert.Empty(t, executor.destroyed)
+}
+
+func TestInstancePoolRefillDiscardsUnwantedInstances(t *testing.T) {
+	instanceStore := newFakePoolInstanceStore(
+		// Of an older image
+		models.Instance{ID: 1, ImageID: 1, Pooled: true},
+		// Kept
+		models.Instance{ID: 2, ImageID: 2, Pooled: true},
+		// In excess of the pool's size
+		models.Instance{ID: 3, ImageID: 2, Pooled: true},
+		// Left behind by an interrupted refill
+		models.Instance{ID: 4, ImageID: 2},
+		// Owned by a user, so never touched
+		models.Instance{ID: 5, ImageID: 1, UserEmail: "test@draupnir"},
+	)
+	executor := &fakePoolExecutor{}
+	pool := newTestInstancePool(instanceStore, &fakeMaintenanceModeStore{}, executor, 1)
+
+	pool.refill(context.Background(), make(chan struct{}))
+
+	assert.Equal(t, []int{1, 3, 4}, executor.destroyed)
+	assert.Empty(t, executor.created)
+
+	instances, _ := instanceStore.List(context.Background())
+	assert.Equal(t, 2, len(instances))
+	assert.Equal(t, 2, instances[0].ID)
+	assert.Equal(t, 5, instances[1].ID)
+}
+
+func TestInstancePoolDiscardSkipsClaimedInstance(t *testing.T) {
+	instanceStore := newFakePoolInstanceStore(
+		models.Instance{ID: 1, ImageID: 1, Pooled: true},
+	)
+	// The instance is claimed after the refill has listed it, but before it's
+	// discarded
+	instanceStore.beforeDestroyUnowned = func(instance models.Instance) {
+		_, err := instanceStore.Claim(context.Background(), instance.ImageID, "test@draupnir", "session-id", 0)
+		assert.Nil(t, err)
+	}
+	executor := &fakePoolExecutor{}
+	pool := newTestInstancePool(instanceStore, &fakeMaintenanceModeStore{}, executor, 0)
+
+	pool.refill(context.Background(), make(chan struct{}))
+
+	assert.Empty(t, executor.destroyed)
+
+	instance, err := instanceStore.Get(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", instance.UserEmail)
+	assert.False(t, instance.Pooled)
+}
+
+func TestInstancePoolRefillReplacesClaimedInstance(t *testing.T) {
+	instanceStore := newFakePoolInstanceStore(
+		models.Instance{ID: 1, ImageID: 2, Pooled: true},
+	)
+	executor := &fakePoolExecutor{}
+	pool := newTestInstancePool(instanceStore, &fakeMaintenanceModeStore{}, executor, 1)
+
+	claimed, err := instanceStore.Claim(context.Background(), 2, "test@draupnir", "session-id", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, claimed.ID)
+
+	_, err = instanceStore.Claim(context.Background(), 2, "otheruser@draupnir", "session-id", 0)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	pool.refill(context.Background(), make(chan struct{}))
+
+	assert.Empty(t, executor.destroyed)
+	assert.Equal(t, 1, len(executor.created))
+
+	instance, err := instanceStore.Get(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", instance.UserEmail)
+
+	replacement, err := instanceStore.Get(context.Background(), executor.created[0])
+	assert.Nil(t, err)
+	assert.True(t, replacement.Pooled)
+}
+
+func TestInstancePoolRefillSkippedDuringMaintenance(t *testing.T) {
+	instanceStore := newFakePoolInstanceStore(
+		models.Instance{ID: 1, ImageID: 1, Pooled: true},
+	)
+	executor := &fakePoolExecutor{}
+	pool := newTestInstancePool(instanceStore, &fakeMaintenanceModeStore{enabled: true}, executor, 2)
+
+	pool.refill(context.Background(), make(chan struct{}))
+
+	assert.Empty(t, executor.created)
+	assert.Empty(t, executor.destroyed)
+
+	instances, _ := instanceStore.List(context.Background())
+	assert.Equal(t, 1, len(instances))
+}
@@ -2,30 +2,46 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/certs"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/health"
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/proxy"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
 	"github.com/gocardless/draupnir/pkg/server/api/routes"
 	"github.com/gocardless/draupnir/pkg/server/config"
 	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tracing"
 	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/gorilla/mux"
 	rungroup "github.com/oklog/run"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/oauth2"
 )
 
 // ConfigFilePath is the expected path of the server configuration file
 const ConfigFilePath = "/etc/draupnir/config.toml"
 
+var tracer = otel.Tracer("github.com/gocardless/draupnir/pkg/server")
+
 // Run starts the draupnir server
 // Any error returned is fatal
 func Run(logger log.Logger) error {
@@ -40,13 +56,42 @@ func Run(logger log.Logger) error {
 		return errors.Wrap(err, "failed to parse trusted proxes")
 	}
 
+	defaultRole := auth.RoleUser
+	if cfg.DefaultRole != "" {
+		defaultRole, err = auth.ParseRole(cfg.DefaultRole)
+		if err != nil {
+			return errors.Wrap(err, "invalid default role")
+		}
+	}
+
 	logger.Info("Configuration successfully loaded")
 
 	logger = log.With("environment", cfg.Environment)
 
-	oauthConfig := createOauthConfig(cfg.OAuthConfig)
-	authenticator := createAuthenticator(cfg, oauthConfig)
-	executor := createExecutor(cfg)
+	shutdownTracing, err := tracing.Setup(cfg.TracingConfig)
+	if err != nil {
+		return errors.Wrap(err, "failed to setup tracing")
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.With("error", err.Error()).Error("failed to flush traces")
+		}
+	}()
+
+	oidcClient, err := createOIDCClient(cfg)
+	if err != nil {
+		return err
+	}
+	oauthClient := createOAuthClient(cfg, oidcClient)
+	sessionTokens, sessionDuration, err := createSessionTokens(cfg.SessionConfig, logger)
+	if err != nil {
+		return err
+	}
+	certificateOptions, err := createCertificateOptions(cfg.CertificatesConfig)
+	if err != nil {
+		return err
+	}
+	executor := createExecutor(cfg, certificateOptions)
 
 	db, err := sql.Open("postgres", cfg.DatabaseURL)
 	if err != nil {
@@ -55,20 +100,92 @@ func Run(logger log.Logger) error {
 	imageStore := createImageStore(db)
 	instanceStore := createInstanceStore(db, cfg)
 	whitelistedAddressStore := createWhitelistedAddressStore(db)
+	imageAccessRuleStore := createImageAccessRuleStore(db)
+	roleAssignmentStore := createRoleAssignmentStore(db)
+	instanceDestructionStore := createInstanceDestructionStore(db)
+	auditEventStore := createAuditEventStore(db)
+	maintenanceModeStore := createMaintenanceModeStore(db)
+	sessionStore := createSessionStore(db)
+	authenticator := createAuthenticator(cfg, oauthClient, sessionTokens, sessionStore)
+	apiKeyStore := createAPIKeyStore(db)
+	oauthHandshakeStore, err := createOAuthHandshakeStore(cfg, db)
+	if err != nil {
+		return err
+	}
+	defer oauthHandshakeStore.Close()
 
 	sentryClient, err := raven.New(cfg.SentryDsn)
 	if err != nil {
 		return errors.Wrap(err, "Could not initialise sentry-raven client")
 	}
 
+	// Readiness checks, served on /ready. Background goroutines report their
+	// liveness through heartbeats, which fail if they haven't run for a couple
+	// of intervals.
+	minFreeDiskPercent := cfg.MinFreeDiskPercent
+	if minFreeDiskPercent == 0 {
+		minFreeDiskPercent = 5
+	}
+	readyChecks := []health.Check{
+		health.DatabaseCheck(db),
+		health.DiskSpaceCheck(cfg.DataPath, minFreeDiskPercent),
+		health.BinariesCheck(exec.PgCtlPath, "btrfs"),
+	}
+
+	// Graceful shutdown. Mutating requests are tracked by the drainer, so that
+	// they can complete before the server exits.
+	drainer := &middleware.Drainer{}
+	drainTimeout := DefaultDrainTimeout
+	if cfg.ShutdownTimeout != "" {
+		drainTimeout, err = time.ParseDuration(cfg.ShutdownTimeout)
+		if err != nil {
+			return errors.Wrap(err, "invalid shutdown timeout")
+		}
+	}
+	operationsCtx, abandonOperations := context.WithCancel(context.Background())
+	defer abandonOperations()
+
+	readyChecks = append(readyChecks, health.Check{
+		Name: "shutdown",
+		Check: func(ctx context.Context) error {
+			if drainer.Draining() {
+				return errors.New("server is shutting down")
+			}
+			return nil
+		},
+	})
+
+	cleanInterval, err := time.ParseDuration(cfg.CleanInterval)
+	if err != nil {
+		return errors.Wrap(err, "invalid clean interval")
+	}
+	cleanerHeartbeat := health.NewHeartbeat("cleaner", 2*cleanInterval+time.Minute)
+	readyChecks = append(readyChecks, cleanerHeartbeat.Check())
+
+	expiryWarning := DefaultCertificateExpiryWarning
+	if cfg.CertificatesConfig.ExpiryWarning != "" {
+		expiryWarning, err = time.ParseDuration(cfg.CertificatesConfig.ExpiryWarning)
+		if err != nil {
+			return errors.Wrap(err, "invalid certificate expiry warning")
+		}
+	}
+
 	// Setup the IP address whitelisting component.
 	// This is optional, it's useful to be able to disable this in environments
 	// where iptables is not available (e.g. integration tests).
 	var whitelister *IPAddressWhitelister
 	var whitelisterTriggerFunc func(string)
+	var whitelisterInterval time.Duration
 
 	if cfg.EnableWhitelisting {
-		whitelister = NewIPAddressWhitelister(logger.With("component", "whitelister"), sentryClient, whitelistedAddressStore)
+		whitelisterInterval, err = time.ParseDuration(cfg.WhitelisterInterval)
+		if err != nil {
+			return errors.Wrap(err, "invalid whitelister update interval")
+		}
+		whitelisterHeartbeat := health.NewHeartbeat("whitelister", 2*whitelisterInterval+time.Minute)
+		readyChecks = append(readyChecks, health.IPTablesChainCheck(ChainName), whitelisterHeartbeat.Check())
+
+		whitelister = NewIPAddressWhitelister(logger.With("component", "whitelister"), sentryClient, whitelistedAddressStore, whitelisterHeartbeat)
 		whitelisterTriggerFunc = whitelister.TriggerReconcile
 	} else {
 		whitelisterTriggerFunc = func(s string) {
@@ -76,38 +193,153 @@ func Run(logger log.Logger) error {
 		}
 	}
 
+	// Instances of the latest image are created in advance, so that users
+	// don't have to wait for them
+	poolInterval := DefaultInstancePoolInterval
+	if cfg.InstancePoolInterval != "" {
+		poolInterval, err = time.ParseDuration(cfg.InstancePoolInterval)
+		if err != nil {
+			return errors.Wrap(err, "invalid instance pool refill interval")
+		}
+	}
+	poolHeartbeat := health.NewHeartbeat("instance_pool", 2*poolInterval+time.Minute)
+	readyChecks = append(readyChecks, poolHeartbeat.Check())
+
+	instancePool := NewInstancePool(
+		logger.With("component", "pool"),
+		sentryClient,
+		imageStore,
+		instanceStore,
+		maintenanceModeStore,
+		executor,
+		cfg.InstancePoolSize,
+		cfg.MinInstancePort,
+		cfg.MaxInstancePort,
+		poolHeartbeat,
+	)
+
+	// Instances can be exposed on a single port by the proxy, which routes
+	// connections by the hostname the client connects to
+	var instanceProxy *proxy.Proxy
+	var proxyPort uint16
+	if cfg.ProxyConfig.ListenAddress != "" {
+		instanceProxy, proxyPort, err = createProxy(
+			logger.With("component", "proxy"),
+			cfg,
+			instanceStore,
+			whitelistedAddressStore,
+			trustedProxies,
+			certificateOptions,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
 	imageRouteSet := routes.Images{
-		ImageStore:    imageStore,
-		InstanceStore: instanceStore,
-		Executor:      executor,
+		ImageStore:           imageStore,
+		InstanceStore:        instanceStore,
+		ImageAccessRuleStore: imageAccessRuleStore,
+		Executor:             executor,
+		RefillPool:           instancePool.TriggerRefill,
+	}
+
+	imageAccessRuleRouteSet := routes.ImageAccessRules{
+		ImageStore:           imageStore,
+		ImageAccessRuleStore: imageAccessRuleStore,
+	}
+
+	roleAssignmentRouteSet := routes.RoleAssignments{
+		RoleAssignmentStore: roleAssignmentStore,
+	}
+
+	apiKeyRouteSet := routes.APIKeys{
+		APIKeyStore: apiKeyStore,
 	}
 
 	instanceRouteSet := routes.Instances{
 		InstanceStore:           instanceStore,
 		ImageStore:              imageStore,
+		ImageAccessRuleStore:    imageAccessRuleStore,
 		WhitelistedAddressStore: whitelistedAddressStore,
 		ApplyWhitelist:          whitelisterTriggerFunc,
+		RefillPool:              instancePool.TriggerRefill,
 		Executor:                executor,
 		MinInstancePort:         cfg.MinInstancePort,
 		MaxInstancePort:         cfg.MaxInstancePort,
 	}
+	if instanceProxy != nil {
+		instanceRouteSet.ProxyDomain = cfg.ProxyConfig.Domain
+		instanceRouteSet.ProxyPort = proxyPort
+	}
+
+	adminInstanceRouteSet := routes.AdminInstances{
+		InstanceStore:            instanceStore,
+		InstanceDestructionStore: instanceDestructionStore,
+		ApplyWhitelist:           whitelisterTriggerFunc,
+		Executor:                 executor,
+	}
+
+	auditEventRouteSet := routes.AuditEvents{
+		AuditEventStore: auditEventStore,
+	}
+
+	maintenanceModeRouteSet := routes.MaintenanceModes{
+		MaintenanceModeStore: maintenanceModeStore,
+	}
 
 	accessTokenRouteSet := routes.AccessTokens{
-		Callbacks: make(map[string]chan routes.OAuthCallback),
-		Client:    &oauthConfig,
+		Handshakes: oauthHandshakeStore,
+		Client:     oidcClient,
+		Sessions: auth.Sessions{
+			OAuthClient:            oauthClient,
+			Store:                  sessionStore,
+			Tokens:                 sessionTokens,
+			TrustedUserEmailDomain: cfg.TrustedUserEmailDomain,
+			AllowedGroups:          cfg.OAuthConfig.AllowedGroups,
+			Duration:               sessionDuration,
+		},
+		VerificationURL: deviceVerificationURL(cfg.OAuthConfig.RedirectURL),
+		SessionStore:    sessionStore,
+	}
+
+	adminUserRouteSet := routes.AdminUsers{
+		SessionStore: sessionStore,
+		Client:       oidcClient,
+		Instances:    adminInstanceRouteSet,
+	}
+
+	readyRouteSet := routes.Ready{
+		Checks:  readyChecks,
+		Timeout: 5 * time.Second,
 	}
 
 	router := mux.NewRouter()
 
-	// Every request will be logged, and any error raised in serving the request
-	// will also be logged.
+	// Every request will be traced and logged, and any error raised in serving
+	// the request will also be logged.
 	rootHandler := chain.
 		New(middleware.NewErrorHandler(logger)).
+		Add(middleware.Trace).
 		Add(middleware.RecordUserIPAddress(logger, trustedProxies, cfg.UseXForwardedFor)).
 		Add(middleware.NewRequestLogger(logger))
 
 	rootHandler = rootHandler.
-		Add(middleware.NewSentryReporter(sentryClient))
+		Add(middleware.NewSentryReporter(sentryClient)).
+		Add(middleware.InstrumentRequests).
+		Add(middleware.RejectWhenDraining(drainer))
+
+	// Metrics
+	// Like the healthcheck, this is unauthenticated so that it's easy to scrape.
+	prometheus.MustRegister(metrics.StateCollector{
+		Logger:          logger.With("component", "metrics"),
+		ImageStore:      imageStore,
+		InstanceStore:   instanceStore,
+		DataPath:        cfg.DataPath,
+		MinInstancePort: cfg.MinInstancePort,
+		MaxInstancePort: cfg.MaxInstancePort,
+	})
+	router.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
 
 	// Healthcheck
 	// We don't enforce a particular API version on this route, because it should
@@ -119,6 +351,17 @@ func Run(logger log.Logger) error {
 			Resolve(routes.HealthCheck),
 	)
 
+	// Readiness
+	// Unlike the healthcheck, this checks that draupnir's dependencies are
+	// available, so that it can be used to decide whether to route traffic to
+	// this server.
+	router.Methods("GET").Path("/ready").HandlerFunc(
+		rootHandler.
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Resolve(readyRouteSet.Get),
+	)
+
 	// OAuth
 	// These routes are a bit special, because they don't accept or return JSON.
 	// They're intended to be used through a web browser.
@@ -133,6 +376,14 @@ func Run(logger log.Logger) error {
 			Resolve(accessTokenRouteSet.Callback),
 	)
 
+	// The verification page of the device authorisation flow, where users
+	// authenticating a device without a browser enter their code
+	router.Methods("GET").Path("/device").HandlerFunc(
+		rootHandler.
+			Add(routes.OauthErrorRenderer).
+			Resolve(accessTokenRouteSet.Device),
+	)
+
 	// Core API routes
 	// These routes all accept and return JSON, and will enforce that the client
 	// sends a compatible API version header.
@@ -141,10 +392,27 @@ func Run(logger log.Logger) error {
 		Add(middleware.WithVersion).
 		Add(middleware.AsJSON).
 		Add(middleware.CheckAPIVersion(version.Version)).
-		Add(middleware.Authenticate(authenticator))
+		Add(middleware.AuthenticateAPIKey(apiKeyStore)).
+		Add(middleware.Authenticate(authenticator)).
+		Add(middleware.ResolveGroups(cfg.AccessGroups)).
+		Add(middleware.LoadPermissions(roleAssignmentStore, defaultRole))
+
+	// Each route declares the permission it requires, which is checked against
+	// the roles held by the authenticated user.
+	withPermission := func(permission auth.Permission) chain.Chain {
+		return defaultChain.Add(middleware.RequirePermission(permission))
+	}
+
+	// State-changing routes, and those that hand out credentials, are recorded
+	// in the audit log. Denied requests are recorded too.
+	audited := func(permission auth.Permission, action string, resourceType string) chain.Chain {
+		return defaultChain.
+			Add(middleware.Audit(auditEventStore, action, resourceType)).
+			Add(middleware.RequirePermission(permission))
+	}
 
 	// Access Tokens
-	// This route is hit before the user is authenticated, so we don't use the
+	// These routes are hit before the user is authenticated, so we don't use the
 	// Authenticate middleware
 	router.Methods("POST").Path("/access_tokens").HandlerFunc(
 		rootHandler.
@@ -155,75 +423,204 @@ func Run(logger log.Logger) error {
 			Resolve(accessTokenRouteSet.Create),
 	)
 
+	router.Methods("POST").Path("/device_authorisations").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(accessTokenRouteSet.CreateDeviceAuthorisation),
+	)
+
+	// Anyone who has authenticated may log out
+	router.Methods("DELETE").Path("/access_tokens/current").HandlerFunc(
+		defaultChain.
+			Add(middleware.Audit(auditEventStore, "session.logout", "session")).
+			Resolve(accessTokenRouteSet.Destroy),
+	)
+
 	// Images
 	router.Methods("GET").Path("/images").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.List),
+		withPermission(auth.PermissionReadImages).Resolve(imageRouteSet.List),
 	)
 
 	router.Methods("POST").Path("/images").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Create),
+		audited(auth.PermissionManageImages, "image.create", "image").
+			Add(middleware.RejectDuringMaintenance(maintenanceModeStore)).
+			Resolve(imageRouteSet.Create),
 	)
 
 	router.Methods("GET").Path("/images/{id}").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Get),
+		withPermission(auth.PermissionReadImages).Resolve(imageRouteSet.Get),
 	)
 
 	router.Methods("POST").Path("/images/{id}/done").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Done),
+		audited(auth.PermissionManageImages, "image.finalise", "image").Resolve(imageRouteSet.Done),
 	)
 
 	router.Methods("DELETE").Path("/images/{id}").HandlerFunc(
-		defaultChain.Resolve(imageRouteSet.Destroy),
+		audited(auth.PermissionManageImages, "image.destroy", "image").Resolve(imageRouteSet.Destroy),
 	)
 
 	// Instances
 	router.Methods("GET").Path("/instances").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.List),
+		withPermission(auth.PermissionReadInstances).Resolve(instanceRouteSet.List),
 	)
 
 	router.Methods("POST").Path("/instances").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Create),
+		audited(auth.PermissionManageInstances, "instance.create", "instance").
+			Add(middleware.RejectDuringMaintenance(maintenanceModeStore)).
+			Resolve(instanceRouteSet.Create),
 	)
 
 	router.Methods("GET").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Get),
+		audited(auth.PermissionReadInstances, "instance.retrieve_credentials", "instance").Resolve(instanceRouteSet.Get),
 	)
 
 	router.Methods("DELETE").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Destroy),
+		audited(auth.PermissionManageInstances, "instance.destroy", "instance").Resolve(instanceRouteSet.Destroy),
 	)
 
-	router.Methods("DELETE").Path("/instances/{id}").HandlerFunc(
-		defaultChain.Resolve(instanceRouteSet.Destroy),
+	// Tunnels relay connections to instances over an upgraded request, for
+	// clients that can't be whitelisted
+	router.Methods("GET").Path("/instances/{id}/tunnel").HandlerFunc(
+		audited(auth.PermissionReadInstances, "instance.tunnel", "instance").Resolve(instanceRouteSet.Tunnel),
+	)
+
+	router.Methods("POST").Path("/instances/{id}/credentials/rotate").HandlerFunc(
+		audited(auth.PermissionManageInstances, "instance.rotate_credentials", "instance").Resolve(instanceRouteSet.RotateCredentials),
+	)
+
+	// Admin
+	router.Methods("GET").Path("/admin/images/{id}/access_rules").HandlerFunc(
+		withPermission(auth.PermissionManageAccess).Resolve(imageAccessRuleRouteSet.List),
+	)
+
+	router.Methods("POST").Path("/admin/images/{id}/access_rules").HandlerFunc(
+		audited(auth.PermissionManageAccess, "image_access_rule.create", "image").Resolve(imageAccessRuleRouteSet.Create),
+	)
+
+	router.Methods("DELETE").Path("/admin/images/{id}/access_rules/{rule_id}").HandlerFunc(
+		audited(auth.PermissionManageAccess, "image_access_rule.destroy", "image").Resolve(imageAccessRuleRouteSet.Destroy),
+	)
+
+	router.Methods("GET").Path("/admin/instances").HandlerFunc(
+		withPermission(auth.PermissionManageAllInstances).Resolve(adminInstanceRouteSet.List),
+	)
+
+	router.Methods("POST").Path("/admin/instances/{id}/destroy").HandlerFunc(
+		audited(auth.PermissionManageAllInstances, "instance.destroy", "instance").Resolve(adminInstanceRouteSet.Destroy),
+	)
+
+	router.Methods("POST").Path("/admin/instances/{id}/reassign").HandlerFunc(
+		audited(auth.PermissionManageAllInstances, "instance.reassign", "instance").Resolve(adminInstanceRouteSet.Reassign),
+	)
+
+	router.Methods("GET").Path("/admin/instance_destructions").HandlerFunc(
+		withPermission(auth.PermissionManageAllInstances).Resolve(adminInstanceRouteSet.ListDestructions),
+	)
+
+	router.Methods("GET").Path("/admin/audit_events").HandlerFunc(
+		withPermission(auth.PermissionReadAuditLog).Resolve(auditEventRouteSet.List),
+	)
+
+	router.Methods("GET").Path("/admin/role_assignments").HandlerFunc(
+		withPermission(auth.PermissionManageAccess).Resolve(roleAssignmentRouteSet.List),
+	)
+
+	router.Methods("PUT").Path("/admin/role_assignments/{principal}").HandlerFunc(
+		audited(auth.PermissionManageAccess, "role.assign", "principal").Resolve(roleAssignmentRouteSet.Update),
+	)
+
+	router.Methods("DELETE").Path("/admin/role_assignments/{principal}").HandlerFunc(
+		audited(auth.PermissionManageAccess, "role.unassign", "principal").Resolve(roleAssignmentRouteSet.Destroy),
+	)
+
+	router.Methods("GET").Path("/admin/api_keys").HandlerFunc(
+		withPermission(auth.PermissionManageAccess).Resolve(apiKeyRouteSet.List),
+	)
+
+	router.Methods("POST").Path("/admin/api_keys").HandlerFunc(
+		audited(auth.PermissionManageAccess, "api_key.create", "api_key").Resolve(apiKeyRouteSet.Create),
+	)
+
+	router.Methods("DELETE").Path("/admin/api_keys/{id}").HandlerFunc(
+		audited(auth.PermissionManageAccess, "api_key.revoke", "api_key").Resolve(apiKeyRouteSet.Destroy),
+	)
+
+	router.Methods("POST").Path("/admin/users/{email}/revoke_sessions").HandlerFunc(
+		audited(auth.PermissionManageAccess, "user.revoke_sessions", "user").Resolve(adminUserRouteSet.RevokeSessions),
+	)
+
+	// Maintenance mode
+	// Anyone may check whether maintenance mode is enabled, but only admins can
+	// change it.
+	router.Methods("GET").Path("/maintenance").HandlerFunc(
+		defaultChain.Resolve(maintenanceModeRouteSet.Get),
+	)
+
+	router.Methods("PUT").Path("/admin/maintenance").HandlerFunc(
+		audited(auth.PermissionManageMaintenance, "maintenance.enable", "maintenance_mode").Resolve(maintenanceModeRouteSet.Update),
+	)
+
+	router.Methods("DELETE").Path("/admin/maintenance").HandlerFunc(
+		audited(auth.PermissionManageMaintenance, "maintenance.disable", "maintenance_mode").Resolve(maintenanceModeRouteSet.Destroy),
 	)
 
 	var g rungroup.Group
 
+	// On SIGINT or SIGTERM, every component is stopped. The HTTP servers keep
+	// serving reads while mutating requests drain, so the servers are shut down
+	// in the background and waited for once the group has stopped.
+	var shutdowns sync.WaitGroup
+	shutdown := func(server *http.Server) {
+		shutdowns.Add(1)
+		go func() {
+			defer shutdowns.Done()
+			gracefulShutdown(logger, server, drainer, drainTimeout, abandonOperations)
+		}()
+	}
+
+	{
+		stop := make(chan struct{})
+
+		g.Add(
+			func() error { waitForSignal(logger, stop); return nil },
+			func(error) { close(stop) },
+		)
+	}
+
+	// Requests, and the executor operations they run, are cancelled only once
+	// the drain timeout has expired
+	baseContext := func(net.Listener) context.Context { return operationsCtx }
+
 	if cfg.HTTPConfig.SecureListenAddress != "" {
 		// The default server for draupnir which will listen on TLS
 		server := http.Server{
-			Addr:    cfg.HTTPConfig.SecureListenAddress,
-			Handler: router,
+			Addr:        cfg.HTTPConfig.SecureListenAddress,
+			Handler:     router,
+			BaseContext: baseContext,
 		}
 
 		g.Add(
 			func() error {
 				return server.ListenAndServeTLS(cfg.HTTPConfig.TLSCertificatePath, cfg.HTTPConfig.TLSPrivateKeyPath)
 			},
-			func(error) { server.Shutdown(context.Background()) },
+			func(error) { shutdown(&server) },
 		)
 	}
 
 	if cfg.HTTPConfig.InsecureListenAddress != "" {
 		// If configured, then allow connections via a non-TLS port.
 		serverInsecure := http.Server{
-			Addr:    cfg.HTTPConfig.InsecureListenAddress,
-			Handler: router,
+			Addr:        cfg.HTTPConfig.InsecureListenAddress,
+			Handler:     router,
+			BaseContext: baseContext,
 		}
 
 		g.Add(
 			func() error { return serverInsecure.ListenAndServe() },
-			func(error) { serverInsecure.Shutdown(context.Background()) },
+			func(error) { shutdown(&serverInsecure) },
 		)
 	}
 
@@ -231,33 +628,47 @@ func Run(logger log.Logger) error {
 		return errors.New("Neither a secure or insecure listen was address specified")
 	}
 
+	if instanceProxy != nil {
+		listener, err := net.Listen("tcp", cfg.ProxyConfig.ListenAddress)
+		if err != nil {
+			return errors.Wrap(err, "failed to listen for proxy connections")
+		}
+
+		g.Add(
+			func() error { return instanceProxy.Serve(listener) },
+			func(error) { instanceProxy.Shutdown() },
+		)
+	}
+
 	{
 		// We clean out old instances that have invalid tokens periodically as access
 		// to the PostgreSQL instances only relies on certificate authentication. This
 		// means that is situations, such as a user being offboarded, they will lose
 		// access to the draupnir, but not their instances.
-		logger = logger.With("component", "cleaner")
+		// The logger is captured by the shutdown and signal handlers above, so
+		// it isn't reassigned
+		cleanerLogger := logger.With("component", "cleaner")
 
-		instanceCleaner := NewInstanceCleaner(logger, sentryClient, instanceStore, executor, authenticator)
-		cleanInterval, err := time.ParseDuration(cfg.CleanInterval)
-		if err != nil {
-			return errors.Wrap(err, "invalid clean interval")
-		}
+		instanceCleaner := NewInstanceCleaner(cleanerLogger, sentryClient, instanceStore, executor, authenticator, sessionStore, apiKeyStore, auditEventStore, cleanerHeartbeat, expiryWarning)
 
-		cleanerCtx, cleanerCancel := context.WithCancel(context.Background())
+		cleanerStop := make(chan struct{})
 
 		g.Add(
-			func() error { return instanceCleaner.Start(cleanerCtx, cleanInterval) },
-			func(error) { cleanerCancel() },
+			func() error { return instanceCleaner.Start(operationsCtx, cleanerStop, cleanInterval) },
+			func(error) { close(cleanerStop) },
 		)
 	}
 
-	if cfg.EnableWhitelisting {
-		whitelisterInterval, err := time.ParseDuration(cfg.WhitelisterInterval)
-		if err != nil {
-			return errors.Wrap(err, "invalid whitelister update interval")
-		}
+	{
+		poolStop := make(chan struct{})
 
+		g.Add(
+			func() error { return instancePool.Start(operationsCtx, poolStop, poolInterval) },
+			func(error) { close(poolStop) },
+		)
+	}
+
+	if cfg.EnableWhitelisting {
 		whitelisterCtx, whitelisterCancel := context.WithCancel(context.Background())
 
 		g.Add(
@@ -266,23 +677,44 @@ func Run(logger log.Logger) error {
 		)
 	}
 
-	if err := g.Run(); err != nil {
+	err = g.Run()
+	shutdowns.Wait()
+	if err != nil && err != http.ErrServerClosed {
 		return errors.Wrap(err, "could not start HTTP servers")
 	}
 	return nil
 }
 
-func createOauthConfig(c config.OAuthConfig) oauth2.Config {
-	return oauth2.Config{
-		ClientID:     c.ClientID,
-		ClientSecret: c.ClientSecret,
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
-			TokenURL: "https://www.googleapis.com/oauth2/v4/token",
-		},
-		RedirectURL: c.RedirectURL,
+// createOIDCClient discovers the OpenID Connect identity provider that users
+// authenticate with. The integration tests don't talk to one, so discovery is
+// skipped in the test environment.
+func createOIDCClient(c config.Config) (*auth.OIDCClient, error) {
+	oauthConfig := oauth2.Config{
+		ClientID:     c.OAuthConfig.ClientID,
+		ClientSecret: c.OAuthConfig.ClientSecret,
+		Scopes:       c.OAuthConfig.Scopes,
+		RedirectURL:  c.OAuthConfig.RedirectURL,
 	}
+	if c.Environment == "test" {
+		return &auth.OIDCClient{Config: &oauthConfig}, nil
+	}
+
+	issuerURL := c.OAuthConfig.IssuerURL
+	if issuerURL == "" {
+		issuerURL = auth.DefaultIssuerURL
+	}
+
+	client, err := auth.NewOIDCClient(
+		context.Background(),
+		issuerURL,
+		oauthConfig,
+		c.OAuthConfig.EmailClaim,
+		c.OAuthConfig.GroupsClaim,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to discover OIDC provider")
+	}
+	return client, nil
 }
 
 func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
@@ -300,18 +732,61 @@ func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 	return trusted, nil
 }
 
-func createAuthenticator(c config.Config, oauthConfig oauth2.Config) auth.Authenticator {
-	authenticator := auth.GoogleAuthenticator{
-		OAuthClient:            auth.GoogleOAuthClient{Config: &oauthConfig},
-		SharedSecret:           c.SharedSecret,
-		TrustedUserEmailDomain: c.TrustedUserEmailDomain,
+// deviceVerificationURL returns the URL of the device verification page, which
+// is served from the same host as the OAuth callback
+func deviceVerificationURL(redirectURL string) string {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "/device"
 	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/device"}).String()
+}
+
+func createOAuthClient(c config.Config, oidcClient *auth.OIDCClient) auth.OAuthClient {
 	if c.Environment == "test" {
-		authenticator.OAuthClient = auth.IntegrationTestOAuthClient{}
+		return auth.IntegrationTestOAuthClient{}
+	}
+	return oidcClient
+}
+
+func createAuthenticator(c config.Config, oauthClient auth.OAuthClient, tokens auth.SessionTokens, sessionStore store.SessionStore) auth.Authenticator {
+	authenticator := auth.OIDCAuthenticator{
+		OAuthClient:  oauthClient,
+		SharedSecret: c.SharedSecret,
+		Tokens:       tokens,
+		Sessions:     sessionStore,
+	}
+	if c.Environment == "test" {
+		return auth.IntegrationTestAuthenticator{Authenticator: authenticator}
 	}
 	return authenticator
 }
 
+// createSessionTokens returns the signer of session tokens, and how long they
+// are valid for. The secret is only optional in the test environment, where a
+// key is generated instead.
+func createSessionTokens(c config.SessionConfig, logger log.Logger) (auth.SessionTokens, time.Duration, error) {
+	duration := auth.DefaultSessionDuration
+	if c.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(c.Duration)
+		if err != nil {
+			return auth.SessionTokens{}, duration, errors.Wrap(err, "invalid session duration")
+		}
+	}
+
+	if c.Secret != "" {
+		return auth.SessionTokens{Key: []byte(c.Secret)}, duration, nil
+	}
+
+	logger.Warn("sessions.secret is not set: generating a key, which is only valid until the server restarts")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return auth.SessionTokens{}, duration, errors.Wrap(err, "failed to generate session key")
+	}
+	return auth.SessionTokens{Key: key}, duration, nil
+}
+
 func createImageStore(db *sql.DB) store.ImageStore {
 	return store.DBImageStore{DB: db}
 }
@@ -324,6 +799,118 @@ func createWhitelistedAddressStore(db *sql.DB) store.WhitelistedAddressStore {
 	return store.DBWhitelistedAddressStore{DB: db}
 }
 
-func createExecutor(c config.Config) exec.Executor {
-	return exec.OSExecutor{DataPath: c.DataPath}
+func createImageAccessRuleStore(db *sql.DB) store.ImageAccessRuleStore {
+	return store.DBImageAccessRuleStore{DB: db}
+}
+
+func createRoleAssignmentStore(db *sql.DB) store.RoleAssignmentStore {
+	return store.DBRoleAssignmentStore{DB: db}
+}
+
+func createInstanceDestructionStore(db *sql.DB) store.InstanceDestructionStore {
+	return store.DBInstanceDestructionStore{DB: db}
+}
+
+func createSessionStore(db *sql.DB) store.SessionStore {
+	return store.DBSessionStore{DB: db}
+}
+
+func createAPIKeyStore(db *sql.DB) store.APIKeyStore {
+	return store.DBAPIKeyStore{DB: db}
+}
+
+// createOAuthHandshakeStore holds pending OAuth handshakes in memory, unless
+// they're configured to be shared between replicas through Postgres
+func createOAuthHandshakeStore(c config.Config, db *sql.DB) (store.OAuthHandshakeStore, error) {
+	switch c.OAuthConfig.HandshakeStore {
+	case "", "memory":
+		return store.NewMemoryOAuthHandshakeStore(), nil
+	case "postgres":
+		handshakeStore, err := store.NewDBOAuthHandshakeStore(db, c.DatabaseURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to listen for oauth handshakes")
+		}
+		return handshakeStore, nil
+	default:
+		return nil, fmt.Errorf("unknown oauth handshake store: %s", c.OAuthConfig.HandshakeStore)
+	}
+}
+
+func createAuditEventStore(db *sql.DB) store.AuditEventStore {
+	return store.DBAuditEventStore{DB: db}
+}
+
+func createMaintenanceModeStore(db *sql.DB) store.MaintenanceModeStore {
+	return store.DBMaintenanceModeStore{DB: db}
+}
+
+func createExecutor(c config.Config, certificates certs.Options) exec.Executor {
+	executor := exec.OSExecutor{DataPath: c.DataPath, Certificates: certificates}
+	if c.ProxyConfig.BindInstancesToLocalhost {
+		executor.ListenAddresses = "localhost"
+	}
+
+	return exec.InstrumentedExecutor{Executor: executor}
+}
+
+// createProxy returns the proxy that exposes every instance on one port, and
+// the port that clients connect to it on
+func createProxy(logger log.Logger, c config.Config, instanceStore store.InstanceStore, whitelistedAddressStore store.WhitelistedAddressStore, trustedProxies []*net.IPNet, certificates certs.Options) (*proxy.Proxy, uint16, error) {
+	publicPort := c.ProxyConfig.PublicPort
+	if publicPort == 0 {
+		_, port, err := net.SplitHostPort(c.ProxyConfig.ListenAddress)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid proxy listen address")
+		}
+		parsed, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid proxy listen address")
+		}
+		publicPort = uint16(parsed)
+	}
+
+	// Draupnir can read every file in an instance directory except the server
+	// key, which the proxy doesn't need
+	credentials := func(ctx context.Context, instanceID int) (certs.Bundle, error) {
+		return certs.ReadBundle(filepath.Join(c.DataPath, "instances", strconv.Itoa(instanceID))), nil
+	}
+
+	p, err := proxy.New(
+		logger,
+		instanceStore,
+		whitelistedAddressStore,
+		credentials,
+		c.ProxyConfig.Domain,
+		c.ProxyConfig.Mode,
+		c.EnableWhitelisting,
+		trustedProxies,
+		c.ProxyConfig.ProxyProtocol,
+		certificates,
+	)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "invalid proxy configuration")
+	}
+
+	return p, publicPort, nil
+}
+
+func createCertificateOptions(c config.CertificatesConfig) (certs.Options, error) {
+	opts := certs.Options{KeyType: c.KeyType, KeySize: c.KeySize}
+	if c.Validity != "" {
+		validity, err := time.ParseDuration(c.Validity)
+		if err != nil {
+			return opts, errors.Wrap(err, "invalid certificate validity")
+		}
+		opts.Validity = validity
+	}
+	if c.AuthorityValidity != "" {
+		validity, err := time.ParseDuration(c.AuthorityValidity)
+		if err != nil {
+			return opts, errors.Wrap(err, "invalid certificate authority validity")
+		}
+		opts.AuthorityValidity = validity
+	}
+
+	opts = opts.WithDefaults()
+	return opts, errors.Wrap(opts.Validate(), "invalid certificate configuration")
 }
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// DefaultDrainTimeout is how long in-flight mutating requests are given to
+// complete when the server shuts down, if shutdown_timeout isn't configured
+const DefaultDrainTimeout = 2 * time.Minute
+
+// waitForSignal blocks until the process receives SIGINT or SIGTERM, or stop
+// is closed
+func waitForSignal(logger log.Logger, stop <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		logger.With("signal", sig.String()).Info("Received signal, shutting down")
+	case <-stop:
+	}
+}
+
+// gracefulShutdown stops the server once in-flight mutating requests have
+// completed. New mutating requests are refused in the meantime, but reads are
+// still served. If the requests don't complete within drainTimeout, abandon is
+// called to cancel them, after which they have middleware.RollbackTimeout to
+// undo their changes before the server is stopped regardless. Scripts run by
+// the executor aren't cancelled, so an abandoned request only rolls back once
+// its script has exited.
+func gracefulShutdown(logger log.Logger, server *http.Server, drainer *middleware.Drainer, drainTimeout time.Duration, abandon func()) {
+	logger = logger.With("address", server.Addr)
+	logger.With("timeout", drainTimeout.String()).Info("Draining in-flight requests")
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if err := drainer.Drain(ctx); err != nil {
+		logger.Warn("Drain timeout expired, abandoning in-flight requests")
+		abandon()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), middleware.RollbackTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.With("error", err.Error()).Error("Requests still in flight when server stopped")
+		return
+	}
+
+	logger.Info("Server stopped")
+}
@@ -9,9 +9,14 @@ import (
 
 	"github.com/coreos/go-iptables/iptables"
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/health"
+	"github.com/gocardless/draupnir/pkg/metrics"
 	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tracing"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const ChainName = "DRAUPNIR-WHITELIST"
@@ -41,9 +46,10 @@ type IPAddressWhitelister struct {
 	sentryClient            *raven.Client
 	whitelistedAddressStore store.WhitelistedAddressStore
 	reconcileTrigger        chan (reconcileRequest)
+	heartbeat               *health.Heartbeat
 }
 
-func NewIPAddressWhitelister(logger log.Logger, sentryClient *raven.Client, addressStore store.WhitelistedAddressStore) *IPAddressWhitelister {
+func NewIPAddressWhitelister(logger log.Logger, sentryClient *raven.Client, addressStore store.WhitelistedAddressStore, heartbeat *health.Heartbeat) *IPAddressWhitelister {
 	return &IPAddressWhitelister{
 		logger:                  logger,
 		sentryClient:            sentryClient,
@@ -54,6 +60,7 @@ func NewIPAddressWhitelister(logger log.Logger, sentryClient *raven.Client, addr
 		// But at this point something has likely gone very wrong and we should be
 		// receiving sentries.
 		reconcileTrigger: make(chan reconcileRequest, 100),
+		heartbeat:        heartbeat,
 	}
 }
 
@@ -87,8 +94,10 @@ func (iw *IPAddressWhitelister) Start(ctx context.Context, interval time.Duratio
 		case <-ctx.Done():
 			return nil
 		case request := <-iw.reconcileTrigger:
-			err = iw.reconcile(ipt, request)
+			err = iw.reconcile(ctx, ipt, request)
+			iw.heartbeat.Beat()
 			if err != nil {
+				metrics.WhitelistReconcileErrorsTotal.Inc()
 				err = errors.Wrap(err, "failed to reconcile whitelist rules")
 				// Given that this is an asynchronous process, and the worst case
 				// scenario of a failure is that a legitimate user cannot access their
@@ -107,7 +116,11 @@ func (iw *IPAddressWhitelister) TriggerReconcile(source string) {
 	iw.reconcileTrigger <- reconcileRequest{source, time.Now()}
 }
 
-func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconcileRequest) error {
+func (iw *IPAddressWhitelister) reconcile(ctx context.Context, ipt *iptables.IPTables, request reconcileRequest) (err error) {
+	ctx, span := tracer.Start(ctx, "IPAddressWhitelister.reconcile",
+		trace.WithAttributes(attribute.String("trigger_source", request.Source)))
+	defer func() { tracing.End(span, err) }()
+
 	start := time.Now()
 	logger := iw.logger.With("trigger_source", request.Source)
 
@@ -115,7 +128,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 		Info("Starting whitelist reconciliation")
 
 	// Build up a list of desired rules, as per the whitelisted_addresses table
-	whitelist, err := iw.whitelistedAddressStore.List()
+	whitelist, err := iw.whitelistedAddressStore.List(ctx)
 	if err != nil {
 		return errors.Wrap(err, "failed to retrieve whitelisted IP addresses")
 	}
@@ -141,6 +154,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 		if err != nil {
 			return errors.Wrapf(err, "failed to add rule to chain: %v", rule)
 		}
+		metrics.WhitelistRuleChangesTotal.WithLabelValues("added").Inc()
 		logger.
 			With("user_email", rule.UserEmail).
 			With("ip_address", rule.IPNet).
@@ -153,6 +167,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 		if err != nil {
 			return errors.Wrapf(err, "failed to remove rule from chain: %v", rule)
 		}
+		metrics.WhitelistRuleChangesTotal.WithLabelValues("removed").Inc()
 		logger.
 			With("user_email", rule.UserEmail).
 			With("ip_address", rule.IPNet).
@@ -165,6 +180,8 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 	}
 
 	duration := time.Since(start)
+	metrics.WhitelistReconcileDuration.Observe(duration.Seconds())
+	metrics.WhitelistRules.Set(float64(len(desired)))
 	logger.With("duration", duration.Seconds()).Info("Finished whitelist reconciliation")
 
 	return err
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/lib/pq"
+)
+
+type APIKeyStore interface {
+	List(ctx context.Context) ([]models.APIKey, error)
+	Get(ctx context.Context, id int) (models.APIKey, error)
+	GetByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+	Create(ctx context.Context, key models.APIKey) (models.APIKey, error)
+	Revoke(ctx context.Context, id int) error
+}
+
+type DBAPIKeyStore struct {
+	DB *sql.DB
+}
+
+func (s DBAPIKeyStore) List(ctx context.Context) ([]models.APIKey, error) {
+	ctx, span := startSpan(ctx, "DBAPIKeyStore.List")
+	defer span.End()
+
+	return s.query(
+		ctx,
+		`SELECT id, description, key_hash, scopes, created_by, created_at, expires_at, revoked_at
+		 FROM api_keys
+		 ORDER BY id ASC`,
+	)
+}
+
+func (s DBAPIKeyStore) Get(ctx context.Context, id int) (models.APIKey, error) {
+	ctx, span := startSpan(ctx, "DBAPIKeyStore.Get")
+	defer span.End()
+
+	return s.queryOne(
+		ctx,
+		`SELECT id, description, key_hash, scopes, created_by, created_at, expires_at, revoked_at
+		 FROM api_keys
+		 WHERE id = $1`,
+		id,
+	)
+}
+
+// GetByHash returns the key with the given hash, which is how requests are
+// authenticated
+func (s DBAPIKeyStore) GetByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	ctx, span := startSpan(ctx, "DBAPIKeyStore.GetByHash")
+	defer span.End()
+
+	return s.queryOne(
+		ctx,
+		`SELECT id, description, key_hash, scopes, created_by, created_at, expires_at, revoked_at
+		 FROM api_keys
+		 WHERE key_hash = $1`,
+		keyHash,
+	)
+}
+
+func (s DBAPIKeyStore) Create(ctx context.Context, key models.APIKey) (models.APIKey, error) {
+	ctx, span := startSpan(ctx, "DBAPIKeyStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO api_keys (description, key_hash, scopes, created_by, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id`,
+		key.Description,
+		key.KeyHash,
+		pq.Array(key.Scopes),
+		key.CreatedBy,
+		key.CreatedAt,
+		key.ExpiresAt,
+	)
+
+	err := row.Scan(&key.ID)
+	return key, err
+}
+
+func (s DBAPIKeyStore) Revoke(ctx context.Context, id int) error {
+	ctx, span := startSpan(ctx, "DBAPIKeyStore.Revoke")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(
+		ctx,
+		`UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`,
+		id,
+	)
+	return err
+}
+
+func (s DBAPIKeyStore) queryOne(ctx context.Context, query string, args ...interface{}) (models.APIKey, error) {
+	keys, err := s.query(ctx, query, args...)
+	if err != nil {
+		return models.APIKey{}, err
+	}
+
+	if len(keys) == 0 {
+		return models.APIKey{}, sql.ErrNoRows
+	}
+
+	return keys[0], nil
+}
+
+func (s DBAPIKeyStore) query(ctx context.Context, query string, args ...interface{}) ([]models.APIKey, error) {
+	keys := make([]models.APIKey, 0)
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return keys, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var key models.APIKey
+		err = rows.Scan(
+			&key.ID,
+			&key.Description,
+			&key.KeyHash,
+			pq.Array(&key.Scopes),
+			&key.CreatedBy,
+			&key.CreatedAt,
+			&key.ExpiresAt,
+			&key.RevokedAt,
+		)
+		if err != nil {
+			return keys, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
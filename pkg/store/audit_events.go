@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// AuditEventFilter restricts the audit events returned by List. Zero-valued
+// fields don't restrict the results.
+type AuditEventFilter struct {
+	Actor        string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
+
+type AuditEventStore interface {
+	Create(ctx context.Context, event models.AuditEvent) (models.AuditEvent, error)
+	List(ctx context.Context, filter AuditEventFilter) ([]models.AuditEvent, error)
+}
+
+type DBAuditEventStore struct {
+	DB *sql.DB
+}
+
+func (s DBAuditEventStore) Create(ctx context.Context, event models.AuditEvent) (models.AuditEvent, error) {
+	ctx, span := startSpan(ctx, "DBAuditEventStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO audit_events (actor, action, resource_type, resource_id, source_ip, outcome, detail, created_at)
+		 VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, NULLIF($7, ''), $8)
+		 RETURNING id`,
+		event.Actor,
+		event.Action,
+		event.ResourceType,
+		event.ResourceID,
+		event.SourceIP,
+		event.Outcome,
+		event.Detail,
+		event.CreatedAt,
+	)
+
+	err := row.Scan(&event.ID)
+	return event, err
+}
+
+// List returns the audit events matching the filter, most recent first
+func (s DBAuditEventStore) List(ctx context.Context, filter AuditEventFilter) ([]models.AuditEvent, error) {
+	ctx, span := startSpan(ctx, "DBAuditEventStore.List")
+	defer span.End()
+
+	events := make([]models.AuditEvent, 0)
+
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		addCondition("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		addCondition("action = $%d", filter.Action)
+	}
+	if filter.ResourceType != "" {
+		addCondition("resource_type = $%d", filter.ResourceType)
+	}
+	if filter.ResourceID != "" {
+		addCondition("resource_id = $%d", filter.ResourceID)
+	}
+	if !filter.Since.IsZero() {
+		addCondition("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCondition("created_at < $%d", filter.Until)
+	}
+	args = append(args, filter.Limit)
+
+	rows, err := s.DB.QueryContext(
+		ctx,
+		fmt.Sprintf(
+			`SELECT id, actor, action, resource_type, resource_id, COALESCE(source_ip, ''), outcome, COALESCE(detail, ''), created_at
+			 FROM audit_events
+			 WHERE %s
+			 ORDER BY id DESC
+			 LIMIT $%d`,
+			strings.Join(conditions, " AND "),
+			len(args),
+		),
+		args...,
+	)
+	if err != nil {
+		return events, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var event models.AuditEvent
+		err = rows.Scan(
+			&event.ID,
+			&event.Actor,
+			&event.Action,
+			&event.ResourceType,
+			&event.ResourceID,
+			&event.SourceIP,
+			&event.Outcome,
+			&event.Detail,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return events, err
+		}
+
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type ImageAccessRuleStore interface {
+	List(ctx context.Context) ([]models.ImageAccessRule, error)
+	ListForImage(ctx context.Context, imageID int) ([]models.ImageAccessRule, error)
+	Get(ctx context.Context, id int) (models.ImageAccessRule, error)
+	Create(ctx context.Context, rule models.ImageAccessRule) (models.ImageAccessRule, error)
+	Destroy(ctx context.Context, rule models.ImageAccessRule) error
+}
+
+type DBImageAccessRuleStore struct {
+	DB *sql.DB
+}
+
+func (s DBImageAccessRuleStore) List(ctx context.Context) ([]models.ImageAccessRule, error) {
+	ctx, span := startSpan(ctx, "DBImageAccessRuleStore.List")
+	defer span.End()
+
+	return s.query(
+		ctx,
+		`SELECT id, image_id, user_email, group_name, created_at, updated_at
+		 FROM image_access_rules
+		 ORDER BY id ASC`,
+	)
+}
+
+func (s DBImageAccessRuleStore) ListForImage(ctx context.Context, imageID int) ([]models.ImageAccessRule, error) {
+	ctx, span := startSpan(ctx, "DBImageAccessRuleStore.ListForImage")
+	defer span.End()
+
+	return s.query(
+		ctx,
+		`SELECT id, image_id, user_email, group_name, created_at, updated_at
+		 FROM image_access_rules
+		 WHERE image_id = $1
+		 ORDER BY id ASC`,
+		imageID,
+	)
+}
+
+func (s DBImageAccessRuleStore) Get(ctx context.Context, id int) (models.ImageAccessRule, error) {
+	ctx, span := startSpan(ctx, "DBImageAccessRuleStore.Get")
+	defer span.End()
+
+	rules, err := s.query(
+		ctx,
+		`SELECT id, image_id, user_email, group_name, created_at, updated_at
+		 FROM image_access_rules
+		 WHERE id = $1`,
+		id,
+	)
+	if err != nil {
+		return models.ImageAccessRule{}, err
+	}
+
+	if len(rules) == 0 {
+		return models.ImageAccessRule{}, sql.ErrNoRows
+	}
+
+	return rules[0], nil
+}
+
+func (s DBImageAccessRuleStore) Create(ctx context.Context, rule models.ImageAccessRule) (models.ImageAccessRule, error) {
+	ctx, span := startSpan(ctx, "DBImageAccessRuleStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO image_access_rules (image_id, user_email, group_name, created_at, updated_at)
+		 VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5)
+		 RETURNING id`,
+		rule.ImageID,
+		rule.UserEmail,
+		rule.GroupName,
+		rule.CreatedAt,
+		rule.UpdatedAt,
+	)
+
+	err := row.Scan(&rule.ID)
+	return rule, err
+}
+
+func (s DBImageAccessRuleStore) Destroy(ctx context.Context, rule models.ImageAccessRule) error {
+	ctx, span := startSpan(ctx, "DBImageAccessRuleStore.Destroy")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM image_access_rules WHERE id = $1", rule.ID)
+	return err
+}
+
+func (s DBImageAccessRuleStore) query(ctx context.Context, query string, args ...interface{}) ([]models.ImageAccessRule, error) {
+	rules := make([]models.ImageAccessRule, 0)
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return rules, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var rule models.ImageAccessRule
+		var userEmail, groupName sql.NullString
+
+		err = rows.Scan(
+			&rule.ID,
+			&rule.ImageID,
+			&userEmail,
+			&groupName,
+			&rule.CreatedAt,
+			&rule.UpdatedAt,
+		)
+		if err != nil {
+			return rules, err
+		}
+
+		rule.UserEmail = userEmail.String
+		rule.GroupName = groupName.String
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
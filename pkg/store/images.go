@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/gocardless/draupnir/pkg/models"
@@ -8,21 +9,25 @@ import (
 )
 
 type ImageStore interface {
-	List() ([]models.Image, error)
-	Create(models.Image) (models.Image, error)
-	Get(id int) (models.Image, error)
-	Destroy(image models.Image) error
-	MarkAsReady(models.Image) (models.Image, error)
+	List(ctx context.Context) ([]models.Image, error)
+	Create(ctx context.Context, image models.Image) (models.Image, error)
+	Get(ctx context.Context, id int) (models.Image, error)
+	Destroy(ctx context.Context, image models.Image) error
+	MarkAsReady(ctx context.Context, image models.Image) (models.Image, error)
 }
 
 type DBImageStore struct {
 	DB *sql.DB
 }
 
-func (s DBImageStore) List() ([]models.Image, error) {
+func (s DBImageStore) List(ctx context.Context) ([]models.Image, error) {
+	ctx, span := startSpan(ctx, "DBImageStore.List")
+	defer span.End()
+
 	images := make([]models.Image, 0)
 
-	rows, err := s.DB.Query(
+	rows, err := s.DB.QueryContext(
+		ctx,
 		`SELECT id, backed_up_at, ready, created_at, updated_at FROM images ORDER BY id ASC`,
 	)
 	if err != nil {
@@ -51,10 +56,14 @@ func (s DBImageStore) List() ([]models.Image, error) {
 	return images, nil
 }
 
-func (s DBImageStore) Get(id int) (models.Image, error) {
+func (s DBImageStore) Get(ctx context.Context, id int) (models.Image, error) {
+	ctx, span := startSpan(ctx, "DBImageStore.Get")
+	defer span.End()
+
 	image := models.Image{}
 
-	row := s.DB.QueryRow(
+	row := s.DB.QueryRowContext(
+		ctx,
 		`SELECT id, backed_up_at, ready, anon, created_at, updated_at
 		FROM images
 		WHERE id = $1`,
@@ -75,8 +84,12 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 	return image, nil
 }
 
-func (s DBImageStore) Create(image models.Image) (models.Image, error) {
-	row := s.DB.QueryRow(
+func (s DBImageStore) Create(ctx context.Context, image models.Image) (models.Image, error) {
+	ctx, span := startSpan(ctx, "DBImageStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
 		`INSERT INTO images (backed_up_at, ready, anon, created_at, updated_at)
 		 VALUES ($1, $2, $3, $4, $5)
 		 RETURNING id, backed_up_at, ready, created_at, updated_at`,
@@ -100,8 +113,12 @@ func (s DBImageStore) Create(image models.Image) (models.Image, error) {
 	return image, nil
 }
 
-func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
-	row := s.DB.QueryRow(
+func (s DBImageStore) MarkAsReady(ctx context.Context, image models.Image) (models.Image, error) {
+	ctx, span := startSpan(ctx, "DBImageStore.MarkAsReady")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
 		`UPDATE images
 		 SET ready = TRUE,
 				 updated_at = now()
@@ -125,7 +142,10 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	return image, nil
 }
 
-func (s DBImageStore) Destroy(image models.Image) error {
-	_, err := s.DB.Exec("DELETE FROM images WHERE id = $1", image.ID)
+func (s DBImageStore) Destroy(ctx context.Context, image models.Image) error {
+	ctx, span := startSpan(ctx, "DBImageStore.Destroy")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM images WHERE id = $1", image.ID)
 	return err
 }
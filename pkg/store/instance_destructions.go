@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type InstanceDestructionStore interface {
+	List(ctx context.Context) ([]models.InstanceDestruction, error)
+	Create(ctx context.Context, destruction models.InstanceDestruction) (models.InstanceDestruction, error)
+}
+
+type DBInstanceDestructionStore struct {
+	DB *sql.DB
+}
+
+func (s DBInstanceDestructionStore) List(ctx context.Context) ([]models.InstanceDestruction, error) {
+	ctx, span := startSpan(ctx, "DBInstanceDestructionStore.List")
+	defer span.End()
+
+	destructions := make([]models.InstanceDestruction, 0)
+
+	rows, err := s.DB.QueryContext(
+		ctx,
+		`SELECT id, instance_id, image_id, user_email, destroyed_by, reason, created_at
+		 FROM instance_destructions
+		 ORDER BY id ASC`,
+	)
+	if err != nil {
+		return destructions, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var destruction models.InstanceDestruction
+		err = rows.Scan(
+			&destruction.ID,
+			&destruction.InstanceID,
+			&destruction.ImageID,
+			&destruction.UserEmail,
+			&destruction.DestroyedBy,
+			&destruction.Reason,
+			&destruction.CreatedAt,
+		)
+		if err != nil {
+			return destructions, err
+		}
+
+		destructions = append(destructions, destruction)
+	}
+
+	return destructions, rows.Err()
+}
+
+func (s DBInstanceDestructionStore) Create(ctx context.Context, destruction models.InstanceDestruction) (models.InstanceDestruction, error) {
+	ctx, span := startSpan(ctx, "DBInstanceDestructionStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO instance_destructions (instance_id, image_id, user_email, destroyed_by, reason, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id`,
+		destruction.InstanceID,
+		destruction.ImageID,
+		destruction.UserEmail,
+		destruction.DestroyedBy,
+		destruction.Reason,
+		destruction.CreatedAt,
+	)
+
+	err := row.Scan(&destruction.ID)
+	return destruction, err
+}
@@ -1,17 +1,26 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/gocardless/draupnir/pkg/models"
 	_ "github.com/lib/pq" // used to setup the PG driver
 )
 
 type InstanceStore interface {
-	Create(models.Instance) (models.Instance, error)
-	List() ([]models.Instance, error)
-	Get(id int) (models.Instance, error)
-	Destroy(instance models.Instance) error
+	Create(ctx context.Context, instance models.Instance) (models.Instance, error)
+	List(ctx context.Context) ([]models.Instance, error)
+	Get(ctx context.Context, id int) (models.Instance, error)
+	Destroy(ctx context.Context, instance models.Instance) error
+	UpdateOwner(ctx context.Context, instance models.Instance, email string) (models.Instance, error)
+	MarkAsPooled(ctx context.Context, instance models.Instance) (models.Instance, error)
+	Claim(ctx context.Context, imageID int, email, sessionID string, apiKeyID int) (models.Instance, error)
+	DestroyUnowned(ctx context.Context, instance models.Instance) (bool, error)
 }
 
 type DBInstanceStore struct {
@@ -19,17 +28,24 @@ type DBInstanceStore struct {
 	PublicHostname string
 }
 
-func (s DBInstanceStore) Create(instance models.Instance) (models.Instance, error) {
-	row := s.DB.QueryRow(
-		`INSERT INTO instances (image_id, port, created_at, updated_at, user_email, refresh_token)
-		 VALUES ($1, $2, $3, $4, $5, $6)
+func (s DBInstanceStore) Create(ctx context.Context, instance models.Instance) (models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO instances (image_id, port, created_at, updated_at, user_email, session_id, api_key_id, pooled, password_authentication)
+		 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), $8, $9)
 		 RETURNING id`,
 		instance.ImageID,
 		instance.Port,
 		instance.CreatedAt,
 		instance.UpdatedAt,
 		instance.UserEmail,
-		instance.RefreshToken,
+		instance.SessionID,
+		instance.APIKeyID,
+		instance.Pooled,
+		instance.PasswordAuthentication,
 	)
 
 	err := row.Scan(&instance.ID)
@@ -38,11 +54,15 @@ func (s DBInstanceStore) Create(instance models.Instance) (models.Instance, erro
 	return instance, err
 }
 
-func (s DBInstanceStore) List() ([]models.Instance, error) {
+func (s DBInstanceStore) List(ctx context.Context) ([]models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.List")
+	defer span.End()
+
 	instances := make([]models.Instance, 0)
 
-	rows, err := s.DB.Query(
-		`SELECT id, image_id, port, created_at, updated_at, user_email, refresh_token
+	rows, err := s.DB.QueryContext(
+		ctx,
+		`SELECT id, image_id, port, created_at, updated_at, user_email, session_id, COALESCE(api_key_id, 0), pooled, password_authentication
 		 FROM instances
 		 ORDER BY id ASC`,
 	)
@@ -61,7 +81,10 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 			&instance.CreatedAt,
 			&instance.UpdatedAt,
 			&instance.UserEmail,
-			&instance.RefreshToken,
+			&instance.SessionID,
+			&instance.APIKeyID,
+			&instance.Pooled,
+			&instance.PasswordAuthentication,
 		)
 
 		if err != nil {
@@ -75,11 +98,15 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 	return instances, nil
 }
 
-func (s DBInstanceStore) Get(id int) (models.Instance, error) {
+func (s DBInstanceStore) Get(ctx context.Context, id int) (models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.Get")
+	defer span.End()
+
 	instance := models.Instance{}
 
-	row := s.DB.QueryRow(
-		`SELECT id, image_id, port, created_at, updated_at, user_email
+	row := s.DB.QueryRowContext(
+		ctx,
+		`SELECT id, image_id, port, created_at, updated_at, user_email, pooled, password_authentication
 		 FROM instances
 		 WHERE id = $1`,
 		id,
@@ -91,6 +118,8 @@ func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 		&instance.CreatedAt,
 		&instance.UpdatedAt,
 		&instance.UserEmail,
+		&instance.Pooled,
+		&instance.PasswordAuthentication,
 	)
 	if err != nil {
 		return instance, err
@@ -100,7 +129,157 @@ func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 	return instance, nil
 }
 
-func (s DBInstanceStore) Destroy(instance models.Instance) error {
-	_, err := s.DB.Exec("DELETE FROM instances WHERE id = $1", instance.ID)
+func (s DBInstanceStore) Destroy(ctx context.Context, instance models.Instance) error {
+	ctx, span := startSpan(ctx, "DBInstanceStore.Destroy")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM instances WHERE id = $1", instance.ID)
 	return err
 }
+
+// UpdateOwner transfers an instance to another user. The previous owner's
+// session or API key is cleared, so the instance is no longer destroyed by the
+// cleaner when it's revoked.
+func (s DBInstanceStore) UpdateOwner(ctx context.Context, instance models.Instance, email string) (models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.UpdateOwner")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`UPDATE instances
+		 SET user_email = $2, session_id = '', api_key_id = NULL, updated_at = NOW()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		instance.ID,
+		email,
+	)
+
+	err := row.Scan(&instance.UpdatedAt)
+	instance.UserEmail = email
+	instance.SessionID = ""
+	instance.APIKeyID = 0
+
+	return instance, err
+}
+
+// MarkAsPooled adds an instance that has been created in advance to the pool,
+// from which it can be claimed
+func (s DBInstanceStore) MarkAsPooled(ctx context.Context, instance models.Instance) (models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.MarkAsPooled")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`UPDATE instances
+		 SET pooled = true, updated_at = NOW()
+		 WHERE id = $1
+		 RETURNING updated_at`,
+		instance.ID,
+	)
+
+	err := row.Scan(&instance.UpdatedAt)
+	instance.Pooled = true
+
+	return instance, err
+}
+
+// Claim assigns a pooled instance of the image to a user, as though it had
+// just been created for them. Concurrent claims never receive the same
+// instance. If the pool holds no instances of the image, sql.ErrNoRows is
+// returned.
+func (s DBInstanceStore) Claim(ctx context.Context, imageID int, email, sessionID string, apiKeyID int) (models.Instance, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.Claim")
+	defer span.End()
+
+	instance := models.Instance{}
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`UPDATE instances
+		 SET user_email = $2, session_id = $3, api_key_id = NULLIF($4, 0), pooled = false, created_at = NOW(), updated_at = NOW()
+		 WHERE id = (
+		   SELECT id FROM instances
+		   WHERE pooled AND image_id = $1
+		   ORDER BY id ASC
+		   LIMIT 1
+		   FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING id, image_id, port, created_at, updated_at, user_email, session_id, COALESCE(api_key_id, 0)`,
+		imageID,
+		email,
+		sessionID,
+		apiKeyID,
+	)
+	err := row.Scan(
+		&instance.ID,
+		&instance.ImageID,
+		&instance.Port,
+		&instance.CreatedAt,
+		&instance.UpdatedAt,
+		&instance.UserEmail,
+		&instance.SessionID,
+		&instance.APIKeyID,
+	)
+	if err != nil {
+		return instance, err
+	}
+
+	instance.Hostname = s.PublicHostname
+	return instance, nil
+}
+
+// DestroyUnowned deletes the instance, provided that nobody owns it, and
+// reports whether it was deleted. An instance that has been claimed since it
+// was listed is left alone, so the pool can't discard an instance that a user
+// has just been given.
+func (s DBInstanceStore) DestroyUnowned(ctx context.Context, instance models.Instance) (bool, error) {
+	ctx, span := startSpan(ctx, "DBInstanceStore.DestroyUnowned")
+	defer span.End()
+
+	var id int
+	err := s.DB.QueryRowContext(
+		ctx,
+		`DELETE FROM instances
+		 WHERE id = $1 AND user_email = ''
+		 RETURNING id`,
+		instance.ID,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// GenerateRandomFreePort picks a port in the range [minPort, maxPort) that
+// isn't used by any instance
+func GenerateRandomFreePort(ctx context.Context, store InstanceStore, minPort uint16, maxPort uint16) (uint16, error) {
+	attempts := 0
+	port := uint16(0)
+	portAvailable := false
+
+GetNewPort:
+	for !portAvailable {
+		attempts++
+		if attempts >= 100 {
+			return port, errors.Errorf("No free port found after %d attempts", attempts)
+		}
+
+		rand.Seed(time.Now().Unix() + int64(time.Now().Nanosecond()))
+		port = minPort + uint16(rand.Intn(int(maxPort-minPort)))
+
+		instances, err := store.List(ctx)
+		if err != nil {
+			return port, errors.Wrap(err, "failed to list instances to determine free port")
+		}
+
+		for _, instance := range instances {
+			if instance.Port == port {
+				goto GetNewPort
+			}
+		}
+		portAvailable = true
+	}
+
+	return port, nil
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type MaintenanceModeStore interface {
+	Get(ctx context.Context) (models.MaintenanceMode, error)
+	Enable(ctx context.Context, mode models.MaintenanceMode) (models.MaintenanceMode, error)
+	Disable(ctx context.Context) error
+}
+
+type DBMaintenanceModeStore struct {
+	DB *sql.DB
+}
+
+// Get returns the current maintenance mode. If maintenance mode isn't enabled,
+// the returned MaintenanceMode has Enabled set to false.
+func (s DBMaintenanceModeStore) Get(ctx context.Context) (models.MaintenanceMode, error) {
+	ctx, span := startSpan(ctx, "DBMaintenanceModeStore.Get")
+	defer span.End()
+
+	mode := models.MaintenanceMode{ID: 1}
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`SELECT id, message, ends_at, enabled_by, created_at
+		 FROM maintenance_mode`,
+	)
+	err := row.Scan(&mode.ID, &mode.Message, &mode.EndsAt, &mode.EnabledBy, &mode.CreatedAt)
+	if err == sql.ErrNoRows {
+		return mode, nil
+	}
+	if err != nil {
+		return mode, err
+	}
+
+	mode.Enabled = true
+	return mode, nil
+}
+
+// Enable turns on maintenance mode, replacing the message and end time if it
+// is already enabled
+func (s DBMaintenanceModeStore) Enable(ctx context.Context, mode models.MaintenanceMode) (models.MaintenanceMode, error) {
+	ctx, span := startSpan(ctx, "DBMaintenanceModeStore.Enable")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO maintenance_mode (message, ends_at, enabled_by, created_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (id) DO UPDATE
+		 SET message = EXCLUDED.message, ends_at = EXCLUDED.ends_at, enabled_by = EXCLUDED.enabled_by
+		 RETURNING id, created_at`,
+		mode.Message,
+		mode.EndsAt,
+		mode.EnabledBy,
+		mode.CreatedAt,
+	)
+
+	err := row.Scan(&mode.ID, &mode.CreatedAt)
+	mode.Enabled = true
+	return mode, err
+}
+
+func (s DBMaintenanceModeStore) Disable(ctx context.Context) error {
+	ctx, span := startSpan(ctx, "DBMaintenanceModeStore.Disable")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM maintenance_mode")
+	return err
+}
@@ -0,0 +1,626 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/lib/pq"
+)
+
+// ErrOAuthHandshakeNotFound is returned when waiting on a handshake that was
+// never begun, or has already been collected
+var ErrOAuthHandshakeNotFound = errors.New("OAuth handshake not found")
+
+// ErrOAuthHandshakeTimedOut is returned when a handshake expires before the
+// OAuth flow is completed
+var ErrOAuthHandshakeTimedOut = errors.New("Callback timed out")
+
+// OAuthHandshakeStore holds the OAuth flows that clients are waiting on, keyed
+// by the flow's state parameter. The client that begins a handshake waits for
+// it, while the OAuth callback, which may be served by another process,
+// completes it.
+type OAuthHandshakeStore interface {
+	// Begin starts a handshake, which expires at the given time. Expired
+	// handshakes are removed.
+	Begin(ctx context.Context, state string, expiresAt time.Time) error
+	// Pending reports whether a handshake with the given state is waiting to be
+	// completed
+	Pending(ctx context.Context, state string) (bool, error)
+	// Complete records the outcome of the handshake, reporting whether it was
+	// pending
+	Complete(ctx context.Context, handshake models.OAuthHandshake) (bool, error)
+	// Wait blocks until the handshake is completed, then removes and returns it
+	Wait(ctx context.Context, state string) (models.OAuthHandshake, error)
+
+	// CreateDevice starts a device authorisation, which expires at the given
+	// time. Expired device authorisations are removed.
+	CreateDevice(ctx context.Context, deviceCode, userCode string, expiresAt time.Time) error
+	// BeginDevice starts an OAuth flow with the given state for the pending
+	// device authorisation with the user code, reporting whether there was one.
+	// Each call replaces the state, so that the user can try again if the flow
+	// fails.
+	BeginDevice(ctx context.Context, userCode, state string) (bool, error)
+	// DevicePending reports whether the OAuth flow with the given state is
+	// authenticating a device
+	DevicePending(ctx context.Context, state string) (bool, error)
+	// CompleteDevice records the outcome of the OAuth flow for the device
+	// authorisation with the handshake's state, reporting whether it was pending
+	CompleteDevice(ctx context.Context, handshake models.OAuthHandshake) (bool, error)
+	// PollDevice reports whether the device authorisation has been completed,
+	// in which case it's removed and its outcome returned, so that it can only
+	// be collected once
+	PollDevice(ctx context.Context, deviceCode string) (models.OAuthHandshake, bool, error)
+
+	Close() error
+}
+
+// MemoryOAuthHandshakeStore holds handshakes in memory, so the OAuth callback
+// must be served by the same process as the client that's waiting on it
+type MemoryOAuthHandshakeStore struct {
+	mu         sync.Mutex
+	handshakes map[string]*memoryOAuthHandshake
+	devices    map[string]*memoryDeviceAuthorisation
+}
+
+type memoryOAuthHandshake struct {
+	expiresAt time.Time
+	completed chan struct{}
+	handshake *models.OAuthHandshake
+}
+
+// memoryDeviceAuthorisation is keyed by its device code
+type memoryDeviceAuthorisation struct {
+	userCode  string
+	state     string
+	expiresAt time.Time
+	handshake *models.OAuthHandshake
+}
+
+func NewMemoryOAuthHandshakeStore() *MemoryOAuthHandshakeStore {
+	return &MemoryOAuthHandshakeStore{
+		handshakes: make(map[string]*memoryOAuthHandshake),
+		devices:    make(map[string]*memoryDeviceAuthorisation),
+	}
+}
+
+func (s *MemoryOAuthHandshakeStore) Begin(ctx context.Context, state string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, pending := range s.handshakes {
+		if now.After(pending.expiresAt) {
+			delete(s.handshakes, key)
+		}
+	}
+
+	if _, ok := s.handshakes[state]; ok {
+		return errors.New("an OAuth handshake with this state has already begun")
+	}
+
+	s.handshakes[state] = &memoryOAuthHandshake{expiresAt: expiresAt, completed: make(chan struct{})}
+	return nil
+}
+
+func (s *MemoryOAuthHandshakeStore) Pending(ctx context.Context, state string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.handshakes[state]
+	return ok && pending.handshake == nil && time.Now().Before(pending.expiresAt), nil
+}
+
+func (s *MemoryOAuthHandshakeStore) Complete(ctx context.Context, handshake models.OAuthHandshake) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending, ok := s.handshakes[handshake.State]
+	if !ok || pending.handshake != nil || time.Now().After(pending.expiresAt) {
+		return false, nil
+	}
+
+	pending.handshake = &handshake
+	close(pending.completed)
+	return true, nil
+}
+
+func (s *MemoryOAuthHandshakeStore) Wait(ctx context.Context, state string) (models.OAuthHandshake, error) {
+	s.mu.Lock()
+	pending, ok := s.handshakes[state]
+	s.mu.Unlock()
+
+	if !ok {
+		return models.OAuthHandshake{}, ErrOAuthHandshakeNotFound
+	}
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.handshakes[state] == pending {
+			delete(s.handshakes, state)
+		}
+	}()
+
+	timeout := time.NewTimer(time.Until(pending.expiresAt))
+	defer timeout.Stop()
+
+	select {
+	case <-pending.completed:
+		return *pending.handshake, nil
+	case <-timeout.C:
+		return models.OAuthHandshake{}, ErrOAuthHandshakeTimedOut
+	case <-ctx.Done():
+		return models.OAuthHandshake{}, ctx.Err()
+	}
+}
+
+func (s *MemoryOAuthHandshakeStore) CreateDevice(ctx context.Context, deviceCode, userCode string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, device := range s.devices {
+		if now.After(device.expiresAt) {
+			delete(s.devices, key)
+		}
+	}
+
+	for key, device := range s.devices {
+		if key == deviceCode || device.userCode == userCode {
+			return errors.New("a device authorisation with this code already exists")
+		}
+	}
+
+	s.devices[deviceCode] = &memoryDeviceAuthorisation{userCode: userCode, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryOAuthHandshakeStore) BeginDevice(ctx context.Context, userCode, state string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, device := range s.devices {
+		if device.userCode == userCode && device.handshake == nil && time.Now().Before(device.expiresAt) {
+			device.state = state
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryOAuthHandshakeStore) DevicePending(ctx context.Context, state string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pendingDevice(state) != nil, nil
+}
+
+func (s *MemoryOAuthHandshakeStore) CompleteDevice(ctx context.Context, handshake models.OAuthHandshake) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device := s.pendingDevice(handshake.State)
+	if device == nil {
+		return false, nil
+	}
+
+	device.handshake = &handshake
+	return true, nil
+}
+
+func (s *MemoryOAuthHandshakeStore) PollDevice(ctx context.Context, deviceCode string) (models.OAuthHandshake, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device, ok := s.devices[deviceCode]
+	if !ok || time.Now().After(device.expiresAt) {
+		delete(s.devices, deviceCode)
+		return models.OAuthHandshake{}, false, ErrOAuthHandshakeNotFound
+	}
+
+	if device.handshake == nil {
+		return models.OAuthHandshake{}, false, nil
+	}
+
+	delete(s.devices, deviceCode)
+	return *device.handshake, true, nil
+}
+
+func (s *MemoryOAuthHandshakeStore) Close() error {
+	return nil
+}
+
+// pendingDevice returns the device authorisation that the OAuth flow with the
+// given state was started for, if it's still waiting to be completed
+func (s *MemoryOAuthHandshakeStore) pendingDevice(state string) *memoryDeviceAuthorisation {
+	if state == "" {
+		return nil
+	}
+
+	for _, device := range s.devices {
+		if device.state == state && device.handshake == nil && time.Now().Before(device.expiresAt) {
+			return device
+		}
+	}
+	return nil
+}
+
+// oauthHandshakeChannel is notified with the state of each handshake as it's
+// completed
+const oauthHandshakeChannel = "oauth_handshakes"
+
+// oauthHandshakeRecheckInterval is how often waiters check on their handshake
+// regardless of notifications, which are lost while the listener reconnects
+const oauthHandshakeRecheckInterval = 5 * time.Second
+
+// DBOAuthHandshakeStore holds handshakes in Postgres, so that the OAuth
+// callback can be served by any process. Processes are told when a handshake
+// is completed with LISTEN/NOTIFY.
+type DBOAuthHandshakeStore struct {
+	DB       *sql.DB
+	listener *pq.Listener
+
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+// NewDBOAuthHandshakeStore listens for completed handshakes on a dedicated
+// connection to the database at databaseURL
+func NewDBOAuthHandshakeStore(db *sql.DB, databaseURL string) (*DBOAuthHandshakeStore, error) {
+	listener := pq.NewListener(databaseURL, 10*time.Millisecond, time.Minute, nil)
+	if err := listener.Listen(oauthHandshakeChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s := &DBOAuthHandshakeStore{
+		DB:       db,
+		listener: listener,
+		waiters:  make(map[string]map[chan struct{}]bool),
+	}
+	go s.dispatch()
+	return s, nil
+}
+
+// dispatch wakes the waiters for each handshake that's completed
+func (s *DBOAuthHandshakeStore) dispatch() {
+	for notification := range s.listener.Notify {
+		s.mu.Lock()
+		for state, waiters := range s.waiters {
+			// A nil notification means the listener has reconnected, and may have
+			// missed notifications, so every waiter checks its handshake
+			if notification != nil && notification.Extra != state {
+				continue
+			}
+			for wake := range waiters {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *DBOAuthHandshakeStore) Begin(ctx context.Context, state string, expiresAt time.Time) error {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.Begin")
+	defer span.End()
+
+	// Clients that give up waiting leave their handshakes behind
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM oauth_handshakes WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+
+	_, err := s.DB.ExecContext(
+		ctx,
+		`INSERT INTO oauth_handshakes (state, expires_at) VALUES ($1, $2)`,
+		state,
+		expiresAt,
+	)
+	return err
+}
+
+func (s *DBOAuthHandshakeStore) Pending(ctx context.Context, state string) (bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.Pending")
+	defer span.End()
+
+	var pending bool
+	err := s.DB.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+		   SELECT 1 FROM oauth_handshakes
+		   WHERE state = $1 AND completed_at IS NULL AND expires_at > NOW()
+		 )`,
+		state,
+	).Scan(&pending)
+	return pending, err
+}
+
+func (s *DBOAuthHandshakeStore) Complete(ctx context.Context, handshake models.OAuthHandshake) (bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.Complete")
+	defer span.End()
+
+	token, err := json.Marshal(handshake.Token)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(
+		ctx,
+		`UPDATE oauth_handshakes
+		 SET token = $2, error = $3, completed_at = NOW()
+		 WHERE state = $1 AND completed_at IS NULL AND expires_at > NOW()`,
+		handshake.State,
+		string(token),
+		handshake.Error,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if completed, err := result.RowsAffected(); err != nil || completed == 0 {
+		return false, err
+	}
+
+	// The notification is only sent once the transaction commits
+	if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, oauthHandshakeChannel, handshake.State); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *DBOAuthHandshakeStore) Wait(ctx context.Context, state string) (models.OAuthHandshake, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.Wait")
+	defer span.End()
+
+	// The waiter is registered before the handshake is first checked, so that
+	// a notification can't be missed in between
+	wake := make(chan struct{}, 1)
+	s.addWaiter(state, wake)
+	defer s.removeWaiter(state, wake)
+
+	for {
+		handshake, completed, expiresAt, err := s.get(ctx, state)
+		if err == sql.ErrNoRows {
+			return handshake, ErrOAuthHandshakeNotFound
+		}
+		if err != nil {
+			return handshake, err
+		}
+
+		if completed {
+			return handshake, s.delete(ctx, state)
+		}
+
+		remaining := time.Until(expiresAt)
+		if remaining <= 0 {
+			return models.OAuthHandshake{}, firstError(ErrOAuthHandshakeTimedOut, s.delete(ctx, state))
+		}
+		if remaining > oauthHandshakeRecheckInterval {
+			remaining = oauthHandshakeRecheckInterval
+		}
+
+		recheck := time.NewTimer(remaining)
+		select {
+		case <-wake:
+		case <-recheck.C:
+		case <-ctx.Done():
+			recheck.Stop()
+			return models.OAuthHandshake{}, ctx.Err()
+		}
+		recheck.Stop()
+	}
+}
+
+func (s *DBOAuthHandshakeStore) CreateDevice(ctx context.Context, deviceCode, userCode string, expiresAt time.Time) error {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.CreateDevice")
+	defer span.End()
+
+	// Clients that give up polling leave their device authorisations behind
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM device_authorisations WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+
+	_, err := s.DB.ExecContext(
+		ctx,
+		`INSERT INTO device_authorisations (device_code, user_code, expires_at) VALUES ($1, $2, $3)`,
+		deviceCode,
+		userCode,
+		expiresAt,
+	)
+	return err
+}
+
+func (s *DBOAuthHandshakeStore) BeginDevice(ctx context.Context, userCode, state string) (bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.BeginDevice")
+	defer span.End()
+
+	result, err := s.DB.ExecContext(
+		ctx,
+		`UPDATE device_authorisations
+		 SET state = $2
+		 WHERE user_code = $1 AND completed_at IS NULL AND expires_at > NOW()`,
+		userCode,
+		state,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	begun, err := result.RowsAffected()
+	return begun > 0, err
+}
+
+func (s *DBOAuthHandshakeStore) DevicePending(ctx context.Context, state string) (bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.DevicePending")
+	defer span.End()
+
+	var pending bool
+	err := s.DB.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+		   SELECT 1 FROM device_authorisations
+		   WHERE state = $1 AND completed_at IS NULL AND expires_at > NOW()
+		 )`,
+		state,
+	).Scan(&pending)
+	return pending, err
+}
+
+func (s *DBOAuthHandshakeStore) CompleteDevice(ctx context.Context, handshake models.OAuthHandshake) (bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.CompleteDevice")
+	defer span.End()
+
+	token, err := json.Marshal(handshake.Token)
+	if err != nil {
+		return false, err
+	}
+
+	// Clients poll for the outcome, so there's no need to notify them
+	result, err := s.DB.ExecContext(
+		ctx,
+		`UPDATE device_authorisations
+		 SET token = $2, error = $3, completed_at = NOW()
+		 WHERE state = $1 AND completed_at IS NULL AND expires_at > NOW()`,
+		handshake.State,
+		string(token),
+		handshake.Error,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	completed, err := result.RowsAffected()
+	return completed > 0, err
+}
+
+func (s *DBOAuthHandshakeStore) PollDevice(ctx context.Context, deviceCode string) (models.OAuthHandshake, bool, error) {
+	ctx, span := startSpan(ctx, "DBOAuthHandshakeStore.PollDevice")
+	defer span.End()
+
+	handshake := models.OAuthHandshake{}
+	var state, token, handshakeError sql.NullString
+	var expiresAt time.Time
+
+	// Deleting the authorisation as it's read means that only one poll can
+	// collect it
+	err := s.DB.QueryRowContext(
+		ctx,
+		`DELETE FROM device_authorisations
+		 WHERE device_code = $1 AND (completed_at IS NOT NULL OR expires_at <= NOW())
+		 RETURNING state, token, error, expires_at`,
+		deviceCode,
+	).Scan(&state, &token, &handshakeError, &expiresAt)
+	if err == sql.ErrNoRows {
+		var exists bool
+		err := s.DB.QueryRowContext(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM device_authorisations WHERE device_code = $1)`,
+			deviceCode,
+		).Scan(&exists)
+		if err != nil {
+			return handshake, false, err
+		}
+		if !exists {
+			return handshake, false, ErrOAuthHandshakeNotFound
+		}
+		return handshake, false, nil
+	}
+	if err != nil {
+		return handshake, false, err
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return handshake, false, ErrOAuthHandshakeNotFound
+	}
+
+	if token.Valid {
+		if err := json.Unmarshal([]byte(token.String), &handshake.Token); err != nil {
+			return handshake, false, err
+		}
+	}
+	handshake.State = state.String
+	handshake.Error = handshakeError.String
+	return handshake, true, nil
+}
+
+func (s *DBOAuthHandshakeStore) Close() error {
+	return s.listener.Close()
+}
+
+func (s *DBOAuthHandshakeStore) get(ctx context.Context, state string) (models.OAuthHandshake, bool, time.Time, error) {
+	handshake := models.OAuthHandshake{State: state}
+	var token, handshakeError sql.NullString
+	var completedAt *time.Time
+	var expiresAt time.Time
+
+	err := s.DB.QueryRowContext(
+		ctx,
+		`SELECT token, error, completed_at, expires_at
+		 FROM oauth_handshakes
+		 WHERE state = $1`,
+		state,
+	).Scan(&token, &handshakeError, &completedAt, &expiresAt)
+	if err != nil {
+		return handshake, false, expiresAt, err
+	}
+
+	if completedAt == nil {
+		return handshake, false, expiresAt, nil
+	}
+
+	if token.Valid {
+		if err := json.Unmarshal([]byte(token.String), &handshake.Token); err != nil {
+			return handshake, false, expiresAt, err
+		}
+	}
+	handshake.Error = handshakeError.String
+	return handshake, true, expiresAt, nil
+}
+
+func (s *DBOAuthHandshakeStore) delete(ctx context.Context, state string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM oauth_handshakes WHERE state = $1`, state)
+	return err
+}
+
+func (s *DBOAuthHandshakeStore) addWaiter(state string, wake chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waiters[state] == nil {
+		s.waiters[state] = make(map[chan struct{}]bool)
+	}
+	s.waiters[state][wake] = true
+}
+
+func (s *DBOAuthHandshakeStore) removeWaiter(state string, wake chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.waiters[state], wake)
+	if len(s.waiters[state]) == 0 {
+		delete(s.waiters, state)
+	}
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/lib/pq"
+)
+
+type RoleAssignmentStore interface {
+	List(ctx context.Context) ([]models.RoleAssignment, error)
+	ListForPrincipals(ctx context.Context, principals []string) ([]models.RoleAssignment, error)
+	Upsert(ctx context.Context, assignment models.RoleAssignment) (models.RoleAssignment, error)
+	Destroy(ctx context.Context, principal string) error
+}
+
+type DBRoleAssignmentStore struct {
+	DB *sql.DB
+}
+
+func (s DBRoleAssignmentStore) List(ctx context.Context) ([]models.RoleAssignment, error) {
+	ctx, span := startSpan(ctx, "DBRoleAssignmentStore.List")
+	defer span.End()
+
+	return s.query(
+		ctx,
+		`SELECT principal, role, created_at, updated_at
+		 FROM role_assignments
+		 ORDER BY principal ASC`,
+	)
+}
+
+func (s DBRoleAssignmentStore) ListForPrincipals(ctx context.Context, principals []string) ([]models.RoleAssignment, error) {
+	ctx, span := startSpan(ctx, "DBRoleAssignmentStore.ListForPrincipals")
+	defer span.End()
+
+	return s.query(
+		ctx,
+		`SELECT principal, role, created_at, updated_at
+		 FROM role_assignments
+		 WHERE principal = ANY($1)
+		 ORDER BY principal ASC`,
+		pq.Array(principals),
+	)
+}
+
+func (s DBRoleAssignmentStore) Upsert(ctx context.Context, assignment models.RoleAssignment) (models.RoleAssignment, error) {
+	ctx, span := startSpan(ctx, "DBRoleAssignmentStore.Upsert")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
+		`INSERT INTO role_assignments (principal, role, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (principal) DO UPDATE SET role = EXCLUDED.role, updated_at = NOW()
+		 RETURNING created_at, updated_at`,
+		assignment.Principal,
+		assignment.Role,
+		assignment.CreatedAt,
+		assignment.UpdatedAt,
+	)
+
+	err := row.Scan(&assignment.CreatedAt, &assignment.UpdatedAt)
+	return assignment, err
+}
+
+func (s DBRoleAssignmentStore) Destroy(ctx context.Context, principal string) error {
+	ctx, span := startSpan(ctx, "DBRoleAssignmentStore.Destroy")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM role_assignments WHERE principal = $1", principal)
+	return err
+}
+
+func (s DBRoleAssignmentStore) query(ctx context.Context, query string, args ...interface{}) ([]models.RoleAssignment, error) {
+	assignments := make([]models.RoleAssignment, 0)
+
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return assignments, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var assignment models.RoleAssignment
+		err = rows.Scan(
+			&assignment.Principal,
+			&assignment.Role,
+			&assignment.CreatedAt,
+			&assignment.UpdatedAt,
+		)
+		if err != nil {
+			return assignments, err
+		}
+
+		assignments = append(assignments, assignment)
+	}
+
+	return assignments, rows.Err()
+}
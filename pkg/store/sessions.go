@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type SessionStore interface {
+	Create(ctx context.Context, session models.Session) (models.Session, error)
+	ListToVerify(ctx context.Context) ([]models.Session, error)
+	ListRevoked(ctx context.Context) ([]models.Session, error)
+	RevocationReason(ctx context.Context, id string) (string, bool, error)
+	Revoke(ctx context.Context, id string, reason string) error
+	LogOut(ctx context.Context, id string) (models.Session, error)
+	RevokeUser(ctx context.Context, email string, reason string) ([]models.Session, error)
+}
+
+// LoggedOutReason is recorded as the reason for revoking sessions that users
+// have logged out of
+const LoggedOutReason = "logged out"
+
+type DBSessionStore struct {
+	DB *sql.DB
+}
+
+// sessionsInUse matches the sessions that are still relevant: those that
+// haven't expired, and those that instances were created in
+const sessionsInUse = `(expires_at > NOW() OR id IN (SELECT session_id FROM instances))`
+
+// revocable matches the sessions that can be revoked: those that haven't been,
+// and those that have been logged out of. A logged out session's instances are
+// kept while the user has another session, but are destroyed if the session is
+// revoked for another reason.
+const revocable = `(revoked_at IS NULL OR revocation_reason = '` + LoggedOutReason + `')`
+
+func (s DBSessionStore) Create(ctx context.Context, session models.Session) (models.Session, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.Create")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(
+		ctx,
+		`INSERT INTO sessions (id, user_email, refresh_token, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		session.ID,
+		session.UserEmail,
+		session.RefreshToken,
+		session.CreatedAt,
+		session.ExpiresAt,
+	)
+
+	return session, err
+}
+
+// ListToVerify returns the sessions whose refresh tokens should still be
+// checked, so that they can be revoked once the user loses access
+func (s DBSessionStore) ListToVerify(ctx context.Context) ([]models.Session, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.ListToVerify")
+	defer span.End()
+
+	return s.list(ctx, `WHERE revoked_at IS NULL AND `+sessionsInUse)
+}
+
+// ListRevoked returns the revoked sessions whose tokens haven't yet expired,
+// or that instances were created in
+func (s DBSessionStore) ListRevoked(ctx context.Context) ([]models.Session, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.ListRevoked")
+	defer span.End()
+
+	return s.list(ctx, `WHERE revoked_at IS NOT NULL AND `+sessionsInUse)
+}
+
+// RevocationReason returns why the session was revoked, and whether it was
+func (s DBSessionStore) RevocationReason(ctx context.Context, id string) (string, bool, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.RevocationReason")
+	defer span.End()
+
+	var reason string
+	err := s.DB.QueryRowContext(
+		ctx,
+		`SELECT revocation_reason FROM sessions WHERE id = $1 AND revoked_at IS NOT NULL`,
+		id,
+	).Scan(&reason)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+
+	return reason, err == nil, err
+}
+
+func (s DBSessionStore) Revoke(ctx context.Context, id string, reason string) error {
+	ctx, span := startSpan(ctx, "DBSessionStore.Revoke")
+	defer span.End()
+
+	_, err := s.DB.ExecContext(
+		ctx,
+		`UPDATE sessions
+		 SET revoked_at = NOW(), revocation_reason = $2
+		 WHERE id = $1 AND `+revocable,
+		id,
+		reason,
+	)
+	return err
+}
+
+// LogOut revokes the session, returning it, or sql.ErrNoRows if it has already
+// been revoked. The instances created in the session are kept while the user
+// has another session, through which their access is still verified.
+func (s DBSessionStore) LogOut(ctx context.Context, id string) (models.Session, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.LogOut")
+	defer span.End()
+
+	rows, err := s.DB.QueryContext(
+		ctx,
+		`UPDATE sessions
+		 SET revoked_at = NOW(), revocation_reason = $2
+		 WHERE id = $1 AND revoked_at IS NULL
+		 RETURNING `+sessionColumns,
+		id,
+		LoggedOutReason,
+	)
+	if err != nil {
+		return models.Session{}, err
+	}
+
+	sessions, err := scanSessions(rows)
+	if err != nil {
+		return models.Session{}, err
+	}
+	if len(sessions) == 0 {
+		return models.Session{}, sql.ErrNoRows
+	}
+
+	return sessions[0], nil
+}
+
+// RevokeUser revokes every session of the user, including those they've logged
+// out of, returning those that were revoked. Instances created in them are
+// destroyed by the cleaner, unless they're reassigned first.
+func (s DBSessionStore) RevokeUser(ctx context.Context, email string, reason string) ([]models.Session, error) {
+	ctx, span := startSpan(ctx, "DBSessionStore.RevokeUser")
+	defer span.End()
+
+	rows, err := s.DB.QueryContext(
+		ctx,
+		`UPDATE sessions
+		 SET revoked_at = NOW(), revocation_reason = $2
+		 WHERE user_email = $1 AND `+revocable+`
+		 RETURNING `+sessionColumns,
+		email,
+		reason,
+	)
+	if err != nil {
+		return make([]models.Session, 0), err
+	}
+
+	return scanSessions(rows)
+}
+
+const sessionColumns = `id, user_email, refresh_token, created_at, expires_at, revoked_at, revocation_reason`
+
+func (s DBSessionStore) list(ctx context.Context, where string) ([]models.Session, error) {
+	rows, err := s.DB.QueryContext(
+		ctx,
+		`SELECT `+sessionColumns+`
+		 FROM sessions `+where+`
+		 ORDER BY created_at ASC`,
+	)
+	if err != nil {
+		return make([]models.Session, 0), err
+	}
+
+	return scanSessions(rows)
+}
+
+func scanSessions(rows *sql.Rows) ([]models.Session, error) {
+	sessions := make([]models.Session, 0)
+	defer rows.Close()
+
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserEmail,
+			&session.RefreshToken,
+			&session.CreatedAt,
+			&session.ExpiresAt,
+			&session.RevokedAt,
+			&session.RevocationReason,
+		)
+		if err != nil {
+			return sessions, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
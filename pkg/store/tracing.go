@@ -0,0 +1,22 @@
+package store
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/gocardless/draupnir/pkg/store")
+
+// startSpan starts a client span for a single store operation, named after the
+// store and method (e.g. DBImageStore.Get)
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(
+		ctx,
+		name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql")),
+	)
+}
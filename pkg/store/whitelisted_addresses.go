@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/gocardless/draupnir/pkg/models"
@@ -8,8 +9,9 @@ import (
 )
 
 type WhitelistedAddressStore interface {
-	Create(models.WhitelistedAddress) (models.WhitelistedAddress, error)
-	List() ([]models.WhitelistedAddress, error)
+	Create(ctx context.Context, address models.WhitelistedAddress) (models.WhitelistedAddress, error)
+	List(ctx context.Context) ([]models.WhitelistedAddress, error)
+	IsWhitelisted(ctx context.Context, instanceID int, ipAddress string) (bool, error)
 }
 
 type DBWhitelistedAddressStore struct {
@@ -17,8 +19,12 @@ type DBWhitelistedAddressStore struct {
 	PublicHostname string
 }
 
-func (s DBWhitelistedAddressStore) Create(address models.WhitelistedAddress) (models.WhitelistedAddress, error) {
-	row := s.DB.QueryRow(
+func (s DBWhitelistedAddressStore) Create(ctx context.Context, address models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+	ctx, span := startSpan(ctx, "DBWhitelistedAddressStore.Create")
+	defer span.End()
+
+	row := s.DB.QueryRowContext(
+		ctx,
 		`INSERT INTO whitelisted_addresses (ip_address, instance_id, created_at, updated_at)
 		 VALUES ($1, $2, $3, $4)
 		 ON CONFLICT (ip_address, instance_id) DO UPDATE SET updated_at = NOW()
@@ -34,10 +40,14 @@ func (s DBWhitelistedAddressStore) Create(address models.WhitelistedAddress) (mo
 	return address, err
 }
 
-func (s DBWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
+func (s DBWhitelistedAddressStore) List(ctx context.Context) ([]models.WhitelistedAddress, error) {
+	ctx, span := startSpan(ctx, "DBWhitelistedAddressStore.List")
+	defer span.End()
+
 	addresses := make([]models.WhitelistedAddress, 0)
 
-	rows, err := s.DB.Query(
+	rows, err := s.DB.QueryContext(
+		ctx,
 		`SELECT
 		   whitelisted_addresses.ip_address,
 		   whitelisted_addresses.created_at,
@@ -82,3 +92,23 @@ func (s DBWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
 
 	return addresses, nil
 }
+
+// IsWhitelisted reports whether connections to the instance from the IP
+// address are allowed
+func (s DBWhitelistedAddressStore) IsWhitelisted(ctx context.Context, instanceID int, ipAddress string) (bool, error) {
+	ctx, span := startSpan(ctx, "DBWhitelistedAddressStore.IsWhitelisted")
+	defer span.End()
+
+	var whitelisted bool
+	err := s.DB.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+		   SELECT 1 FROM whitelisted_addresses
+		   WHERE instance_id = $1 AND ip_address >>= $2::inet
+		 )`,
+		instanceID,
+		ipAddress,
+	).Scan(&whitelisted)
+
+	return whitelisted, err
+}
@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+)
+
+// OpenFunc opens a new tunnel to an instance
+type OpenFunc func() (io.ReadWriteCloser, error)
+
+// Forward accepts connections on the listener, and relays each through a new
+// tunnel until either side closes it. It returns once the listener is closed.
+func Forward(logger log.Logger, listener net.Listener, open OpenFunc) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Temporary() {
+				logger.With("error", err.Error()).Info("Failed to accept connection")
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+
+		go func() {
+			defer conn.Close()
+
+			remote, err := open()
+			if err != nil {
+				logger.With("error", err.Error()).Error("Failed to open tunnel")
+				return
+			}
+
+			logger.Debug("Tunnel opened")
+			Splice(conn, remote)
+			logger.Debug("Tunnel closed")
+		}()
+	}
+}
@@ -0,0 +1,102 @@
+// Package tunnel carries connections to instances over HTTP, for clients that
+// can't reach an instance's port directly. The client upgrades a request to
+// the API to a raw byte stream, which the server relays to the instance, so
+// Postgres' own TLS runs end to end through the tunnel.
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Protocol is the value of the Upgrade header that opens a tunnel
+const Protocol = "draupnir-tunnel"
+
+// IsUpgrade reports whether the request asks to open a tunnel
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), Protocol)
+}
+
+// SetUpgrade sets the headers that ask to open a tunnel
+func SetUpgrade(h http.Header) {
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", Protocol)
+}
+
+// Accept takes over the connection underlying the response, and tells the
+// client that the tunnel is open. Anything the client sent after its request
+// is read from the returned connection first.
+func Accept(w http.ResponseWriter) (net.Conn, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection does not support upgrades")
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to take over connection")
+	}
+
+	_, err = fmt.Fprintf(
+		conn,
+		"HTTP/1.1 %d %s\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n",
+		http.StatusSwitchingProtocols, http.StatusText(http.StatusSwitchingProtocols), Protocol,
+	)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to accept upgrade")
+	}
+
+	if buf.Reader.Buffered() == 0 {
+		return conn, nil
+	}
+	return bufferedConn{Conn: conn, reader: buf.Reader}, nil
+}
+
+// bufferedConn reads data that was buffered while reading the request before
+// reading from the connection itself
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Splice copies data in both directions until either side closes its
+// connection
+func Splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	relay := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go relay(a, b)
+	go relay(b, a)
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// headerContains reports whether the comma separated header contains token
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
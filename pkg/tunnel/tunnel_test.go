@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUpgrade(t *testing.T) {
+	testCases := []struct {
+		name       string
+		connection string
+		upgrade    string
+		expected   bool
+	}{
+		{"upgrade", "Upgrade", Protocol, true},
+		{"mixed case", "keep-alive, upgrade", "Draupnir-Tunnel", true},
+		{"other protocol", "Upgrade", "websocket", false},
+		{"no connection header", "", Protocol, false},
+		{"no upgrade header", "Upgrade", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/instances/1/tunnel", nil)
+			if tc.connection != "" {
+				r.Header.Set("Connection", tc.connection)
+			}
+			if tc.upgrade != "" {
+				r.Header.Set("Upgrade", tc.upgrade)
+			}
+			assert.Equal(t, tc.expected, IsUpgrade(r))
+		})
+	}
+}
+
+// echoServer accepts tunnels and echoes everything sent through them
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsUpgrade(r) {
+			w.WriteHeader(http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, err := Accept(w)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+}
+
+// open opens a tunnel to the server, sending early straight after the request
+func open(t *testing.T, server *httptest.Server, early string) net.Conn {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/instances/1/tunnel", nil)
+	SetUpgrade(req.Header)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(conn, early); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, Protocol, resp.Header.Get("Upgrade"))
+
+	return bufferedConn{Conn: conn, reader: reader}
+}
+
+func TestAccept(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+
+	conn := open(t, server, "early")
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, " data"); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, len("early data"))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "early data", string(echoed))
+}
+
+func TestForward(t *testing.T) {
+	server := echoServer(t)
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- Forward(log.Base(), listener, func() (io.ReadWriteCloser, error) {
+			return open(t, server, ""), nil
+		})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	echoed := make([]byte, len("hello"))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(echoed))
+
+	listener.Close()
+	assert.Nil(t, <-done)
+}
@@ -16,10 +16,110 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: audit_events_append_only(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+
 SET default_tablespace = '';
 
 SET default_with_oids = false;
 
+--
+-- Name: api_keys; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.api_keys (
+    id integer NOT NULL,
+    description text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone,
+    revoked_at timestamp with time zone
+);
+
+
+--
+-- Name: api_keys_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.api_keys_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: api_keys_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.api_keys_id_seq OWNED BY public.api_keys.id;
+
+
+--
+-- Name: audit_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.audit_events (
+    id bigint NOT NULL,
+    actor text NOT NULL,
+    action text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id text NOT NULL,
+    source_ip text,
+    outcome text NOT NULL,
+    detail text,
+    created_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.audit_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.audit_events_id_seq OWNED BY public.audit_events.id;
+
+
+--
+-- Name: device_authorisations; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.device_authorisations (
+    device_code text NOT NULL,
+    user_code text NOT NULL,
+    state text,
+    token text,
+    error text,
+    completed_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+
+
 --
 -- Name: gorp_migrations; Type: TABLE; Schema: public; Owner: -
 --
@@ -30,6 +130,41 @@ CREATE TABLE public.gorp_migrations (
 );
 
 
+--
+-- Name: image_access_rules; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.image_access_rules (
+    id integer NOT NULL,
+    image_id integer NOT NULL,
+    user_email text,
+    group_name text,
+    created_at timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT image_access_rules_check CHECK (((user_email IS NULL) <> (group_name IS NULL)))
+);
+
+
+--
+-- Name: image_access_rules_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.image_access_rules_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: image_access_rules_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.image_access_rules_id_seq OWNED BY public.image_access_rules.id;
+
+
 --
 -- Name: images; Type: TABLE; Schema: public; Owner: -
 --
@@ -64,6 +199,41 @@ CREATE SEQUENCE public.images_id_seq
 ALTER SEQUENCE public.images_id_seq OWNED BY public.images.id;
 
 
+--
+-- Name: instance_destructions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.instance_destructions (
+    id integer NOT NULL,
+    instance_id integer NOT NULL,
+    image_id integer NOT NULL,
+    user_email text NOT NULL,
+    destroyed_by text NOT NULL,
+    reason text NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: instance_destructions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.instance_destructions_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: instance_destructions_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.instance_destructions_id_seq OWNED BY public.instance_destructions.id;
+
+
 --
 -- Name: instances; Type: TABLE; Schema: public; Owner: -
 --
@@ -75,7 +245,10 @@ CREATE TABLE public.instances (
     updated_at timestamp with time zone NOT NULL,
     port integer NOT NULL,
     user_email text,
-    refresh_token text
+    pooled boolean DEFAULT false NOT NULL,
+    password_authentication boolean DEFAULT false NOT NULL,
+    session_id text DEFAULT ''::text NOT NULL,
+    api_key_id integer
 );
 
 
@@ -99,6 +272,61 @@ CREATE SEQUENCE public.instances_id_seq
 ALTER SEQUENCE public.instances_id_seq OWNED BY public.instances.id;
 
 
+--
+-- Name: maintenance_mode; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.maintenance_mode (
+    id integer DEFAULT 1 NOT NULL,
+    message text NOT NULL,
+    ends_at timestamp with time zone,
+    enabled_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT maintenance_mode_id_check CHECK ((id = 1))
+);
+
+
+--
+-- Name: oauth_handshakes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.oauth_handshakes (
+    state text NOT NULL,
+    token text,
+    error text,
+    completed_at timestamp with time zone,
+    expires_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: role_assignments; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.role_assignments (
+    principal text NOT NULL,
+    role text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    CONSTRAINT role_assignments_role_check CHECK ((role = ANY (ARRAY['viewer'::text, 'user'::text, 'image-publisher'::text, 'admin'::text])))
+);
+
+
+--
+-- Name: sessions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.sessions (
+    id text NOT NULL,
+    user_email text NOT NULL,
+    refresh_token text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    revoked_at timestamp with time zone,
+    revocation_reason text DEFAULT ''::text NOT NULL
+);
+
+
 --
 -- Name: whitelisted_addresses; Type: TABLE; Schema: public; Owner: -
 --
@@ -111,6 +339,27 @@ CREATE TABLE public.whitelisted_addresses (
 );
 
 
+--
+-- Name: api_keys id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.api_keys ALTER COLUMN id SET DEFAULT nextval('public.api_keys_id_seq'::regclass);
+
+
+--
+-- Name: audit_events id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.audit_events ALTER COLUMN id SET DEFAULT nextval('public.audit_events_id_seq'::regclass);
+
+
+--
+-- Name: image_access_rules id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_access_rules ALTER COLUMN id SET DEFAULT nextval('public.image_access_rules_id_seq'::regclass);
+
+
 --
 -- Name: images id; Type: DEFAULT; Schema: public; Owner: -
 --
@@ -118,6 +367,13 @@ CREATE TABLE public.whitelisted_addresses (
 ALTER TABLE ONLY public.images ALTER COLUMN id SET DEFAULT nextval('public.images_id_seq'::regclass);
 
 
+--
+-- Name: instance_destructions id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instance_destructions ALTER COLUMN id SET DEFAULT nextval('public.instance_destructions_id_seq'::regclass);
+
+
 --
 -- Name: instances id; Type: DEFAULT; Schema: public; Owner: -
 --
@@ -125,6 +381,54 @@ ALTER TABLE ONLY public.images ALTER COLUMN id SET DEFAULT nextval('public.image
 ALTER TABLE ONLY public.instances ALTER COLUMN id SET DEFAULT nextval('public.instances_id_seq'::regclass);
 
 
+--
+-- Name: api_keys api_keys_key_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.api_keys
+    ADD CONSTRAINT api_keys_key_hash_key UNIQUE (key_hash);
+
+
+--
+-- Name: api_keys api_keys_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.api_keys
+    ADD CONSTRAINT api_keys_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: audit_events audit_events_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.audit_events
+    ADD CONSTRAINT audit_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: device_authorisations device_authorisations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.device_authorisations
+    ADD CONSTRAINT device_authorisations_pkey PRIMARY KEY (device_code);
+
+
+--
+-- Name: device_authorisations device_authorisations_state_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.device_authorisations
+    ADD CONSTRAINT device_authorisations_state_key UNIQUE (state);
+
+
+--
+-- Name: device_authorisations device_authorisations_user_code_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.device_authorisations
+    ADD CONSTRAINT device_authorisations_user_code_key UNIQUE (user_code);
+
+
 --
 -- Name: gorp_migrations gorp_migrations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -133,6 +437,14 @@ ALTER TABLE ONLY public.gorp_migrations
     ADD CONSTRAINT gorp_migrations_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: image_access_rules image_access_rules_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_access_rules
+    ADD CONSTRAINT image_access_rules_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: images images_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -141,6 +453,14 @@ ALTER TABLE ONLY public.images
     ADD CONSTRAINT images_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: instance_destructions instance_destructions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instance_destructions
+    ADD CONSTRAINT instance_destructions_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: instances instances_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -149,6 +469,38 @@ ALTER TABLE ONLY public.instances
     ADD CONSTRAINT instances_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: maintenance_mode maintenance_mode_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.maintenance_mode
+    ADD CONSTRAINT maintenance_mode_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: oauth_handshakes oauth_handshakes_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_handshakes
+    ADD CONSTRAINT oauth_handshakes_pkey PRIMARY KEY (state);
+
+
+--
+-- Name: role_assignments role_assignments_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_assignments
+    ADD CONSTRAINT role_assignments_pkey PRIMARY KEY (principal);
+
+
+--
+-- Name: sessions sessions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.sessions
+    ADD CONSTRAINT sessions_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: whitelisted_addresses whitelisted_addresses_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -157,6 +509,64 @@ ALTER TABLE ONLY public.whitelisted_addresses
     ADD CONSTRAINT whitelisted_addresses_pkey PRIMARY KEY (ip_address, instance_id);
 
 
+--
+-- Name: audit_events_actor_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_actor_idx ON public.audit_events USING btree (actor);
+
+
+--
+-- Name: audit_events_created_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_created_at_idx ON public.audit_events USING btree (created_at);
+
+
+--
+-- Name: audit_events_resource_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_resource_idx ON public.audit_events USING btree (resource_type, resource_id);
+
+
+--
+-- Name: image_access_rules_image_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX image_access_rules_image_id_idx ON public.image_access_rules USING btree (image_id);
+
+
+--
+-- Name: instances_pooled_image_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX instances_pooled_image_id_idx ON public.instances USING btree (image_id) WHERE pooled;
+
+
+--
+-- Name: audit_events audit_events_append_only; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_append_only BEFORE DELETE OR UPDATE ON public.audit_events FOR EACH STATEMENT EXECUTE PROCEDURE public.audit_events_append_only();
+
+
+--
+-- Name: image_access_rules image_access_rules_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_access_rules
+    ADD CONSTRAINT image_access_rules_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id) ON DELETE CASCADE;
+
+
+--
+-- Name: instances instances_api_key_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instances
+    ADD CONSTRAINT instances_api_key_id_fkey FOREIGN KEY (api_key_id) REFERENCES public.api_keys(id);
+
+
 --
 -- Name: instances instances_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --